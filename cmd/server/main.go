@@ -1,41 +1,70 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
 	"runtime/debug"
-	"sndv-kv/internal/agents"
 	"sndv-kv/internal/api"
-	"sndv-kv/internal/common"
 	"sndv-kv/internal/config"
 	"sndv-kv/internal/core"
+	"sndv-kv/internal/engine"
 	"sndv-kv/internal/logger"
 	"sndv-kv/internal/metrics"
 	"sndv-kv/internal/storage"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/o1egl/paseto"
 	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
 )
 
 func main() {
 	cfgPath := flag.String("config", "", "Config path")
+	verifyWal := flag.Bool("verify-wal", false, "Check the active and frozen WALs offline, then exit")
+	restoreFrom := flag.String("restore", "", "Snapshot directory to restore into the data directory before starting")
+	force := flag.Bool("force", false, "Let --restore replace a store already in the data directory")
 	flag.Parse()
 
-	if err := Run(*cfgPath); err != nil {
+	if *verifyWal {
+		cfg, err := config.LoadConfigurationFromFile(*cfgPath)
+		if err == nil {
+			err = verifyWalFiles(cfg.WriteAheadLogFilePath, os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := Run(*cfgPath, *restoreFrom, *force); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func Run(configPath string) error {
+// Run starts the server. restoreFrom, when set, overrides the configured
+// restore_from_path; force lets the restore replace an existing store.
+func Run(configPath, restoreFrom string, force bool) error {
 	cfg, err := config.LoadConfigurationFromFile(configPath)
 	if err != nil {
 		return err
 	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if restoreFrom != "" {
+		cfg.RestoreFromPath = restoreFrom
+	}
 
 	// Start pprof server
 	// @TODO: need to test first
@@ -45,72 +74,371 @@ func Run(configPath string) error {
 		}()
 	}
 
+	logger.SetConsoleOutputEnabled(cfg.LogToConsole)
+	if err := logger.SetOutputFormat(cfg.LogFormat); err != nil {
+		return err
+	}
+	logger.SetRetention(cfg.LogMaxBackups, time.Duration(cfg.LogMaxAgeHours)*time.Hour)
 	if err := logger.InitializeLogger(cfg.LogDirectoryPath, cfg.LogSeverityLevel); err != nil {
 		return err
 	}
+	defer logger.ShutdownLogger()
 
-	configureRuntime(cfg)
-	os.MkdirAll(cfg.DataDirectoryPath, 0755)
-
-	system := core.NewSystemState(cfg)
+	if err := configureRuntime(cfg); err != nil {
+		return err
+	}
+	metrics.Global = metrics.SystemMetricsRegistry{}
 
-	if err := recoverWal(system); err != nil {
+	if cfg.RestoreFromPath != "" {
+		if err := engine.Restore(cfg, force); err != nil {
+			return err
+		}
+	}
+	eng, err := engine.Open(cfg)
+	if err != nil {
 		return err
 	}
+	defer eng.Close()
 
-	startAgents(system)
-	printAdminToken(cfg)
+	if err := printAdminToken(cfg, os.Stdout); err != nil {
+		return err
+	}
 
-	return startHttpServer(system, cfg.ServerPort)
+	return startHttpServer(eng, cfg, configPath)
 }
 
-func configureRuntime(cfg config.SystemConfiguration) {
+func configureRuntime(cfg config.SystemConfiguration) error {
+	if cfg.GarbageCollectionPercent < -1 {
+		return fmt.Errorf("invalid garbage_collection_percent %d", cfg.GarbageCollectionPercent)
+	}
+	if cfg.MaximumSystemMemoryInBytes < 0 {
+		return fmt.Errorf("invalid maximum_system_memory_in_bytes %d", cfg.MaximumSystemMemoryInBytes)
+	}
+
 	if cfg.MaximumCpuCount > 0 {
 		runtime.GOMAXPROCS(cfg.MaximumCpuCount)
 	}
-	// High Throughput Tuning: Less frequent GC
-	debug.SetGCPercent(200)
+
+	// High Throughput Tuning: Less frequent GC unless configured otherwise
+	gcPercent := cfg.GarbageCollectionPercent
+	if gcPercent == 0 {
+		gcPercent = config.DefaultGarbageCollectionPercent
+	}
+	debug.SetGCPercent(gcPercent)
+
+	// Soft limit so the collector works harder before the process outgrows
+	// the memtable and cache budget
+	if cfg.MaximumSystemMemoryInBytes > 0 {
+		debug.SetMemoryLimit(cfg.MaximumSystemMemoryInBytes)
+	}
+	return nil
 }
 
-func recoverWal(system *core.SystemState) error {
-	if !system.Configuration.EnableDiskDurability {
+// verifyWalFiles decodes every WAL segment rotated from basePath in
+// verify-only mode and prints a report for each, oldest first as recovery
+// replays them; the last one is the active WAL. It fails if any is corrupt.
+func verifyWalFiles(basePath string, out io.Writer) error {
+	paths, err := storage.WalSegmentPaths(basePath)
+	if err != nil {
+		return err
+	}
+
+	corrupt := 0
+	for i, path := range paths {
+		report, err := storage.VerifyWAL(path)
+		if err != nil {
+			return err
+		}
+
+		label := path
+		if i == len(paths)-1 {
+			label += " (active)"
+		}
+		fmt.Fprintf(out, "%s: %d records (%d tombstones), %d/%d bytes valid\n",
+			label, report.Records, report.Tombstones, report.ValidBytes, report.SizeInBytes)
+		if report.Records > 0 {
+			fmt.Fprintf(out, "  keys:   min %d, max %d, mean %.1f bytes\n",
+				report.KeySizes.Min, report.KeySizes.Max, report.KeySizes.Mean(report.Records))
+			fmt.Fprintf(out, "  values: min %d, max %d, mean %.1f bytes\n",
+				report.ValueSizes.Min, report.ValueSizes.Max, report.ValueSizes.Mean(report.Records))
+		}
+		if report.Corruption != nil {
+			corrupt++
+			fmt.Fprintf(out, "  CORRUPT at offset %d: %v\n", report.CorruptOffset, report.Corruption)
+		}
+	}
+
+	if corrupt > 0 {
+		return fmt.Errorf("%d of %d WAL files are corrupt", corrupt, len(paths))
+	}
+	return nil
+}
+
+// printAdminToken issues an admin token when no static one is configured. It
+// goes to out unless an output file is set, which keeps it out of captured
+// stdout logs; the file is only readable by the owner.
+func printAdminToken(cfg config.SystemConfiguration, out io.Writer) error {
+	if cfg.AuthenticationToken != "" {
 		return nil
 	}
 
-	wal, err := storage.NewDiskWAL(system.Configuration.WriteAheadLogFilePath, true)
+	ttl := cfg.AdminTokenTtlInHours
+	if ttl <= 0 {
+		ttl = config.DefaultAdminTokenTtlInHours
+	}
+	subject := cfg.AdminTokenSubject
+	if subject == "" {
+		subject = config.DefaultAdminTokenSubject
+	}
+
+	key := []byte(fmt.Sprintf("%-32s", cfg.AuthenticationSecret))[:32]
+	token, err := paseto.NewV2().Encrypt(key, paseto.JSONToken{
+		Subject: subject, Expiration: time.Now().Add(time.Duration(ttl) * time.Hour),
+	}, "")
+	if err != nil {
+		return fmt.Errorf("failed to issue admin token: %w", err)
+	}
+
+	if cfg.AdminTokenOutputFile == "" {
+		fmt.Fprintf(out, "ADMIN TOKEN: %s\n", token)
+		return nil
+	}
+
+	// Create with 0600, and re-apply it in case the file already existed
+	if err := os.WriteFile(cfg.AdminTokenOutputFile, []byte(token+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write admin token: %w", err)
+	}
+	if err := os.Chmod(cfg.AdminTokenOutputFile, 0600); err != nil {
+		return fmt.Errorf("failed to restrict admin token file: %w", err)
+	}
+	fmt.Fprintf(out, "ADMIN TOKEN written to %s\n", cfg.AdminTokenOutputFile)
+	return nil
+}
+
+// shutdownTimeout bounds a graceful shutdown. Whatever is not flushed by
+// then is recovered from the WAL on the next start.
+const shutdownTimeout = 30 * time.Second
+
+// startHttpServer serves until the listener fails or SIGINT/SIGTERM arrives.
+// On a signal it stops accepting connections, lets in-flight requests
+// finish, then shuts the engine down, flushing every memtable. SIGHUP
+// reloads configPath instead.
+func startHttpServer(eng *engine.Engine, cfg config.SystemConfiguration, configPath string) error {
+	router := &api.HttpApiRouter{SystemState: eng.SystemState(), Ingestion: eng.Ingestion()}
+	server := newHttpServer(router.GetFastHTTPHandler(), cfg)
+
+	addr := fmt.Sprintf(":%d", cfg.ServerPort)
+	logger.LogInfoEvent("Listening on %s (fasthttp)", addr)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 3)
+	go func() { served <- server.ListenAndServe(addr) }()
+
+	grpcServer, err := startGrpcServer(router, cfg, served)
+	if err != nil {
+		server.Shutdown()
+		return err
+	}
+	respServer, err := startRespServer(router, cfg, served)
 	if err != nil {
+		server.Shutdown()
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
 		return err
 	}
-	system.ActiveWal = wal
 
-	return system.ActiveWal.Replay(func(e common.Entry) {
-		system.MemTable.Put(e.Key, e.Value, e.ExpiryTimestamp, e.IsDeleted)
-	})
+wait:
+	for {
+		select {
+		case err := <-served:
+			return err
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				logger.LogInfoEvent("Received %v, shutting down", sig)
+				break wait
+			}
+			logger.LogInfoEvent("Received %v, reloading the configuration", sig)
+			cfg = reloadConfiguration(eng.SystemState(), configPath, cfg)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.ShutdownWithContext(ctx); err != nil {
+		logger.LogErrorEvent("HTTP server shutdown: %v", err)
+	}
+	if grpcServer != nil {
+		stopGrpcServer(ctx, grpcServer)
+	}
+	if respServer != nil {
+		respServer.Close()
+	}
+	if err := eng.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	logger.LogInfoEvent("Shutdown complete")
+	return nil
 }
 
-func startAgents(system *core.SystemState) {
-	metrics.Global = metrics.SystemMetricsRegistry{}
-	agents.InitializeIngestionSubsystem(system)
-	agents.StartFlushAgentInBackground(system)
-	agents.StartCompactionAgentInBackground(system)
+// reloadableFields are the configuration fields a reload applies to the
+// running server, by JSON name. Changes to any other field need a restart.
+var reloadableFields = map[string]bool{
+	"compaction_interval_in_seconds":      true,
+	"level_zero_compaction_trigger_count": true,
+	"log_severity_level":                  true,
+	"key_cache_capacity_count":            true,
 }
 
-func printAdminToken(cfg config.SystemConfiguration) {
-	if cfg.AuthenticationToken == "" {
-		key := []byte(fmt.Sprintf("%-32s", cfg.AuthenticationSecret))[:32]
-		token, _ := paseto.NewV2().Encrypt(key, paseto.JSONToken{
-			Subject: "admin", Expiration: time.Now().Add(24 * time.Hour),
-		}, "")
-		fmt.Printf("ADMIN TOKEN: %s\n", token)
+// reloadConfiguration re-reads configPath and applies the reloadable fields
+// that differ from current to state, returning the configuration now in
+// effect. Other changed fields are logged and ignored. Nothing is applied
+// if the file fails to load or validate.
+func reloadConfiguration(state *core.SystemState, configPath string, current config.SystemConfiguration) config.SystemConfiguration {
+	if configPath == "" {
+		logger.LogErrorEvent("Configuration reload skipped: the server was started without a configuration file")
+		return current
+	}
+	next, err := config.LoadConfigurationFromFile(configPath)
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		logger.LogErrorEvent("Configuration reload failed, keeping the running configuration: %v", err)
+		return current
+	}
+	// A restore only ever happens at startup, however it was requested.
+	next.RestoreFromPath = current.RestoreFromPath
+
+	changed, ignored := configurationChanges(current, next)
+	for _, field := range ignored {
+		logger.LogErrorEvent("Configuration reload ignored %s: it only changes on restart", field)
 	}
+	if len(changed) == 0 {
+		logger.LogInfoEvent("Configuration reloaded, nothing to apply")
+		return current
+	}
+
+	state.Mutex.Lock()
+	applyReloadableFields(&state.Configuration, next)
+	state.Mutex.Unlock()
+
+	logger.SetSeverityLevel(next.LogSeverityLevel)
+	if state.KeyCache != nil {
+		state.KeyCache.Resize(next.KeyCacheCapacityCount)
+	}
+	for _, change := range changed {
+		logger.LogInfoEvent("Configuration reload applied %s", change)
+	}
+
+	applyReloadableFields(&current, next)
+	return current
 }
 
-func startHttpServer(system *core.SystemState, port int) error {
-	router := &api.HttpApiRouter{SystemState: system}
-	handler := router.GetFastHTTPHandler()
+func applyReloadableFields(dst *config.SystemConfiguration, src config.SystemConfiguration) {
+	dst.CompactionIntervalInSeconds = src.CompactionIntervalInSeconds
+	dst.LevelZeroCompactionTriggerCount = src.LevelZeroCompactionTriggerCount
+	dst.LogSeverityLevel = src.LogSeverityLevel
+	dst.KeyCacheCapacityCount = src.KeyCacheCapacityCount
+}
 
-	addr := fmt.Sprintf(":%d", port)
-	logger.LogInfoEvent("Listening on %s (fasthttp)", addr)
+// configurationChanges compares current and next field by field. It returns
+// "name: old -> new" for each reloadable field that differs, and the JSON
+// name of every other field that does; their values may be secrets.
+func configurationChanges(current, next config.SystemConfiguration) (changed, ignored []string) {
+	before, after := reflect.ValueOf(current), reflect.ValueOf(next)
+	for i := 0; i < before.NumField(); i++ {
+		was, now := before.Field(i).Interface(), after.Field(i).Interface()
+		if reflect.DeepEqual(was, now) {
+			continue
+		}
+		name, _, _ := strings.Cut(before.Type().Field(i).Tag.Get("json"), ",")
+		if reloadableFields[name] {
+			changed = append(changed, fmt.Sprintf("%s: %v -> %v", name, was, now))
+		} else {
+			ignored = append(ignored, name)
+		}
+	}
+	return changed, ignored
+}
+
+// startGrpcServer serves the gRPC KeyValue service on cfg.GrpcPort, sending
+// its exit to served. It returns nil when no port is configured.
+func startGrpcServer(router *api.HttpApiRouter, cfg config.SystemConfiguration, served chan<- error) (*grpc.Server, error) {
+	if cfg.GrpcPort <= 0 {
+		return nil, nil
+	}
+	addr := fmt.Sprintf(":%d", cfg.GrpcPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("grpc listener: %w", err)
+	}
+	logger.LogInfoEvent("Listening on %s (grpc)", addr)
+
+	server := api.NewGrpcServer(router)
+	go func() { served <- server.Serve(listener) }()
+	return server, nil
+}
 
-	return fasthttp.ListenAndServe(addr, handler)
+// startRespServer serves the Redis protocol on cfg.RespPort, sending its
+// exit to served. It returns nil when no port is configured.
+func startRespServer(router *api.HttpApiRouter, cfg config.SystemConfiguration, served chan<- error) (*api.RespServer, error) {
+	if cfg.RespPort <= 0 {
+		return nil, nil
+	}
+	addr := fmt.Sprintf(":%d", cfg.RespPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resp listener: %w", err)
+	}
+	logger.LogInfoEvent("Listening on %s (resp)", addr)
+
+	server := api.NewRespServer(router)
+	go func() { served <- server.Serve(listener) }()
+	return server, nil
+}
+
+// stopGrpcServer lets in-flight calls finish, cutting them off once ctx
+// expires.
+func stopGrpcServer(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.LogErrorEvent("gRPC server shutdown: %v", ctx.Err())
+		server.Stop()
+	}
+}
+
+// newHttpServer applies the connection tuning from cfg. Zero values keep the
+// fasthttp defaults, except that read/write timeouts default to the request
+// timeout.
+func newHttpServer(handler fasthttp.RequestHandler, cfg config.SystemConfiguration) *fasthttp.Server {
+	readTimeout := cfg.ServerReadTimeoutInMilliseconds
+	if readTimeout == 0 {
+		readTimeout = cfg.RequestTimeoutInMilliseconds
+	}
+	writeTimeout := cfg.ServerWriteTimeoutInMilliseconds
+	if writeTimeout == 0 {
+		writeTimeout = cfg.RequestTimeoutInMilliseconds
+	}
+
+	return &fasthttp.Server{
+		Handler:            handler,
+		ReadTimeout:        time.Duration(readTimeout) * time.Millisecond,
+		WriteTimeout:       time.Duration(writeTimeout) * time.Millisecond,
+		IdleTimeout:        time.Duration(cfg.ServerIdleTimeoutInMilliseconds) * time.Millisecond,
+		MaxConnsPerIP:      cfg.ServerMaximumConnectionsPerIp,
+		TCPKeepalive:       cfg.ServerTcpKeepaliveEnabled,
+		TCPKeepalivePeriod: time.Duration(cfg.ServerTcpKeepalivePeriodInSeconds) * time.Second,
+		// Lets /import decode a restore as it arrives
+		StreamRequestBody: true,
+	}
 }
@@ -1,70 +1,241 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sndv-kv/internal/common"
 	"sndv-kv/internal/config"
 	"sndv-kv/internal/core"
+	"sndv-kv/internal/storage"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/o1egl/paseto"
+	"github.com/valyala/fasthttp"
 )
 
-func TestRecoverWal(t *testing.T) {
-	dir := "./test_main_wal"
-	os.RemoveAll(dir)
-	os.MkdirAll(dir, 0755)
-	defer os.RemoveAll(dir)
+func TestConfigureRuntime(t *testing.T) {
+	cfg := config.SystemConfiguration{MaximumCpuCount: 2}
+	if err := configureRuntime(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := debug.SetGCPercent(config.DefaultGarbageCollectionPercent); got != config.DefaultGarbageCollectionPercent {
+		t.Errorf("Expected default GC percent %d, got %d", config.DefaultGarbageCollectionPercent, got)
+	}
+}
+
+func TestConfigureRuntime_AppliesGCTuning(t *testing.T) {
+	defer debug.SetMemoryLimit(math.MaxInt64)
 
-	cfg := config.SystemConfiguration{
-		WriteAheadLogFilePath: dir + "/wal.log",
-		EnableDiskDurability:  true,
+	cfg := config.SystemConfiguration{GarbageCollectionPercent: 150, MaximumSystemMemoryInBytes: 512 * 1024 * 1024}
+	if err := configureRuntime(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := debug.SetGCPercent(config.DefaultGarbageCollectionPercent); got != 150 {
+		t.Errorf("Expected GC percent 150, got %d", got)
+	}
+	if got := debug.SetMemoryLimit(-1); got != 512*1024*1024 {
+		t.Errorf("Expected memory limit to be applied, got %d", got)
 	}
-	system := core.NewSystemState(cfg)
 
-	// Case 1: Success (New file)
-	if err := recoverWal(system); err != nil {
-		t.Fatalf("Recover failed: %v", err)
+	if err := configureRuntime(config.SystemConfiguration{GarbageCollectionPercent: -5}); err == nil {
+		t.Error("Expected invalid GC percent to be rejected")
 	}
-	if system.ActiveWal == nil {
-		t.Error("WAL not initialized")
+	if err := configureRuntime(config.SystemConfiguration{MaximumSystemMemoryInBytes: -1}); err == nil {
+		t.Error("Expected negative memory limit to be rejected")
 	}
-	system.ActiveWal.Close()
+}
 
-	// Case 2: Disabled
-	// Fix: Update the configuration inside the system struct, not the local copy
-	system.Configuration.EnableDiskDurability = false
-	system.ActiveWal = nil
+func TestReloadConfiguration_AppliesSafeFields(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(fmt.Sprintf(`{"data_directory_path": %q}`, dir))
+	cfg, err := config.LoadConfigurationFromFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := core.NewSystemState(cfg)
+
+	writeConfig(fmt.Sprintf(`{
+		"data_directory_path": %q,
+		"write_ahead_log_file_path": %q,
+		"compaction_interval_in_seconds": 30,
+		"level_zero_compaction_trigger_count": 8,
+		"key_cache_capacity_count": 100
+	}`, dir, filepath.Join(dir, "moved.wal")))
+	cfg = reloadConfiguration(state, configPath, cfg)
 
-	if err := recoverWal(system); err != nil {
-		t.Error("Should succeed when disabled")
+	if got := state.Configuration; got.CompactionIntervalInSeconds != 30 || got.LevelZeroCompactionTriggerCount != 8 {
+		t.Errorf("Expected compaction settings 30s and 8, got %ds and %d", got.CompactionIntervalInSeconds, got.LevelZeroCompactionTriggerCount)
+	}
+	if state.KeyCache.CapacityCount() != 100 {
+		t.Errorf("Expected the key cache resized to 100, got %d", state.KeyCache.CapacityCount())
 	}
-	if system.ActiveWal != nil {
-		t.Error("Should not init WAL when disabled")
+	if state.Configuration.WriteAheadLogFilePath == filepath.Join(dir, "moved.wal") || cfg.WriteAheadLogFilePath == filepath.Join(dir, "moved.wal") {
+		t.Error("Expected the WAL path change to be ignored")
+	}
+	if cfg.CompactionIntervalInSeconds != 30 {
+		t.Errorf("Expected the returned configuration to carry the change, got %ds", cfg.CompactionIntervalInSeconds)
+	}
+
+	// An invalid file applies nothing
+	writeConfig(`{"level_zero_compaction_trigger_count": 0, "compaction_interval_in_seconds": 1}`)
+	cfg = reloadConfiguration(state, configPath, cfg)
+	if state.Configuration.CompactionIntervalInSeconds != 30 || cfg.LevelZeroCompactionTriggerCount != 8 {
+		t.Error("Expected an invalid configuration to be rejected")
 	}
 }
 
-func TestConfigureRuntime(t *testing.T) {
-	cfg := config.SystemConfiguration{MaximumCpuCount: 2}
-	configureRuntime(cfg)
+func TestConfigurationChanges(t *testing.T) {
+	current := config.SystemConfiguration{DataDirectoryPath: "a", LogSeverityLevel: "INFO", AuthenticationSecret: "s1"}
+	next := current
+	next.DataDirectoryPath = "b"
+	next.LogSeverityLevel = "DEBUG"
+	next.AuthenticationSecret = "s2"
+
+	changed, ignored := configurationChanges(current, next)
+	if len(changed) != 1 || changed[0] != "log_severity_level: INFO -> DEBUG" {
+		t.Errorf("Expected the log level change, got %v", changed)
+	}
+	if strings.Join(ignored, ",") != "data_directory_path,authentication_secret" {
+		t.Errorf("Expected data_directory_path and authentication_secret ignored, got %v", ignored)
+	}
 }
 
 func TestPrintToken(t *testing.T) {
 	cfg := config.SystemConfiguration{AuthenticationSecret: "s"}
-	printAdminToken(cfg)
+	var out bytes.Buffer
+	if err := printAdminToken(cfg, &out); err != nil || !strings.HasPrefix(out.String(), "ADMIN TOKEN: v2.local.") {
+		t.Errorf("Expected a printed token, got %q (%v)", out.String(), err)
+	}
 
+	out.Reset()
 	cfg.AuthenticationToken = "preset"
-	printAdminToken(cfg)
+	printAdminToken(cfg, &out)
+	if out.Len() != 0 {
+		t.Errorf("No token should be issued with a static token, got %q", out.String())
+	}
 }
 
-func TestStartAgents(t *testing.T) {
-	dir := "./test_main_agents"
-	os.RemoveAll(dir)
-	os.MkdirAll(dir, 0755)
-	defer os.RemoveAll(dir)
+func TestPrintToken_WritesRestrictedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.token")
+	cfg := config.SystemConfiguration{
+		AuthenticationSecret: "s",
+		AdminTokenTtlInHours: 2,
+		AdminTokenSubject:    "ops",
+		AdminTokenOutputFile: path,
+	}
+
+	var out bytes.Buffer
+	if err := printAdminToken(cfg, &out); err != nil {
+		t.Fatal(err)
+	}
 
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected 0600 permissions, got %o", perm)
+	}
+	raw, _ := os.ReadFile(path)
+	token := strings.TrimSpace(string(raw))
+	if strings.Contains(out.String(), token) {
+		t.Error("Token leaked to stdout")
+	}
+
+	var claims paseto.JSONToken
+	key := []byte(fmt.Sprintf("%-32s", "s"))[:32]
+	if err := paseto.NewV2().Decrypt(token, key, &claims, nil); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "ops" {
+		t.Errorf("Expected subject ops, got %q", claims.Subject)
+	}
+	if remaining := time.Until(claims.Expiration); remaining > 2*time.Hour || remaining < time.Hour {
+		t.Errorf("Expected a ~2h lifetime, got %v", remaining)
+	}
+}
+
+func TestNewHttpServer_AppliesTuning(t *testing.T) {
 	cfg := config.SystemConfiguration{
-		DataDirectoryPath:     dir,
-		WriteAheadLogFilePath: dir + "/wal.log",
+		RequestTimeoutInMilliseconds:      1500,
+		ServerWriteTimeoutInMilliseconds:  3000,
+		ServerIdleTimeoutInMilliseconds:   60000,
+		ServerMaximumConnectionsPerIp:     64,
+		ServerTcpKeepaliveEnabled:         true,
+		ServerTcpKeepalivePeriodInSeconds: 30,
+	}
+	server := newHttpServer(func(ctx *fasthttp.RequestCtx) {}, cfg)
+
+	if server.ReadTimeout != 1500*time.Millisecond {
+		t.Errorf("Read timeout should fall back to the request timeout, got %v", server.ReadTimeout)
+	}
+	if server.WriteTimeout != 3*time.Second {
+		t.Errorf("Unexpected write timeout %v", server.WriteTimeout)
+	}
+	if server.IdleTimeout != time.Minute {
+		t.Errorf("Unexpected idle timeout %v", server.IdleTimeout)
+	}
+	if server.MaxConnsPerIP != 64 {
+		t.Errorf("Unexpected max conns per IP %d", server.MaxConnsPerIP)
+	}
+	if !server.TCPKeepalive || server.TCPKeepalivePeriod != 30*time.Second {
+		t.Errorf("Keep-alive not applied: %v %v", server.TCPKeepalive, server.TCPKeepalivePeriod)
+	}
+}
+
+func TestVerifyWalFiles(t *testing.T) {
+	dir := t.TempDir()
+	active := filepath.Join(dir, "wal.log")
+
+	wal, _ := storage.NewDiskWAL(active, true)
+	wal.WriteBatch([]common.Entry{{Key: "k", Value: []byte("v")}})
+	wal.Close()
+
+	var out bytes.Buffer
+	if err := verifyWalFiles(active, &out); err != nil {
+		t.Fatalf("Clean WAL reported as corrupt: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "1 records") {
+		t.Errorf("Unexpected report: %s", out.String())
 	}
-	sys := core.NewSystemState(cfg)
 
-	startAgents(sys)
+	frozen := active + ".1"
+	os.WriteFile(frozen, []byte{1, 0, 0}, 0644)
+
+	out.Reset()
+	if err := verifyWalFiles(active, &out); err == nil {
+		t.Error("Expected the truncated frozen WAL to fail verification")
+	}
+	if !strings.Contains(out.String(), "CORRUPT at offset 0") {
+		t.Errorf("Corruption not reported: %s", out.String())
+	}
+
+	// Segments are listed in rotation order: the base log first, then by
+	// start time, so .10 follows .9 and is the active one
+	os.Remove(frozen)
+	for _, suffix := range []string{".10", ".9"} {
+		wal, _ := storage.NewDiskWAL(active+suffix, true)
+		wal.Close()
+	}
+	out.Reset()
+	if err := verifyWalFiles(active, &out); err != nil {
+		t.Fatalf("Clean WALs reported as corrupt: %v\n%s", err, out.String())
+	}
+	report := out.String()
+	base, nine, ten := strings.Index(report, active+":"), strings.Index(report, active+".9:"), strings.Index(report, active+".10 (active):")
+	if base < 0 || nine < base || ten < nine {
+		t.Errorf("Segments not reported in rotation order:\n%s", report)
+	}
 }
@@ -1,13 +1,23 @@
 package agents
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"slices"
 	"sndv-kv/internal/common"
 	"sndv-kv/internal/config"
 	"sndv-kv/internal/logger"
+	"sndv-kv/internal/metrics"
 	"sndv-kv/internal/storage"
 	testFactory "sndv-kv/internal/testing"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -27,9 +37,10 @@ func TestIngest_SubmitSingle_CriticalPath(t *testing.T) {
 	f := testFactory.NewTestFactory(t)
 	defer f.Cleanup()
 	state := f.CreateSystem()
-	InitializeIngestionSubsystem(state)
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
 
-	if err := SubmitIngestionRequest("k1", []byte("v1"), 0, false); err != nil {
+	if err := ingestion.SubmitIngestionRequest("k1", []byte("v1"), 0, false); err != nil {
 		t.Fatalf("Submit failed: %v", err)
 	}
 
@@ -46,13 +57,14 @@ func TestIngest_SubmitBatch_CriticalPath(t *testing.T) {
 	f := testFactory.NewTestFactory(t)
 	defer f.Cleanup()
 	state := f.CreateSystem()
-	InitializeIngestionSubsystem(state)
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
 
 	keys := []string{"b1", "b2"}
 	vals := [][]byte{[]byte("v1"), []byte("v2")}
 	ttls := []int{0, 0}
 
-	if err := SubmitBatchIngestion(keys, vals, ttls); err != nil {
+	if err := ingestion.SubmitBatchIngestion(keys, vals, ttls); err != nil {
 		t.Fatalf("Batch failed: %v", err)
 	}
 
@@ -66,8 +78,205 @@ func TestIngest_SubmitBatch_CriticalPath(t *testing.T) {
 	}
 }
 
+func TestIngest_OperationMetrics(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	metrics.Global = metrics.SystemMetricsRegistry{}
+
+	for _, key := range []string{"p1", "p2"} {
+		if err := ingestion.SubmitIngestionRequest(key, []byte("v"), 0, false); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := ingestion.SubmitIngestionRequest("p1", nil, 0, true); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	keys := []string{"b1", "b2", "b3", "b4", "b5"}
+	if err := ingestion.SubmitBatchIngestion(keys, make([][]byte, len(keys)), make([]int, len(keys))); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if err := ingestion.SubmitBatchDeletion([]string{"b1", "b2"}); err != nil {
+		t.Fatalf("Batch delete failed: %v", err)
+	}
+
+	m := &metrics.Global
+	if m.PutOps != 7 || m.DeleteOps != 3 || m.WriteOps != 10 {
+		t.Errorf("Expected 7 puts, 3 deletes, 10 writes; got %d, %d, %d", m.PutOps, m.DeleteOps, m.WriteOps)
+	}
+	if m.BatchOps != 2 {
+		t.Errorf("Expected 2 batch ops, got %d", m.BatchOps)
+	}
+	if m.BatchSizeHistogram[1] != 2 {
+		t.Errorf("Expected both batches in the 2-10 bucket, got %v", m.BatchSizeHistogram)
+	}
+}
+
+func TestIngest_AsyncWritesApplyBeforeStop(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+	ingestion := InitializeIngestionSubsystem(state)
+
+	for i := 0; i < 50; i++ {
+		if err := ingestion.SubmitIngestionAsync(context.Background(), fmt.Sprintf("async_%d", i), []byte("v"), 0, false); err != nil {
+			t.Fatalf("Async put failed: %v", err)
+		}
+	}
+	ingestion.Stop()
+
+	if n := state.MemTable.Len(); n != 50 {
+		t.Errorf("Expected every queued async write applied by Stop, got %d", n)
+	}
+	if err := ingestion.SubmitIngestionAsync(context.Background(), "late", nil, 0, false); !errors.Is(err, ErrIngestionStopped) {
+		t.Errorf("Async put after Stop should fail, got %v", err)
+	}
+}
+
+func TestIngest_FlushBacklogThrottlesWriters(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.MaximumMemtableSizeInBytes = 512
+		c.MaximumImmutableMemtableCount = 2
+	})
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+	defer state.StopBackgroundAgents()
+	metrics.Global = metrics.SystemMetricsRegistry{}
+
+	// Holding the flush lock makes every flush as slow as the test wants
+	state.FlushMutex.Lock()
+	StartFlushAgentInBackground(state)
+
+	const writes = 200
+	var written atomic.Int64
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < writes; i++ {
+			if err := ingestion.SubmitIngestionRequest(fmt.Sprintf("key_%03d", i), make([]byte, 100), 0, false); err != nil {
+				done <- err
+				return
+			}
+			written.Add(1)
+		}
+		done <- nil
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	state.Mutex.RLock()
+	queued := len(state.ImmutableMem)
+	state.Mutex.RUnlock()
+	if queued > 2 {
+		t.Errorf("Expected at most 2 memtables awaiting flush, got %d", queued)
+	}
+	if n := written.Load(); n == writes {
+		t.Error("Writers were not throttled while flushes were stuck")
+	}
+
+	state.FlushMutex.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Writers still stalled after flushes resumed: %d of %d written", written.Load(), writes)
+	}
+	if metrics.Global.WriteStallCount == 0 {
+		t.Error("Expected the stall to be counted")
+	}
+}
+
+func TestIngest_FullQueueReportsOverload(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.EnableDiskDurability = false
+		c.MaximumMemtableSizeInBytes = 1
+		c.MaximumImmutableMemtableCount = 1
+		c.IngestionQueueTimeoutInMilliseconds = 20
+	})
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+	// With no flush agent the second rotation stalls the only shard for good
+	defer state.StopBackgroundAgents()
+
+	var err error
+	for i := 0; i < 20000 && err == nil; i++ {
+		err = ingestion.SubmitIngestionAsync(context.Background(), fmt.Sprintf("key_%d", i), []byte("v"), 0, false)
+	}
+	if !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("Expected the full queue to report overload, got %v", err)
+	}
+
+	start := time.Now()
+	err = ingestion.SubmitIngestionRequest("late", []byte("v"), 0, false)
+	if !errors.Is(err, ErrOverloaded) {
+		t.Errorf("Expected a blocking write to give up as overloaded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Overloaded write took %v to fail", elapsed)
+	}
+}
+
+func TestIngest_PooledRepliesNeverCrossTalk(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	ingestion := InitializeIngestionSubsystem(f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.EnableDiskDurability = false
+		c.MaximumCpuCount = 4
+	}))
+	defer ingestion.Stop()
+
+	// Successes, failures and abandoned requests interleave on the same
+	// pooled channels; each caller must get only its own outcome
+	const requests = 5000
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key_%d", i)
+			switch i % 3 {
+			case 0:
+				if err := ingestion.SubmitCompareAndSwap(context.Background(), key, nil, true, []byte("v"), 0); err != nil {
+					errs <- fmt.Errorf("%s: expected success, got %v", key, err)
+				}
+			case 1:
+				err := ingestion.SubmitCompareAndSwap(context.Background(), key, []byte("other"), false, []byte("v"), 0)
+				if !errors.Is(err, ErrCompareAndSwapFailed) {
+					errs <- fmt.Errorf("%s: expected a failed swap, got %v", key, err)
+				}
+			case 2:
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%50)*time.Microsecond)
+				defer cancel()
+				err := ingestion.SubmitCompareAndSwap(ctx, key, nil, true, []byte("v"), 0)
+				if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+					errs <- fmt.Errorf("%s: expected success or a timeout, got %v", key, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
 func TestIngest_Negative_BatchEmpty(t *testing.T) {
-	if err := SubmitBatchIngestion(nil, nil, nil); err != nil {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	ingestion := InitializeIngestionSubsystem(f.CreateSystem())
+	defer ingestion.Stop()
+
+	if err := ingestion.SubmitBatchIngestion(nil, nil, nil); err != nil {
 		t.Error("Empty batch should return nil")
 	}
 }
@@ -77,17 +286,149 @@ func TestIngest_Negative_WalError(t *testing.T) {
 	defer f.Cleanup()
 
 	state := f.CreateSystem()
-	InitializeIngestionSubsystem(state)
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
 
 	// Sabotage WAL
 	state.ActiveWal.Close()
 
-	err := SubmitIngestionRequest("k1", []byte("v1"), 0, false)
+	err := ingestion.SubmitIngestionRequest("k1", []byte("v1"), 0, false)
 	if err == nil {
 		t.Error("Expected error from closed WAL")
 	}
 }
 
+// failOnceWal blocks its first write until released and fails it; later
+// writes go to the wrapped log.
+type failOnceWal struct {
+	common.WriteAheadLog
+	release chan struct{}
+	failed  atomic.Bool
+}
+
+func (w *failOnceWal) WriteBatch(entries []common.Entry) error {
+	if w.failed.CompareAndSwap(false, true) {
+		<-w.release
+		return errors.New("injected WAL failure")
+	}
+	return w.WriteAheadLog.WriteBatch(entries)
+}
+
+func TestIngest_AbandonedReplyNeverReachesLaterRequest(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem()
+	wal := &failOnceWal{WriteAheadLog: state.ActiveWal, release: make(chan struct{})}
+	state.ActiveWal = wal
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	// The caller gives up while the shard is still writing its request
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ingestion.SubmitIngestionRequestContext(ctx, "abandoned", []byte("v"), 0, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to expire, got %v", err)
+	}
+
+	// The shard now replies with an error to the abandoned channel. Had it
+	// been pooled, one of these requests would receive that error.
+	close(wal.release)
+	for i := 0; i < 100; i++ {
+		if err := ingestion.SubmitIngestionRequest(fmt.Sprintf("k%d", i), []byte("v"), 0, false); err != nil {
+			t.Fatalf("Request %d received a reply meant for another caller: %v", i, err)
+		}
+	}
+}
+
+func TestIngest_Negative_BatchWalErrorIsReported(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem()
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	state.ActiveWal.Close()
+
+	err := ingestion.SubmitBatchIngestion([]string{"a", "b"}, [][]byte{[]byte("1"), []byte("2")}, []int{0, 0})
+	if err == nil {
+		t.Error("Expected the WAL error to fail the batch")
+	}
+	if _, found := state.MemTable.Get("a"); found {
+		t.Error("A batch rejected by the WAL must not reach the memtable")
+	}
+}
+
+func TestIngest_SameShardBatchIsAtomic(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.MaximumCpuCount = 4
+		c.EnableDiskDurability = false
+	})
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	const batches, batchSize = 200, 16
+
+	// Every key of a batch goes to the same ingestion shard but spreads
+	// across many memtable shards
+	keysFor := func(batch int) []string {
+		var keys []string
+		for i := 0; len(keys) < batchSize; i++ {
+			key := fmt.Sprintf("batch_%03d_%d", batch, i)
+			if ingestion.shardFor(key) == 0 {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+
+	done := make(chan struct{})
+	violations := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			seen := make(map[string]int)
+			for _, e := range state.MemTable.GetAll() {
+				seen[e.Key[:len("batch_000")]]++
+			}
+			for batch, count := range seen {
+				if count != batchSize {
+					select {
+					case violations <- fmt.Sprintf("%s: saw %d of %d keys", batch, count, batchSize):
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	vals, ttls := make([][]byte, batchSize), make([]int, batchSize)
+	for i := range vals {
+		vals[i] = []byte("v")
+	}
+	for b := 0; b < batches; b++ {
+		if err := ingestion.SubmitBatchIngestion(keysFor(b), vals, ttls); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+
+	select {
+	case v := <-violations:
+		t.Errorf("Reader observed a partial batch: %s", v)
+	default:
+	}
+}
+
 func TestIngest_Positive_RotationTrigger(t *testing.T) {
 	f := testFactory.NewTestFactory(t)
 	defer f.Cleanup()
@@ -95,9 +436,10 @@ func TestIngest_Positive_RotationTrigger(t *testing.T) {
 	state := f.CreateSystem(func(c *config.SystemConfiguration) {
 		c.MaximumMemtableSizeInBytes = 10
 	})
-	InitializeIngestionSubsystem(state)
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
 
-	SubmitIngestionRequest("trigger", make([]byte, 20), 0, false)
+	ingestion.SubmitIngestionRequest("trigger", make([]byte, 20), 0, false)
 
 	for i := 0; i < 20; i++ {
 		state.Mutex.RLock()
@@ -111,6 +453,63 @@ func TestIngest_Positive_RotationTrigger(t *testing.T) {
 	t.Error("Memtable did not rotate")
 }
 
+func TestIngest_Positive_RotationByWalSize(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.MaximumMemtableSizeInBytes = 64 * 1024 * 1024
+		c.MaximumWalSizeInBytes = 4 * 1024
+	})
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	for i := 0; i < 600; i++ {
+		key := fmt.Sprintf("small_%03d", i)
+		if err := ingestion.SubmitIngestionRequest(key, []byte("v"), 0, false); err != nil {
+			t.Fatalf("Put %s failed: %v", key, err)
+		}
+	}
+
+	state.Mutex.RLock()
+	immutables := len(state.ImmutableMem)
+	frozen := len(state.FrozenWALs)
+	activeSize := state.ActiveWal.SizeInBytes()
+	state.Mutex.RUnlock()
+
+	// The WAL is split into segments while every write stays in the one
+	// memtable
+	if frozen < 2 {
+		t.Fatalf("Expected WAL size to start new segments, got %d frozen WALs", frozen)
+	}
+	if immutables != 0 {
+		t.Errorf("WAL rotation should not rotate the memtable, got %d immutables", immutables)
+	}
+	if activeSize >= state.Configuration.MaximumWalSizeInBytes+1024 {
+		t.Errorf("Active WAL grew to %d bytes, expected it to stay near the limit", activeSize)
+	}
+
+	// Every segment stays on disk until the memtable holding its writes is flushed
+	segments, _ := filepath.Glob(state.Configuration.WriteAheadLogFilePath + "*")
+	if len(segments) != frozen+1 {
+		t.Errorf("Expected one segment per frozen WAL plus the active one, got %d segments for %d frozen WALs", len(segments), frozen)
+	}
+
+	flushed, err := FlushAll(context.Background(), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed != 1 {
+		t.Errorf("Expected the one memtable flushed, got %d", flushed)
+	}
+	state.Mutex.RLock()
+	frozen = len(state.FrozenWALs)
+	state.Mutex.RUnlock()
+	if segments, _ := filepath.Glob(state.Configuration.WriteAheadLogFilePath + "*"); frozen != 0 || len(segments) != 1 {
+		t.Errorf("Expected the flush to delete every frozen segment, %d frozen WALs and %v left", frozen, segments)
+	}
+}
+
 func TestIngest_Negative_RotationWalFailure(t *testing.T) {
 	f := testFactory.NewTestFactory(t)
 	defer f.Cleanup()
@@ -137,14 +536,17 @@ func TestIngest_Negative_RotationWalFailure(t *testing.T) {
 // Coverage for helper functions
 func TestHelper_PrepareEntries(t *testing.T) {
 	req := IngestReq{Key: "k", TTL: 10}
-	batch := []IngestReq{req}
+	batch := []IngestReq{req, {Key: "k"}}
 
 	// FIX: Pass nil for the reusable buffer argument
-	entries := prepareEntries(batch, nil)
+	entries := prepareEntries(batch, nil, 7)
 
 	if entries[0].ExpiryTimestamp == 0 {
 		t.Error("TTL calculation failed")
 	}
+	if entries[0].Sequence != 7 || entries[1].Sequence != 8 {
+		t.Errorf("Expected sequences 7 and 8, got %d and %d", entries[0].Sequence, entries[1].Sequence)
+	}
 }
 
 func TestHelper_DrainQueue(t *testing.T) {
@@ -189,13 +591,76 @@ func TestFlush_CriticalPath_Cycle(t *testing.T) {
 	t.Error("Flush failed to create SSTable")
 }
 
+func TestFlush_LifecycleHook(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+
+	hookFired := make(chan storage.SSTableMetadata, 1)
+	state.RegisterFlushHook(func(meta storage.SSTableMetadata) { hookFired <- meta })
+	StartFlushAgentInBackground(state)
+
+	mem := storage.NewMemoryTable(100)
+	mem.Put("a", []byte("v"), 0, false)
+	mem.Put("b", []byte("v"), 0, false)
+
+	state.Mutex.Lock()
+	state.ImmutableMem = append(state.ImmutableMem, mem)
+	state.FlushCondition.Signal()
+	state.Mutex.Unlock()
+
+	select {
+	case meta := <-hookFired:
+		if meta.Level != 0 || meta.MinKey != "a" || meta.MaxKey != "b" || meta.KeyCount != 2 {
+			t.Errorf("Unexpected metadata in hook: %+v", meta)
+		}
+		state.Mutex.RLock()
+		committed := state.SSTables[0][0].Filename
+		state.Mutex.RUnlock()
+		if committed != meta.Filename {
+			t.Error("Hook fired with metadata that differs from the committed table")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Flush hook never fired")
+	}
+}
+
+func TestFlush_FilenamesNeverCollide(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+
+	for i := 0; i < 50; i++ {
+		mem := storage.NewMemoryTable(10)
+		mem.Put(fmt.Sprintf("k%d", i), []byte("v"), 0, false)
+		state.ImmutableMem = append(state.ImmutableMem, mem)
+		processFlush(state, mem)
+	}
+
+	seen := make(map[string]bool)
+	for i, meta := range state.SSTables[0] {
+		if seen[meta.Filename] {
+			t.Fatalf("Filename collision: %s", meta.Filename)
+		}
+		seen[meta.Filename] = true
+
+		level, fileID, ok := storage.ParseSSTableFilename(meta.Filename)
+		if !ok || level != 0 || fileID != int64(i+1) || meta.FileID != fileID {
+			t.Errorf("Table %d: parsed level=%d id=%d ok=%v, metadata id=%d", i, level, fileID, ok, meta.FileID)
+		}
+	}
+	if len(seen) != 50 {
+		t.Errorf("Expected 50 distinct tables, got %d", len(seen))
+	}
+}
+
 func TestFlush_Negative_CommitError(t *testing.T) {
 	f := testFactory.NewTestFactory(t)
 	defer f.Cleanup()
 	state := f.CreateSystem()
 
 	// Direct call to test error branch
-	commitFlush(state, storage.SSTableMetadata{}, errors.New("err"), "f", 0)
+	commitFlush(state, nil, nil, errors.New("err"), 0)
 
 	state.Mutex.RLock()
 	if len(state.SSTables[0]) != 0 {
@@ -223,6 +688,106 @@ func TestFlush_Positive_RotateFrozen(t *testing.T) {
 	}
 }
 
+func TestFlush_ConcurrentWorkersFlushEveryTable(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.FlushConcurrency = 3
+	})
+
+	const tables = 5
+	for i := 0; i < tables; i++ {
+		mem := storage.NewMemoryTable(100)
+		for j := 0; j < 500; j++ {
+			mem.Put(fmt.Sprintf("t%d_%03d", i, j), []byte("v"), 0, false)
+		}
+		wal, err := storage.NewDiskWAL(fmt.Sprintf("%s/frozen.%d", f.RootDir, i), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.QueueRecoveredImmutable(mem, wal)
+	}
+
+	StartFlushAgentInBackground(state)
+	defer state.StopBackgroundAgents()
+	state.Mutex.Lock()
+	state.FlushCondition.Broadcast()
+	state.Mutex.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state.Mutex.RLock()
+		done := len(state.ImmutableMem) == 0
+		state.Mutex.RUnlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Immutable tables were not flushed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	state.Mutex.RLock()
+	defer state.Mutex.RUnlock()
+	if len(state.SSTables[0]) != tables {
+		t.Fatalf("Expected %d L0 tables, got %d", tables, len(state.SSTables[0]))
+	}
+	prefixes := make(map[string]bool)
+	for _, meta := range state.SSTables[0] {
+		if meta.KeyCount != 500 {
+			t.Errorf("Table %s holds %d keys", meta.Filename, meta.KeyCount)
+		}
+		prefixes[meta.MinKey[:2]] = true
+	}
+	if len(prefixes) != tables {
+		t.Errorf("Expected one table per memtable, got %v", prefixes)
+	}
+	if len(state.FrozenWALs) != 0 {
+		t.Errorf("Expected every frozen WAL deleted, %d left", len(state.FrozenWALs))
+	}
+	if leftovers, _ := filepath.Glob(f.RootDir + "/frozen.*"); len(leftovers) != 0 {
+		t.Errorf("Frozen WAL files left behind: %v", leftovers)
+	}
+}
+
+func TestFlush_OutOfOrderFlushRetiresInOrder(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+
+	var mems []*storage.ShardedMemoryTable
+	for i := 0; i < 3; i++ {
+		mem := storage.NewMemoryTable(10)
+		mem.PutEntry(common.Entry{Key: "k", Value: []byte(strconv.Itoa(i)), Sequence: uint64(i + 1)})
+		wal, _ := storage.NewDiskWAL(fmt.Sprintf("%s/frozen.%d", f.RootDir, i), true)
+		mems = append(mems, mem)
+		state.QueueRecoveredImmutable(mem, wal)
+	}
+
+	// The newest finishing first must not leave the older ones shadowing it
+	processFlush(state, mems[2])
+	if len(state.ImmutableMem) != 3 || len(state.FrozenWALs) != 3 {
+		t.Fatalf("Retired ahead of older tables: %d memtables, %d WALs", len(state.ImmutableMem), len(state.FrozenWALs))
+	}
+	if e, _ := state.CaptureReadView().FindEntry("k"); string(e.Value) != "2" {
+		t.Errorf("Expected the newest value, got %q", e.Value)
+	}
+
+	processFlush(state, mems[0])
+	if len(state.ImmutableMem) != 2 || len(state.FrozenWALs) != 2 {
+		t.Fatalf("Expected only the oldest retired: %d memtables, %d WALs", len(state.ImmutableMem), len(state.FrozenWALs))
+	}
+	if _, err := os.Stat(f.RootDir + "/frozen.0"); !os.IsNotExist(err) {
+		t.Error("Oldest frozen WAL not deleted")
+	}
+
+	processFlush(state, mems[1])
+	if len(state.ImmutableMem) != 0 || len(state.FrozenWALs) != 0 {
+		t.Errorf("Expected everything retired: %d memtables, %d WALs", len(state.ImmutableMem), len(state.FrozenWALs))
+	}
+}
+
 // -----------------------------------------------------------------------------
 // Compaction Agent Tests
 // -----------------------------------------------------------------------------
@@ -266,7 +831,7 @@ func TestCompaction_Negative_MergeError(t *testing.T) {
 	// Create invalid metadata pointing to non-existent file
 	badMeta := storage.SSTableMetadata{Filename: "missing.sst"}
 
-	_, _, err := performMerge([]storage.SSTableMetadata{badMeta}, f.RootDir, nil)
+	_, err := performMerge([]storage.SSTableMetadata{badMeta}, singleMergeOutput(f.RootDir+"/L1_1.sst"), nil, storage.SSTableWriteOptions{}, false)
 	if err == nil {
 		t.Error("Expected error opening missing SSTable")
 	}
@@ -282,7 +847,8 @@ func TestCompaction_EdgeCase_TombstonePreservation(t *testing.T) {
 	m1, _ := storage.WriteSortedStringTableToDisk(e1, f.RootDir+"/1.sst", 0, nil)
 	m2, _ := storage.WriteSortedStringTableToDisk(e2, f.RootDir+"/2.sst", 0, nil)
 
-	fname, _, err := performMerge([]storage.SSTableMetadata{m1, m2}, f.RootDir, nil)
+	fname := f.RootDir + "/L1_3.sst"
+	_, err := performMerge([]storage.SSTableMetadata{m1, m2}, singleMergeOutput(fname), nil, storage.SSTableWriteOptions{}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -295,3 +861,1000 @@ func TestCompaction_EdgeCase_TombstonePreservation(t *testing.T) {
 		t.Error("Deleted state lost during merge")
 	}
 }
+
+func TestCompaction_DropsTombstonesAtBottomLevel(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.LevelZeroCompactionTriggerCount = 1
+	})
+
+	write := func(id int64, entries ...common.Entry) storage.SSTableMetadata {
+		meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(f.RootDir, 0, id), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	state.SSTables[0] = []storage.SSTableMetadata{
+		write(1, common.Entry{Key: "gone", Value: []byte("v"), Sequence: 1}, common.Entry{Key: "kept", Value: []byte("v"), Sequence: 2}),
+		write(2, common.Entry{Key: "gone", IsDeleted: true, Sequence: 3}),
+	}
+	checkAndRunCompaction(state)
+
+	if len(state.SSTables[0]) != 0 || len(state.SSTables[1]) != 1 {
+		t.Fatalf("Expected one L1 table, got %d L0 and %d L1", len(state.SSTables[0]), len(state.SSTables[1]))
+	}
+	keys := tableKeys(t, state.SSTables[1][0])
+	if fmt.Sprint(keys) != "[kept]" {
+		t.Errorf("Expected the tombstone to be gone from L1, found keys %v", keys)
+	}
+
+	// With L2 holding "kept" too, the tombstone has something to shadow
+	state.SSTables[2] = []storage.SSTableMetadata{write(3, common.Entry{Key: "kept", Value: []byte("old"), Sequence: 0})}
+	state.SSTables[0] = []storage.SSTableMetadata{write(4, common.Entry{Key: "kept", IsDeleted: true, Sequence: 4})}
+	checkAndRunCompaction(state)
+
+	if len(state.SSTables[1]) != 1 {
+		t.Fatalf("Expected one L1 table, got %d", len(state.SSTables[1]))
+	}
+	if e, _ := storage.FindInSSTable(state.SSTables[1][0], "kept"); !e.IsDeleted {
+		t.Error("Tombstone dropped while an older version remains in L2")
+	}
+}
+
+func TestCompaction_PushesOverBudgetLevelDown(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	// L1 may hold 1KB and L2 10KB
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.LevelZeroCompactionTriggerCount = 1
+		c.MaximumMemtableSizeInBytes = 1024
+	})
+	state.ReserveFileIDsThrough(10)
+
+	value := make([]byte, 600)
+	write := func(level int, id int64, entries ...common.Entry) storage.SSTableMetadata {
+		meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(f.RootDir, level, id), level, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	oldest := write(1, 1, common.Entry{Key: "a", Value: value, Sequence: 5}, common.Entry{Key: "c", Value: value, Sequence: 6})
+	newer := write(1, 2, common.Entry{Key: "x", Value: []byte("v"), Sequence: 7})
+	overlapped := write(2, 3, common.Entry{Key: "b", Value: []byte("old"), Sequence: 1})
+	untouched := write(2, 4, common.Entry{Key: "y", Value: []byte("old"), Sequence: 2})
+	state.SSTables[1] = []storage.SSTableMetadata{oldest, newer}
+	state.SSTables[2] = []storage.SSTableMetadata{overlapped, untouched}
+
+	checkAndRunCompaction(state)
+
+	if len(state.SSTables[1]) != 1 || state.SSTables[1][0].Filename != newer.Filename {
+		t.Fatalf("Expected only the newer table left in L1, got %v", state.SSTables[1])
+	}
+	var l2 []string
+	for _, meta := range state.SSTables[2] {
+		if meta.Filename == oldest.Filename || meta.Filename == overlapped.Filename {
+			t.Errorf("Merged table %s still live", meta.Filename)
+		}
+		l2 = append(l2, tableKeys(t, meta)...)
+	}
+	if !slices.ContainsFunc(state.SSTables[2], func(m storage.SSTableMetadata) bool { return m.Filename == untouched.Filename }) {
+		t.Error("Non-overlapping L2 table was rewritten")
+	}
+	slices.Sort(l2)
+	if fmt.Sprint(l2) != "[a b c y]" {
+		t.Errorf("Expected L2 to hold a, b, c and y, got %v", l2)
+	}
+	if _, err := os.Stat(overlapped.Filename); !os.IsNotExist(err) {
+		t.Error("Merged L2 table not removed")
+	}
+}
+
+func TestCompaction_OverlappingTablesByKeyRange(t *testing.T) {
+	table := func(minKey, maxKey string) storage.SSTableMetadata {
+		return storage.SSTableMetadata{Filename: minKey + "-" + maxKey, MinKey: minKey, MaxKey: maxKey, KeyCount: 2}
+	}
+	level := []storage.SSTableMetadata{table("a", "c"), table("d", "f"), table("x", "z")}
+
+	cases := []struct {
+		source storage.SSTableMetadata
+		want   string
+	}{
+		{table("e", "g"), "[d-f]"},
+		{table("h", "k"), "[]"},
+		{table("0", "1"), "[]"},
+		{table("c", "d"), "[a-c d-f]"},
+		{table("b", "y"), "[a-c d-f x-z]"},
+	}
+	for _, tc := range cases {
+		var got []string
+		for _, meta := range overlappingTables(level, []storage.SSTableMetadata{tc.source}) {
+			got = append(got, meta.Filename)
+		}
+		if fmt.Sprint(got) != tc.want {
+			t.Errorf("Source [%s, %s]: expected %s, got %v", tc.source.MinKey, tc.source.MaxKey, tc.want, got)
+		}
+	}
+}
+
+func TestCompaction_LeavesNonOverlappingTablesUntouched(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.LevelZeroCompactionTriggerCount = 3
+	})
+	state.ReserveFileIDsThrough(10)
+
+	write := func(level int, id int64, keys ...string) storage.SSTableMetadata {
+		var entries []common.Entry
+		for _, k := range keys {
+			entries = append(entries, common.Entry{Key: k, Value: []byte("v"), Sequence: uint64(id)})
+		}
+		meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(f.RootDir, level, id), level, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	merged := write(1, 1, "a", "c")
+	untouched := write(1, 2, "m", "p")
+	state.SSTables[1] = []storage.SSTableMetadata{merged, untouched}
+	// The oldest L0 table pulls in the one overlapping it but not the third
+	state.SSTables[0] = []storage.SSTableMetadata{write(0, 3, "b", "c"), write(0, 4, "x", "z"), write(0, 5, "c", "d")}
+	left := state.SSTables[0][1]
+
+	checkAndRunCompaction(state)
+
+	if len(state.SSTables[0]) != 1 || state.SSTables[0][0].Filename != left.Filename {
+		t.Fatalf("Expected only the non-overlapping L0 table left, got %v", state.SSTables[0])
+	}
+	if len(state.SSTables[1]) != 2 {
+		t.Fatalf("Expected two L1 tables, got %d", len(state.SSTables[1]))
+	}
+	if state.SSTables[1][0].Filename != untouched.Filename {
+		t.Errorf("Non-overlapping L1 table was rewritten")
+	}
+	if info, err := os.Stat(untouched.Filename); err != nil || info.Size() == 0 {
+		t.Errorf("Non-overlapping L1 table missing: %v", err)
+	}
+	if keys := tableKeys(t, state.SSTables[1][1]); fmt.Sprint(keys) != "[a b c d]" {
+		t.Errorf("Expected the merged table to hold a to d, got %v", keys)
+	}
+	if _, err := os.Stat(merged.Filename); !os.IsNotExist(err) {
+		t.Error("Overlapping L1 table not removed")
+	}
+}
+
+func TestCompactionScheduler_ClaimsKeepOverlappingJobsApart(t *testing.T) {
+	table := func(name, minKey, maxKey string) storage.SSTableMetadata {
+		return storage.SSTableMetadata{Filename: name, MinKey: minKey, MaxKey: maxKey, KeyCount: 2}
+	}
+	job := func(level int, tables ...storage.SSTableMetadata) *compactionClaim {
+		return newCompactionClaim(compactionJob{level: level, tables: tables})
+	}
+
+	scheduler := newCompactionScheduler(8)
+	held := job(0, table("L0_1", "a", "f"))
+	if !scheduler.tryClaim(held) {
+		t.Fatal("First claim refused")
+	}
+
+	cases := []struct {
+		name  string
+		claim *compactionClaim
+		want  bool
+	}{
+		{"disjoint range, same levels", job(0, table("L0_2", "g", "k")), true},
+		{"overlapping range, same levels", job(0, table("L0_3", "e", "h")), false},
+		{"overlapping range, shared level", job(1, table("L1_4", "b", "c")), false},
+		{"overlapping range, levels apart", job(2, table("L2_5", "a", "z")), true},
+		{"same file", job(2, table("L0_1", "a", "f")), false},
+	}
+	for _, tc := range cases {
+		if got := scheduler.tryClaim(tc.claim); got != tc.want {
+			t.Errorf("%s: expected claim %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	if !scheduler.isClaimed(table("L0_1", "a", "f")) || !scheduler.isLevelBusy(2) || scheduler.isLevelBusy(1) {
+		t.Error("Held claims not reported")
+	}
+	scheduler.release(held)
+	if !scheduler.tryClaim(job(0, table("L0_6", "b", "c"))) {
+		t.Error("Claim refused after the conflicting one was released")
+	}
+}
+
+func TestCompaction_ConcurrentWorkersCompactDisjointRanges(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.LevelZeroCompactionTriggerCount = 1
+		c.CompactionConcurrency = 4
+	})
+	state.ReserveFileIDsThrough(10)
+
+	var want []string
+	for i := int64(1); i <= 8; i++ {
+		// Pairs of overlapping tables over four disjoint ranges
+		key := fmt.Sprintf("range%d", (i-1)/2)
+		meta, err := storage.WriteSortedStringTableToDisk([]common.Entry{
+			{Key: key + "_a", Value: []byte("v"), Sequence: uint64(i)},
+			{Key: fmt.Sprintf("%s_b%d", key, i), Value: []byte("v"), Sequence: uint64(i)},
+		}, storage.SSTableFilename(f.RootDir, 0, i), 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.SSTables[0] = append(state.SSTables[0], meta)
+		want = append(want, key+"_a", fmt.Sprintf("%s_b%d", key, i))
+	}
+	want = slices.Compact(slices.Sorted(slices.Values(want)))
+
+	StartCompactionAgentInBackground(state)
+	defer state.StopBackgroundAgents()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state.Mutex.RLock()
+		done := len(state.SSTables[0]) == 0
+		state.Mutex.RUnlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("L0 was not compacted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	state.Mutex.RLock()
+	defer state.Mutex.RUnlock()
+	if len(state.SSTables[1]) != 4 {
+		t.Fatalf("Expected one L1 table per range, got %d", len(state.SSTables[1]))
+	}
+	var keys []string
+	for _, meta := range state.SSTables[1] {
+		keys = append(keys, tableKeys(t, meta)...)
+	}
+	slices.Sort(keys)
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("Expected keys %v, got %v", want, keys)
+	}
+}
+
+// singleMergeOutput writes a merge to one L1 table at filename.
+func singleMergeOutput(filename string) mergeOutput {
+	return mergeOutput{Level: 1, NextFilename: func() string { return filename }}
+}
+
+func TestCompaction_PurgesExpiredEntries(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.LevelZeroCompactionTriggerCount = 1
+	})
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	ingestion.SubmitIngestionRequest("short_lived", []byte("v"), 1, false)
+	ingestion.SubmitIngestionRequest("kept", []byte("v"), 0, false)
+	if _, err := Sync(state, true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	checkAndRunCompaction(state)
+	if len(state.SSTables[1]) != 1 {
+		t.Fatalf("Expected one L1 table, got %d", len(state.SSTables[1]))
+	}
+	if keys := tableKeys(t, state.SSTables[1][0]); fmt.Sprint(keys) != "[kept]" {
+		t.Errorf("Expected the expired key to be purged, found keys %v", keys)
+	}
+
+	// Above the bottom level an expired entry must still hide older versions
+	older, _ := storage.WriteSortedStringTableToDisk([]common.Entry{
+		{Key: "k", Value: []byte("old"), Sequence: 1},
+	}, f.RootDir+"/L0_90.sst", 0, nil)
+	newer, _ := storage.WriteSortedStringTableToDisk([]common.Entry{
+		{Key: "k", Value: []byte("expired"), ExpiryTimestamp: 1, Sequence: 2},
+	}, f.RootDir+"/L0_91.sst", 0, nil)
+	merged, err := performMerge([]storage.SSTableMetadata{older, newer}, singleMergeOutput(f.RootDir+"/L1_92.sst"), nil, storage.SSTableWriteOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := storage.FindInSSTable(merged[0], "k"); !e.IsDeleted || len(e.Value) != 0 {
+		t.Errorf("Expected the expired entry reduced to a tombstone, got %+v", e)
+	}
+}
+
+func TestCompaction_MergeKeepsHighestSequence(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	// The later file holds the older writes, as after a reordering compaction
+	m1, _ := storage.WriteSortedStringTableToDisk([]common.Entry{
+		{Key: "deleted", IsDeleted: true, Sequence: 8},
+		{Key: "updated", Value: []byte("new"), Sequence: 9},
+	}, f.RootDir+"/L0_1.sst", 0, nil)
+	m2, _ := storage.WriteSortedStringTableToDisk([]common.Entry{
+		{Key: "deleted", Value: []byte("old"), Sequence: 2},
+		{Key: "updated", Value: []byte("old"), Sequence: 3},
+	}, f.RootDir+"/L0_2.sst", 0, nil)
+
+	outputs, err := performMerge([]storage.SSTableMetadata{m1, m2}, singleMergeOutput(f.RootDir+"/L1_3.sst"), nil, storage.SSTableWriteOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := outputs[0]
+	if e, _ := storage.FindInSSTable(merged, "deleted"); !e.IsDeleted || e.Sequence != 8 {
+		t.Errorf("Delete resurrected by the merge: %+v", e)
+	}
+	if e, _ := storage.FindInSSTable(merged, "updated"); string(e.Value) != "new" {
+		t.Errorf("Expected the newer update, got %q", e.Value)
+	}
+	if merged.MaxSequence != 9 {
+		t.Errorf("Expected max sequence 9, got %d", merged.MaxSequence)
+	}
+}
+
+func TestCompaction_ReadOnlyMode_PausesAndResumes(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+
+	e := []common.Entry{{Key: "r", Value: []byte("v")}}
+	m1, _ := storage.WriteSortedStringTableToDisk(e, f.RootDir+"/L0_1.sst", 0, nil)
+	m2, _ := storage.WriteSortedStringTableToDisk(e, f.RootDir+"/L0_2.sst", 0, nil)
+	state.SSTables[0] = append(state.SSTables[0], m1, m2)
+
+	state.SetReadOnlyMode(true)
+	checkAndRunCompaction(state)
+
+	if len(state.SSTables[0]) != 2 || len(state.SSTables[1]) != 0 {
+		t.Fatal("Compaction advanced in read-only mode")
+	}
+
+	state.SetReadOnlyMode(false)
+	checkAndRunCompaction(state)
+
+	if len(state.SSTables[0]) != 0 || len(state.SSTables[1]) != 1 {
+		t.Error("Compaction did not resume after leaving read-only mode")
+	}
+}
+
+func TestFlush_ReadOnlyMode_PausesAndResumes(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+	state.SetReadOnlyMode(true)
+	StartFlushAgentInBackground(state)
+
+	mem := storage.NewMemoryTable(100)
+	mem.Put("f1", []byte("v"), 0, false)
+
+	state.Mutex.Lock()
+	state.ImmutableMem = append(state.ImmutableMem, mem)
+	state.FlushCondition.Signal()
+	state.Mutex.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	state.Mutex.RLock()
+	flushed := len(state.SSTables[0])
+	state.Mutex.RUnlock()
+	if flushed != 0 {
+		t.Fatal("Flush ran in read-only mode")
+	}
+
+	state.SetReadOnlyMode(false)
+	for i := 0; i < 20; i++ {
+		state.Mutex.RLock()
+		flushed = len(state.SSTables[0])
+		state.Mutex.RUnlock()
+		if flushed > 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("Flush did not resume after leaving read-only mode")
+}
+
+func TestDrain_NoWriteLandsAfterRotation(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	// Writers race the drain; each write is either refused or on disk
+	var wg sync.WaitGroup
+	var accepted sync.Map
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				key := fmt.Sprintf("w%d_%05d", w, i)
+				err := ingestion.SubmitIngestionRequest(key, []byte("v"), 0, false)
+				if errors.Is(err, ErrReadOnlyMode) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Put %s: %v", key, err)
+					return
+				}
+				accepted.Store(key, true)
+			}
+		}(w)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := Drain(state); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	state.Mutex.RLock()
+	defer state.Mutex.RUnlock()
+	if n := state.MemTable.Len(); n != 0 || len(state.ImmutableMem) != 0 {
+		t.Fatalf("Writes landed after the drain: %d in the memtable, %d immutables", n, len(state.ImmutableMem))
+	}
+	view := state.CaptureReadView()
+	accepted.Range(func(key, _ any) bool {
+		if _, ok := view.FindEntry(key.(string)); !ok {
+			t.Errorf("Acknowledged write %s is not in the drained SSTables", key)
+			return false
+		}
+		return true
+	})
+}
+
+func TestIngest_StopDrainsAndRejects(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+	ingestion := InitializeIngestionSubsystem(state)
+
+	if err := ingestion.SubmitIngestionRequest("before", []byte("v"), 0, false); err != nil {
+		t.Fatal(err)
+	}
+	ingestion.Stop()
+
+	if err := ingestion.SubmitIngestionRequest("after", []byte("v"), 0, false); err != ErrIngestionStopped {
+		t.Errorf("Expected ErrIngestionStopped, got %v", err)
+	}
+	if err := ingestion.SubmitBatchIngestion([]string{"b"}, [][]byte{nil}, []int{0}); err != ErrIngestionStopped {
+		t.Errorf("Expected ErrIngestionStopped for batch, got %v", err)
+	}
+	if _, ok := state.MemTable.Get("before"); !ok {
+		t.Error("Write accepted before Stop was lost")
+	}
+}
+
+func TestIngest_TwoSystemsConcurrently_NoCrossContamination(t *testing.T) {
+	factoryA := testFactory.NewTestFactory(t)
+	defer factoryA.Cleanup()
+	factoryB := testFactory.NewNamedTestFactory(t, t.Name()+"_b")
+	defer factoryB.Cleanup()
+
+	stateA := factoryA.CreateSystem(func(c *config.SystemConfiguration) { c.MaximumCpuCount = 4 })
+	stateB := factoryB.CreateSystem(func(c *config.SystemConfiguration) { c.MaximumCpuCount = 2 })
+	ingestionA := InitializeIngestionSubsystem(stateA)
+	defer ingestionA.Stop()
+	ingestionB := InitializeIngestionSubsystem(stateB)
+	defer ingestionB.Stop()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				ingestionA.SubmitIngestionRequest(fmt.Sprintf("a:%d:%d", worker, i), []byte("A"), 0, false)
+			}
+		}(w)
+		go func(worker int) {
+			defer wg.Done()
+			keys := []string{fmt.Sprintf("b:%d:x", worker), fmt.Sprintf("b:%d:y", worker)}
+			ingestionB.SubmitBatchIngestion(keys, [][]byte{[]byte("B"), []byte("B")}, []int{0, 0})
+		}(w)
+	}
+	wg.Wait()
+
+	entriesA := stateA.MemTable.GetAll()
+	entriesB := stateB.MemTable.GetAll()
+	if len(entriesA) != 800 || len(entriesB) != 16 {
+		t.Fatalf("Unexpected counts: A=%d B=%d", len(entriesA), len(entriesB))
+	}
+	for _, e := range entriesA {
+		if !strings.HasPrefix(e.Key, "a:") {
+			t.Fatalf("System A received foreign key %s", e.Key)
+		}
+	}
+	for _, e := range entriesB {
+		if !strings.HasPrefix(e.Key, "b:") {
+			t.Fatalf("System B received foreign key %s", e.Key)
+		}
+	}
+}
+
+func TestTtlReclamation_ExpiredTableCompactedAway(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.TtlReclamationIntervalInSeconds = 1
+		c.TtlReclamationExpiredRatio = 0.5
+	})
+
+	expiredAt := time.Now().Add(-time.Second).UnixNano()
+	var entries []common.Entry
+	for i := 0; i < 50; i++ {
+		entries = append(entries, common.Entry{Key: fmt.Sprintf("ttl_%02d", i), Value: []byte("v"), ExpiryTimestamp: expiredAt})
+	}
+	meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(f.RootDir, 0, state.AllocateFileID()), 0, state.BloomFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SSTables[0] = []storage.SSTableMetadata{meta}
+
+	StartTtlReclamationAgentInBackground(state)
+	defer state.StopBackgroundAgents()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		state.Mutex.RLock()
+		remaining := len(state.SSTables[0])
+		state.Mutex.RUnlock()
+
+		if _, err := os.Stat(meta.Filename); remaining == 0 && os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("Expired table was not reclaimed within the configured window")
+}
+
+func TestMemtableTtlSweeper_SizeDropsAfterSweep(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.MemtableTtlSweepIntervalInSeconds = 1
+	})
+
+	// A flushed value the expired write shadows
+	older, err := storage.WriteSortedStringTableToDisk([]common.Entry{{Key: "ttl_00", Value: []byte("old"), Sequence: 1}}, storage.SSTableFilename(f.RootDir, 0, state.AllocateFileID()), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SSTables[0] = []storage.SSTableMetadata{older}
+
+	expiredAt := time.Now().Add(-time.Second).UnixNano()
+	for i := 0; i < 50; i++ {
+		state.MemTable.PutEntry(common.Entry{Key: fmt.Sprintf("ttl_%02d", i), Value: make([]byte, 512), ExpiryTimestamp: expiredAt, Sequence: 2})
+	}
+	state.MemTable.PutEntry(common.Entry{Key: "live", Value: []byte("v"), Sequence: 3})
+	before := state.MemTable.Size()
+
+	StartMemtableTtlSweeperInBackground(state)
+	defer state.StopBackgroundAgents()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for state.MemTable.Size() > before-50*512 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if size := state.MemTable.Size(); size > before-50*512 {
+		t.Fatalf("Expected the memtable to shrink from %d bytes, still %d", before, size)
+	}
+
+	e, found := state.CaptureReadView().FindEntry("ttl_00")
+	if !found || !e.IsDeleted {
+		t.Errorf("Swept key must keep shadowing its flushed value, got %+v", e)
+	}
+}
+
+func TestTtlReclamation_KeepsTombstoneOverOlderValue(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem()
+
+	older, _ := storage.WriteSortedStringTableToDisk(
+		[]common.Entry{{Key: "k", Value: []byte("old")}},
+		storage.SSTableFilename(f.RootDir, 1, state.AllocateFileID()), 1, state.BloomFilter)
+
+	expiredAt := time.Now().Add(-time.Second).UnixNano()
+	newer, _ := storage.WriteSortedStringTableToDisk(
+		[]common.Entry{
+			{Key: "k", Value: []byte("new"), ExpiryTimestamp: expiredAt},
+			{Key: "x", Value: []byte("gone"), ExpiryTimestamp: expiredAt},
+		},
+		storage.SSTableFilename(f.RootDir, 0, state.AllocateFileID()), 0, state.BloomFilter)
+
+	state.SSTables[0] = []storage.SSTableMetadata{newer}
+	state.SSTables[1] = []storage.SSTableMetadata{older}
+
+	reclaimExpiredTables(state)
+
+	if len(state.SSTables[0]) != 1 || state.SSTables[0][0].Filename == newer.Filename {
+		t.Fatalf("Expected the L0 table to be rewritten, got %+v", state.SSTables[0])
+	}
+	if state.SSTables[0][0].KeyCount != 1 {
+		t.Errorf("Expected only the shadowing tombstone to survive, got %d entries", state.SSTables[0][0].KeyCount)
+	}
+
+	e, found := state.CaptureReadView().FindEntry("k")
+	if !found || !e.IsDeleted {
+		t.Errorf("Older value resurfaced after reclamation: %+v", e)
+	}
+}
+
+func TestIngest_CounterSurvivesFlushAndCompaction(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem()
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+	ctx := context.Background()
+
+	increment := func(delta, want int64) {
+		t.Helper()
+		got, err := ingestion.SubmitIncrement(ctx, "hits", delta, 0)
+		if err != nil {
+			t.Fatalf("Increment failed: %v", err)
+		}
+		if got != want {
+			t.Fatalf("Expected %d after increment, got %d", want, got)
+		}
+	}
+	flush := func() {
+		state.Mutex.Lock()
+		rotateMemTable(state)
+		table := state.ImmutableMem[0]
+		state.Mutex.Unlock()
+		processFlush(state, table)
+	}
+
+	if err := ingestion.SubmitCounterWrite(ctx, "hits", 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	increment(3, 8)
+
+	flush()
+	increment(2, 10)
+
+	flush()
+	state.Mutex.Lock()
+	tables := state.SSTables[0]
+	state.SSTables[0] = nil
+	state.Mutex.Unlock()
+	executeCompaction(state, tables)
+
+	// Served from the compacted L1 table
+	e, found := state.CaptureReadView().FindEntry("hits")
+	if n, ok := common.DecodeCounter(e.Value); !found || !e.IsCounter || !ok || n != 10 {
+		t.Fatalf("Counter lost its encoding after compaction: %+v", e)
+	}
+	increment(1, 11)
+
+	// Concurrent increments on one key must not lose updates
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ingestion.SubmitIncrement(ctx, "hits", 1, 0)
+			}
+		}()
+	}
+	wg.Wait()
+	increment(0, 411)
+
+	ingestion.SubmitIngestionRequest("plain", []byte("abc"), 0, false)
+	if _, err := ingestion.SubmitIncrement(ctx, "plain", 1, 0); !errors.Is(err, ErrNotCounter) {
+		t.Errorf("Expected ErrNotCounter for a plain value, got %v", err)
+	}
+}
+
+func TestIngest_CompareAndSwapIsAtomic(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.MaximumCpuCount = 4
+	})
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+	ctx := context.Background()
+
+	if err := ingestion.SubmitCompareAndSwap(ctx, "n", nil, true, []byte("0"), 0); err != nil {
+		t.Fatalf("Create-if-absent failed: %v", err)
+	}
+	if err := ingestion.SubmitCompareAndSwap(ctx, "n", nil, true, []byte("0"), 0); !errors.Is(err, ErrCompareAndSwapFailed) {
+		t.Fatalf("Create-if-absent over a live key: expected ErrCompareAndSwapFailed, got %v", err)
+	}
+
+	// Read-modify-write loops only lose updates if a swap is not atomic
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				current, _ := state.CaptureReadView().FindEntry("n")
+				n, _ := strconv.Atoi(string(current.Value))
+				err := ingestion.SubmitCompareAndSwap(ctx, "n", current.Value, false, []byte(strconv.Itoa(n+1)), 0)
+				if err == nil {
+					done++
+				} else if !errors.Is(err, ErrCompareAndSwapFailed) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	final, _ := state.CaptureReadView().FindEntry("n")
+	if string(final.Value) != strconv.Itoa(workers*increments) {
+		t.Errorf("Expected %d after concurrent swaps, got %s", workers*increments, final.Value)
+	}
+}
+
+func TestCheckpoint_DrainsFrozenWals(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.MaximumMemtableSizeInBytes = 256
+	})
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
+
+	// No flush agent is running, so every rotation leaves a frozen WAL behind
+	for i := 0; i < 100; i++ {
+		ingestion.SubmitIngestionRequest(fmt.Sprintf("key_%03d", i), make([]byte, 32), 0, false)
+	}
+
+	state.Mutex.RLock()
+	frozenBefore := len(state.FrozenWALs)
+	state.Mutex.RUnlock()
+	if frozenBefore < 2 {
+		t.Fatalf("Expected several frozen WALs before the checkpoint, got %d", frozenBefore)
+	}
+
+	flushed, err := Checkpoint(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed != frozenBefore {
+		t.Errorf("Expected %d memtables flushed, got %d", frozenBefore, flushed)
+	}
+
+	state.Mutex.RLock()
+	frozenAfter, immutableAfter := len(state.FrozenWALs), len(state.ImmutableMem)
+	state.Mutex.RUnlock()
+	if frozenAfter != 0 || immutableAfter != 0 {
+		t.Errorf("Checkpoint left %d frozen WALs and %d immutable memtables", frozenAfter, immutableAfter)
+	}
+
+	// Only the active WAL remains on disk
+	walFiles, _ := filepath.Glob(state.Configuration.WriteAheadLogFilePath + "*")
+	if len(walFiles) != 1 {
+		t.Errorf("Expected only the active WAL on disk, found %v", walFiles)
+	}
+
+	state.SetReadOnlyMode(true)
+	if _, err := Checkpoint(state); !errors.Is(err, ErrReadOnlyMode) {
+		t.Errorf("Expected checkpoint to be refused in read-only mode, got %v", err)
+	}
+}
+
+func TestFlushAndCompaction_PartitionedTables(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	const partitions = 4
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.SSTablePartitionCount = partitions
+	})
+
+	flush := func(prefix string) {
+		mem := storage.NewMemoryTable(100)
+		for i := 0; i < 200; i++ {
+			mem.Put(fmt.Sprintf("%s_%03d", prefix, i), []byte(prefix), 0, false)
+		}
+		state.Mutex.Lock()
+		state.ImmutableMem = append(state.ImmutableMem, mem)
+		state.Mutex.Unlock()
+		processFlush(state, mem)
+	}
+	flush("a")
+	flush("b")
+
+	state.Mutex.RLock()
+	l0 := append([]storage.SSTableMetadata(nil), state.SSTables[0]...)
+	state.Mutex.RUnlock()
+	if len(l0) != 2*partitions {
+		t.Fatalf("Expected %d partitioned L0 tables, got %d", 2*partitions, len(l0))
+	}
+	for _, meta := range l0 {
+		for _, key := range tableKeys(t, meta) {
+			if !meta.Partition.Contains(key) {
+				t.Fatalf("Key %s stored outside its partition in %s", key, meta.Filename)
+			}
+		}
+	}
+
+	state.Mutex.Lock()
+	state.SSTables[0] = nil
+	state.Mutex.Unlock()
+	executeCompaction(state, l0)
+
+	state.Mutex.RLock()
+	l1 := append([]storage.SSTableMetadata(nil), state.SSTables[1]...)
+	state.Mutex.RUnlock()
+	if len(l1) != partitions {
+		t.Fatalf("Expected one L1 table per partition, got %d", len(l1))
+	}
+
+	seen := make(map[int]bool)
+	total := 0
+	for _, meta := range l1 {
+		seen[meta.Partition.Index] = true
+		total += meta.KeyCount
+		for _, key := range tableKeys(t, meta) {
+			if !meta.Partition.Contains(key) {
+				t.Fatalf("Compaction moved %s out of its partition", key)
+			}
+		}
+	}
+	if len(seen) != partitions || total != 400 {
+		t.Errorf("Expected %d distinct partitions holding 400 keys, got %d holding %d", partitions, len(seen), total)
+	}
+
+	e, found := state.CaptureReadView().FindEntry("b_123")
+	if !found || string(e.Value) != "b" {
+		t.Errorf("Lookup after partitioned compaction failed: %+v", e)
+	}
+}
+
+func TestIntervalJitter_VariesWithinBounds(t *testing.T) {
+	base := 10 * time.Second
+	jitter := newIntervalJitter(base, 20, rand.New(rand.NewPCG(1, 2)))
+	low, high := 8*time.Second, 12*time.Second
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := jitter.next()
+		if d < low || d > high {
+			t.Fatalf("Interval %v outside [%v, %v]", d, low, high)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("Expected intervals to vary, got %d distinct values", len(seen))
+	}
+
+	replay := newIntervalJitter(base, 20, rand.New(rand.NewPCG(1, 2)))
+	first := newIntervalJitter(base, 20, rand.New(rand.NewPCG(1, 2)))
+	for i := 0; i < 10; i++ {
+		if a, b := first.next(), replay.next(); a != b {
+			t.Fatalf("Same seed produced %v and %v", a, b)
+		}
+	}
+
+	if d := newIntervalJitter(base, 0, rand.New(rand.NewPCG(1, 2))).next(); d != base {
+		t.Errorf("Zero jitter should keep the base interval, got %v", d)
+	}
+}
+
+func TestBloomFilter_DisabledForLevelZero(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+
+	state := f.CreateSystem(func(c *config.SystemConfiguration) {
+		c.BloomFilterDisabledLevels = []int{0}
+	})
+
+	flush := func(prefix string) {
+		mem := storage.NewMemoryTable(100)
+		for i := 0; i < 50; i++ {
+			mem.Put(fmt.Sprintf("%s_%02d", prefix, i), []byte(prefix), 0, false)
+		}
+		state.Mutex.Lock()
+		state.ImmutableMem = append(state.ImmutableMem, mem)
+		state.Mutex.Unlock()
+		processFlush(state, mem)
+	}
+	flush("a")
+	flush("b")
+
+	state.Mutex.RLock()
+	l0 := append([]storage.SSTableMetadata(nil), state.SSTables[0]...)
+	state.Mutex.RUnlock()
+	for _, meta := range l0 {
+		positives := 0
+		for _, key := range tableKeys(t, meta) {
+			if state.BloomFilter.Contains(meta.FileID, []byte(key)) {
+				positives++
+			}
+		}
+		// A few false positives are possible; a populated filter matches every key
+		if meta.HasBloomFilter || positives == meta.KeyCount {
+			t.Fatalf("L0 table %s was written with a bloom filter", meta.Filename)
+		}
+	}
+	if e, found := state.CaptureReadView().FindEntry("a_07"); !found || string(e.Value) != "a" {
+		t.Errorf("Lookup without bloom filter failed: %+v", e)
+	}
+
+	state.Mutex.Lock()
+	state.SSTables[0] = nil
+	state.Mutex.Unlock()
+	executeCompaction(state, l0)
+
+	state.Mutex.RLock()
+	l1 := state.SSTables[1]
+	state.Mutex.RUnlock()
+	if len(l1) != 1 || !l1[0].HasBloomFilter {
+		t.Fatalf("Expected one L1 table with a bloom filter, got %+v", l1)
+	}
+	if !state.BloomFilter.Contains(l1[0].FileID, []byte("b_42")) {
+		t.Error("L1 bloom filter is missing a key")
+	}
+	if e, found := state.CaptureReadView().FindEntry("b_42"); !found || string(e.Value) != "b" {
+		t.Errorf("Lookup after compaction failed: %+v", e)
+	}
+}
+
+// tableKeys reads every key stored in a table, in order.
+func tableKeys(t *testing.T, meta storage.SSTableMetadata) []string {
+	t.Helper()
+	reader, err := storage.NewSSTableReader(meta.Filename)
+	if err != nil {
+		t.Fatalf("Open %s: %v", meta.Filename, err)
+	}
+	defer reader.Close()
+
+	var keys []string
+	for e, ok := reader.Next(); ok; e, ok = reader.Next() {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
+
+func TestDiskUsage_RecordsSSTablesAndReadAmplification(t *testing.T) {
+	f := testFactory.NewTestFactory(t)
+	defer f.Cleanup()
+	state := f.CreateSystem()
+	metrics.Global = metrics.SystemMetricsRegistry{}
+
+	// Two flushes leave two overlapping L0 tables
+	for _, key := range []string{"a", "b"} {
+		state.MemTable.Put(key, []byte("value"), 0, false)
+		state.MemTable.Put("z", []byte(key), 0, false)
+		if _, err := FlushAll(context.Background(), state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recordDiskUsage(state)
+	if metrics.Global.SSTableCount != 2 || metrics.Global.DiskSizeInBytes <= 0 {
+		t.Errorf("Expected 2 SSTables with a size, got %d tables of %d bytes", metrics.Global.SSTableCount, metrics.Global.DiskSizeInBytes)
+	}
+
+	// Both tables cover "a" and "m", but the bloom filters let lookups open
+	// only the table holding "a" and none for the missing "m"
+	if _, found := state.CaptureReadView().FindEntry("a"); !found {
+		t.Fatal("a should be found on disk")
+	}
+	state.CaptureReadView().FindEntry("m")
+	if metrics.Global.SSTableLookupCount != 2 || metrics.Global.SSTableFilesReadCount != 1 {
+		t.Errorf("Expected 2 lookups reading 1 file, got %d and %d", metrics.Global.SSTableLookupCount, metrics.Global.SSTableFilesReadCount)
+	}
+}
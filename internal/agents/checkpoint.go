@@ -0,0 +1,90 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"time"
+)
+
+// ErrReadOnlyMode is returned for writes and maintenance work refused while
+// the store is in read-only mode.
+var ErrReadOnlyMode = errors.New("read-only mode is active")
+
+// StartCheckpointAgentInBackground runs Checkpoint on a fixed interval so
+// frozen WALs never outlive a slow flush agent for long.
+func StartCheckpointAgentInBackground(bb *core.SystemState) {
+	interval := time.Duration(bb.Configuration.CheckpointIntervalInSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	bb.BackgroundAgents.Add(1)
+	go func() {
+		defer bb.BackgroundAgents.Done()
+
+		ticker := newAgentTicker(bb, interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ticker.Rearm()
+				if bb.IsReadOnlyMode() {
+					continue
+				}
+				if _, err := Checkpoint(bb); err != nil {
+					logger.LogErrorEvent("Checkpoint Failed: %v", err)
+				}
+			case <-bb.StopSignal():
+				return
+			}
+		}
+	}()
+}
+
+// Checkpoint synchronously flushes every immutable memtable queued when it
+// starts, deleting the frozen WAL behind each one, and returns how many were
+// flushed. This bounds WAL disk usage and recovery time.
+func Checkpoint(bb *core.SystemState) (int, error) {
+	if bb.IsReadOnlyMode() {
+		return 0, ErrReadOnlyMode
+	}
+
+	flushed, err := flushImmutableTables(context.Background(), bb)
+	if err != nil {
+		return flushed, fmt.Errorf("checkpoint %w", err)
+	}
+	if flushed > 0 {
+		logger.LogInfoEvent("Checkpoint flushed %d memtables", flushed)
+	}
+	return flushed, nil
+}
+
+// flushImmutableTables flushes, oldest first, every immutable memtable queued
+// when it starts. It stops at the first failed flush, or once ctx is done.
+func flushImmutableTables(ctx context.Context, bb *core.SystemState) (int, error) {
+	bb.FlushMutex.Lock()
+	defer bb.FlushMutex.Unlock()
+
+	bb.Mutex.RLock()
+	pending := append([]common.KeyValueStore(nil), bb.ImmutableMem...)
+	bb.Mutex.RUnlock()
+
+	// With the lock held exclusively no worker is mid-flush, but they may
+	// already have written some of these
+	flushed := 0
+	for _, table := range pending {
+		if err := ctx.Err(); err != nil {
+			return flushed, fmt.Errorf("stopped after %d of %d memtables: %w", flushed, len(pending), err)
+		}
+		if isAwaitingFlush(bb, table) && !processFlush(bb, table) {
+			return flushed, fmt.Errorf("stopped after %d of %d memtables: flush failed", flushed, len(pending))
+		}
+		flushed++
+	}
+	return flushed, nil
+}
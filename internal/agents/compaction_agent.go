@@ -1,9 +1,9 @@
 package agents
 
 import (
+	"cmp"
 	"container/heap"
-	"fmt"
-	"os"
+	"slices"
 	"sndv-kv/internal/common"
 	"sndv-kv/internal/core"
 	"sndv-kv/internal/logger"
@@ -17,8 +17,20 @@ type MergeItem struct {
 }
 type MergeHeap []*MergeItem
 
-func (h MergeHeap) Len() int            { return len(h) }
-func (h MergeHeap) Less(i, j int) bool  { return h[i].Entry.Key < h[j].Entry.Key }
+func (h MergeHeap) Len() int { return len(h) }
+
+// Less pops versions of a key oldest first, by sequence and then by source,
+// so the last one popped is the newest.
+func (h MergeHeap) Less(i, j int) bool {
+	a, b := h[i].Entry, h[j].Entry
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if a.Sequence != b.Sequence {
+		return a.Sequence < b.Sequence
+	}
+	return h[i].SourceID < h[j].SourceID
+}
 func (h MergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
 func (h *MergeHeap) Push(x interface{}) { *h = append(*h, x.(*MergeItem)) }
 func (h *MergeHeap) Pop() interface{} {
@@ -29,83 +41,513 @@ func (h *MergeHeap) Pop() interface{} {
 	return item
 }
 
+// StartCompactionAgentInBackground starts a dispatcher and
+// CompactionConcurrency workers. On every tick, and whenever a worker
+// finishes, the dispatcher queues what is due; the scheduler's claims keep
+// jobs touching overlapping key ranges of the same levels from running
+// together.
 func StartCompactionAgentInBackground(bb *core.SystemState) {
+	workers := max(1, bb.Configuration.CompactionConcurrency)
+	scheduler := newCompactionScheduler(workers)
+	jobs := make(chan scheduledCompaction, workers)
+
+	for i := 0; i < workers; i++ {
+		bb.BackgroundAgents.Add(1)
+		go func() {
+			defer bb.BackgroundAgents.Done()
+			for job := range jobs {
+				runScheduledCompaction(bb, scheduler, job)
+			}
+		}()
+	}
+
+	bb.BackgroundAgents.Add(1)
 	go func() {
-		interval := time.Duration(bb.Configuration.CompactionIntervalInSeconds) * time.Second
-		if interval == 0 {
-			interval = 5 * time.Second
-		}
-		ticker := time.NewTicker(interval)
+		defer bb.BackgroundAgents.Done()
+		defer close(jobs)
+
+		ticker := newAgentTicker(bb, compactionInterval(bb))
+		defer ticker.Stop()
 
-		for range ticker.C {
-			checkAndRunCompaction(bb)
+		for {
+			select {
+			case <-ticker.C:
+				dispatchCompactions(bb, scheduler, jobs)
+				ticker.SetInterval(compactionInterval(bb))
+				ticker.Rearm()
+			case <-scheduler.finished:
+				dispatchCompactions(bb, scheduler, jobs)
+			case <-bb.StopSignal():
+				return
+			}
 		}
 	}()
 }
 
-func checkAndRunCompaction(bb *core.SystemState) {
-	bb.Mutex.Lock()
-	if len(bb.SSTables) == 0 {
-		bb.Mutex.Unlock()
-		return
+// compactionInterval reads the configured interval under the state lock,
+// since a configuration reload may change it while the agent runs.
+func compactionInterval(bb *core.SystemState) time.Duration {
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+
+	interval := time.Duration(bb.Configuration.CompactionIntervalInSeconds) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
 	}
-	l0Count := len(bb.SSTables[0])
-	trigger := bb.Configuration.LevelZeroCompactionTriggerCount
+	return interval
+}
+
+// dispatchCompactions queues due jobs, top level first, until every worker
+// has one. Each queued job holds a read lock on bb.CompactionMutex taken
+// before it was planned, so exclusive holders such as the TTL agent never
+// change its tables between planning and running. Levels below L0 get one
+// job at a time, since their budget is only rechecked once a job commits.
+func dispatchCompactions(bb *core.SystemState, scheduler *compactionScheduler, jobs chan<- scheduledCompaction) {
+	for level := 0; level+1 < levelCount(bb); level++ {
+		for scheduler.hasCapacity() && !bb.IsReadOnlyMode() {
+			if level > 0 && scheduler.isLevelBusy(level) {
+				break
+			}
 
-	if l0Count < trigger {
-		bb.Mutex.Unlock()
+			bb.CompactionMutex.RLock()
+			var tables []storage.SSTableMetadata
+			if level == 0 {
+				tables = levelZeroCompactionInputs(bb, scheduler.isClaimed)
+			} else {
+				tables = levelCompactionInputs(bb, level, scheduler.isClaimed)
+			}
+			var claim *compactionClaim
+			var job compactionJob
+			if len(tables) > 0 {
+				job = planCompaction(bb, level, tables)
+				claim = newCompactionClaim(job)
+			}
+			if claim == nil || !scheduler.tryClaim(claim) {
+				bb.CompactionMutex.RUnlock()
+				break
+			}
+			jobs <- scheduledCompaction{job: job, claim: claim}
+		}
+	}
+}
+
+// runScheduledCompaction runs a queued job unless the agent is stopping or
+// the store went read-only meanwhile, then hands back its lock and claim.
+func runScheduledCompaction(bb *core.SystemState, scheduler *compactionScheduler, job scheduledCompaction) {
+	defer scheduler.release(job.claim)
+	defer bb.CompactionMutex.RUnlock()
+
+	select {
+	case <-bb.StopSignal():
 		return
+	default:
+	}
+	if !bb.IsReadOnlyMode() {
+		runCompaction(bb, job.job)
 	}
+}
 
-	tables := make([]storage.SSTableMetadata, l0Count)
-	copy(tables, bb.SSTables[0])
-	bb.SSTables[0] = make([]storage.SSTableMetadata, 0)
-	bb.Mutex.Unlock()
+func levelCount(bb *core.SystemState) int {
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+	return len(bb.SSTables)
+}
+
+// checkAndRunCompaction runs one exclusive pass, walking the levels top down
+// and compacting each one until it is no longer due: L0 while it holds the
+// trigger count of tables, deeper levels while they are over their size
+// budget. Going top down lets a level pushed over budget by the step above
+// be compacted in the same pass.
+func checkAndRunCompaction(bb *core.SystemState) {
+	bb.CompactionMutex.Lock()
+	defer bb.CompactionMutex.Unlock()
 
-	executeCompaction(bb, tables)
+	for level := 0; level+1 < levelCount(bb); level++ {
+		for !bb.IsReadOnlyMode() {
+			var ok bool
+			if level == 0 {
+				tables := levelZeroCompactionInputs(bb, nil)
+				ok = len(tables) > 0 && executeCompaction(bb, tables)
+			} else {
+				tables := levelCompactionInputs(bb, level, nil)
+				ok = len(tables) > 0 && compactInto(bb, level, tables)
+			}
+			// A failed merge is retried on the next tick rather than spun on
+			if !ok {
+				break
+			}
+		}
+	}
 }
 
-func executeCompaction(bb *core.SystemState, tables []storage.SSTableMetadata) {
-	logger.LogInfoEvent("Compacting %d L0 tables", len(tables))
+// levelZeroCompactionInputs picks the oldest L0 table once L0 has reached
+// the trigger count, together with every L0 table that overlaps it directly
+// or through another picked table. L0 tables left behind share no key with
+// the picked ones, so moving those below them cannot let an older version
+// shadow a newer one. The inputs stay live until the commit swaps them out,
+// so reads and manifest records made meanwhile still include them.
+//
+// Tables for which claimed reports true belong to a running job: they are
+// neither counted towards the trigger nor picked, and nothing is picked if
+// they overlap what would be. claimed may be nil.
+func levelZeroCompactionInputs(bb *core.SystemState, claimed func(storage.SSTableMetadata) bool) []storage.SSTableMetadata {
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
 
-	mergedFile, newMeta, err := performMerge(tables, bb.Configuration.DataDirectoryPath, bb.BloomFilter)
+	tables := bb.SSTables[0]
+	free := unclaimedTables(tables, claimed)
+	if len(free) == 0 || len(free) < bb.Configuration.LevelZeroCompactionTriggerCount {
+		return nil
+	}
 
-	bb.Mutex.Lock()
-	defer bb.Mutex.Unlock()
+	oldest := slices.MinFunc(free, func(a, b storage.SSTableMetadata) int {
+		return cmp.Compare(a.FileID, b.FileID)
+	})
+	picked := []storage.SSTableMetadata{oldest}
+	for {
+		rest := slices.DeleteFunc(slices.Clone(tables), func(meta storage.SSTableMetadata) bool {
+			return slices.ContainsFunc(picked, func(p storage.SSTableMetadata) bool { return p.Filename == meta.Filename })
+		})
+		more := overlappingTables(rest, picked)
+		if len(more) == 0 {
+			break
+		}
+		picked = append(picked, more...)
+	}
+	if len(unclaimedTables(picked, claimed)) < len(picked) {
+		return nil
+	}
+
+	// Keep L0's order so the merge sees the tables as they were flushed
+	return slices.DeleteFunc(slices.Clone(tables), func(meta storage.SSTableMetadata) bool {
+		return !slices.ContainsFunc(picked, func(p storage.SSTableMetadata) bool { return p.Filename == meta.Filename })
+	})
+}
+
+// levelCompactionInputs picks the oldest table of a level over its size
+// budget, together with any table of the level it overlaps, which only
+// tables from before leveled compaction can. Tables for which claimed
+// reports true are passed over; claimed may be nil.
+func levelCompactionInputs(bb *core.SystemState, level int, claimed func(storage.SSTableMetadata) bool) []storage.SSTableMetadata {
+	debt := bb.CompactionDebt()
+	if level >= len(debt.Levels) || debt.Levels[level].Score <= 1 {
+		return nil
+	}
+
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+
+	tables := bb.SSTables[level]
+	free := unclaimedTables(tables, claimed)
+	if len(free) == 0 {
+		return nil
+	}
+	oldest := slices.MinFunc(free, func(a, b storage.SSTableMetadata) int {
+		return cmp.Compare(a.FileID, b.FileID)
+	})
+	picked := []storage.SSTableMetadata{oldest}
+	for _, meta := range overlappingTables(tables, picked) {
+		if meta.Filename != oldest.Filename {
+			picked = append(picked, meta)
+		}
+	}
+	if len(unclaimedTables(picked, claimed)) < len(picked) {
+		return nil
+	}
+	return picked
+}
+
+// unclaimedTables returns the tables for which claimed reports false, or
+// all of them if claimed is nil.
+func unclaimedTables(tables []storage.SSTableMetadata, claimed func(storage.SSTableMetadata) bool) []storage.SSTableMetadata {
+	if claimed == nil {
+		return tables
+	}
+	return slices.DeleteFunc(slices.Clone(tables), claimed)
+}
+
+// executeCompaction merges L0 tables into L1, one merge per key-hash
+// partition so partitioned tables never mix. It reports whether every merge
+// was committed.
+func executeCompaction(bb *core.SystemState, tables []storage.SSTableMetadata) bool {
+	ok := true
+	for _, group := range groupByPartition(tables) {
+		ok = compactInto(bb, 0, group) && ok
+	}
+	return ok
+}
+
+// groupByPartition splits tables by partition, keeping their relative order.
+func groupByPartition(tables []storage.SSTableMetadata) [][]storage.SSTableMetadata {
+	var groups [][]storage.SSTableMetadata
+	position := make(map[storage.SSTablePartition]int)
+	for _, meta := range tables {
+		i, ok := position[meta.Partition]
+		if !ok {
+			i = len(groups)
+			position[meta.Partition] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], meta)
+	}
+	return groups
+}
+
+// overlappingTables returns the tables of level that could hold a key of any
+// of tables: their [MinKey, MaxKey] ranges and partitions both overlap. Only
+// these need rewriting when tables are merged into level.
+func overlappingTables(level []storage.SSTableMetadata, tables []storage.SSTableMetadata) []storage.SSTableMetadata {
+	var overlapping []storage.SSTableMetadata
+	for _, meta := range level {
+		for _, t := range tables {
+			if tablesOverlap(meta, t) {
+				overlapping = append(overlapping, meta)
+				break
+			}
+		}
+	}
+	return overlapping
+}
+
+func tablesOverlap(a, b storage.SSTableMetadata) bool {
+	if a.KeyCount == 0 || b.KeyCount == 0 {
+		return false
+	}
+	return a.MinKey <= b.MaxKey && b.MinKey <= a.MaxKey && a.Partition.Overlaps(b.Partition)
+}
+
+// compactInto merges tables from level with the tables they overlap in the
+// level below, replacing all of them with the merged output there. Levels
+// below L0 are kept free of overlaps this way, so a key is found in at most
+// one of their tables per partition. It reports whether the merge was
+// committed.
+func compactInto(bb *core.SystemState, level int, tables []storage.SSTableMetadata) bool {
+	return runCompaction(bb, planCompaction(bb, level, tables))
+}
+
+// compactionJob is one merge of tables from level into the level below,
+// planned against the tables that level held at the time.
+type compactionJob struct {
+	level         int
+	tables        []storage.SSTableMetadata
+	overlapping   []storage.SSTableMetadata
+	isBottomLevel bool
+}
 
+// inputs returns every table the job merges, oldest data first: the target
+// level's tables hold older versions than the ones merged into it.
+func (job compactionJob) inputs() []storage.SSTableMetadata {
+	return append(slices.Clone(job.overlapping), job.tables...)
+}
+
+// planCompaction finds the tables a merge of tables into the level below
+// must include. Only compaction changes the levels below L0, and a job's
+// claim or an exclusive CompactionMutex keeps other jobs off its key range,
+// so the plan still holds at commit.
+func planCompaction(bb *core.SystemState, level int, tables []storage.SSTableMetadata) compactionJob {
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+
+	job := compactionJob{level: level, tables: tables}
+	if target := level + 1; target < len(bb.SSTables) {
+		job.overlapping = overlappingTables(bb.SSTables[target], tables)
+	}
+	job.isBottomLevel = isBottomLevelFor(bb.SSTables, level+1, job.inputs())
+	return job
+}
+
+// runCompaction merges and commits a planned job, reporting whether it was
+// committed.
+func runCompaction(bb *core.SystemState, job compactionJob) bool {
+	level, target := job.level, job.level+1
+	inputs := job.inputs()
+	isBottomLevel := job.isBottomLevel
+
+	logger.LogInfoEvent("Compacting %d L%d tables with %d L%d tables", len(job.tables), level, len(job.overlapping), target)
+
+	opts := sstableWriteOptions(bb)
+	opts.Partition = commonPartition(inputs)
+	output := mergeOutput{
+		Level: target,
+		NextFilename: func() string {
+			return storage.SSTableFilename(bb.Configuration.DataDirectoryPath, target, bb.AllocateFileID())
+		},
+		TargetSizeInBytes: bb.Configuration.MaximumMemtableSizeInBytes,
+	}
+	outputs, err := performMerge(inputs, output, bb.BloomFilterForLevel(target), opts, isBottomLevel)
 	if err != nil {
 		logger.LogErrorEvent("Compaction Failed: %v", err)
-		bb.SSTables[0] = append(tables, bb.SSTables[0]...)
-		return
+		return false
 	}
 
-	commitCompaction(bb, tables, newMeta, mergedFile)
+	bb.Mutex.Lock()
+	committed := commitCompaction(bb, level, inputs, outputs)
+	bb.Mutex.Unlock()
+
+	if committed {
+		for _, meta := range outputs {
+			bb.NotifyCompactionCommitted(meta)
+		}
+	}
+	return committed
 }
 
-func commitCompaction(bb *core.SystemState, oldTables []storage.SSTableMetadata, newMeta storage.SSTableMetadata, filename string) {
-	if len(bb.SSTables) < 2 {
-		bb.SSTables = append(bb.SSTables, make([]storage.SSTableMetadata, 0))
+// commonPartition returns the partition all tables share, or the zero value,
+// which may hold any key, if they differ.
+func commonPartition(tables []storage.SSTableMetadata) storage.SSTablePartition {
+	for _, meta := range tables[1:] {
+		if meta.Partition != tables[0].Partition {
+			return storage.SSTablePartition{}
+		}
 	}
-	bb.SSTables[1] = append(bb.SSTables[1], newMeta)
+	return tables[0].Partition
+}
 
+// isBottomLevelFor reports whether merging tables into level produces its
+// bottom-most data: no table below that level could hold an older version
+// of any of their keys, so their tombstones shadow nothing. The tables the
+// merge overlaps in level itself must be among tables. Caller must hold
+// bb.Mutex.
+func isBottomLevelFor(levels [][]storage.SSTableMetadata, level int, tables []storage.SSTableMetadata) bool {
+	for l := level + 1; l < len(levels); l++ {
+		if len(overlappingTables(levels[l], tables)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// commitCompaction replaces the merged tables, taken from level and the one
+// below it, with the output in the level below. The output may be empty when
+// nothing survived the merge. The inputs are only deleted once the manifest
+// no longer lists them. Caller must hold bb.Mutex.
+func commitCompaction(bb *core.SystemState, level int, oldTables, outputs []storage.SSTableMetadata) bool {
+	obsolete := make([]string, 0, len(oldTables))
 	for _, t := range oldTables {
-		os.Remove(t.Filename)
+		obsolete = append(obsolete, t.Filename)
+	}
+
+	levels := slices.Clone(bb.SSTables)
+	for len(levels) < level+2 {
+		levels = append(levels, make([]storage.SSTableMetadata, 0))
+	}
+	for _, l := range []int{level, level + 1} {
+		levels[l] = slices.DeleteFunc(slices.Clone(levels[l]), func(meta storage.SSTableMetadata) bool {
+			return slices.Contains(obsolete, meta.Filename)
+		})
+	}
+	levels[level+1] = append(levels[level+1], outputs...)
+
+	if err := bb.CommitSSTables(levels); err != nil {
+		logger.LogErrorEvent("Compaction Failed: %v", err)
+		for _, meta := range outputs {
+			storage.RemoveSSTableFile(meta.Filename)
+		}
+		return false
 	}
-	logger.LogInfoEvent("Compaction Success: %s", filename)
+
+	bb.RemoveSSTableFiles(obsolete)
+	logger.LogInfoEvent("Compaction Success: %d tables into %d L%d tables", len(oldTables), len(outputs), level+1)
+	return true
 }
 
-func performMerge(tables []storage.SSTableMetadata, dir string, bloom common.BloomFilter) (string, storage.SSTableMetadata, error) {
+// mergeOutput describes where a merge writes its tables.
+type mergeOutput struct {
+	Level int
+	// NextFilename names each output table in turn.
+	NextFilename func() string
+	// TargetSizeInBytes starts a new table once the current one has grown to
+	// this size. Zero writes a single table.
+	TargetSizeInBytes int64
+}
+
+// performMerge writes the newest version of every key in tables, reclaiming
+// what reclaimEntry can. Entries stream from the inputs straight into the
+// output tables, so memory stays bounded by one entry per input however
+// large the tables are. Nothing is written if no entry survives.
+func performMerge(tables []storage.SSTableMetadata, output mergeOutput, bloom common.BloomFilter, opts storage.SSTableWriteOptions, isBottomLevel bool) ([]storage.SSTableMetadata, error) {
 	iters, err := createIterators(tables)
 	if err != nil {
-		return "", storage.SSTableMetadata{}, err
+		return nil, err
 	}
 	defer closeIterators(iters)
 
-	entries := mergeIterators(iters)
+	// Every input key may survive, so this bounds each output's key count
+	expectedEntries := 0
+	for _, meta := range tables {
+		expectedEntries += meta.KeyCount
+	}
 
-	fname := fmt.Sprintf("%s/L1_%d.sst", dir, time.Now().UnixNano())
-	meta, err := storage.WriteSortedStringTableToDisk(entries, fname, 1, bloom)
-	return fname, meta, err
+	var outputs []storage.SSTableMetadata
+	var writer *storage.SSTableWriter
+	fail := func(err error) ([]storage.SSTableMetadata, error) {
+		if writer != nil {
+			writer.Abort()
+		}
+		for _, written := range outputs {
+			storage.RemoveSSTableFile(written.Filename)
+		}
+		return nil, err
+	}
+	finish := func() error {
+		meta, err := writer.Finish()
+		writer = nil
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, meta)
+		return nil
+	}
+
+	merged := newMergeIterator(iters)
+	now := time.Now().UnixNano()
+	for e, ok := merged.Next(); ok; e, ok = merged.Next() {
+		e, keep := reclaimEntry(e, isBottomLevel, now)
+		if !keep {
+			continue
+		}
+
+		if writer == nil {
+			if writer, err = storage.NewSSTableWriter(output.NextFilename(), output.Level, bloom, opts, expectedEntries); err != nil {
+				return fail(err)
+			}
+		}
+		if err := writer.Add(e); err != nil {
+			return fail(err)
+		}
+		if output.TargetSizeInBytes > 0 && writer.SizeInBytes() >= output.TargetSizeInBytes {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	// A table that stopped early would silently drop the rest of its keys
+	for _, it := range iters {
+		if err := it.Err(); err != nil {
+			return fail(err)
+		}
+	}
+	if writer != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return outputs, nil
+}
+
+// reclaimEntry decides what a merged entry still needs on disk. An expired
+// entry keeps only a tombstone, which still hides older versions of its key
+// further down. At the bottom level there is nothing left to hide, so
+// tombstones and expired entries are dropped altogether.
+func reclaimEntry(e common.Entry, isBottomLevel bool, nowUnixNano int64) (common.Entry, bool) {
+	if e.IsExpiredAt(nowUnixNano) {
+		e = common.Entry{Key: e.Key, IsDeleted: true, Sequence: e.Sequence}
+	}
+	if e.IsDeleted && isBottomLevel {
+		return common.Entry{}, false
+	}
+	return e, true
 }
 
 func createIterators(tables []storage.SSTableMetadata) ([]*storage.SSTableReader, error) {
@@ -127,32 +569,43 @@ func closeIterators(iters []*storage.SSTableReader) {
 	}
 }
 
-func mergeIterators(iters []*storage.SSTableReader) []common.Entry {
-	mh := &MergeHeap{}
-	heap.Init(mh)
+// mergeIterator yields the newest version of each key across iters in key
+// order, holding only the next entry of each iterator.
+type mergeIterator struct {
+	iters []*storage.SSTableReader
+	heap  *MergeHeap
+}
 
-	for i, iter := range iters {
-		if e, ok := iter.Next(); ok {
-			heap.Push(mh, &MergeItem{Entry: e, SourceID: i})
-		}
+func newMergeIterator(iters []*storage.SSTableReader) *mergeIterator {
+	m := &mergeIterator{iters: iters, heap: &MergeHeap{}}
+	heap.Init(m.heap)
+	for i := range iters {
+		m.advance(i)
 	}
+	return m
+}
 
-	var entries []common.Entry
-	var lastKey string
-
-	for mh.Len() > 0 {
-		top := heap.Pop(mh).(*MergeItem)
+func (m *mergeIterator) advance(source int) {
+	if e, ok := m.iters[source].Next(); ok {
+		heap.Push(m.heap, &MergeItem{Entry: e, SourceID: source})
+	}
+}
 
-		if len(entries) > 0 && lastKey == top.Entry.Key {
-			entries[len(entries)-1] = top.Entry
-		} else {
-			entries = append(entries, top.Entry)
-			lastKey = top.Entry.Key
-		}
+// Next returns the next key's newest version, or false once every iterator
+// is exhausted.
+func (m *mergeIterator) Next() (common.Entry, bool) {
+	if m.heap.Len() == 0 {
+		return common.Entry{}, false
+	}
 
-		if e, ok := iters[top.SourceID].Next(); ok {
-			heap.Push(mh, &MergeItem{Entry: e, SourceID: top.SourceID})
-		}
+	// Versions of a key pop oldest first, so the last one popped wins
+	top := heap.Pop(m.heap).(*MergeItem)
+	m.advance(top.SourceID)
+	newest := top.Entry
+	for m.heap.Len() > 0 && (*m.heap)[0].Entry.Key == newest.Key {
+		top = heap.Pop(m.heap).(*MergeItem)
+		m.advance(top.SourceID)
+		newest = top.Entry
 	}
-	return entries
+	return newest, true
 }
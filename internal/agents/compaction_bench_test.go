@@ -0,0 +1,89 @@
+package agents
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/storage"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkStreamingMerge compacts four 32MB tables under a 16MB soft memory
+// limit and reports the peak live heap, which should stay a small fraction
+// of the data merged.
+func BenchmarkStreamingMerge(b *testing.B) {
+	const (
+		tableCount     = 4
+		entriesPerFile = 32 * 1024
+		valueSize      = 1024
+	)
+	dir := b.TempDir()
+	value := make([]byte, valueSize)
+
+	tables := make([]storage.SSTableMetadata, tableCount)
+	for t := range tables {
+		w, err := storage.NewSSTableWriter(storage.SSTableFilename(dir, 0, int64(t+1)), 0, nil, storage.SSTableWriteOptions{}, entriesPerFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		// Interleaved keys so every table overlaps every other
+		for i := 0; i < entriesPerFile; i++ {
+			key := fmt.Sprintf("key%09d", i*tableCount+t)
+			if err := w.Add(common.Entry{Key: key, Value: value, Sequence: uint64(i*tableCount + t + 1)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if tables[t], err = w.Finish(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(16 << 20))
+
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	go func() {
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak.Load() {
+					peak.Store(stats.HeapAlloc)
+				}
+			}
+		}
+	}()
+
+	b.SetBytes(tableCount * entriesPerFile * valueSize)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		next := int64(100)
+		output := mergeOutput{
+			Level: 1,
+			NextFilename: func() string {
+				next++
+				return storage.SSTableFilename(dir, 1, next)
+			},
+			TargetSizeInBytes: 16 << 20,
+		}
+		outputs, err := performMerge(tables, output, nil, storage.SSTableWriteOptions{}, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		for _, meta := range outputs {
+			storage.RemoveSSTableFile(meta.Filename)
+		}
+		b.StartTimer()
+	}
+	b.StopTimer()
+	close(done)
+
+	b.ReportMetric(float64(peak.Load())/(1<<20), "peak-heap-MB")
+}
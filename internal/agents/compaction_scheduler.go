@@ -0,0 +1,136 @@
+package agents
+
+import (
+	"slices"
+	"sndv-kv/internal/storage"
+	"sync"
+)
+
+// compactionScheduler tracks the claims of queued and running compaction
+// jobs so concurrent workers never merge the same tables, nor overlapping
+// key ranges of the same level.
+type compactionScheduler struct {
+	mutex    sync.Mutex
+	claims   []*compactionClaim
+	capacity int
+
+	// finished wakes the dispatcher when a job's claim is released.
+	finished chan struct{}
+}
+
+// compactionClaim covers the source level of a job and the level below it,
+// over the key range and partition of every table the job merges. The
+// merged output never falls outside that range.
+type compactionClaim struct {
+	level     int
+	files     []string
+	hasRange  bool
+	minKey    string
+	maxKey    string
+	partition storage.SSTablePartition
+}
+
+// scheduledCompaction is a job queued for a worker with its claim.
+type scheduledCompaction struct {
+	job   compactionJob
+	claim *compactionClaim
+}
+
+func newCompactionScheduler(capacity int) *compactionScheduler {
+	return &compactionScheduler{capacity: capacity, finished: make(chan struct{}, 1)}
+}
+
+func newCompactionClaim(job compactionJob) *compactionClaim {
+	inputs := job.inputs()
+	claim := &compactionClaim{level: job.level, partition: commonPartition(inputs)}
+	for _, meta := range inputs {
+		claim.files = append(claim.files, meta.Filename)
+		if meta.KeyCount == 0 {
+			continue
+		}
+		if !claim.hasRange || meta.MinKey < claim.minKey {
+			claim.minKey = meta.MinKey
+		}
+		if !claim.hasRange || meta.MaxKey > claim.maxKey {
+			claim.maxKey = meta.MaxKey
+		}
+		claim.hasRange = true
+	}
+	return claim
+}
+
+// conflicts reports whether two jobs could touch the same tables or keys.
+func (c *compactionClaim) conflicts(other *compactionClaim) bool {
+	for _, f := range c.files {
+		if slices.Contains(other.files, f) {
+			return true
+		}
+	}
+	// Each claim spans its level and the next, so these share none
+	if c.level > other.level+1 || other.level > c.level+1 {
+		return false
+	}
+	return c.hasRange && other.hasRange &&
+		c.minKey <= other.maxKey && other.minKey <= c.maxKey &&
+		c.partition.Overlaps(other.partition)
+}
+
+func (s *compactionScheduler) hasCapacity() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.claims) < s.capacity
+}
+
+// tryClaim records claim unless it conflicts with one already held.
+func (s *compactionScheduler) tryClaim(claim *compactionClaim) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.claims) >= s.capacity {
+		return false
+	}
+	for _, held := range s.claims {
+		if held.conflicts(claim) {
+			return false
+		}
+	}
+	s.claims = append(s.claims, claim)
+	return true
+}
+
+func (s *compactionScheduler) release(claim *compactionClaim) {
+	s.mutex.Lock()
+	s.claims = slices.DeleteFunc(s.claims, func(held *compactionClaim) bool { return held == claim })
+	s.mutex.Unlock()
+
+	select {
+	case s.finished <- struct{}{}:
+	default:
+	}
+}
+
+// isClaimed reports whether a held claim includes meta.
+func (s *compactionScheduler) isClaimed(meta storage.SSTableMetadata) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, held := range s.claims {
+		if slices.Contains(held.files, meta.Filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLevelBusy reports whether a held claim compacts from level.
+func (s *compactionScheduler) isLevelBusy(level int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, held := range s.claims {
+		if held.level == level {
+			return true
+		}
+	}
+	return false
+}
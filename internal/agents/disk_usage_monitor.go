@@ -0,0 +1,41 @@
+package agents
+
+import (
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/metrics"
+	"time"
+)
+
+// StartDiskUsageMonitorInBackground periodically publishes the SSTables'
+// summed size and count to the metrics registry. The interval bounds how
+// often new tables are stat'ed, so the monitor stays off the disk's back.
+func StartDiskUsageMonitorInBackground(bb *core.SystemState) {
+	interval := time.Duration(bb.Configuration.DiskUsageIntervalInSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+	recordDiskUsage(bb)
+
+	bb.BackgroundAgents.Add(1)
+	go func() {
+		defer bb.BackgroundAgents.Done()
+
+		ticker := newAgentTicker(bb, interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				recordDiskUsage(bb)
+				ticker.Rearm()
+			case <-bb.StopSignal():
+				return
+			}
+		}
+	}()
+}
+
+func recordDiskUsage(bb *core.SystemState) {
+	sizeInBytes, tableCount := bb.SSTableDiskUsage()
+	metrics.SetDiskUsage(sizeInBytes, tableCount)
+}
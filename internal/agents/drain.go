@@ -0,0 +1,35 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+)
+
+// Drain readies the store to be migrated off: it enables read-only mode so
+// new writes are refused, then rotates the active memtable and flushes every
+// memtable to SSTables. Enabling the mode waits for batches being applied,
+// and shards refuse the rest, so nothing lands after the rotation. It waits for any running compaction or TTL rewrite
+// first, and since read-only mode is left on, neither resumes afterwards, so
+// the table set stays fixed for an export. Returns how many memtables were
+// flushed.
+func Drain(bb *core.SystemState) (int, error) {
+	bb.SetReadOnlyMode(true)
+
+	bb.CompactionMutex.Lock()
+	defer bb.CompactionMutex.Unlock()
+
+	bb.Mutex.Lock()
+	if bb.MemTable.Size() > 0 {
+		rotateMemTable(bb)
+	}
+	bb.Mutex.Unlock()
+
+	flushed, err := flushImmutableTables(context.Background(), bb)
+	if err != nil {
+		return flushed, fmt.Errorf("drain %w", err)
+	}
+	logger.LogInfoEvent("Drain flushed %d memtables; store is read-only", flushed)
+	return flushed, nil
+}
@@ -1,14 +1,13 @@
 package agents
 
 import (
-	"fmt"
+	"slices"
 	"sndv-kv/internal/common"
 	"sndv-kv/internal/core"
 	"sndv-kv/internal/logger"
 	"sndv-kv/internal/storage"
 	"sort"
 	"sync"
-	"time"
 )
 
 var flushBufferPool = sync.Pool{
@@ -19,76 +18,195 @@ var flushBufferPool = sync.Pool{
 	},
 }
 
+// StartFlushAgentInBackground starts FlushConcurrency flush workers. Each
+// claims a different immutable memtable, writes it to its own L0 tables
+// and commits on its own, so a burst of rotations is flushed in parallel.
 func StartFlushAgentInBackground(bb *core.SystemState) {
-	go func() {
-		for {
-			table := waitForFlush(bb)
-			if table != nil {
-				processFlush(bb, table)
+	workers := max(1, bb.Configuration.FlushConcurrency)
+	for i := 0; i < workers; i++ {
+		bb.BackgroundAgents.Add(1)
+		go func() {
+			defer bb.BackgroundAgents.Done()
+			for {
+				table := waitForFlush(bb)
+				if table == nil {
+					return
+				}
+
+				// A checkpoint may have flushed it while we waited for the lock
+				bb.FlushMutex.RLock()
+				if isAwaitingFlush(bb, table) {
+					processFlush(bb, table)
+				}
+				bb.FlushMutex.RUnlock()
+
+				bb.Mutex.Lock()
+				bb.ReleaseFlushClaim(table)
+				bb.Mutex.Unlock()
 			}
-		}
-	}()
+		}()
+	}
 }
 
+// waitForFlush blocks until it can claim a table to flush, or returns nil
+// once the agents are being stopped.
 func waitForFlush(bb *core.SystemState) common.KeyValueStore {
 	bb.Mutex.Lock()
 	defer bb.Mutex.Unlock()
 
-	for len(bb.ImmutableMem) == 0 {
+	for {
+		if bb.IsStopping() {
+			return nil
+		}
+		if !bb.IsReadOnlyMode() {
+			if table := bb.ClaimImmutableForFlush(); table != nil {
+				return table
+			}
+		}
 		bb.FlushCondition.Wait()
 	}
-	return bb.ImmutableMem[0]
 }
 
-func processFlush(bb *core.SystemState, table common.KeyValueStore) {
-	filename := fmt.Sprintf("%s/L0_%d.sst", bb.Configuration.DataDirectoryPath, time.Now().UnixNano())
+func isAwaitingFlush(bb *core.SystemState, table common.KeyValueStore) bool {
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+	return bb.IsAwaitingFlush(table)
+}
 
-	// MEMORY OPTIMIZATION: Get buffer from pool
-	bufPtr := flushBufferPool.Get().(*[]common.Entry)
-	entries := (*bufPtr)[:0] // Reset length
+// sortEntriesByKey puts a memtable dump in the key order SSTables need.
+func sortEntriesByKey(entries []common.Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+}
 
-	// Dump MemTable into buffer
-	if mem, ok := table.(*storage.ShardedMemoryTable); ok {
+// memtableEntries appends every entry of table, tombstones included, to
+// entries in key order.
+func memtableEntries(table common.KeyValueStore, entries []common.Entry) []common.Entry {
+	switch mem := table.(type) {
+	case storage.OrderedMemoryTable:
+		// Already in key order, so no sort
+		mem.AscendRange("", "", func(e common.Entry) bool {
+			entries = append(entries, e)
+			return true
+		})
+	case *storage.ShardedMemoryTable:
 		// Optimized path avoiding intermediate allocs
 		entries = mem.DumpToSlice(entries)
-	} else {
+		sortEntriesByKey(entries)
+	default:
 		// Fallback for tests
-		entries = table.GetAll()
+		entries = append(entries, table.GetAll()...)
+		sortEntriesByKey(entries)
 	}
+	return entries
+}
 
-	// SSTables MUST be sorted
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Key < entries[j].Key
-	})
+// processFlush writes table to L0 and reports whether it was committed.
+func processFlush(bb *core.SystemState, table common.KeyValueStore) bool {
+	// MEMORY OPTIMIZATION: Get buffer from pool
+	bufPtr := flushBufferPool.Get().(*[]common.Entry)
+	entries := memtableEntries(table, (*bufPtr)[:0]) // Reset length
 
-	meta, err := storage.WriteSortedStringTableToDisk(entries, filename, 0, bb.BloomFilter)
+	metas, err := writePartitionedTables(bb, entries)
 
 	// Return buffer to pool
 	flushBufferPool.Put(bufPtr)
 
-	commitFlush(bb, meta, err, filename, len(entries))
+	if !commitFlush(bb, table, metas, err, len(entries)) {
+		return false
+	}
+	for _, meta := range metas {
+		bb.NotifyFlushCommitted(meta)
+	}
+	return true
+}
+
+// writePartitionedTables writes sorted entries as one L0 table, or as one
+// table per non-empty key-hash partition when partitioning is configured.
+// On error the tables written so far are removed.
+func writePartitionedTables(bb *core.SystemState, entries []common.Entry) ([]storage.SSTableMetadata, error) {
+	count := bb.Configuration.SSTablePartitionCount
+	if count <= 1 {
+		filename := storage.SSTableFilename(bb.Configuration.DataDirectoryPath, 0, bb.AllocateFileID())
+		meta, err := storage.WriteSortedStringTableToDiskWithOptions(entries, filename, 0, bb.BloomFilterForLevel(0), sstableWriteOptions(bb))
+		if err != nil {
+			return nil, err
+		}
+		return []storage.SSTableMetadata{meta}, nil
+	}
+
+	// Appending in order keeps every partition sorted
+	partitions := make([][]common.Entry, count)
+	for _, e := range entries {
+		p := storage.PartitionOf(e.Key, count)
+		partitions[p] = append(partitions[p], e)
+	}
+
+	metas := make([]storage.SSTableMetadata, 0, count)
+	for p, part := range partitions {
+		if len(part) == 0 {
+			continue
+		}
+
+		opts := sstableWriteOptions(bb)
+		opts.Partition = storage.SSTablePartition{Index: p, Count: count}
+		filename := storage.SSTableFilename(bb.Configuration.DataDirectoryPath, 0, bb.AllocateFileID())
+
+		meta, err := storage.WriteSortedStringTableToDiskWithOptions(part, filename, 0, bb.BloomFilterForLevel(0), opts)
+		if err != nil {
+			for _, written := range metas {
+				storage.RemoveSSTableFile(written.Filename)
+			}
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+func sstableWriteOptions(bb *core.SystemState) storage.SSTableWriteOptions {
+	// engine.Open rejects unknown codecs, so the error cannot happen here
+	threshold, _ := storage.ValueCompressionThreshold(bb.Configuration.SSTableCompression, bb.Configuration.SSTableValueCompressionThresholdInBytes)
+	return storage.SSTableWriteOptions{
+		BlockSizeInBytes:                 bb.Configuration.SSTableBlockSizeInBytes,
+		ValueCompressionThresholdInBytes: threshold,
+	}
 }
 
-func commitFlush(bb *core.SystemState, meta storage.SSTableMetadata, err error, filename string, count int) {
+// commitFlush adds the flushed tables to L0 and retires the memtable and its
+// WAL, along with any newer ones flushed ahead of it. A memtable flushed
+// ahead of an older one stays queued until that one is flushed. It reports
+// false if the flush failed, leaving the memtable queued.
+func commitFlush(bb *core.SystemState, table common.KeyValueStore, metas []storage.SSTableMetadata, err error, count int) bool {
 	bb.Mutex.Lock()
 	defer bb.Mutex.Unlock()
 
 	if err != nil {
 		logger.LogErrorEvent("Flush Error: %v", err)
-		return
+		return false
 	}
 
-	if len(bb.SSTables) == 0 {
-		bb.SSTables = make([][]storage.SSTableMetadata, 4)
+	levels := slices.Clone(bb.SSTables)
+	if len(levels) == 0 {
+		levels = make([][]storage.SSTableMetadata, 4)
 	}
-	bb.SSTables[0] = append(bb.SSTables[0], meta)
+	levels[0] = append(levels[0], metas...)
 
-	if len(bb.ImmutableMem) > 0 {
-		bb.ImmutableMem = bb.ImmutableMem[1:]
+	// The WAL is only deleted once the manifest knows about the tables
+	if err := bb.CommitSSTables(levels); err != nil {
+		logger.LogErrorEvent("Flush Error: %v", err)
+		for _, meta := range metas {
+			storage.RemoveSSTableFile(meta.Filename)
+		}
+		return false
 	}
 
-	rotateFrozenWal(bb)
-	logger.LogInfoEvent("Flushed %d keys to %s", count, filename)
+	for frozen := bb.RetireFlushedImmutable(table); frozen > 0; frozen-- {
+		rotateFrozenWal(bb)
+	}
+	logger.LogInfoEvent("Flushed %d keys to %d tables", count, len(metas))
+	return true
 }
 
 func rotateFrozenWal(bb *core.SystemState) {
@@ -1,6 +1,9 @@
 package agents
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"runtime"
@@ -9,6 +12,7 @@ import (
 	"sndv-kv/internal/logger"
 	"sndv-kv/internal/metrics"
 	"sndv-kv/internal/storage"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -18,7 +22,23 @@ type IngestReq struct {
 	Val             []byte
 	TTL             int
 	IsDeleted       bool
+	IsCounter       bool
 	ResponseChannel chan error
+
+	// Increments carry a Delta instead of a value; the shard resolves them
+	// into a counter write and stores the new total in Result.
+	IsIncrement bool
+	Delta       int64
+	Result      *int64
+
+	// Compare-and-swap writes apply only if the live value equals Expected,
+	// or with ExpectAbsent, only if the key has no live value.
+	IsCompareAndSwap bool
+	Expected         []byte
+	ExpectAbsent     bool
+
+	// Touches carry only a TTL; the shard rewrites the live value with it.
+	IsTouch bool
 }
 
 type BatchIngestReq struct {
@@ -31,108 +51,335 @@ type ShardChannels struct {
 	BatchQueue  chan *BatchIngestReq
 }
 
-var (
+// ErrIngestionStopped is returned for writes submitted after Stop.
+var ErrIngestionStopped = errors.New("ingestion subsystem stopped")
+
+// ErrCompareAndSwapFailed is returned when a compare-and-swap finds a value
+// other than the expected one.
+var ErrCompareAndSwapFailed = errors.New("current value does not match the expected value")
+
+// ErrNotCounter is returned when incrementing a key whose live value is
+// neither a fixed-width counter nor a base-10 integer.
+var ErrNotCounter = errors.New("value is not a counter")
+
+// ErrKeyNotFound is returned when touching a key with no live value.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrOverloaded is returned when a shard queue stays full for longer than
+// IngestionQueueTimeoutInMilliseconds.
+var ErrOverloaded = errors.New("ingestion queue is full")
+
+// IngestionSubsystem owns the shard goroutines that apply writes to one
+// SystemState. Each instance is independent, so several stores can run in
+// the same process.
+type IngestionSubsystem struct {
+	state         *core.SystemState
 	shardChannels []ShardChannels
 	numShards     int
+	queueTimeout  time.Duration
+
+	stopSignal   chan struct{}
+	stopOnce     sync.Once
+	shardsExited chan struct{}
+
+	// A request and its response channel go back to their pools only once
+	// no shard can touch them again: the reply was received, or the request
+	// never reached a queue. Abandoned ones are left to the GC, otherwise a
+	// late reply would land on a channel another caller is waiting on.
+	reqPool        sync.Pool
+	respChanPool   sync.Pool
+	entrySlicePool sync.Pool
+}
 
-	reqPool = sync.Pool{
-		New: func() interface{} { return &IngestReq{} },
-	}
-	respChanPool = sync.Pool{
-		New: func() interface{} { return make(chan error, 1) },
-	}
-	entrySlicePool = sync.Pool{
-		New: func() interface{} {
-			s := make([]common.Entry, 0, 100)
-			return &s
-		},
+// InitializeIngestionSubsystem starts IngestionShardCount shard goroutines,
+// falling back to MaximumCpuCount and then the CPU count. Keys are routed to
+// shards by hash, so every write of a key is applied in submission order by
+// one goroutine; the memtable shards its locks separately.
+func InitializeIngestionSubsystem(bb *core.SystemState) *IngestionSubsystem {
+	numShards := runtime.NumCPU()
+	if bb.Configuration.IngestionShardCount > 0 {
+		numShards = bb.Configuration.IngestionShardCount
+	} else if bb.Configuration.MaximumCpuCount > 0 {
+		numShards = bb.Configuration.MaximumCpuCount
 	}
-)
 
-func InitializeIngestionSubsystem(bb *core.SystemState) {
-	numShards = runtime.NumCPU()
-	if bb.Configuration.MaximumCpuCount > 0 {
-		numShards = bb.Configuration.MaximumCpuCount
+	ing := &IngestionSubsystem{
+		state:         bb,
+		shardChannels: make([]ShardChannels, numShards),
+		numShards:     numShards,
+		queueTimeout:  time.Duration(bb.Configuration.IngestionQueueTimeoutInMilliseconds) * time.Millisecond,
+		stopSignal:    make(chan struct{}),
+		shardsExited:  make(chan struct{}),
+		reqPool: sync.Pool{
+			New: func() interface{} { return &IngestReq{} },
+		},
+		respChanPool: sync.Pool{
+			New: func() interface{} { return make(chan error, 1) },
+		},
+		entrySlicePool: sync.Pool{
+			New: func() interface{} {
+				s := make([]common.Entry, 0, 100)
+				return &s
+			},
+		},
 	}
 
-	shardChannels = make([]ShardChannels, numShards)
+	var shards sync.WaitGroup
 	for i := 0; i < numShards; i++ {
-		shardChannels[i] = ShardChannels{
+		ing.shardChannels[i] = ShardChannels{
 			SingleQueue: make(chan *IngestReq, 10000),
 			BatchQueue:  make(chan *BatchIngestReq, 100),
 		}
-		go runShard(i, shardChannels[i], bb)
+		shards.Add(1)
+		go func(id int) {
+			defer shards.Done()
+			ing.runShard(id, ing.shardChannels[id])
+		}(i)
 	}
+	go func() {
+		shards.Wait()
+		close(ing.shardsExited)
+	}()
+
 	logger.LogInfoEvent("Ingest initialized with %d shards", numShards)
+	return ing
 }
 
-func SubmitIngestionRequest(key string, val []byte, ttl int, deleted bool) error {
+// Stop drains the shard queues and waits for every shard goroutine to exit.
+// Writes submitted afterwards fail with ErrIngestionStopped.
+func (ing *IngestionSubsystem) Stop() {
+	ing.stopOnce.Do(func() { close(ing.stopSignal) })
+	<-ing.shardsExited
+}
+
+func (ing *IngestionSubsystem) shardFor(key string) int {
 	h := fnv.New32a()
 	h.Write([]byte(key))
-	shardID := int(h.Sum32()) % numShards
+	return int(h.Sum32()) % ing.numShards
+}
 
-	req := reqPool.Get().(*IngestReq)
-	req.Key = key
-	req.Val = val
-	req.TTL = ttl
-	req.IsDeleted = deleted
+func (ing *IngestionSubsystem) SubmitIngestionRequest(key string, val []byte, ttl int, deleted bool) error {
+	return ing.SubmitIngestionRequestContext(context.Background(), key, val, ttl, deleted)
+}
 
-	respChan := respChanPool.Get().(chan error)
-	req.ResponseChannel = respChan
+// SubmitIngestionRequestContext is SubmitIngestionRequest bounded by ctx. A
+// request abandoned after it was queued may still be applied.
+func (ing *IngestionSubsystem) SubmitIngestionRequestContext(ctx context.Context, key string, val []byte, ttl int, deleted bool) error {
+	return ing.submit(ctx, IngestReq{Key: key, Val: val, TTL: ttl, IsDeleted: deleted})
+}
 
-	shardChannels[shardID].SingleQueue <- req
+// SubmitIngestionAsync queues a write without waiting for it to be applied:
+// it returns once the owning shard has the request, or ctx ends first. Any
+// WAL error is only logged, so the write may be lost without the caller
+// knowing, and durability is never confirmed.
+func (ing *IngestionSubsystem) SubmitIngestionAsync(ctx context.Context, key string, val []byte, ttl int, deleted bool) error {
+	// Not pooled: nothing tells the caller when the shard is done with it
+	req := &IngestReq{Key: key, Val: val, TTL: ttl, IsDeleted: deleted}
+	return enqueue(ing, ctx, ing.shardChannels[ing.shardFor(key)].SingleQueue, req)
+}
+
+// SubmitCounterWrite stores n as a fixed-width counter.
+func (ing *IngestionSubsystem) SubmitCounterWrite(ctx context.Context, key string, n int64, ttl int) error {
+	return ing.submit(ctx, IngestReq{Key: key, Val: common.EncodeCounter(n), TTL: ttl, IsCounter: true})
+}
+
+// SubmitIncrement adds delta to the fixed-width counter at key and returns
+// the new total. A missing, deleted or expired key counts as zero, and a
+// plain value holding a base-10 integer counts as that integer. The read and
+// the write both happen on the shard goroutine owning the key, so concurrent
+// increments never lose updates.
+func (ing *IngestionSubsystem) SubmitIncrement(ctx context.Context, key string, delta int64, ttl int) (int64, error) {
+	var result int64
+	err := ing.submit(ctx, IngestReq{Key: key, TTL: ttl, IsIncrement: true, Delta: delta, Result: &result})
+	return result, err
+}
 
-	err := <-respChan
+// SubmitCompareAndSwap writes value at key only if the live value equals
+// expected, or if expectAbsent is set, only if the key has no live value.
+// Otherwise it returns ErrCompareAndSwapFailed. Like increments, the check
+// and the write happen on the shard goroutine owning the key, so no other
+// write can land in between.
+func (ing *IngestionSubsystem) SubmitCompareAndSwap(ctx context.Context, key string, expected []byte, expectAbsent bool, value []byte, ttl int) error {
+	return ing.submit(ctx, IngestReq{Key: key, Val: value, TTL: ttl, IsCompareAndSwap: true, Expected: expected, ExpectAbsent: expectAbsent})
+}
+
+// SubmitTouch replaces the TTL of the live value at key, keeping the value,
+// or returns ErrKeyNotFound if there is none. A ttl of 0 removes the expiry.
+// The value is read and rewritten on the shard goroutine owning the key, so
+// the client never resends it.
+func (ing *IngestionSubsystem) SubmitTouch(ctx context.Context, key string, ttl int) error {
+	return ing.submit(ctx, IngestReq{Key: key, TTL: ttl, IsTouch: true})
+}
+
+func (ing *IngestionSubsystem) submit(ctx context.Context, r IngestReq) error {
+	shardID := ing.shardFor(r.Key)
+
+	req := ing.reqPool.Get().(*IngestReq)
+	*req = r
+
+	respChan := ing.respChanPool.Get().(chan error)
+	req.ResponseChannel = respChan
+
+	if err := enqueue(ing, ctx, ing.shardChannels[shardID].SingleQueue, req); err != nil {
+		ing.recycle(req, respChan)
+		return err
+	}
 
-	respChanPool.Put(respChan)
-	req.Val = nil
-	req.Key = ""
-	reqPool.Put(req)
+	var err error
+	select {
+	case err = <-respChan:
+	case <-ctx.Done():
+		// The shard still owns req and will reply on respChan later
+		return ctx.Err()
+	case <-ing.shardsExited:
+		// The shards drain their queues before exiting, so a reply may
+		// still be waiting; otherwise the request was never processed.
+		select {
+		case err = <-respChan:
+		default:
+			return ErrIngestionStopped
+		}
+	}
 
+	ing.recycle(req, respChan)
 	return err
 }
 
-func SubmitBatchIngestion(keys []string, vals [][]byte, ttls []int) error {
+// enqueue hands item to a shard queue. If the queue is full it waits for
+// room, for at most the configured queue timeout, and then returns
+// ErrOverloaded.
+func enqueue[T any](ing *IngestionSubsystem, ctx context.Context, queue chan T, item T) error {
+	if ing.isStopped() {
+		return ErrIngestionStopped
+	}
+	select {
+	case queue <- item:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if ing.queueTimeout > 0 {
+		timer := time.NewTimer(ing.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case queue <- item:
+		return nil
+	case <-timeout:
+		return ErrOverloaded
+	case <-ing.stopSignal:
+		return ErrIngestionStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ing *IngestionSubsystem) isStopped() bool {
+	select {
+	case <-ing.stopSignal:
+		return true
+	default:
+		return false
+	}
+}
+
+// recycle returns a request and its empty response channel to their pools.
+// Shards reply exactly once per request, but a channel still holding a value
+// would hand a stale reply to the next caller, so one that is not empty is
+// left to the GC instead.
+func (ing *IngestionSubsystem) recycle(req *IngestReq, respChan chan error) {
+	*req = IngestReq{}
+	ing.reqPool.Put(req)
+
+	select {
+	case stray := <-respChan:
+		logger.LogErrorEvent("Dropping a response channel holding a second reply: %v", stray)
+		return
+	default:
+	}
+	ing.respChanPool.Put(respChan)
+}
+
+func (ing *IngestionSubsystem) SubmitBatchIngestion(keys []string, vals [][]byte, ttls []int) error {
+	return ing.SubmitBatchIngestionContext(context.Background(), keys, vals, ttls)
+}
+
+// SubmitBatchIngestionContext is SubmitBatchIngestion bounded by ctx. Shard
+// batches already dispatched when ctx ends may still be applied.
+func (ing *IngestionSubsystem) SubmitBatchIngestionContext(ctx context.Context, keys []string, vals [][]byte, ttls []int) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	metrics.RecordBatch(len(keys))
+	shardBatches := ing.groupItemsByShard(keys, vals, ttls, false)
+	return ing.dispatchAndAwaitBatches(ctx, shardBatches)
+}
+
+// SubmitBatchDeletion writes tombstones for every key, grouped per shard like
+// SubmitBatchIngestion.
+func (ing *IngestionSubsystem) SubmitBatchDeletion(keys []string) error {
+	return ing.SubmitBatchDeletionContext(context.Background(), keys)
+}
+
+// SubmitBatchDeletionContext is SubmitBatchDeletion bounded by ctx.
+func (ing *IngestionSubsystem) SubmitBatchDeletionContext(ctx context.Context, keys []string) error {
 	if len(keys) == 0 {
 		return nil
 	}
 
-	shardBatches := groupItemsByShard(keys, vals, ttls)
-	return dispatchAndAwaitBatches(shardBatches)
+	metrics.RecordBatch(len(keys))
+	shardBatches := ing.groupItemsByShard(keys, make([][]byte, len(keys)), make([]int, len(keys)), true)
+	return ing.dispatchAndAwaitBatches(ctx, shardBatches)
 }
 
-func groupItemsByShard(keys []string, vals [][]byte, ttls []int) map[int][]IngestReq {
+func (ing *IngestionSubsystem) groupItemsByShard(keys []string, vals [][]byte, ttls []int, deleted bool) map[int][]IngestReq {
 	batches := make(map[int][]IngestReq)
 	for i := range keys {
-		h := fnv.New32a()
-		h.Write([]byte(keys[i]))
-		shardID := int(h.Sum32()) % numShards
+		shardID := ing.shardFor(keys[i])
 
 		batches[shardID] = append(batches[shardID], IngestReq{
 			Key:       keys[i],
 			Val:       vals[i],
 			TTL:       ttls[i],
-			IsDeleted: false,
+			IsDeleted: deleted,
 		})
 	}
 	return batches
 }
 
-func dispatchAndAwaitBatches(batches map[int][]IngestReq) error {
-	activeShards := len(batches)
-	responseChan := make(chan error, activeShards)
+func (ing *IngestionSubsystem) dispatchAndAwaitBatches(ctx context.Context, batches map[int][]IngestReq) error {
+	// Buffered for every batch so shards never block on an abandoned caller.
+	responseChan := make(chan error, len(batches))
 
+	dispatched := 0
 	for id, items := range batches {
 		req := &BatchIngestReq{
 			Items:           items,
 			ResponseChannel: responseChan,
 		}
-		shardChannels[id].BatchQueue <- req
+		if err := enqueue(ing, ctx, ing.shardChannels[id].BatchQueue, req); err != nil {
+			return err
+		}
+		dispatched++
 	}
 
 	var finalErr error
-	for i := 0; i < activeShards; i++ {
-		err := <-responseChan
+	for i := 0; i < dispatched; i++ {
+		var err error
+		select {
+		case err = <-responseChan:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ing.shardsExited:
+			select {
+			case err = <-responseChan:
+			default:
+				return ErrIngestionStopped
+			}
+		}
 		if err != nil && finalErr == nil {
 			finalErr = err
 		}
@@ -140,7 +387,7 @@ func dispatchAndAwaitBatches(batches map[int][]IngestReq) error {
 	return finalErr
 }
 
-func runShard(id int, chans ShardChannels, bb *core.SystemState) {
+func (ing *IngestionSubsystem) runShard(id int, chans ShardChannels) {
 	itemBuffer := make([]IngestReq, 0, 1000)
 
 	for {
@@ -148,12 +395,32 @@ func runShard(id int, chans ShardChannels, bb *core.SystemState) {
 		case req := <-chans.SingleQueue:
 			itemBuffer = append(itemBuffer, *req)
 			drainSingleQueue(chans.SingleQueue, &itemBuffer)
-			processBatch(id, itemBuffer, bb)
+			ing.processBatch(id, itemBuffer)
 			itemBuffer = itemBuffer[:0]
 
 		case batch := <-chans.BatchQueue:
-			processBatch(id, batch.Items, bb)
-			batch.ResponseChannel <- nil
+			batch.ResponseChannel <- ing.processBatch(id, batch.Items)
+
+		case <-ing.stopSignal:
+			ing.drainShardOnStop(id, chans, itemBuffer)
+			return
+		}
+	}
+}
+
+// drainShardOnStop applies whatever was already queued when Stop was called.
+func (ing *IngestionSubsystem) drainShardOnStop(id int, chans ShardChannels, itemBuffer []IngestReq) {
+	for {
+		select {
+		case req := <-chans.SingleQueue:
+			itemBuffer = append(itemBuffer, *req)
+			drainSingleQueue(chans.SingleQueue, &itemBuffer)
+			ing.processBatch(id, itemBuffer)
+			itemBuffer = itemBuffer[:0]
+		case batch := <-chans.BatchQueue:
+			batch.ResponseChannel <- ing.processBatch(id, batch.Items)
+		default:
+			return
 		}
 	}
 }
@@ -171,54 +438,199 @@ func drainSingleQueue(queue chan *IngestReq, batch *[]IngestReq) {
 	}
 }
 
-func processBatch(shardID int, batch []IngestReq, bb *core.SystemState) {
+// processBatch applies batch all-or-nothing and returns the WAL error that
+// rejected it, if any, for callers without per-item response channels.
+func (ing *IngestionSubsystem) processBatch(shardID int, batch []IngestReq) error {
 	if len(batch) == 0 {
-		return
+		return nil
 	}
+	bb := ing.state
 
-	entriesPtr := entrySlicePool.Get().(*[]common.Entry)
+	entriesPtr := ing.entrySlicePool.Get().(*[]common.Entry)
 	entries := (*entriesPtr)[:0]
 
-	entries = prepareEntries(batch, entries)
+	batch = resolveConditionalWrites(bb, batch)
+	if len(batch) == 0 {
+		ing.entrySlicePool.Put(entriesPtr)
+		return nil
+	}
+	entries = prepareEntries(batch, entries, bb.AllocateSequences(len(batch)))
 
-	if err := writeWalIfEnabled(shardID, entries, bb); err != nil {
+	full, err := applyBatch(shardID, bb, batch, entries)
+	if err != nil {
 		notifyErrors(batch, err)
-		entrySlicePool.Put(entriesPtr)
-		return
+		ing.entrySlicePool.Put(entriesPtr)
+		return err
+	}
+	if full {
+		rotate(bb)
 	}
 
-	applyToMemTable(bb, batch, entries)
-
-	entrySlicePool.Put(entriesPtr)
+	ing.entrySlicePool.Put(entriesPtr)
 
-	metrics.Global.WriteOps += int64(len(batch))
+	recordWrites(batch)
 	notifySuccess(batch)
+	return nil
 }
 
-func prepareEntries(batch []IngestReq, out []common.Entry) []common.Entry {
-	now := time.Now()
+func recordWrites(batch []IngestReq) {
+	var deletes int64
 	for _, req := range batch {
-		out = append(out, createEntry(req, now))
+		if req.IsDeleted {
+			deletes++
+		}
+	}
+	metrics.RecordWrites(int64(len(batch))-deletes, deletes)
+}
+
+// prepareEntries numbers the batch from firstSequence in submission order, so
+// a later write of a key in the same batch wins.
+func prepareEntries(batch []IngestReq, out []common.Entry, firstSequence uint64) []common.Entry {
+	now := time.Now()
+	for i, req := range batch {
+		out = append(out, createEntry(req, now, firstSequence+uint64(i)))
 	}
 	return out
 }
 
-func createEntry(req IngestReq, now time.Time) common.Entry {
+func createEntry(req IngestReq, now time.Time, sequence uint64) common.Entry {
 	var exp int64
 	if req.TTL > 0 {
 		exp = now.Add(time.Duration(req.TTL) * time.Second).UnixNano()
 	}
 
-	valCopy := make([]byte, len(req.Val))
-	// removed -
-	// copy(valCopy, req.Val)
-
+	// The WAL record and the memtable share the submitted slice.
 	return common.Entry{
 		Key:             req.Key,
-		Value:           valCopy,
+		Value:           req.Val,
 		ExpiryTimestamp: exp,
 		IsDeleted:       req.IsDeleted,
+		IsCounter:       req.IsCounter,
+		Sequence:        sequence,
+	}
+}
+
+// resolveConditionalWrites turns increments into counter writes and touches
+// into rewrites of the value, and checks compare-and-swaps, all against the
+// current value. Earlier writes in the
+// same batch are not applied yet, so they are consulted before the stored
+// value. Failed requests are answered here and dropped.
+func resolveConditionalWrites(bb *core.SystemState, batch []IngestReq) []IngestReq {
+	hasConditional := false
+	for i := range batch {
+		if batch[i].IsIncrement || batch[i].IsCompareAndSwap || batch[i].IsTouch {
+			hasConditional = true
+			break
+		}
+	}
+	if !hasConditional {
+		return batch
+	}
+
+	now := time.Now().UnixNano()
+	bb.PinSSTables()
+	defer bb.UnpinSSTables()
+	view := bb.CaptureReadView()
+	pending := make(map[string]common.Entry)
+	kept := batch[:0]
+
+	for _, req := range batch {
+		if req.IsIncrement || req.IsCompareAndSwap || req.IsTouch {
+			current, found := pending[req.Key]
+			if !found {
+				current, found = view.FindEntry(req.Key)
+			}
+
+			switch {
+			case req.IsTouch:
+				if !found || current.IsDeleted || current.IsExpiredAt(now) {
+					req.ResponseChannel <- ErrKeyNotFound
+					continue
+				}
+				req.IsTouch = false
+				req.Val, req.IsCounter = current.Value, current.IsCounter
+			case req.IsIncrement:
+				total, err := counterValue(current, found, now)
+				if err != nil {
+					req.ResponseChannel <- err
+					continue
+				}
+				total += req.Delta
+				*req.Result = total
+
+				req.IsIncrement = false
+				req.IsCounter = true
+				req.Val = common.EncodeCounter(total)
+			default:
+				if !compareMatches(req, current, found, now) {
+					req.ResponseChannel <- ErrCompareAndSwapFailed
+					continue
+				}
+				req.IsCompareAndSwap = false
+			}
+		}
+
+		pending[req.Key] = common.Entry{Key: req.Key, Value: req.Val, IsDeleted: req.IsDeleted, IsCounter: req.IsCounter}
+		kept = append(kept, req)
+	}
+	return kept
+}
+
+// compareMatches reports whether a compare-and-swap's expectation holds for
+// the current entry. Counters compare by their decimal form, as served.
+func compareMatches(req IngestReq, e common.Entry, found bool, nowUnixNano int64) bool {
+	live := found && !e.IsDeleted && !e.IsExpiredAt(nowUnixNano)
+	if req.ExpectAbsent || !live {
+		return req.ExpectAbsent && !live
+	}
+	if e.IsCounter {
+		n, _ := common.DecodeCounter(e.Value)
+		return string(req.Expected) == strconv.FormatInt(n, 10)
+	}
+	return bytes.Equal(req.Expected, e.Value)
+}
+
+func counterValue(e common.Entry, found bool, nowUnixNano int64) (int64, error) {
+	if !found || e.IsDeleted || e.IsExpiredAt(nowUnixNano) {
+		return 0, nil
+	}
+	if !e.IsCounter {
+		n, err := strconv.ParseInt(string(e.Value), 10, 64)
+		if err != nil {
+			return 0, ErrNotCounter
+		}
+		return n, nil
+	}
+	n, ok := common.DecodeCounter(e.Value)
+	if !ok {
+		return 0, ErrNotCounter
+	}
+	return n, nil
+}
+
+// applyBatch logs the batch and applies it to the memtable under the read
+// lock. Rotations, and switching to read-only mode, take the lock for
+// writing, so a batch lands wholly in one memtable and WAL, and none lands
+// once read-only mode is on, however long ago its request was checked. It
+// reports whether the memtable or the WAL is now due a rotation; an
+// in-memory-only store evicts instead.
+func applyBatch(shardID int, bb *core.SystemState, batch []IngestReq, entries []common.Entry) (bool, error) {
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+
+	if bb.IsReadOnlyMode() {
+		return false, ErrReadOnlyMode
+	}
+	if err := writeWalIfEnabled(shardID, entries, bb); err != nil {
+		return false, err
+	}
+	applyToMemTable(bb, batch, entries)
+
+	if bb.Configuration.InMemoryOnly {
+		evictIfFull(bb)
+		return false, nil
 	}
+	return memTableNeedsRotation(bb) || walNeedsRotation(bb), nil
 }
 
 func writeWalIfEnabled(shardID int, entries []common.Entry, bb *core.SystemState) error {
@@ -229,53 +641,119 @@ func writeWalIfEnabled(shardID int, entries []common.Entry, bb *core.SystemState
 		logger.LogErrorEvent("Shard %d WAL Error: %v", shardID, err)
 		return err
 	}
+	metrics.SetWalSizeInBytes(bb.ActiveWal.SizeInBytes())
 	return nil
 }
 
+// applyToMemTable writes the whole batch in one atomic memtable operation, so
+// readers never observe part of a shard batch.
 func applyToMemTable(bb *core.SystemState, batch []IngestReq, entries []common.Entry) {
-	for i := 0; i < len(batch); i++ {
-		bb.MemTable.Put(batch[i].Key, batch[i].Val, entries[i].ExpiryTimestamp, batch[i].IsDeleted)
-		if bb.KeyCache != nil {
+	bb.MemTable.PutEntries(entries)
+	if bb.KeyCache != nil {
+		for i := range batch {
 			bb.KeyCache.RemoveFromCache(batch[i].Key)
 		}
 	}
+	if bb.NegativeCache != nil {
+		keys := make([]string, len(batch))
+		for i := range batch {
+			keys[i] = batch[i].Key
+		}
+		bb.NegativeCache.Invalidate(keys...)
+	}
+}
 
-	// Check if rotation needed (atomic read, no lock)
-	if bb.MemTable.Size() >= bb.Configuration.MaximumMemtableSizeInBytes {
-		// Take lock to rotate
-		bb.Mutex.Lock()
+// rotate rotates the memtable once it is full, or just the WAL once it has
+// outgrown its limit.
+func rotate(bb *core.SystemState) {
+	bb.Mutex.Lock()
+	defer bb.Mutex.Unlock()
 
-		// Double-check under lock (another thread might have rotated)
-		if bb.MemTable.Size() >= bb.Configuration.MaximumMemtableSizeInBytes {
-			rotateMemTable(bb)
-		}
+	// Double-check under lock (another thread might have rotated)
+	if memTableNeedsRotation(bb) {
+		awaitFlushBacklog(bb)
+	}
+	if memTableNeedsRotation(bb) {
+		rotateMemTable(bb)
+	} else if walNeedsRotation(bb) {
+		rotateWal(bb)
+	}
+}
+
+// awaitFlushBacklog blocks while MaximumImmutableMemtableCount memtables
+// await a flush, so a write burst is throttled to the flush rate instead of
+// piling up memtables. The shard stops taking writes meanwhile. It gives up
+// once the agents are stopping. Caller must hold bb.Mutex for writing.
+func awaitFlushBacklog(bb *core.SystemState) {
+	limit := bb.Configuration.MaximumImmutableMemtableCount
+	if limit <= 0 || len(bb.ImmutableMem) < limit {
+		return
+	}
 
-		bb.Mutex.Unlock()
+	metrics.IncrementWriteStallCount()
+	logger.LogInfoEvent("Writes stalled: %d memtables awaiting flush", len(bb.ImmutableMem))
+	for len(bb.ImmutableMem) >= limit && !bb.IsStopping() {
+		bb.FlushProgress.Wait()
 	}
 }
 
+// inMemoryEvictionWatermarkPercent is the share of the memtable budget an
+// in-memory-only store is trimmed back to, leaving headroom so eviction does
+// not run on every batch.
+const inMemoryEvictionWatermarkPercent = 90
+
+// evictIfFull keeps an in-memory-only store within its memtable budget by
+// dropping least recently used entries instead of rotating to disk.
+func evictIfFull(bb *core.SystemState) {
+	limit := bb.Configuration.MaximumMemtableSizeInBytes
+	if limit <= 0 || bb.MemTable.Size() < limit {
+		return
+	}
+	table, ok := bb.MemTable.(interface{ EvictLeastRecentlyUsed(int64) int })
+	if !ok {
+		return
+	}
+	evicted := table.EvictLeastRecentlyUsed(limit * inMemoryEvictionWatermarkPercent / 100)
+	logger.LogDebugEvent("Evicted %d entries from in-memory store", evicted)
+}
+
+func memTableNeedsRotation(bb *core.SystemState) bool {
+	return bb.MemTable.Size() >= bb.Configuration.MaximumMemtableSizeInBytes
+}
+
+// walNeedsRotation reports whether the active WAL has outgrown its limit.
+// Starting a new segment then bounds how much a restart has to replay
+// without rotating the memtable.
+func walNeedsRotation(bb *core.SystemState) bool {
+	maxWal := bb.Configuration.MaximumWalSizeInBytes
+	return maxWal > 0 && bb.Configuration.EnableDiskDurability && bb.ActiveWal != nil && bb.ActiveWal.SizeInBytes() >= maxWal
+}
+
+// rotateMemTable queues the active memtable for a flush along with the WALs
+// holding its writes, the active one included.
 func rotateMemTable(bb *core.SystemState) {
 	logger.LogInfoEvent("Rotating MemTable...")
-	bb.ImmutableMem = append(bb.ImmutableMem, bb.MemTable)
-	bb.MemTable = storage.NewMemoryTable(1024 * 1024)
-
 	if bb.Configuration.EnableDiskDurability && bb.ActiveWal != nil {
 		rotateWal(bb)
 	}
+	bb.FreezeMemTable(bb.NewMemTable())
 	bb.FlushCondition.Signal()
 }
 
+// rotateWal starts a new WAL segment. The full one stays on disk until the
+// memtable holding its writes is flushed.
 func rotateWal(bb *core.SystemState) {
 	newPath := fmt.Sprintf("%s.%d", bb.Configuration.WriteAheadLogFilePath, time.Now().UnixNano())
-	nw, err := storage.NewDiskWAL(newPath, true)
+	// engine.Open rejects unknown modes, so the error cannot happen here
+	syncEveryBatch, _ := storage.SyncsEveryBatch(bb.Configuration.WalSyncMode)
+	nw, err := storage.NewDiskWAL(newPath, syncEveryBatch)
 
 	if err != nil {
 		logger.LogErrorEvent("WAL Rotate Failed: %v", err)
 		return
 	}
 
-	bb.FrozenWALs = append(bb.FrozenWALs, bb.ActiveWal)
-	bb.ActiveWal = nw
+	bb.FreezeActiveWal(nw)
 }
 
 func notifySuccess(batch []IngestReq) {
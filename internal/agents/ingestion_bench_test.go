@@ -16,13 +16,14 @@ func BenchmarkSingleIngestion(b *testing.B) {
 		c.MaximumMemtableSizeInBytes = 64 * 1024 * 1024
 		c.EnableDiskDurability = false
 	})
-	InitializeIngestionSubsystem(state)
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		key := fmt.Sprintf("key%d", i)
 		val := []byte("testvalue1234567890")
-		_ = SubmitIngestionRequest(key, val, 0, false)
+		_ = ingestion.SubmitIngestionRequest(key, val, 0, false)
 	}
 }
 
@@ -34,7 +35,8 @@ func BenchmarkBatchIngestion(b *testing.B) {
 		c.MaximumMemtableSizeInBytes = 64 * 1024 * 1024
 		c.EnableDiskDurability = false
 	})
-	InitializeIngestionSubsystem(state)
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
 
 	batchSize := 100
 	keys := make([]string, batchSize)
@@ -48,7 +50,7 @@ func BenchmarkBatchIngestion(b *testing.B) {
 			vals[j] = []byte("testvalue1234567890")
 			ttls[j] = 0
 		}
-		_ = SubmitBatchIngestion(keys, vals, ttls)
+		_ = ingestion.SubmitBatchIngestion(keys, vals, ttls)
 	}
 }
 
@@ -60,7 +62,8 @@ func BenchmarkConcurrentIngestion(b *testing.B) {
 		c.MaximumMemtableSizeInBytes = 64 * 1024 * 1024
 		c.EnableDiskDurability = false
 	})
-	InitializeIngestionSubsystem(state)
+	ingestion := InitializeIngestionSubsystem(state)
+	defer ingestion.Stop()
 
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
@@ -68,7 +71,7 @@ func BenchmarkConcurrentIngestion(b *testing.B) {
 		for pb.Next() {
 			key := fmt.Sprintf("key%d", i)
 			val := []byte("testvalue1234567890")
-			_ = SubmitIngestionRequest(key, val, 0, false)
+			_ = ingestion.SubmitIngestionRequest(key, val, 0, false)
 			i++
 		}
 	})
@@ -0,0 +1,80 @@
+package agents
+
+import (
+	"math/rand/v2"
+	"sndv-kv/internal/core"
+	"time"
+)
+
+// intervalJitter spreads the wake-ups of a periodic agent by up to ±percent
+// of its base interval, so instances started together drift out of lockstep
+// instead of all compacting at once.
+type intervalJitter struct {
+	base    time.Duration
+	percent int
+	rng     *rand.Rand
+}
+
+// newIntervalJitter uses rng as its only source of randomness; pass a seeded
+// one for reproducible intervals.
+func newIntervalJitter(base time.Duration, percent int, rng *rand.Rand) *intervalJitter {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return &intervalJitter{base: base, percent: percent, rng: rng}
+}
+
+func newTimeSeededJitter(base time.Duration, percent int) *intervalJitter {
+	seed := uint64(time.Now().UnixNano())
+	return newIntervalJitter(base, percent, rand.New(rand.NewPCG(seed, seed>>32)))
+}
+
+// next returns the delay until the following tick.
+func (j *intervalJitter) next() time.Duration {
+	spread := int64(j.base) * int64(j.percent) / 100
+	if spread <= 0 {
+		return j.base
+	}
+	d := j.base + time.Duration(j.rng.Int64N(2*spread+1)-spread)
+	if d <= 0 {
+		// Only reachable at 100%; keep a tight loop out of the agent.
+		return time.Millisecond
+	}
+	return d
+}
+
+// jitteredTicker is a ticker whose period is redrawn from an intervalJitter
+// after every tick.
+type jitteredTicker struct {
+	C      <-chan time.Time
+	timer  *time.Timer
+	jitter *intervalJitter
+}
+
+func newJitteredTicker(jitter *intervalJitter) *jitteredTicker {
+	timer := time.NewTimer(jitter.next())
+	return &jitteredTicker{C: timer.C, timer: timer, jitter: jitter}
+}
+
+// Rearm schedules the next tick; call it after each receive from C.
+func (t *jitteredTicker) Rearm() {
+	t.timer.Reset(t.jitter.next())
+}
+
+// SetInterval changes the base interval from the next Rearm on.
+func (t *jitteredTicker) SetInterval(interval time.Duration) {
+	t.jitter.base = interval
+}
+
+func (t *jitteredTicker) Stop() {
+	t.timer.Stop()
+}
+
+// newAgentTicker returns the ticker periodic agents wake on, jittered by the
+// configured percentage.
+func newAgentTicker(bb *core.SystemState, interval time.Duration) *jitteredTicker {
+	return newJitteredTicker(newTimeSeededJitter(interval, bb.Configuration.IntervalJitterPercent))
+}
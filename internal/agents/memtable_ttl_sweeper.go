@@ -0,0 +1,57 @@
+package agents
+
+import (
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"time"
+)
+
+// StartMemtableTtlSweeperInBackground periodically sweeps expired entries out
+// of the active memtable, so they stop holding memory and counting towards
+// the rotation threshold while they wait for a flush.
+func StartMemtableTtlSweeperInBackground(bb *core.SystemState) {
+	interval := time.Duration(bb.Configuration.MemtableTtlSweepIntervalInSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	bb.BackgroundAgents.Add(1)
+	go func() {
+		defer bb.BackgroundAgents.Done()
+
+		ticker := newAgentTicker(bb, interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sweepExpiredFromMemTable(bb)
+				ticker.Rearm()
+			case <-bb.StopSignal():
+				return
+			}
+		}
+	}()
+}
+
+// sweepExpiredFromMemTable sweeps the active memtable and returns how many
+// entries it swept. A disk-backed store keeps tombstones in their place,
+// since an older version of the key may sit in an immutable memtable or an
+// SSTable; an in-memory store has nothing below the memtable.
+func sweepExpiredFromMemTable(bb *core.SystemState) int {
+	bb.Mutex.RLock()
+	table := bb.MemTable
+	bb.Mutex.RUnlock()
+
+	sweeper, ok := table.(interface {
+		SweepExpired(nowUnixNano int64, keepTombstones bool) int
+	})
+	if !ok {
+		return 0
+	}
+	swept := sweeper.SweepExpired(time.Now().UnixNano(), !bb.Configuration.InMemoryOnly)
+	if swept > 0 {
+		logger.LogDebugEvent("Swept %d expired entries from the memtable", swept)
+	}
+	return swept
+}
@@ -0,0 +1,109 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/storage"
+)
+
+// ErrSnapshotTargetNotEmpty is returned for a snapshot into a directory that
+// already holds files.
+var ErrSnapshotTargetNotEmpty = errors.New("snapshot target is not empty")
+
+// ErrSnapshotUnsupported is returned for a snapshot of a store with no
+// SSTables on disk.
+var ErrSnapshotUnsupported = errors.New("snapshots need a disk-backed store")
+
+// Snapshot writes a point-in-time copy of the store into dir, which must be
+// missing or empty. It flushes every memtable, then, holding the read lock so
+// no flush or compaction can change the layout, hard-links the SSTables and
+// writes a manifest listing them. dir can be opened as a data directory.
+// Returns how many tables the snapshot holds.
+//
+// In read-only mode the live data directory is left alone: nothing is
+// flushed, and the memtables are written as extra L0 tables inside dir.
+func Snapshot(bb *core.SystemState, dir string) (int, error) {
+	if bb.Manifest == nil {
+		return 0, ErrSnapshotUnsupported
+	}
+	if err := prepareSnapshotDirectory(dir); err != nil {
+		return 0, err
+	}
+
+	readOnly := bb.IsReadOnlyMode()
+	if !readOnly {
+		if _, err := FlushAll(context.Background(), bb); err != nil {
+			return 0, fmt.Errorf("snapshot %w", err)
+		}
+	}
+
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+
+	tables := 0
+	for _, level := range bb.SSTables {
+		for _, meta := range level {
+			if err := storage.LinkSSTableFile(meta.Filename, dir); err != nil {
+				return tables, fmt.Errorf("snapshot of %s: %w", meta.Filename, err)
+			}
+			tables++
+		}
+	}
+
+	levels := bb.SSTables
+	if readOnly {
+		metas, err := writeSnapshotMemtables(bb, dir)
+		if err != nil {
+			return tables, fmt.Errorf("snapshot %w", err)
+		}
+		tables += len(metas)
+		levels = append([][]storage.SSTableMetadata(nil), bb.SSTables...)
+		if len(levels) == 0 {
+			levels = append(levels, nil)
+		}
+		levels[0] = append(slices.Clip(levels[0]), metas...)
+	}
+	if err := storage.WriteManifest(dir, levels); err != nil {
+		return tables, fmt.Errorf("snapshot %w", err)
+	}
+
+	logger.LogInfoEvent("Snapshot of %d SSTables written to %s", tables, dir)
+	return tables, nil
+}
+
+// writeSnapshotMemtables writes each non-empty memtable, oldest first, as an
+// L0 table in dir, so a snapshot taken without flushing still holds every
+// write. Callers hold the read lock.
+func writeSnapshotMemtables(bb *core.SystemState, dir string) ([]storage.SSTableMetadata, error) {
+	memtables := append(slices.Clone(bb.ImmutableMem), bb.MemTable)
+	var metas []storage.SSTableMetadata
+	for _, table := range memtables {
+		entries := memtableEntries(table, nil)
+		if len(entries) == 0 {
+			continue
+		}
+		filename := storage.SSTableFilename(dir, 0, bb.AllocateFileID())
+		meta, err := storage.WriteSortedStringTableToDiskWithOptions(entries, filename, 0, nil, sstableWriteOptions(bb))
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+func prepareSnapshotDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrSnapshotTargetNotEmpty
+	}
+	return os.MkdirAll(dir, 0755)
+}
@@ -0,0 +1,76 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+)
+
+// ErrDurabilityDisabled is returned for a WAL sync requested while disk
+// durability is off, since there is no log to make durable.
+var ErrDurabilityDisabled = errors.New("disk durability is disabled")
+
+// Sync is a durability barrier: once it returns without error, every write
+// acknowledged before the call is on stable storage. It fsyncs the active
+// and frozen WALs; with flush set it also rotates the active memtable and
+// flushes every memtable to SSTables. Returns how many memtables were
+// flushed.
+func Sync(bb *core.SystemState, flush bool) (int, error) {
+	if !flush {
+		if !bb.Configuration.EnableDiskDurability || bb.ActiveWal == nil {
+			return 0, ErrDurabilityDisabled
+		}
+		if err := syncWriteAheadLogs(bb); err != nil {
+			return 0, fmt.Errorf("sync %w", err)
+		}
+		return 0, nil
+	}
+
+	if bb.IsReadOnlyMode() {
+		return 0, ErrReadOnlyMode
+	}
+	if err := syncWriteAheadLogs(bb); err != nil {
+		return 0, fmt.Errorf("sync %w", err)
+	}
+
+	flushed, err := FlushAll(context.Background(), bb)
+	if err != nil {
+		return flushed, fmt.Errorf("sync %w", err)
+	}
+	logger.LogInfoEvent("Sync flushed %d memtables", flushed)
+	return flushed, nil
+}
+
+// FlushAll rotates the active memtable and flushes every memtable to
+// SSTables, leaving the WALs nothing to replay. Once ctx is done it stops
+// before the next memtable and returns ctx.Err().
+func FlushAll(ctx context.Context, bb *core.SystemState) (int, error) {
+	bb.Mutex.Lock()
+	if bb.MemTable.Size() > 0 {
+		rotateMemTable(bb)
+	}
+	bb.Mutex.Unlock()
+
+	return flushImmutableTables(ctx, bb)
+}
+
+// syncWriteAheadLogs fsyncs every open WAL. The read lock keeps rotation and
+// flushes from closing a log while it is being synced.
+func syncWriteAheadLogs(bb *core.SystemState) error {
+	bb.Mutex.RLock()
+	defer bb.Mutex.RUnlock()
+
+	wals := append([]common.WriteAheadLog{bb.ActiveWal}, bb.FrozenWALs...)
+	for _, wal := range wals {
+		if wal == nil {
+			continue
+		}
+		if err := wal.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package agents
+
+import (
+	"slices"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/config"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/storage"
+	"time"
+)
+
+// ttlSampleSize bounds how many entry headers are read per table and pass.
+const ttlSampleSize = 128
+
+// StartTtlReclamationAgentInBackground periodically samples every SSTable and
+// rewrites the ones dominated by expired entries, so TTL data is reclaimed
+// within a bounded time instead of waiting for an incidental compaction.
+func StartTtlReclamationAgentInBackground(bb *core.SystemState) {
+	interval := time.Duration(bb.Configuration.TtlReclamationIntervalInSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	bb.BackgroundAgents.Add(1)
+	go func() {
+		defer bb.BackgroundAgents.Done()
+
+		ticker := newAgentTicker(bb, interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				reclaimExpiredTables(bb)
+				ticker.Rearm()
+			case <-bb.StopSignal():
+				return
+			}
+		}
+	}()
+}
+
+func reclaimExpiredTables(bb *core.SystemState) {
+	bb.CompactionMutex.Lock()
+	defer bb.CompactionMutex.Unlock()
+
+	if bb.IsReadOnlyMode() {
+		return
+	}
+
+	threshold := bb.Configuration.TtlReclamationExpiredRatio
+	if threshold <= 0 {
+		threshold = config.DefaultTtlReclamationExpiredRatio
+	}
+
+	bb.Mutex.RLock()
+	levels := make([][]storage.SSTableMetadata, len(bb.SSTables))
+	for l, tables := range bb.SSTables {
+		levels[l] = append([]storage.SSTableMetadata(nil), tables...)
+	}
+	bb.Mutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	for level, tables := range levels {
+		for i, meta := range tables {
+			ratio, err := storage.SampleExpiredRatio(meta, ttlSampleSize, now)
+			if err != nil {
+				logger.LogErrorEvent("TTL sampling failed for %s: %v", meta.Filename, err)
+				continue
+			}
+			if ratio == 0 || ratio < threshold {
+				continue
+			}
+			reclaimTable(bb, level, meta, olderTables(levels, level, i), now)
+		}
+	}
+}
+
+// olderTables returns every table that may hold an older version of a key in
+// levels[level][index]: earlier tables of the same level and all deeper levels.
+func olderTables(levels [][]storage.SSTableMetadata, level, index int) []storage.SSTableMetadata {
+	older := append([]storage.SSTableMetadata(nil), levels[level][:index]...)
+	for l := level + 1; l < len(levels); l++ {
+		older = append(older, levels[l]...)
+	}
+	return older
+}
+
+func reclaimTable(bb *core.SystemState, level int, meta storage.SSTableMetadata, older []storage.SSTableMetadata, now int64) {
+	entries, dropped, err := collectLiveEntries(meta, older, now)
+	if err != nil {
+		logger.LogErrorEvent("TTL reclamation failed to read %s: %v", meta.Filename, err)
+		return
+	}
+
+	var newMeta storage.SSTableMetadata
+	if len(entries) > 0 {
+		opts := sstableWriteOptions(bb)
+		opts.Partition = meta.Partition
+
+		filename := storage.SSTableFilename(bb.Configuration.DataDirectoryPath, level, bb.AllocateFileID())
+		newMeta, err = storage.WriteSortedStringTableToDiskWithOptions(entries, filename, level, bb.BloomFilterForLevel(level), opts)
+		if err != nil {
+			logger.LogErrorEvent("TTL reclamation failed to write %s: %v", filename, err)
+			return
+		}
+	}
+
+	bb.Mutex.Lock()
+	replaced := replaceTable(bb, level, meta, newMeta, len(entries) > 0)
+	bb.Mutex.Unlock()
+
+	if !replaced {
+		if len(entries) > 0 {
+			storage.RemoveSSTableFile(newMeta.Filename)
+		}
+		return
+	}
+
+	logger.LogInfoEvent("TTL reclamation rewrote %s: %d expired entries dropped", meta.Filename, dropped)
+	if len(entries) > 0 {
+		bb.NotifyCompactionCommitted(newMeta)
+	}
+}
+
+// collectLiveEntries reads a table, dropping expired entries. An expired key
+// that an older table also holds is kept as a tombstone instead, otherwise
+// the older value would resurface on reads.
+func collectLiveEntries(meta storage.SSTableMetadata, older []storage.SSTableMetadata, now int64) ([]common.Entry, int, error) {
+	reader, err := storage.NewSSTableReader(meta.Filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+
+	var entries []common.Entry
+	dropped := 0
+	for {
+		e, ok := reader.Next()
+		if !ok {
+			break
+		}
+		if !e.IsExpiredAt(now) {
+			entries = append(entries, e)
+			continue
+		}
+
+		dropped++
+		if shadowsOlderTable(e.Key, older) {
+			entries = append(entries, common.Entry{Key: e.Key, IsDeleted: true, Sequence: e.Sequence})
+		}
+	}
+	if err := reader.Err(); err != nil {
+		return nil, 0, err
+	}
+	return entries, dropped, nil
+}
+
+func shadowsOlderTable(key string, older []storage.SSTableMetadata) bool {
+	for _, meta := range older {
+		if _, found := storage.FindInSSTable(meta, key); found {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceTable puts the rewritten table at old's position, keeping the
+// newest-last order reads rely on, or drops it when nothing survived. It
+// reports false if old is no longer live or the manifest could not record
+// the change. Caller must hold bb.Mutex.
+func replaceTable(bb *core.SystemState, level int, old, rewritten storage.SSTableMetadata, hasRewritten bool) bool {
+	if level >= len(bb.SSTables) {
+		return false
+	}
+
+	tables := bb.SSTables[level]
+	for i, meta := range tables {
+		if meta.Filename != old.Filename {
+			continue
+		}
+
+		// Build a new slice: read views share the old backing array.
+		updated := make([]storage.SSTableMetadata, 0, len(tables))
+		updated = append(updated, tables[:i]...)
+		if hasRewritten {
+			updated = append(updated, rewritten)
+		}
+		levels := slices.Clone(bb.SSTables)
+		levels[level] = append(updated, tables[i+1:]...)
+
+		if err := bb.CommitSSTables(levels); err != nil {
+			logger.LogErrorEvent("TTL reclamation failed to commit %s: %v", old.Filename, err)
+			return false
+		}
+		bb.RemoveSSTableFiles([]string{old.Filename})
+		return true
+	}
+	return false
+}
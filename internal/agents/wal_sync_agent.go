@@ -0,0 +1,45 @@
+package agents
+
+import (
+	"sndv-kv/internal/config"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/metrics"
+	"sndv-kv/internal/storage"
+	"time"
+)
+
+// StartWalSyncAgentInBackground fsyncs the WALs on a timer under the
+// interval sync mode, bounding how many acknowledged writes a power loss
+// can take to one interval's worth. The timer is not jittered, since the
+// interval is that bound.
+func StartWalSyncAgentInBackground(bb *core.SystemState) {
+	if bb.Configuration.WalSyncMode != storage.WalSyncInterval || !bb.Configuration.EnableDiskDurability {
+		return
+	}
+	interval := time.Duration(bb.Configuration.WalSyncIntervalInMilliseconds) * time.Millisecond
+	if interval <= 0 {
+		interval = config.DefaultWalSyncIntervalInMilliseconds * time.Millisecond
+	}
+
+	bb.BackgroundAgents.Add(1)
+	go func() {
+		defer bb.BackgroundAgents.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := syncWriteAheadLogs(bb); err != nil {
+					logger.LogErrorEvent("Timed WAL sync failed: %v", err)
+					continue
+				}
+				metrics.IncrementWalSyncCount()
+			case <-bb.StopSignal():
+				return
+			}
+		}
+	}()
+}
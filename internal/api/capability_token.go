@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sndv-kv/internal/config"
+	"sndv-kv/internal/logger"
+	"strconv"
+	"time"
+
+	"github.com/o1egl/paseto"
+	"github.com/valyala/fasthttp"
+)
+
+// Claims carried by key-scoped capability tokens.
+const (
+	capabilitySubject        = "capability"
+	capabilityKeyClaim       = "key"
+	capabilityOperationClaim = "op"
+)
+
+const defaultCapabilityTtlInSeconds = 3600
+
+// scopedOperations maps the routes a capability token can be minted for to
+// the operation name stored in its claims.
+var scopedOperations = map[string]string{
+	"/get":    "get",
+	"/put":    "put",
+	"/delete": "delete",
+}
+
+// HandleMintTokenRequest issues a token restricted to one operation on one key,
+// for presigned-URL style sharing, or with scope=read a token limited to the
+// read-only routes, e.g. for dashboards. Key-scoped and read-scoped tokens
+// cannot reach this route.
+func (router *HttpApiRouter) HandleMintTokenRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") {
+		return
+	}
+
+	args := ctx.QueryArgs()
+	ttl := defaultCapabilityTtlInSeconds
+	if raw := args.Peek("ttl"); len(raw) > 0 {
+		parsed, err := strconv.Atoi(string(raw))
+		if err != nil || parsed <= 0 {
+			ctx.Error("Invalid ttl", fasthttp.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	if scope := string(args.Peek("scope")); scope != "" {
+		router.mintScopedToken(ctx, scope, ttl)
+		return
+	}
+
+	key := string(args.Peek("key"))
+	op := string(args.Peek("op"))
+	if key == "" {
+		ctx.Error("Missing key", fasthttp.StatusBadRequest)
+		return
+	}
+	if !isScopedOperation(op) {
+		ctx.Error("Invalid op", fasthttp.StatusBadRequest)
+		return
+	}
+
+	claims := paseto.JSONToken{
+		Subject:    capabilitySubject,
+		IssuedAt:   time.Now(),
+		Expiration: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	claims.Set(capabilityKeyClaim, key)
+	claims.Set(capabilityOperationClaim, op)
+
+	token, err := paseto.NewV2().Encrypt(router.secretKey(), claims, "")
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	logger.LogInfoEvent("Minted %s capability for key %q (ttl %ds)", op, key, ttl)
+
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"token":"%s"}`, token)
+}
+
+// mintScopedToken issues a token for scope under the admin subject. A caller
+// can only hand out scopes it holds itself.
+func (router *HttpApiRouter) mintScopedToken(ctx *fasthttp.RequestCtx, scope string, ttl int) {
+	if scope != ScopeRead && scope != ScopeWrite {
+		ctx.Error("Invalid scope", fasthttp.StatusBadRequest)
+		return
+	}
+	if scope == ScopeWrite && requestScope(ctx) != ScopeWrite {
+		ctx.Error("Forbidden", fasthttp.StatusForbidden)
+		return
+	}
+
+	cfg := router.SystemState.Configuration
+	subject := cfg.AdminTokenSubject
+	if subject == "" {
+		subject = config.DefaultAdminTokenSubject
+	}
+	token, err := NewScopedToken(cfg.AuthenticationSecret, subject, scope, time.Duration(ttl)*time.Second)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	logger.LogInfoEvent("Minted %s-scoped token (ttl %ds)", scope, ttl)
+
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"token":"%s"}`, token)
+}
+
+// authorizeScope lets key-scoped tokens perform only their operation on their
+// key. Tokens without a key claim are unrestricted.
+func authorizeScope(ctx *fasthttp.RequestCtx, claims paseto.JSONToken) bool {
+	scopedKey := claims.Get(capabilityKeyClaim)
+	if scopedKey == "" {
+		return true
+	}
+
+	op, ok := scopedOperations[string(ctx.Path())]
+	if !ok || op != claims.Get(capabilityOperationClaim) {
+		return false
+	}
+	return requestKey(ctx, op) == scopedKey
+}
+
+func isScopedOperation(op string) bool {
+	for _, allowed := range scopedOperations {
+		if op == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// requestKey extracts the key a request targets: from the query string, or
+// from the JSON body for puts, gunzipped if need be.
+func requestKey(ctx *fasthttp.RequestCtx, op string) string {
+	if op != "put" {
+		return string(ctx.QueryArgs().Peek("key"))
+	}
+
+	body := ctx.PostBody()
+	if isGzipEncoded(ctx) {
+		var err error
+		if body, err = gunzipRequestBody(ctx); err != nil {
+			return ""
+		}
+	}
+	var payload SinglePutRequestPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return payload.Key
+}
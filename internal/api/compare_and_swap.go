@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"sndv-kv/internal/agents"
+
+	"github.com/valyala/fasthttp"
+)
+
+type CompareAndSwapRequestPayload struct {
+	Key string `json:"key"`
+	// Expected is the value the key must hold, or null for "must not exist".
+	// It is required, so an omitted field is not mistaken for null.
+	Expected   json.RawMessage `json:"expected"`
+	Value      string          `json:"value"`
+	TimeToLive int             `json:"ttl"`
+}
+
+// HandleCompareAndSwapRequest serves POST /cas: the write applies only if
+// the key currently holds expected, and 409 Conflict is returned otherwise.
+func (router *HttpApiRouter) HandleCompareAndSwapRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") || !router.isWritable(ctx) {
+		return
+	}
+
+	body, ok := router.requestBody(ctx)
+	if !ok {
+		return
+	}
+	var payload CompareAndSwapRequestPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Key == "" || len(payload.Expected) == 0 {
+		ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+		return
+	}
+
+	var expected *string
+	if err := json.Unmarshal(payload.Expected, &expected); err != nil {
+		ctx.Error("Expected must be a string or null", fasthttp.StatusBadRequest)
+		return
+	}
+	var expectedValue []byte
+	if expected != nil {
+		expectedValue = []byte(*expected)
+	}
+
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	err := router.Ingestion.SubmitCompareAndSwap(reqCtx, payload.Key, expectedValue, expected == nil, []byte(payload.Value), payload.TimeToLive)
+	if errors.Is(err, agents.ErrCompareAndSwapFailed) {
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+		return
+	} else if err != nil {
+		writeIngestionError(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/valyala/fasthttp"
+)
+
+// minGzipBodyBytes is the smallest response worth compressing; below it
+// the gzip header and trailer outweigh the savings.
+const minGzipBodyBytes = 256
+
+// compressedRoutes are the read routes whose responses are gzipped for
+// clients that accept it.
+var compressedRoutes = map[string]bool{
+	"/get":  true,
+	"/mget": true,
+	"/scan": true,
+}
+
+var errDecompressedBodyTooLarge = errors.New("decompressed body too large")
+
+// compressResponse gzips a buffered response on a compressed route when
+// compression is enabled and the client sent Accept-Encoding: gzip.
+func (router *HttpApiRouter) compressResponse(ctx *fasthttp.RequestCtx) {
+	if !router.SystemState.Configuration.HttpCompressionEnabled || !compressedRoutes[string(ctx.Path())] {
+		return
+	}
+	ctx.Response.Header.Add("Vary", "Accept-Encoding")
+
+	body := ctx.Response.Body()
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || ctx.Response.IsBodyStream() || len(body) < minGzipBodyBytes {
+		return
+	}
+	if !ctx.Request.Header.HasAcceptEncoding("gzip") {
+		return
+	}
+	ctx.Response.SetBodyRaw(fasthttp.AppendGzipBytes(nil, body))
+	ctx.Response.Header.SetContentEncoding("gzip")
+}
+
+// requestBody returns the request body, gunzipped when it was sent with
+// Content-Encoding: gzip and compression is enabled. It answers the request
+// itself and returns false when the body cannot be used.
+func (router *HttpApiRouter) requestBody(ctx *fasthttp.RequestCtx) ([]byte, bool) {
+	if !isGzipEncoded(ctx) {
+		return ctx.PostBody(), true
+	}
+	if !router.SystemState.Configuration.HttpCompressionEnabled {
+		ctx.Error("Compressed bodies are disabled", fasthttp.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	body, err := gunzipRequestBody(ctx)
+	if errors.Is(err, errDecompressedBodyTooLarge) {
+		ctx.Error("Request Entity Too Large", fasthttp.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+func isGzipEncoded(ctx *fasthttp.RequestCtx) bool {
+	return bytes.EqualFold(ctx.Request.Header.ContentEncoding(), []byte("gzip"))
+}
+
+// gunzipRequestBody decompresses the body, refusing to inflate it past the
+// size the server accepts uncompressed, so a small body cannot expand into
+// an arbitrarily large one.
+func gunzipRequestBody(ctx *fasthttp.RequestCtx) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(ctx.PostBody()))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	body, err := io.ReadAll(io.LimitReader(reader, fasthttp.DefaultMaxRequestBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > fasthttp.DefaultMaxRequestBodySize {
+		return nil, errDecompressedBodyTooLarge
+	}
+	return body, nil
+}
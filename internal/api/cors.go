@@ -0,0 +1,67 @@
+package api
+
+import (
+	"slices"
+
+	"github.com/valyala/fasthttp"
+)
+
+// CORS response headers sent to allowed origins.
+const (
+	corsAllowedMethods = "GET, HEAD, POST, PUT, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type, Content-Encoding"
+	corsExposedHeaders = "X-Source, X-Next-Key"
+	corsMaxAgeSeconds  = "600"
+)
+
+// handlePreflight answers CORS preflight requests, which carry no token, so
+// it runs before authentication. It returns true when ctx was a preflight.
+func (router *HttpApiRouter) handlePreflight(ctx *fasthttp.RequestCtx) bool {
+	if !ctx.IsOptions() || len(ctx.Request.Header.Peek("Access-Control-Request-Method")) == 0 {
+		return false
+	}
+	origin, allowed := router.allowedOrigin(ctx)
+	if origin == "" {
+		return false
+	}
+	if !allowed {
+		ctx.Error("Origin not allowed", fasthttp.StatusForbidden)
+		return true
+	}
+
+	ctx.Response.Header.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	ctx.Response.Header.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	ctx.Response.Header.Set("Access-Control-Max-Age", corsMaxAgeSeconds)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+	return true
+}
+
+// addCorsHeaders echoes an allowed Origin on the response. It runs once the
+// response is final, since ctx.Error drops headers set before it and error
+// responses must reach the page too.
+func (router *HttpApiRouter) addCorsHeaders(ctx *fasthttp.RequestCtx) {
+	origin, allowed := router.allowedOrigin(ctx)
+	if origin == "" {
+		return
+	}
+	ctx.Response.Header.Add("Vary", "Origin")
+	if !allowed {
+		// Without the allow header the browser withholds the response
+		return
+	}
+	ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+	if !ctx.IsOptions() {
+		ctx.Response.Header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+	}
+}
+
+// allowedOrigin returns the request's Origin, or "" when there is none or
+// CORS is not configured, and whether that origin is allowed.
+func (router *HttpApiRouter) allowedOrigin(ctx *fasthttp.RequestCtx) (string, bool) {
+	allowed := router.SystemState.Configuration.AllowedOrigins
+	origin := string(ctx.Request.Header.Peek("Origin"))
+	if origin == "" || len(allowed) == 0 {
+		return "", false
+	}
+	return origin, slices.Contains(allowed, origin) || slices.Contains(allowed, "*")
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sndv-kv/internal/agents"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HandleExportRequest streams every live key as newline-delimited JSON in
+// key order. Each line has the /put payload shape, with ttl holding the
+// remaining seconds, so an export can be replayed into another instance.
+func (router *HttpApiRouter) HandleExportRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "GET") {
+		return
+	}
+
+	it, err := router.SystemState.NewRangeIterator("", "")
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/x-ndjson")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer it.Close()
+		if _, err := writeExport(w, it); err != nil {
+			logger.LogErrorEvent("Export failed: %v", err)
+		}
+	})
+}
+
+// HandleDrainRequest prepares the instance for a migration: writes are
+// refused, everything is flushed to SSTables and an export is written to the
+// data directory. The instance stays read-only afterwards.
+func (router *HttpApiRouter) HandleDrainRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") {
+		return
+	}
+	state := router.SystemState
+
+	flushed, err := agents.Drain(state)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	path := filepath.Join(state.Configuration.DataDirectoryPath, fmt.Sprintf("export-%d.ndjson", time.Now().UnixNano()))
+	exported, err := exportToFile(state, path)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	logger.LogInfoEvent("Drain complete: %d keys exported to %s", exported, path)
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"flushed":  flushed,
+		"exported": exported,
+		"path":     path,
+	})
+}
+
+func exportToFile(state *core.SystemState, path string) (int, error) {
+	it, err := state.NewRangeIterator("", "")
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	count, err := writeExport(w, it)
+	if err != nil {
+		return count, err
+	}
+	if err := w.Flush(); err != nil {
+		return count, err
+	}
+	return count, file.Sync()
+}
+
+// writeExport streams every entry of it, one record per line. A source
+// failing part way is an error, so a truncated export is never mistaken for
+// a complete one.
+func writeExport(w io.Writer, it *core.MergeIterator) (int, error) {
+	encoder := json.NewEncoder(w)
+	now := time.Now().UnixNano()
+
+	count := 0
+	for e, ok := it.Next(); ok; e, ok = it.Next() {
+		if err := encoder.Encode(exportRecord(e, now)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, it.Err()
+}
+
+func exportRecord(e common.Entry, nowUnixNano int64) SinglePutRequestPayload {
+	record := SinglePutRequestPayload{Key: e.Key, Value: string(e.Value)}
+	if e.IsCounter {
+		n, _ := common.DecodeCounter(e.Value)
+		record.Value = strconv.FormatInt(n, 10)
+		record.Counter = true
+	}
+	if e.ExpiryTimestamp > 0 {
+		// Round up so a key never expires earlier on the importing side
+		remaining := time.Duration(e.ExpiryTimestamp - nowUnixNano)
+		record.TimeToLive = max(1, int((remaining+time.Second-1)/time.Second))
+	}
+	return record
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sndv-kv/internal/agents"
+	"sndv-kv/internal/api/kvpb"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/metrics"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// authorizationMetadataKey carries the PASETO token on gRPC calls, as the
+// Authorization header does over HTTP.
+const authorizationMetadataKey = "authorization"
+
+// readOnlyMethods are the RPCs a read-scoped token may call.
+var readOnlyMethods = map[string]bool{
+	kvpb.KeyValue_Get_FullMethodName:  true,
+	kvpb.KeyValue_Scan_FullMethodName: true,
+}
+
+// GrpcKeyValueServer serves the KeyValue service from the same state and
+// ingestion subsystem as the HTTP router.
+type GrpcKeyValueServer struct {
+	kvpb.UnimplementedKeyValueServer
+	router *HttpApiRouter
+}
+
+// NewGrpcServer returns a gRPC server exposing the KeyValue service, with
+// the router's token checks applied to every call.
+func NewGrpcServer(router *HttpApiRouter) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(router.unaryAuthInterceptor),
+		grpc.ChainStreamInterceptor(router.streamAuthInterceptor),
+	)
+	kvpb.RegisterKeyValueServer(server, &GrpcKeyValueServer{router: router})
+	return server
+}
+
+func (router *HttpApiRouter) unaryAuthInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	startTime := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.LogErrorEvent("PANIC: %v\n%s", r, debug.Stack())
+			err = status.Error(codes.Internal, "internal error")
+		}
+		logger.LogAccessRequest("GRPC", info.FullMethod, peerAddress(ctx), time.Since(startTime))
+	}()
+
+	if err := router.authorizeCall(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (router *HttpApiRouter) streamAuthInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	startTime := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.LogErrorEvent("PANIC: %v\n%s", r, debug.Stack())
+			err = status.Error(codes.Internal, "internal error")
+		}
+		logger.LogAccessRequest("GRPC", info.FullMethod, peerAddress(stream.Context()), time.Since(startTime))
+	}()
+
+	if err := router.authorizeCall(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// authorizeCall applies the HTTP token rules to an RPC. Key-scoped
+// capability tokens name HTTP routes, so they are refused here outright.
+func (router *HttpApiRouter) authorizeCall(ctx context.Context, method string) error {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(authorizationMetadataKey); len(values) > 0 {
+			token = values[0]
+		}
+	}
+
+	claims, ok := router.authenticate(token)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if claims.Get(capabilityKeyClaim) != "" {
+		return status.Error(codes.PermissionDenied, "key-scoped tokens cannot call gRPC")
+	}
+	switch tokenScope(claims) {
+	case ScopeWrite:
+		return nil
+	case ScopeRead:
+		if readOnlyMethods[method] {
+			return nil
+		}
+	}
+	return status.Error(codes.PermissionDenied, "forbidden")
+}
+
+func (s *GrpcKeyValueServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+
+	reqCtx, cancel := s.router.requestContextFrom(ctx)
+	defer cancel()
+
+	err := s.router.Ingestion.SubmitIngestionRequestContext(reqCtx, req.GetKey(), req.GetValue(), int(req.GetTtl()), false)
+	if err != nil {
+		return nil, ingestionStatus(err)
+	}
+	return &kvpb.PutResponse{}, nil
+}
+
+func (s *GrpcKeyValueServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+	metrics.IncrementReadOperationsCount()
+
+	entry, found := s.router.SystemState.FindLive(req.GetKey())
+	if !found {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	return &kvpb.GetResponse{Value: []byte(displayValue(entry))}, nil
+}
+
+func (s *GrpcKeyValueServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing key")
+	}
+
+	reqCtx, cancel := s.router.requestContextFrom(ctx)
+	defer cancel()
+
+	if err := s.router.Ingestion.SubmitIngestionRequestContext(reqCtx, req.GetKey(), nil, 0, true); err != nil {
+		return nil, ingestionStatus(err)
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+func (s *GrpcKeyValueServer) BatchPut(ctx context.Context, req *kvpb.BatchPutRequest) (*kvpb.BatchPutResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	count := len(req.GetItems())
+	keys, vals, ttls := make([]string, count), make([][]byte, count), make([]int, count)
+	for i, item := range req.GetItems() {
+		if item.GetKey() == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "item %d: missing key", i)
+		}
+		keys[i], vals[i], ttls[i] = item.GetKey(), item.GetValue(), int(item.GetTtl())
+	}
+
+	reqCtx, cancel := s.router.requestContextFrom(ctx)
+	defer cancel()
+
+	if err := s.router.Ingestion.SubmitBatchIngestionContext(reqCtx, keys, vals, ttls); err != nil {
+		return nil, ingestionStatus(err)
+	}
+	return &kvpb.BatchPutResponse{Count: int32(count)}, nil
+}
+
+// Scan streams the live keys in [start, end) straight off a range iterator,
+// so a large range is never held in memory. The iterator keeps its SSTables
+// pinned until the stream ends.
+func (s *GrpcKeyValueServer) Scan(req *kvpb.ScanRequest, stream kvpb.KeyValue_ScanServer) error {
+	if req.GetLimit() < 0 {
+		return status.Error(codes.InvalidArgument, "invalid limit")
+	}
+
+	it, err := s.router.SystemState.NewRangeIterator(req.GetStart(), req.GetEnd())
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer it.Close()
+
+	limit := int(req.GetLimit())
+	for sent := 0; limit == 0 || sent < limit; sent++ {
+		entry, ok := it.Next()
+		if !ok {
+			break
+		}
+		if err := stream.Send(&kvpb.Entry{Key: entry.Key, Value: []byte(displayValue(entry))}); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+func (s *GrpcKeyValueServer) checkWritable() error {
+	if s.router.SystemState.IsReadOnlyMode() {
+		return status.Error(codes.Unavailable, "read-only mode")
+	}
+	return nil
+}
+
+// ingestionStatus is writeIngestionError for gRPC.
+func ingestionStatus(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, agents.ErrOverloaded), errors.Is(err, agents.ErrIngestionStopped), errors.Is(err, agents.ErrReadOnlyMode):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -1,15 +1,21 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime/debug"
+	"slices"
 	"sndv-kv/internal/agents"
 	"sndv-kv/internal/common"
+	"sndv-kv/internal/config"
 	"sndv-kv/internal/core"
 	"sndv-kv/internal/logger"
 	"sndv-kv/internal/metrics"
 	"sndv-kv/internal/storage"
+	"strconv"
 	"sync"
 	"time"
 
@@ -19,12 +25,15 @@ import (
 
 type HttpApiRouter struct {
 	SystemState *core.SystemState
+	Ingestion   *agents.IngestionSubsystem
 }
 
 type SinglePutRequestPayload struct {
 	Key        string `json:"key"`
 	Value      string `json:"value"`
 	TimeToLive int    `json:"ttl"`
+	// Counter stores Value, a base-10 integer, as a fixed-width counter.
+	Counter bool `json:"counter"`
 }
 
 type BatchPutRequestPayload struct {
@@ -35,8 +44,28 @@ type BatchPutRequestPayload struct {
 	} `json:"items"`
 }
 
+type BatchDeleteRequestPayload struct {
+	Keys []string `json:"keys"`
+}
+
+type SingleGetResponsePayload struct {
+	Key   string `json:"key"`
+	Value string `json:"val"`
+}
+
+// pooledEncoder is a response buffer with a JSON encoder writing into it.
+type pooledEncoder struct {
+	buf     bytes.Buffer
+	encoder *json.Encoder
+}
+
 var encoderPool = sync.Pool{
-	New: func() interface{} { return json.NewEncoder(nil) },
+	New: func() interface{} {
+		e := &pooledEncoder{}
+		e.encoder = json.NewEncoder(&e.buf)
+		e.encoder.SetEscapeHTML(false)
+		return e
+	},
 }
 
 func (router *HttpApiRouter) GetFastHTTPHandler() fasthttp.RequestHandler {
@@ -47,71 +76,208 @@ func (router *HttpApiRouter) GetFastHTTPHandler() fasthttp.RequestHandler {
 
 func (router *HttpApiRouter) handleRequest(ctx *fasthttp.RequestCtx) {
 	startTime := time.Now()
+	routed := false
 	defer func() {
 		recoverPanic(ctx)
-		logger.LogAccessEvent("%s %s %s %v", string(ctx.Method()), string(ctx.Path()), ctx.RemoteAddr(), time.Since(startTime))
+		router.addCorsHeaders(ctx)
+		elapsed := time.Since(startTime)
+		if routed {
+			recordLatency(ctx.Path(), elapsed)
+		}
+		logger.LogAccessRequest(string(ctx.Method()), string(ctx.Path()), ctx.RemoteAddr().String(), elapsed)
 	}()
 
-	if !router.checkAuth(ctx) {
+	if router.handlePreflight(ctx) {
+		return
+	}
+	claims, ok := router.checkAuth(ctx)
+	if !ok {
 		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
 		return
 	}
+	if !authorizeTokenScope(ctx, claims) || !authorizeScope(ctx, claims) {
+		ctx.Error("Forbidden", fasthttp.StatusForbidden)
+		return
+	}
 
+	routed = true
 	router.routePath(ctx)
+	router.compressResponse(ctx)
+}
+
+// recordLatency times lookups and writes separately; admin and
+// observability routes are not recorded.
+func recordLatency(path []byte, elapsed time.Duration) {
+	switch string(path) {
+	case "/get", "/exists", "/mget", "/scan":
+		metrics.RecordReadLatency(elapsed)
+	case "/put", "/batch", "/batch-delete", "/delete", "/incr", "/cas", "/touch", "/match":
+		metrics.RecordWriteLatency(elapsed)
+	default:
+		if bytes.HasPrefix(path, []byte(rawValuePathPrefix)) {
+			metrics.RecordReadLatency(elapsed)
+		}
+	}
 }
 
 func (router *HttpApiRouter) routePath(ctx *fasthttp.RequestCtx) {
 	switch string(ctx.Path()) {
 	case "/put":
 		router.HandleSinglePutRequest(ctx)
-	case "/get":
+	case "/get", "/exists":
 		router.HandleGetRequest(ctx)
 	case "/batch":
 		router.HandleBatchPutRequest(ctx)
+	case "/batch-delete":
+		router.HandleBatchDeleteRequest(ctx)
 	case "/delete":
 		router.HandleDeleteRequest(ctx)
+	case "/incr":
+		router.HandleIncrementRequest(ctx)
+	case "/cas":
+		router.HandleCompareAndSwapRequest(ctx)
+	case "/touch":
+		router.HandleTouchRequest(ctx)
+	case "/mget":
+		router.HandleMultiGetRequest(ctx)
+	case "/scan":
+		router.HandleScanRequest(ctx)
+	case "/match":
+		router.HandlePatternDeleteRequest(ctx)
 	case "/metrics":
 		router.HandleMetricsRequest(ctx)
+	case "/admin/readonly":
+		router.HandleReadOnlyModeRequest(ctx)
+	case "/admin/levels":
+		router.HandleLevelStatsRequest(ctx)
+	case "/admin/stats", "/stats":
+		router.HandleStoreStatsRequest(ctx)
+	case "/admin/token":
+		router.HandleMintTokenRequest(ctx)
+	case "/admin/checkpoint":
+		router.HandleCheckpointRequest(ctx)
+	case "/admin/sync":
+		router.HandleSyncRequest(ctx)
+	case "/admin/drain":
+		router.HandleDrainRequest(ctx)
+	case "/export":
+		router.HandleExportRequest(ctx)
+	case "/import":
+		router.HandleImportRequest(ctx)
+	case "/snapshot":
+		router.HandleSnapshotRequest(ctx)
 	default:
+		if bytes.HasPrefix(ctx.Path(), []byte(rawValuePathPrefix)) {
+			router.HandleRawGetRequest(ctx)
+			return
+		}
 		ctx.Error("Not Found", fasthttp.StatusNotFound)
 	}
 }
 
-func (router *HttpApiRouter) checkAuth(ctx *fasthttp.RequestCtx) bool {
+func (router *HttpApiRouter) checkAuth(ctx *fasthttp.RequestCtx) (paseto.JSONToken, bool) {
+	return router.authenticate(string(ctx.Request.Header.Peek("Authorization")))
+}
+
+// authenticate decrypts and validates a token as sent in the Authorization
+// header. No token is needed when none is configured.
+func (router *HttpApiRouter) authenticate(headerToken string) (paseto.JSONToken, bool) {
 	configToken := router.SystemState.Configuration.AuthenticationToken
-	headerToken := string(ctx.Request.Header.Peek("Authorization"))
 
+	var claims paseto.JSONToken
 	if configToken == "" && headerToken == "" {
-		return true
+		return claims, true
 	}
 
 	var footer string
-	var claims paseto.JSONToken
-	secretKey := []byte(fmt.Sprintf("%-32s", router.SystemState.Configuration.AuthenticationSecret))[:32]
+	if err := paseto.NewV2().Decrypt(headerToken, router.secretKey(), &claims, &footer); err != nil {
+		return claims, false
+	}
 
-	return paseto.NewV2().Decrypt(headerToken, secretKey, &claims, &footer) == nil
+	// IssuedAt, NotBefore and Expiration are enforced when set
+	if claims.Validate(paseto.ValidAt(time.Now())) != nil {
+		return claims, false
+	}
+	return claims, router.hasKnownSubject(claims)
+}
+
+// hasKnownSubject accepts tokens without a subject, admin tokens carrying
+// the configured admin subject, and capability tokens. A capability subject
+// without a key claim is refused, since it would not be scoped to anything.
+func (router *HttpApiRouter) hasKnownSubject(claims paseto.JSONToken) bool {
+	switch claims.Subject {
+	case "":
+		return true
+	case capabilitySubject:
+		return claims.Get(capabilityKeyClaim) != ""
+	}
+
+	adminSubject := router.SystemState.Configuration.AdminTokenSubject
+	if adminSubject == "" {
+		adminSubject = config.DefaultAdminTokenSubject
+	}
+	return claims.Subject == adminSubject
+}
+
+func (router *HttpApiRouter) secretKey() []byte {
+	return secretKeyFor(router.SystemState.Configuration.AuthenticationSecret)
 }
 
 func (router *HttpApiRouter) HandleSinglePutRequest(ctx *fasthttp.RequestCtx) {
-	if !isMethodAllowed(ctx, "POST", "PUT") {
+	if !isMethodAllowed(ctx, "POST", "PUT") || !router.isWritable(ctx) {
 		return
 	}
 
+	body, ok := router.requestBody(ctx)
+	if !ok {
+		return
+	}
 	var payload SinglePutRequestPayload
-	if err := json.Unmarshal(ctx.PostBody(), &payload); err != nil {
+	if err := json.Unmarshal(body, &payload); err != nil {
 		ctx.Error("Bad Request", fasthttp.StatusBadRequest)
 		return
 	}
 
-	if err := agents.SubmitIngestionRequest(payload.Key, []byte(payload.Value), payload.TimeToLive, false); err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	// async=1 answers 202 as soon as the shard has the write, without
+	// waiting for it to reach the WAL
+	if ctx.QueryArgs().GetBool("async") {
+		if payload.Counter {
+			ctx.Error("Counters cannot be written asynchronously", fasthttp.StatusBadRequest)
+			return
+		}
+		if err := router.Ingestion.SubmitIngestionAsync(reqCtx, payload.Key, []byte(payload.Value), payload.TimeToLive, false); err != nil {
+			writeIngestionError(ctx, err)
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusAccepted)
+		return
+	}
+
+	var err error
+	if payload.Counter {
+		n, parseErr := strconv.ParseInt(payload.Value, 10, 64)
+		if parseErr != nil {
+			ctx.Error("Counter value must be an integer", fasthttp.StatusBadRequest)
+			return
+		}
+		err = router.Ingestion.SubmitCounterWrite(reqCtx, payload.Key, n, payload.TimeToLive)
+	} else {
+		err = router.Ingestion.SubmitIngestionRequestContext(reqCtx, payload.Key, []byte(payload.Value), payload.TimeToLive, false)
+	}
+	if err != nil {
+		writeIngestionError(ctx, err)
 		return
 	}
 	ctx.SetStatusCode(fasthttp.StatusCreated)
 }
 
+// HandleGetRequest serves GET /get?key=k. HEAD, like GET /exists, runs the
+// same lookup but answers with the status alone.
 func (router *HttpApiRouter) HandleGetRequest(ctx *fasthttp.RequestCtx) {
-	if !isMethodAllowed(ctx, "GET") {
+	if !isMethodAllowed(ctx, "GET", "HEAD") {
 		return
 	}
 
@@ -128,14 +294,48 @@ func (router *HttpApiRouter) HandleGetRequest(ctx *fasthttp.RequestCtx) {
 	ctx.Error("Not Found", fasthttp.StatusNotFound)
 }
 
+// Values of the X-Source header, naming the tier that served a GET.
+const (
+	sourceCache     = "cache"
+	sourceMemtable  = "memtable"
+	sourceImmutable = "immutable"
+)
+
+func sstableSource(level int) string {
+	return "sstable-L" + strconv.Itoa(level)
+}
+
 func (router *HttpApiRouter) findAndServe(ctx *fasthttp.RequestCtx, key string) bool {
 	if tryServeFromCache(ctx, router.SystemState, key) {
 		return true
 	}
-	if tryServeFromMemory(ctx, router.SystemState, key) {
+
+	negative := router.SystemState.NegativeCache
+	if negative != nil && negative.Contains(key) {
+		metrics.IncrementNegativeCacheHitCount()
+		return false
+	}
+	var generation uint64
+	if negative != nil {
+		generation = negative.Generation()
+	}
+
+	// One view serves the whole lookup, so a flush or compaction moving the
+	// key between tiers cannot hide it. The pin keeps its files on disk.
+	router.SystemState.PinSSTables()
+	defer router.SystemState.UnpinSSTables()
+	view := router.SystemState.CaptureReadView()
+
+	if tryServeFromMemory(ctx, router.SystemState, view, key) {
+		return true
+	}
+	if tryServeFromDisk(ctx, router.SystemState, view, key) {
 		return true
 	}
-	return tryServeFromDisk(ctx, router.SystemState, key)
+	if negative != nil {
+		negative.RememberMissing(key, generation)
+	}
+	return false
 }
 
 func tryServeFromCache(ctx *fasthttp.RequestCtx, state *core.SystemState, key string) bool {
@@ -144,92 +344,95 @@ func tryServeFromCache(ctx *fasthttp.RequestCtx, state *core.SystemState, key st
 	}
 	if val, hit := state.KeyCache.RetrieveFromCache(key); hit {
 		updateMetrics()
-		writeJSON(ctx, key, val)
+		writeJSON(ctx, sourceCache, key, val)
 		return true
 	}
+	metrics.IncrementCacheMissCount()
 	return false
 }
 
-func tryServeFromMemory(ctx *fasthttp.RequestCtx, state *core.SystemState, key string) bool {
-	state.Mutex.RLock()
-	defer state.Mutex.RUnlock()
-
-	if e, ok := state.MemTable.Get(key); ok {
-		return processEntry(ctx, state, e)
+func tryServeFromMemory(ctx *fasthttp.RequestCtx, state *core.SystemState, view core.ReadView, key string) bool {
+	if e, ok := view.MemTable.Get(key); ok {
+		return processEntry(ctx, state, e, sourceMemtable)
 	}
-	for i := len(state.ImmutableMem) - 1; i >= 0; i-- {
-		if e, ok := state.ImmutableMem[i].Get(key); ok {
-			return processEntry(ctx, state, e)
+	for i := len(view.ImmutableMem) - 1; i >= 0; i-- {
+		if e, ok := view.ImmutableMem[i].Get(key); ok {
+			return processEntry(ctx, state, e, sourceImmutable)
 		}
 	}
 	return false
 }
 
-func tryServeFromDisk(ctx *fasthttp.RequestCtx, state *core.SystemState, key string) bool {
-	state.Mutex.RLock()
-	tables := state.SSTables
-	bloom := state.BloomFilter
-	state.Mutex.RUnlock()
-
-	for _, level := range tables {
-		if searchLevel(ctx, state, level, bloom, key) {
+func tryServeFromDisk(ctx *fasthttp.RequestCtx, state *core.SystemState, view core.ReadView, key string) bool {
+	if len(view.SSTables) > 0 {
+		metrics.IncrementSSTableLookupCount()
+	}
+	for l, level := range view.SSTables {
+		if searchLevel(ctx, state, view, l, level, key) {
 			return true
 		}
 	}
 	return false
 }
 
-func searchLevel(ctx *fasthttp.RequestCtx, state *core.SystemState, level []storage.SSTableMetadata, bloom common.BloomFilter, key string) bool {
-	for i := len(level) - 1; i >= 0; i-- {
-		meta := level[i]
-		if bloom != nil && !bloom.Contains(meta.FileID, []byte(key)) {
-			continue
-		}
-		if e, found := storage.FindInSSTable(meta, key); found {
-			return processEntry(ctx, state, e)
-		}
+func searchLevel(ctx *fasthttp.RequestCtx, state *core.SystemState, view core.ReadView, levelNum int, level []storage.SSTableMetadata, key string) bool {
+	if e, found := view.FindInLevel(level, key); found {
+		return processEntry(ctx, state, e, sstableSource(levelNum))
 	}
 	return false
 }
 
-func processEntry(ctx *fasthttp.RequestCtx, state *core.SystemState, e common.Entry) bool {
+func processEntry(ctx *fasthttp.RequestCtx, state *core.SystemState, e common.Entry, source string) bool {
 	if e.IsDeleted {
 		ctx.Error("Not Found", fasthttp.StatusNotFound)
 		return true
 	}
-	if e.ExpiryTimestamp > 0 && time.Now().UnixNano() > e.ExpiryTimestamp {
+	if e.IsExpiredAt(time.Now().UnixNano()) {
 		ctx.Error("Not Found", fasthttp.StatusNotFound)
 		return true
 	}
 
+	if e.IsCounter {
+		n, _ := common.DecodeCounter(e.Value)
+		writeJSON(ctx, source, e.Key, strconv.AppendInt(nil, n, 10))
+		return true
+	}
+
 	if state.KeyCache != nil {
-		state.KeyCache.InsertIntoCache(e.Key, e.Value)
+		state.KeyCache.InsertIntoCache(e.Key, e.Value, e.ExpiryTimestamp)
 	}
-	writeJSON(ctx, e.Key, e.Value)
+	writeJSON(ctx, source, e.Key, e.Value)
 	return true
 }
 
 func (router *HttpApiRouter) HandleBatchPutRequest(ctx *fasthttp.RequestCtx) {
-	if !isMethodAllowed(ctx, "POST") {
+	if !isMethodAllowed(ctx, "POST") || !router.isWritable(ctx) {
 		return
 	}
 
+	body, ok := router.requestBody(ctx)
+	if !ok {
+		return
+	}
 	var req BatchPutRequestPayload
-	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		ctx.Error("Bad Request", fasthttp.StatusBadRequest)
 		return
 	}
 
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
 	keys, vals, ttls := unpackBatch(&req)
-	if err := agents.SubmitBatchIngestion(keys, vals, ttls); err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+	if err := router.Ingestion.SubmitBatchIngestionContext(reqCtx, keys, vals, ttls); err != nil {
+		writeIngestionError(ctx, err)
 		return
 	}
 	ctx.SetStatusCode(fasthttp.StatusCreated)
 }
 
 func (router *HttpApiRouter) HandleDeleteRequest(ctx *fasthttp.RequestCtx) {
-	if !isMethodAllowed(ctx, "DELETE", "POST") {
+	if !isMethodAllowed(ctx, "DELETE", "POST") || !router.isWritable(ctx) {
 		return
 	}
 
@@ -238,19 +441,350 @@ func (router *HttpApiRouter) HandleDeleteRequest(ctx *fasthttp.RequestCtx) {
 		ctx.Error("Missing key", fasthttp.StatusBadRequest)
 		return
 	}
-	if err := agents.SubmitIngestionRequest(key, nil, 0, true); err != nil {
-		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	if err := router.Ingestion.SubmitIngestionRequestContext(reqCtx, key, nil, 0, true); err != nil {
+		writeIngestionError(ctx, err)
 		return
 	}
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
 
+// HandleBatchDeleteRequest writes a tombstone for every listed key in one
+// shard-grouped batch and reports how many it wrote.
+func (router *HttpApiRouter) HandleBatchDeleteRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") || !router.isWritable(ctx) {
+		return
+	}
+
+	body, ok := router.requestBody(ctx)
+	if !ok {
+		return
+	}
+	var req BatchDeleteRequestPayload
+	if err := json.Unmarshal(body, &req); err != nil || slices.Contains(req.Keys, "") {
+		ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+		return
+	}
+
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	if err := router.Ingestion.SubmitBatchDeletionContext(reqCtx, req.Keys); err != nil {
+		writeIngestionError(ctx, err)
+		return
+	}
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"deleted":%d}`, len(req.Keys))
+}
+
+// patternDeleteBatchSize is how many matching keys a pattern delete writes
+// tombstones for at once, so a broad pattern never holds every match.
+const patternDeleteBatchSize = 1000
+
+// HandlePatternDeleteRequest deletes every live key matching a glob pattern.
+// Without confirm=true it is a dry run that only reports the match count.
+func (router *HttpApiRouter) HandlePatternDeleteRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "DELETE", "POST") {
+		return
+	}
+
+	pattern := string(ctx.QueryArgs().Peek("pattern"))
+	if pattern == "" {
+		ctx.Error("Missing pattern", fasthttp.StatusBadRequest)
+		return
+	}
+	confirmed := ctx.QueryArgs().GetBool("confirm")
+	if confirmed && !router.isWritable(ctx) {
+		return
+	}
+
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	matched, err := router.deleteMatchingKeys(reqCtx, pattern, confirmed)
+	if err != nil {
+		if confirmed {
+			logger.LogErrorEvent("Pattern delete %q stopped after removing %d keys: %v", pattern, matched, err)
+		}
+		writeIngestionError(ctx, err)
+		return
+	}
+	if confirmed {
+		logger.LogInfoEvent("Pattern delete %q removed %d keys", pattern, matched)
+	}
+
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"matched":%d,"deleted":%v}`, matched, confirmed)
+}
+
+// deleteMatchingKeys walks the pattern's key range through a pinned iterator
+// and counts the live keys matching it. When confirmed it deletes them in
+// batches of patternDeleteBatchSize as it goes, and the count is of keys
+// deleted so far; batches written before ctx ends stay deleted.
+func (router *HttpApiRouter) deleteMatchingKeys(ctx context.Context, pattern string, confirmed bool) (int, error) {
+	it, err := router.SystemState.NewRangeIterator(globScanBounds(pattern))
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	matched, scanned := 0, 0
+	batch := make([]string, 0, patternDeleteBatchSize)
+	for e, ok := it.Next(); ok; e, ok = it.Next() {
+		if scanned++; scanned%patternDeleteBatchSize == 0 && ctx.Err() != nil {
+			return matched, ctx.Err()
+		}
+		if !matchGlob(pattern, e.Key) {
+			continue
+		}
+		if !confirmed {
+			matched++
+			continue
+		}
+
+		batch = append(batch, e.Key)
+		if len(batch) == patternDeleteBatchSize {
+			if err := router.Ingestion.SubmitBatchDeletionContext(ctx, batch); err != nil {
+				return matched, err
+			}
+			matched += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err := it.Err(); err != nil {
+		return matched, err
+	}
+
+	if err := router.Ingestion.SubmitBatchDeletionContext(ctx, batch); err != nil {
+		return matched, err
+	}
+	return matched + len(batch), nil
+}
+
+// HandleMetricsRequest serves the metrics registry as JSON, or in the
+// Prometheus text format for ?format=prometheus and for scrapers that
+// accept text/plain or OpenMetrics.
 func (router *HttpApiRouter) HandleMetricsRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "GET") {
+		return
+	}
+	var cacheEntries, cacheBytes int
+	if cache := router.SystemState.KeyCache; cache != nil {
+		cacheEntries, cacheBytes = cache.Len(), cache.SizeInBytes()
+	}
+
+	if wantsPrometheusText(ctx) {
+		ctx.SetContentType(metrics.PrometheusContentType)
+		metrics.WritePrometheusText(ctx, metrics.Gauge{
+			Name:  "sndv_memtable_bytes",
+			Help:  "Size of the active and immutable memtables.",
+			Value: router.memtableSizeInBytes(),
+		}, metrics.Gauge{
+			Name:  "sndv_cache_entries",
+			Help:  "Keys held by the key cache.",
+			Value: int64(cacheEntries),
+		}, metrics.Gauge{
+			Name:  "sndv_cache_bytes",
+			Help:  "Summed key and value bytes held by the key cache.",
+			Value: int64(cacheBytes),
+		})
+		return
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(metricsPayload{
+		SystemMetricsRegistry: &metrics.Global,
+		LogMessagesDropped:    logger.DroppedMessageCount(),
+		CacheEntries:          cacheEntries,
+		CacheBytes:            cacheBytes,
+		CacheHitRatio:         metrics.CacheHitRatio(),
+	})
+}
+
+// metricsPayload is the JSON /metrics body: the registry plus the counts
+// and gauges other packages own.
+type metricsPayload struct {
+	*metrics.SystemMetricsRegistry
+	LogMessagesDropped uint64  `json:"log_messages_dropped"`
+	CacheEntries       int     `json:"cache_entries"`
+	CacheBytes         int     `json:"cache_bytes"`
+	CacheHitRatio      float64 `json:"cache_hit_ratio"`
+}
+
+func wantsPrometheusText(ctx *fasthttp.RequestCtx) bool {
+	if format := ctx.QueryArgs().Peek("format"); len(format) > 0 {
+		return string(format) == "prometheus"
+	}
+	accept := ctx.Request.Header.Peek("Accept")
+	return bytes.Contains(accept, []byte("text/plain")) || bytes.Contains(accept, []byte("application/openmetrics-text"))
+}
+
+func (router *HttpApiRouter) memtableSizeInBytes() int64 {
+	state := router.SystemState
+	state.Mutex.RLock()
+	defer state.Mutex.RUnlock()
+
+	size := state.MemTable.Size()
+	for _, table := range state.ImmutableMem {
+		size += table.Size()
+	}
+	return size
+}
+
+// HandleLevelStatsRequest reports per-level SSTable sizes and compaction debt.
+func (router *HttpApiRouter) HandleLevelStatsRequest(ctx *fasthttp.RequestCtx) {
 	if !isMethodAllowed(ctx, "GET") {
 		return
 	}
 	ctx.SetContentType("application/json")
-	json.NewEncoder(ctx).Encode(metrics.Global)
+	json.NewEncoder(ctx).Encode(router.SystemState.CompactionDebt())
+}
+
+// HandleStoreStatsRequest reports key counts and sizes for the whole store.
+func (router *HttpApiRouter) HandleStoreStatsRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "GET") {
+		return
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(router.SystemState.Stats())
+}
+
+// HandleCheckpointRequest flushes all immutable memtables and deletes their
+// frozen WALs before responding.
+func (router *HttpApiRouter) HandleCheckpointRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") || !router.isWritable(ctx) {
+		return
+	}
+
+	flushed, err := agents.Checkpoint(router.SystemState)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"flushed":%d}`, flushed)
+}
+
+// HandleSyncRequest responds once every previously acknowledged write is
+// durable. With flush=true the memtables are also flushed to SSTables.
+func (router *HttpApiRouter) HandleSyncRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") {
+		return
+	}
+
+	flush := false
+	if raw := ctx.QueryArgs().Peek("flush"); len(raw) > 0 {
+		var err error
+		if flush, err = strconv.ParseBool(string(raw)); err != nil {
+			ctx.Error("Invalid flush flag", fasthttp.StatusBadRequest)
+			return
+		}
+	}
+	if flush && !router.isWritable(ctx) {
+		return
+	}
+
+	flushed, err := agents.Sync(router.SystemState, flush)
+	if errors.Is(err, agents.ErrDurabilityDisabled) {
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+		return
+	} else if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"flushed":%d}`, flushed)
+}
+
+// HandleSnapshotRequest writes a point-in-time copy of the store into the
+// directory named by dir, which another instance can boot from. It is
+// allowed in read-only mode, since it does not change the live data set.
+func (router *HttpApiRouter) HandleSnapshotRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") {
+		return
+	}
+
+	dir := string(ctx.QueryArgs().Peek("dir"))
+	if dir == "" {
+		ctx.Error("Missing dir", fasthttp.StatusBadRequest)
+		return
+	}
+
+	tables, err := agents.Snapshot(router.SystemState, dir)
+	switch {
+	case errors.Is(err, agents.ErrSnapshotTargetNotEmpty), errors.Is(err, agents.ErrSnapshotUnsupported):
+		ctx.Error(err.Error(), fasthttp.StatusConflict)
+		return
+	case err != nil:
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"tables": tables,
+		"path":   dir,
+	})
+}
+
+func (router *HttpApiRouter) HandleReadOnlyModeRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") {
+		return
+	}
+
+	enabled, err := strconv.ParseBool(string(ctx.QueryArgs().Peek("enabled")))
+	if err != nil {
+		ctx.Error("Invalid enabled flag", fasthttp.StatusBadRequest)
+		return
+	}
+
+	router.SystemState.SetReadOnlyMode(enabled)
+	logger.LogInfoEvent("Read-only mode set to %v", enabled)
+
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"read_only":%v}`, enabled)
+}
+
+func (router *HttpApiRouter) isWritable(ctx *fasthttp.RequestCtx) bool {
+	if router.SystemState.IsReadOnlyMode() {
+		ctx.Error("Read-only mode", fasthttp.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// requestContext bounds how long a handler waits on ingestion.
+func (router *HttpApiRouter) requestContext() (context.Context, context.CancelFunc) {
+	return router.requestContextFrom(context.Background())
+}
+
+// requestContextFrom is requestContext for a caller that already has a
+// context, such as a gRPC call with its own deadline.
+func (router *HttpApiRouter) requestContextFrom(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := router.SystemState.Configuration.RequestTimeoutInMilliseconds
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(timeout)*time.Millisecond)
+}
+
+func writeIngestionError(ctx *fasthttp.RequestCtx, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		ctx.Error("Gateway Timeout", fasthttp.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, agents.ErrOverloaded) {
+		ctx.Error("Overloaded", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, agents.ErrReadOnlyMode) {
+		ctx.Error("Read-only mode", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
 }
 
 func isMethodAllowed(ctx *fasthttp.RequestCtx, methods ...string) bool {
@@ -280,9 +814,37 @@ func unpackBatch(req *BatchPutRequestPayload) ([]string, [][]byte, []int) {
 	return k, v, t
 }
 
-func writeJSON(ctx *fasthttp.RequestCtx, key string, val []byte) {
+// writeJSON renders the single-value response in a pooled buffer so the
+// exact Content-Length is known up front and no chunked encoding is used.
+// source is reported in the X-Source header.
+func writeJSON(ctx *fasthttp.RequestCtx, source, key string, val []byte) {
+	if isExistenceProbe(ctx) {
+		ctx.Response.Header.Set("X-Source", source)
+		ctx.Response.Header.SetContentLength(0)
+		return
+	}
+
+	e := encoderPool.Get().(*pooledEncoder)
+	defer encoderPool.Put(e)
+	e.buf.Reset()
+
+	if err := e.encoder.Encode(SingleGetResponsePayload{Key: key, Value: string(val)}); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	// Drop the newline Encode appends
+	body := bytes.TrimSuffix(e.buf.Bytes(), []byte("\n"))
+
 	ctx.SetContentType("application/json")
-	fmt.Fprintf(ctx, `{"key":"%s","val":"%s"}`, key, val)
+	ctx.Response.Header.Set("X-Source", source)
+	ctx.SetBody(body)
+	ctx.Response.Header.SetContentLength(len(body))
+}
+
+// isExistenceProbe reports whether a lookup only asks if the key exists, so
+// the value is not sent.
+func isExistenceProbe(ctx *fasthttp.RequestCtx) bool {
+	return ctx.IsHead() || string(ctx.Path()) == "/exists"
 }
 
 func updateMetrics() {
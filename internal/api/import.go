@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sndv-kv/internal/logger"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// importBatchSize is how many records an import hands to the ingestion
+// subsystem at once.
+const importBatchSize = 1000
+
+// importLineError is a record an import could not decode.
+type importLineError struct {
+	line int
+	err  error
+}
+
+func (e *importLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+// HandleImportRequest ingests newline-delimited /put payloads, the format
+// /export writes. The body is decoded as it streams in, so a restore never
+// holds more than one batch in memory. Blank lines are skipped and a final
+// line cut short without its newline is dropped. Records before a malformed
+// line stay imported.
+func (router *HttpApiRouter) HandleImportRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") || !router.isWritable(ctx) {
+		return
+	}
+
+	body := ctx.RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(ctx.PostBody())
+	}
+
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	imported, truncated, err := router.importRecords(reqCtx, body)
+	var lineErr *importLineError
+	switch {
+	case errors.As(err, &lineErr):
+		ctx.Error(fmt.Sprintf("%v (%d keys imported before it)", err, imported), fasthttp.StatusBadRequest)
+		return
+	case err != nil:
+		writeIngestionError(ctx, err)
+		return
+	}
+	if truncated {
+		logger.LogInfoEvent("Import dropped a truncated final line after %d keys", imported)
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"imported":  imported,
+		"truncated": truncated,
+	})
+}
+
+// importRecords reads records from r until EOF and returns how many keys it
+// wrote, and whether an unterminated final line was dropped. Keys read before
+// a malformed line are written before the line is reported.
+func (router *HttpApiRouter) importRecords(ctx context.Context, r io.Reader) (int, bool, error) {
+	reader := bufio.NewReaderSize(r, 64<<10)
+	keys := make([]string, 0, importBatchSize)
+	vals := make([][]byte, 0, importBatchSize)
+	ttls := make([]int, 0, importBatchSize)
+
+	imported := 0
+	flush := func() error {
+		if err := router.Ingestion.SubmitBatchIngestionContext(ctx, keys, vals, ttls); err != nil {
+			return err
+		}
+		imported += len(keys)
+		keys, vals, ttls = keys[:0], vals[:0], ttls[:0]
+		return nil
+	}
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return imported, false, readErr
+		}
+		atEOF := readErr == io.EOF
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var record SinglePutRequestPayload
+			if err := json.Unmarshal(line, &record); err != nil {
+				if err := flush(); err != nil {
+					return imported, false, err
+				}
+				if atEOF {
+					return imported, true, nil
+				}
+				return imported, false, &importLineError{line: lineNumber, err: err}
+			}
+
+			if record.Counter {
+				// Keep the batch ahead of the counter so a later record wins
+				if err := flush(); err != nil {
+					return imported, false, err
+				}
+				n, err := strconv.ParseInt(record.Value, 10, 64)
+				if err != nil {
+					return imported, false, &importLineError{line: lineNumber, err: errors.New("counter value must be an integer")}
+				}
+				if err := router.Ingestion.SubmitCounterWrite(ctx, record.Key, n, record.TimeToLive); err != nil {
+					return imported, false, err
+				}
+				imported++
+			} else {
+				keys = append(keys, record.Key)
+				vals = append(vals, []byte(record.Value))
+				ttls = append(ttls, record.TimeToLive)
+				if len(keys) == importBatchSize {
+					if err := flush(); err != nil {
+						return imported, false, err
+					}
+				}
+			}
+		}
+
+		if atEOF {
+			return imported, false, flush()
+		}
+	}
+}
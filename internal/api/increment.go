@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"sndv-kv/internal/agents"
+
+	"github.com/valyala/fasthttp"
+)
+
+type IncrementRequestPayload struct {
+	Key string `json:"key"`
+	// By defaults to 1 when omitted.
+	By         *int64 `json:"by"`
+	TimeToLive int    `json:"ttl"`
+}
+
+type IncrementResponsePayload struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+// HandleIncrementRequest serves POST /incr, adding by to the integer at key
+// on the shard that owns it and returning the new value. A missing key
+// counts as zero; a value that is not an integer is rejected with 400.
+func (router *HttpApiRouter) HandleIncrementRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") || !router.isWritable(ctx) {
+		return
+	}
+
+	body, ok := router.requestBody(ctx)
+	if !ok {
+		return
+	}
+	var payload IncrementRequestPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Key == "" {
+		ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+		return
+	}
+	by := int64(1)
+	if payload.By != nil {
+		by = *payload.By
+	}
+
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	total, err := router.Ingestion.SubmitIncrement(reqCtx, payload.Key, by, payload.TimeToLive)
+	if errors.Is(err, agents.ErrNotCounter) {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeIngestionError(ctx, err)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(IncrementResponsePayload{Key: payload.Key, Value: total})
+}
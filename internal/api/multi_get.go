@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"sndv-kv/internal/metrics"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maxMultiGetKeys bounds the keys one /mget request may ask for.
+const maxMultiGetKeys = 1000
+
+type MultiGetRequestPayload struct {
+	Keys []string `json:"keys"`
+}
+
+type MultiGetResponsePayload struct {
+	// Results maps every requested key to its value, or null when the key
+	// is missing, deleted or expired.
+	Results map[string]*string `json:"results"`
+}
+
+// HandleMultiGetRequest serves POST /mget. Keys are looked up through the
+// cache, then a single read view of the memtables and SSTables.
+func (router *HttpApiRouter) HandleMultiGetRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") {
+		return
+	}
+
+	body, ok := router.requestBody(ctx)
+	if !ok {
+		return
+	}
+	var req MultiGetRequestPayload
+	if err := json.Unmarshal(body, &req); err != nil || len(req.Keys) == 0 {
+		ctx.Error("Bad Request", fasthttp.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) > maxMultiGetKeys {
+		ctx.Error("Too many keys", fasthttp.StatusRequestEntityTooLarge)
+		return
+	}
+	state := router.SystemState
+
+	results := make(map[string]*string, len(req.Keys))
+	var uncached []string
+	for _, key := range req.Keys {
+		if _, seen := results[key]; seen {
+			continue
+		}
+		results[key] = nil
+		if state.KeyCache != nil {
+			if val, hit := state.KeyCache.RetrieveFromCache(key); hit {
+				updateMetrics()
+				value := string(val)
+				results[key] = &value
+				continue
+			}
+			metrics.IncrementCacheMissCount()
+		}
+		uncached = append(uncached, key)
+	}
+
+	state.PinSSTables()
+	found := state.CaptureReadView().FindEntries(uncached)
+	state.UnpinSSTables()
+
+	now := time.Now().UnixNano()
+	for key, e := range found {
+		if e.IsDeleted || e.IsExpiredAt(now) {
+			continue
+		}
+		if state.KeyCache != nil && !e.IsCounter {
+			state.KeyCache.InsertIntoCache(key, e.Value, e.ExpiryTimestamp)
+		}
+		value := displayValue(e)
+		results[key] = &value
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(MultiGetResponsePayload{Results: results})
+}
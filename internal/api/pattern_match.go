@@ -0,0 +1,53 @@
+package api
+
+import "strings"
+
+// matchGlob reports whether key matches pattern, where '*' matches any run of
+// bytes (including none) and '?' matches exactly one byte. Unlike path.Match,
+// '/' has no special meaning, since keys are not paths.
+func matchGlob(pattern, key string) bool {
+	p, k := 0, 0
+	starP, starK := -1, 0
+
+	for k < len(key) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == key[k]):
+			p++
+			k++
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starK = p, k
+			p++
+		case starP >= 0:
+			// Let the last '*' swallow one more byte and retry.
+			starK++
+			p, k = starP+1, starK
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globScanBounds returns the [start, end) key range that can contain matches
+// for pattern: everything sharing its literal prefix. An empty end means the
+// range is unbounded.
+func globScanBounds(pattern string) (string, string) {
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+		prefix = pattern[:i]
+	}
+
+	end := []byte(prefix)
+	for len(end) > 0 {
+		last := len(end) - 1
+		if end[last] < 0xff {
+			end[last]++
+			return prefix, string(end)
+		}
+		end = end[:last]
+	}
+	return prefix, ""
+}
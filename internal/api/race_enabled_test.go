@@ -0,0 +1,7 @@
+//go:build race
+
+package api
+
+// raceDetectorEnabled reports a -race build, whose instrumentation inflates
+// allocations well past what the code itself makes.
+const raceDetectorEnabled = true
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"io"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const rawValuePathPrefix = "/raw/"
+
+// HandleRawGetRequest serves GET /raw/{key} with the value as the bare
+// response body. Values found in an SSTable are streamed from the file in
+// chunks, so memory stays flat however large the value is. The open handle
+// keeps the file readable even if compaction removes it mid-stream.
+func (router *HttpApiRouter) HandleRawGetRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "GET") {
+		return
+	}
+
+	key := strings.TrimPrefix(string(ctx.Path()), rawValuePathPrefix)
+	if key == "" {
+		ctx.Error("Missing key", fasthttp.StatusBadRequest)
+		return
+	}
+
+	// The pin only needs to last until the value is open: an open handle
+	// stays readable after the file is removed
+	router.SystemState.PinSSTables()
+	defer router.SystemState.UnpinSSTables()
+	view := router.SystemState.CaptureReadView()
+	if e, ok := view.FindInMemory(key); ok {
+		writeRawEntry(ctx, e)
+		return
+	}
+
+	for _, level := range view.SSTables {
+		value, err := openNewestValue(level, view.BloomFilter, key)
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		if value != nil {
+			serveSSTableValue(ctx, key, value)
+			return
+		}
+	}
+	ctx.Error("Not Found", fasthttp.StatusNotFound)
+}
+
+// openNewestValue opens the version of key with the highest sequence in a
+// level, as core.FindInLevel picks it, or returns nil if no table holds key.
+func openNewestValue(level []storage.SSTableMetadata, bloom common.BloomFilter, key string) (*storage.SSTableValue, error) {
+	var best *storage.SSTableValue
+	for i := len(level) - 1; i >= 0; i-- {
+		meta := level[i]
+		if best != nil && meta.MaxSequence <= best.Sequence {
+			continue
+		}
+		if !meta.Partition.Contains(key) {
+			continue
+		}
+		if meta.HasBloomFilter && bloom != nil && !bloom.Contains(meta.FileID, []byte(key)) {
+			continue
+		}
+
+		value, found, err := storage.OpenSSTableValue(meta, key)
+		if err != nil {
+			if best != nil {
+				best.Close()
+			}
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if best != nil && value.Sequence <= best.Sequence {
+			value.Close()
+			continue
+		}
+		if best != nil {
+			best.Close()
+		}
+		best = value
+	}
+	return best, nil
+}
+
+func writeRawEntry(ctx *fasthttp.RequestCtx, e common.Entry) {
+	if e.IsDeleted || e.IsExpiredAt(time.Now().UnixNano()) {
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetContentType("application/octet-stream")
+	if e.IsCounter {
+		n, _ := common.DecodeCounter(e.Value)
+		ctx.SetBody(strconv.AppendInt(nil, n, 10))
+		return
+	}
+	ctx.SetBody(e.Value)
+}
+
+// serveSSTableValue streams value as the body; fasthttp closes it once the
+// response is written.
+func serveSSTableValue(ctx *fasthttp.RequestCtx, key string, value *storage.SSTableValue) {
+	if value.IsDeleted || (value.ExpiryTimestamp > 0 && time.Now().UnixNano() > value.ExpiryTimestamp) {
+		value.Close()
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+		return
+	}
+
+	if value.IsCounter {
+		defer value.Close()
+		encoded, err := io.ReadAll(value)
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		writeRawEntry(ctx, common.Entry{Key: key, Value: encoded, IsCounter: true})
+		return
+	}
+
+	ctx.SetContentType("application/octet-stream")
+	ctx.SetBodyStream(value, int(value.Length))
+}
@@ -0,0 +1,504 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"slices"
+	"sndv-kv/internal/agents"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on one RESP command, so a client cannot make a connection buffer
+// an arbitrary amount before anything is executed.
+const (
+	maxRespArguments = 1024 * 1024
+	maxRespBulkBytes = 64 << 20
+	// maxRespInlineBytes bounds a line: an inline command or a length header
+	maxRespInlineBytes = 64 << 10
+)
+
+// respReadCommands are the commands a read-scoped token may run.
+var respReadCommands = map[string]bool{
+	"GET":    true,
+	"EXISTS": true,
+	"MGET":   true,
+}
+
+// respProtocolError ends a connection: the stream cannot be resynchronised
+// after malformed framing, as in Redis.
+type respProtocolError string
+
+func (e respProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// RespServer speaks the subset of RESP2 that redis-cli and common client
+// libraries need for GET, SET, DEL, EXISTS and MGET, served from the same
+// state and ingestion subsystem as the HTTP router. Commands pipelined on
+// one connection are answered in order, with one flush per burst.
+type RespServer struct {
+	router *HttpApiRouter
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	active    sync.WaitGroup
+}
+
+func NewRespServer(router *HttpApiRouter) *RespServer {
+	return &RespServer{
+		router:    router,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on ln until Close, which makes it return nil.
+func (s *RespServer) Serve(ln net.Listener) error {
+	if !s.track(ln, nil) {
+		ln.Close()
+		return nil
+	}
+	defer s.untrack(ln, nil)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		if !s.track(nil, conn) {
+			conn.Close()
+			return nil
+		}
+		s.active.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, drops every connection and waits for their
+// in-flight commands to finish.
+func (s *RespServer) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.active.Wait()
+	return nil
+}
+
+func (s *RespServer) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *RespServer) track(ln net.Listener, conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	if ln != nil {
+		s.listeners[ln] = struct{}{}
+	}
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (s *RespServer) untrack(ln net.Listener, conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.listeners, ln)
+	delete(s.conns, conn)
+}
+
+// respSession is the per-connection state.
+type respSession struct {
+	reader        *bufio.Reader
+	writer        *bufio.Writer
+	authenticated bool
+	scope         string
+}
+
+func (s *RespServer) serveConn(conn net.Conn) {
+	defer s.active.Done()
+	defer s.untrack(nil, conn)
+	defer conn.Close()
+
+	// Without a configured token every connection starts authenticated
+	_, open := s.router.authenticate("")
+	session := &respSession{
+		reader:        bufio.NewReader(conn),
+		writer:        bufio.NewWriter(conn),
+		authenticated: open,
+		scope:         ScopeWrite,
+	}
+
+	for {
+		args, err := readRespCommand(session.reader)
+		if err != nil {
+			var protocolErr respProtocolError
+			if errors.As(err, &protocolErr) {
+				writeRespError(session.writer, "ERR "+protocolErr.Error())
+				session.writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		startTime := time.Now()
+		quit := s.execute(session, args)
+		logger.LogAccessRequest("RESP", strings.ToUpper(string(args[0])), conn.RemoteAddr().String(), time.Since(startTime))
+
+		// Replies to a pipeline go out together once its last command ran
+		if quit || session.reader.Buffered() == 0 {
+			if err := session.writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// execute runs one command and writes its reply. It reports whether the
+// connection should be closed.
+func (s *RespServer) execute(session *respSession, args [][]byte) (quit bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.LogErrorEvent("PANIC: %v\n%s", r, debug.Stack())
+			writeRespError(session.writer, "ERR internal error")
+			quit = true
+		}
+	}()
+
+	w := session.writer
+	name := strings.ToUpper(string(args[0]))
+	switch name {
+	case "QUIT":
+		writeRespSimple(w, "OK")
+		return true
+	case "AUTH":
+		s.auth(session, args[1:])
+		return false
+	}
+
+	if !session.authenticated {
+		writeRespError(w, "NOAUTH Authentication required.")
+		return false
+	}
+	if session.scope != ScopeWrite && !respReadCommands[name] && name != "PING" {
+		writeRespError(w, "NOPERM this token may only run GET, EXISTS and MGET")
+		return false
+	}
+
+	switch name {
+	case "PING":
+		s.ping(w, args[1:])
+	case "GET":
+		s.get(w, args[1:])
+	case "SET":
+		s.set(w, args[1:])
+	case "DEL":
+		s.del(w, args[1:])
+	case "EXISTS":
+		s.exists(w, args[1:])
+	case "MGET":
+		s.mget(w, args[1:])
+	case "SELECT":
+		// One keyspace: clients that select database 0 keep working
+		if len(args) != 2 || string(args[1]) != "0" {
+			writeRespError(w, "ERR DB index is out of range")
+			return false
+		}
+		writeRespSimple(w, "OK")
+	case "COMMAND":
+		// redis-cli asks for command docs on startup; an empty answer is fine
+		writeRespArrayHeader(w, 0)
+	default:
+		writeRespError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return false
+}
+
+// auth accepts AUTH <token> and the Redis 6 form AUTH <user> <token>, where
+// the token is the one the HTTP API takes in its Authorization header.
+// Key-scoped capability tokens name HTTP routes and are refused.
+func (s *RespServer) auth(session *respSession, args [][]byte) {
+	if len(args) != 1 && len(args) != 2 {
+		writeRespError(session.writer, "ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	claims, ok := s.router.authenticate(string(args[len(args)-1]))
+	if !ok || claims.Get(capabilityKeyClaim) != "" {
+		writeRespError(session.writer, "WRONGPASS invalid token")
+		return
+	}
+	scope := tokenScope(claims)
+	if scope != ScopeWrite && scope != ScopeRead {
+		writeRespError(session.writer, "WRONGPASS invalid token")
+		return
+	}
+	session.authenticated, session.scope = true, scope
+	writeRespSimple(session.writer, "OK")
+}
+
+func (s *RespServer) ping(w *bufio.Writer, args [][]byte) {
+	switch len(args) {
+	case 0:
+		writeRespSimple(w, "PONG")
+	case 1:
+		writeRespBulk(w, args[0])
+	default:
+		writeRespError(w, "ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *RespServer) get(w *bufio.Writer, args [][]byte) {
+	if len(args) != 1 {
+		writeRespError(w, "ERR wrong number of arguments for 'get' command")
+		return
+	}
+	metrics.IncrementReadOperationsCount()
+	entry, found := s.router.SystemState.FindLive(string(args[0]))
+	if !found {
+		writeRespNull(w)
+		return
+	}
+	writeRespBulk(w, []byte(displayValue(entry)))
+}
+
+// set supports SET key value [EX seconds].
+func (s *RespServer) set(w *bufio.Writer, args [][]byte) {
+	if len(args) != 2 && len(args) != 4 {
+		writeRespError(w, "ERR syntax error")
+		return
+	}
+	ttl := 0
+	if len(args) == 4 {
+		if !strings.EqualFold(string(args[2]), "EX") {
+			writeRespError(w, "ERR syntax error")
+			return
+		}
+		n, err := strconv.Atoi(string(args[3]))
+		if err != nil || n <= 0 {
+			writeRespError(w, "ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = n
+	}
+	if !s.isWritable(w) {
+		return
+	}
+
+	ctx, cancel := s.router.requestContext()
+	defer cancel()
+	if err := s.router.Ingestion.SubmitIngestionRequestContext(ctx, string(args[0]), args[1], ttl, false); err != nil {
+		writeRespIngestionError(w, err)
+		return
+	}
+	writeRespSimple(w, "OK")
+}
+
+// del replies with how many of the keys were live, as Redis does; only
+// those get a tombstone.
+func (s *RespServer) del(w *bufio.Writer, args [][]byte) {
+	if len(args) == 0 {
+		writeRespError(w, "ERR wrong number of arguments for 'del' command")
+		return
+	}
+	if !s.isWritable(w) {
+		return
+	}
+
+	var live []string
+	for _, arg := range args {
+		key := string(arg)
+		if _, found := s.router.SystemState.FindLive(key); found && !slices.Contains(live, key) {
+			live = append(live, key)
+		}
+	}
+
+	ctx, cancel := s.router.requestContext()
+	defer cancel()
+	if err := s.router.Ingestion.SubmitBatchDeletionContext(ctx, live); err != nil {
+		writeRespIngestionError(w, err)
+		return
+	}
+	writeRespInteger(w, int64(len(live)))
+}
+
+// exists counts live keys, counting a repeated key each time as Redis does.
+func (s *RespServer) exists(w *bufio.Writer, args [][]byte) {
+	if len(args) == 0 {
+		writeRespError(w, "ERR wrong number of arguments for 'exists' command")
+		return
+	}
+	var count int64
+	for _, arg := range args {
+		if _, found := s.router.SystemState.FindLive(string(arg)); found {
+			count++
+		}
+	}
+	writeRespInteger(w, count)
+}
+
+func (s *RespServer) mget(w *bufio.Writer, args [][]byte) {
+	if len(args) == 0 {
+		writeRespError(w, "ERR wrong number of arguments for 'mget' command")
+		return
+	}
+	if len(args) > maxMultiGetKeys {
+		writeRespError(w, "ERR too many keys")
+		return
+	}
+	writeRespArrayHeader(w, len(args))
+	for _, arg := range args {
+		metrics.IncrementReadOperationsCount()
+		if entry, found := s.router.SystemState.FindLive(string(arg)); found {
+			writeRespBulk(w, []byte(displayValue(entry)))
+		} else {
+			writeRespNull(w)
+		}
+	}
+}
+
+func (s *RespServer) isWritable(w *bufio.Writer) bool {
+	if s.router.SystemState.IsReadOnlyMode() {
+		writeRespError(w, "READONLY the store is in read-only mode")
+		return false
+	}
+	return true
+}
+
+// readRespCommand reads one command: a RESP array of bulk strings, as
+// clients send, or an inline command line, as typed over telnet. A blank
+// inline line yields no arguments.
+func readRespCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRespLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count > maxRespArguments {
+		return nil, respProtocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, max(count, 0))
+	for range count {
+		header, err := readRespLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, respProtocolError(fmt.Sprintf("expected '$', got '%s'", header))
+		}
+		size, err := strconv.Atoi(string(header[1:]))
+		if err != nil || size < 0 || size > maxRespBulkBytes {
+			return nil, respProtocolError("invalid bulk length")
+		}
+
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, respProtocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// readRespLine returns a copy of the next line without its CRLF.
+func readRespLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if len(line) > maxRespInlineBytes {
+			return nil, respProtocolError("too big inline request")
+		}
+	}
+	if len(line) > maxRespInlineBytes {
+		return nil, respProtocolError("too big inline request")
+	}
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")), nil
+}
+
+func writeRespSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeRespError(w *bufio.Writer, msg string) {
+	// Errors are single-line; a newline would break the framing
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func writeRespInteger(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeRespBulk(w *bufio.Writer, b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeRespNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeRespArrayHeader(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// writeRespIngestionError is writeIngestionError for RESP.
+func writeRespIngestionError(w *bufio.Writer, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeRespError(w, "ERR timed out waiting for the write")
+	case errors.Is(err, agents.ErrOverloaded):
+		writeRespError(w, "BUSY overloaded, retry later")
+	case errors.Is(err, agents.ErrReadOnlyMode):
+		writeRespError(w, "READONLY the store is in read-only mode")
+	default:
+		writeRespError(w, "ERR "+err.Error())
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"sndv-kv/internal/common"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultScanLimit = 100
+	// maxScanLimit caps a single page so one scan cannot build an
+	// arbitrarily large response.
+	maxScanLimit = 1000
+)
+
+type scanItem struct {
+	Key string `json:"key"`
+	Val string `json:"val"`
+}
+
+// HandleScanRequest serves GET /scan?start=&end=&limit= with the live keys
+// in [start, end) in key order, as a JSON array of {"key","val"}. When more
+// keys remain, X-Next-Key holds the key to pass as start for the next page.
+func (router *HttpApiRouter) HandleScanRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "GET") {
+		return
+	}
+
+	args := ctx.QueryArgs()
+	start, end := string(args.Peek("start")), string(args.Peek("end"))
+	limit := defaultScanLimit
+	if raw := args.Peek("limit"); len(raw) > 0 {
+		n, err := strconv.Atoi(string(raw))
+		if err != nil || n <= 0 {
+			ctx.Error("Invalid limit", fasthttp.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxScanLimit)
+	}
+
+	state := router.SystemState
+	state.PinSSTables()
+	entries, err := state.CaptureReadView().ScanRange(start, end, limit+1)
+	state.UnpinSSTables()
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	if len(entries) > limit {
+		ctx.Response.Header.Set("X-Next-Key", entries[limit].Key)
+		entries = entries[:limit]
+	}
+
+	items := make([]scanItem, len(entries))
+	for i, e := range entries {
+		items[i] = scanItem{Key: e.Key, Val: displayValue(e)}
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(items)
+}
+
+// displayValue renders counters in decimal, as GET does.
+func displayValue(e common.Entry) string {
+	if e.IsCounter {
+		n, _ := common.DecodeCounter(e.Value)
+		return strconv.FormatInt(n, 10)
+	}
+	return string(e.Value)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/o1egl/paseto"
+	"github.com/valyala/fasthttp"
+)
+
+// scopeClaim limits what a token may do. Tokens without it have full access.
+const scopeClaim = "scope"
+
+// Values of the scope claim.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// scopeUserValue is the request user value holding the caller's scope.
+const scopeUserValue = "scope"
+
+// readOnlyRoutes are the routes a read-scoped token may reach: lookups and
+// the observability endpoints a dashboard polls.
+var readOnlyRoutes = map[string]bool{
+	"/get":          true,
+	"/exists":       true,
+	"/mget":         true,
+	"/scan":         true,
+	"/metrics":      true,
+	"/admin/levels": true,
+	"/admin/stats":  true,
+	"/stats":        true,
+}
+
+// NewScopedToken mints a token granting scope to subject for ttl, signed
+// with the given authentication secret.
+func NewScopedToken(secret, subject, scope string, ttl time.Duration) (string, error) {
+	if scope != ScopeRead && scope != ScopeWrite {
+		return "", fmt.Errorf("unknown scope %q", scope)
+	}
+	claims := paseto.JSONToken{
+		Subject:    subject,
+		IssuedAt:   time.Now(),
+		Expiration: time.Now().Add(ttl),
+	}
+	claims.Set(scopeClaim, scope)
+	return paseto.NewV2().Encrypt(secretKeyFor(secret), claims, "")
+}
+
+// secretKeyFor pads or truncates the configured secret to a V2 key.
+func secretKeyFor(secret string) []byte {
+	return []byte(fmt.Sprintf("%-32s", secret))[:32]
+}
+
+// tokenScope returns the scope the claims grant, ScopeWrite when unset.
+func tokenScope(claims paseto.JSONToken) string {
+	if scope := claims.Get(scopeClaim); scope != "" {
+		return scope
+	}
+	return ScopeWrite
+}
+
+// authorizeTokenScope stores the caller's scope on ctx for handlers, and
+// refuses read-scoped tokens everything but readOnlyRoutes. Unknown scopes
+// are refused everywhere.
+func authorizeTokenScope(ctx *fasthttp.RequestCtx, claims paseto.JSONToken) bool {
+	scope := tokenScope(claims)
+	ctx.SetUserValue(scopeUserValue, scope)
+
+	switch scope {
+	case ScopeWrite:
+		return true
+	case ScopeRead:
+		return isReadOnlyRoute(string(ctx.Path()))
+	}
+	return false
+}
+
+func isReadOnlyRoute(path string) bool {
+	return readOnlyRoutes[path] || strings.HasPrefix(path, rawValuePathPrefix)
+}
+
+// requestScope returns the scope of the token that authorised ctx.
+func requestScope(ctx *fasthttp.RequestCtx) string {
+	if scope, ok := ctx.UserValue(scopeUserValue).(string); ok {
+		return scope
+	}
+	return ScopeWrite
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"errors"
+	"sndv-kv/internal/agents"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HandleTouchRequest serves POST /touch?key=k&ttl=60, giving the live value
+// at key a new TTL without the client resending it. ttl=0 removes the expiry;
+// a missing, deleted or expired key is 404.
+func (router *HttpApiRouter) HandleTouchRequest(ctx *fasthttp.RequestCtx) {
+	if !isMethodAllowed(ctx, "POST") || !router.isWritable(ctx) {
+		return
+	}
+
+	key := string(ctx.QueryArgs().Peek("key"))
+	if key == "" {
+		ctx.Error("Missing key", fasthttp.StatusBadRequest)
+		return
+	}
+	ttl, err := strconv.Atoi(string(ctx.QueryArgs().Peek("ttl")))
+	if err != nil || ttl < 0 {
+		ctx.Error("Invalid ttl", fasthttp.StatusBadRequest)
+		return
+	}
+
+	reqCtx, cancel := router.requestContext()
+	defer cancel()
+
+	err = router.Ingestion.SubmitTouch(reqCtx, key, ttl)
+	if errors.Is(err, agents.ErrKeyNotFound) {
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+		return
+	} else if err != nil {
+		writeIngestionError(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
@@ -2,11 +2,33 @@ package cache
 
 import (
 	"container/list"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// cacheShardCount is the most shards a cache is split into. Each shard has
+// its own lock, so parallel lookups of different keys rarely contend.
+const cacheShardCount = 16
+
+// minimumShardCapacityCount keeps small caches in fewer shards: splitting a
+// handful of entries would make eviction order depend on key hashes.
+const minimumShardCapacityCount = 64
+
+// LruCache is a key cache split into shards by key hash, each evicting its
+// own least recently used entries once it holds its share of the capacity
+// or, when MaxBytes is set, once its keys and values exceed MaxBytes/N bytes.
 type LruCache struct {
-	CapacityCount int
+	MaxBytes      int
+	capacityCount atomic.Int64
+	shards        []*lruShard
+}
+
+type lruShard struct {
+	capacityCount int
+	maxBytes      int
+	sizeInBytes   int
 	evictionList  *list.List
 	itemsMap      map[string]*list.Element
 	mutex         sync.Mutex
@@ -15,74 +37,182 @@ type LruCache struct {
 type cacheEntry struct {
 	key   string
 	value []byte
+	// expiryTimestamp is the entry's expiry in Unix nanoseconds, 0 for none.
+	expiryTimestamp int64
+}
+
+func (e *cacheEntry) isExpiredAt(nowUnixNano int64) bool {
+	return e.expiryTimestamp > 0 && nowUnixNano > e.expiryTimestamp
+}
+
+func (e *cacheEntry) sizeInBytes() int {
+	return len(e.key) + len(e.value)
+}
+
+// NewLruCache returns a cache holding at most capacityCount entries and, if
+// maxBytes is positive, at most maxBytes of keys and values.
+func NewLruCache(capacityCount, maxBytes int) *LruCache {
+	shards := cacheShardCount
+	for shards > 1 && capacityCount/shards < minimumShardCapacityCount {
+		shards /= 2
+	}
+	return newShardedLruCache(capacityCount, maxBytes, shards)
+}
+
+func newShardedLruCache(capacityCount, maxBytes, shardCount int) *LruCache {
+	c := &LruCache{MaxBytes: maxBytes, shards: make([]*lruShard, shardCount)}
+	c.capacityCount.Store(int64(capacityCount))
+	for i := range c.shards {
+		c.shards[i] = &lruShard{
+			capacityCount: shardCapacityCount(capacityCount, shardCount, i),
+			maxBytes:      maxBytes / shardCount,
+			evictionList:  list.New(),
+			itemsMap:      make(map[string]*list.Element),
+		}
+	}
+	return c
+}
+
+// shardCapacityCount is shard's share of capacityCount: an even split, the
+// first shards taking the remainder. A shard of a non-empty cache always
+// holds at least one entry, so a capacity below the shard count still
+// caches keys in every shard.
+func shardCapacityCount(capacityCount, shardCount, shard int) int {
+	share := capacityCount / shardCount
+	if shard < capacityCount%shardCount {
+		share++
+	}
+	if share == 0 && capacityCount > 0 {
+		share = 1
+	}
+	return share
 }
 
-func NewLruCache(capacity int) *LruCache {
-	return &LruCache{
-		CapacityCount: capacity,
-		evictionList:  list.New(),
-		itemsMap:      make(map[string]*list.Element),
+func (c *LruCache) shardFor(key string) *lruShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
 	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
 }
 
+// RetrieveFromCache returns the cached value for key. An entry past its
+// expiry is evicted and reported as a miss.
 func (c *LruCache) RetrieveFromCache(key string) ([]byte, bool) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	element, exists := c.itemsMap[key]
+	element, exists := s.itemsMap[key]
 	if !exists {
 		return nil, false
 	}
 
-	c.evictionList.MoveToFront(element)
 	entry := element.Value.(*cacheEntry)
+	if entry.isExpiredAt(time.Now().UnixNano()) {
+		s.removeElement(element)
+		return nil, false
+	}
+
+	s.evictionList.MoveToFront(element)
 	return entry.value, true
 }
 
-func (c *LruCache) InsertIntoCache(key string, value []byte) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// InsertIntoCache caches value for key until expiryTimestamp, in Unix
+// nanoseconds; 0 means it never expires.
+func (c *LruCache) InsertIntoCache(key string, value []byte, expiryTimestamp int64) {
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, exists := s.itemsMap[key]; exists {
+		s.updateExistingEntry(element, value, expiryTimestamp)
+	} else {
+		s.addNewEntry(key, value, expiryTimestamp)
+	}
+	s.enforceCapacity()
+}
+
+func (c *LruCache) RemoveFromCache(key string) {
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, exists := s.itemsMap[key]; exists {
+		s.removeElement(element)
+	}
+}
 
-	if element, exists := c.itemsMap[key]; exists {
-		c.updateExistingEntry(element, value)
-		return
+// Len returns the number of cached keys.
+func (c *LruCache) Len() int {
+	total := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		total += s.evictionList.Len()
+		s.mutex.Unlock()
 	}
+	return total
+}
 
-	c.addNewEntry(key, value)
-	c.enforceCapacity()
+// CapacityCount returns the most entries the cache holds.
+func (c *LruCache) CapacityCount() int {
+	return int(c.capacityCount.Load())
 }
 
-func (c *LruCache) RemoveFromCache(key string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// Resize changes the entry capacity, evicting least recently used entries
+// from any shard left over its share. The shard count stays as it was
+// built, so below it the cache holds up to one entry per shard.
+func (c *LruCache) Resize(capacityCount int) {
+	c.capacityCount.Store(int64(capacityCount))
+	for i, s := range c.shards {
+		s.mutex.Lock()
+		s.capacityCount = shardCapacityCount(capacityCount, len(c.shards), i)
+		s.enforceCapacity()
+		s.mutex.Unlock()
+	}
+}
 
-	if element, exists := c.itemsMap[key]; exists {
-		c.evictionList.Remove(element)
-		delete(c.itemsMap, key)
+// SizeInBytes returns the summed length of every cached key and value.
+func (c *LruCache) SizeInBytes() int {
+	total := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		total += s.sizeInBytes
+		s.mutex.Unlock()
 	}
+	return total
 }
 
-func (c *LruCache) updateExistingEntry(element *list.Element, value []byte) {
-	c.evictionList.MoveToFront(element)
+func (s *lruShard) updateExistingEntry(element *list.Element, value []byte, expiryTimestamp int64) {
+	s.evictionList.MoveToFront(element)
 	entry := element.Value.(*cacheEntry)
+	s.sizeInBytes += len(value) - len(entry.value)
 	entry.value = value
+	entry.expiryTimestamp = expiryTimestamp
 }
 
-func (c *LruCache) addNewEntry(key string, value []byte) {
-	newEntry := &cacheEntry{key, value}
-	element := c.evictionList.PushFront(newEntry)
-	c.itemsMap[key] = element
+func (s *lruShard) addNewEntry(key string, value []byte, expiryTimestamp int64) {
+	newEntry := &cacheEntry{key, value, expiryTimestamp}
+	element := s.evictionList.PushFront(newEntry)
+	s.itemsMap[key] = element
+	s.sizeInBytes += newEntry.sizeInBytes()
 }
 
-func (c *LruCache) enforceCapacity() {
-	if c.evictionList.Len() <= c.CapacityCount {
-		return
-	}
+func (s *lruShard) removeElement(element *list.Element) {
+	entry := s.evictionList.Remove(element).(*cacheEntry)
+	delete(s.itemsMap, entry.key)
+	s.sizeInBytes -= entry.sizeInBytes()
+}
 
-	oldestElement := c.evictionList.Back()
-	if oldestElement != nil {
-		c.evictionList.Remove(oldestElement)
-		entry := oldestElement.Value.(*cacheEntry)
-		delete(c.itemsMap, entry.key)
+// enforceCapacity evicts from the back until the shard is within both its
+// entry count and, if set, its byte budget.
+func (s *lruShard) enforceCapacity() {
+	for s.evictionList.Len() > 0 && s.isOverCapacity() {
+		s.removeElement(s.evictionList.Back())
 	}
 }
+
+func (s *lruShard) isOverCapacity() bool {
+	return s.evictionList.Len() > s.capacityCount || (s.maxBytes > 0 && s.sizeInBytes > s.maxBytes)
+}
@@ -1,29 +1,31 @@
 package cache
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestLruCache_AllOps(t *testing.T) {
-	c := NewLruCache(2)
+	c := NewLruCache(2, 0)
 
 	// Insert
-	c.InsertIntoCache("k1", []byte("v1"))
+	c.InsertIntoCache("k1", []byte("v1"), 0)
 	val, ok := c.RetrieveFromCache("k1")
 	if !ok || string(val) != "v1" {
 		t.Error("Insert/Retrieve failed")
 	}
 
 	// Update
-	c.InsertIntoCache("k1", []byte("v1_updated"))
+	c.InsertIntoCache("k1", []byte("v1_updated"), 0)
 	val, _ = c.RetrieveFromCache("k1")
 	if string(val) != "v1_updated" {
 		t.Error("Update failed")
 	}
 
 	// Eviction
-	c.InsertIntoCache("k2", []byte("v2"))
-	c.InsertIntoCache("k3", []byte("v3")) // Should evict k1 (LRU) since we accessed it last before k2? No, we updated k1. k1 is MRU.
+	c.InsertIntoCache("k2", []byte("v2"), 0)
+	c.InsertIntoCache("k3", []byte("v3"), 0) // Should evict k1 (LRU) since we accessed it last before k2? No, we updated k1. k1 is MRU.
 	// Wait, InsertIntoCache moves to front.
 	// Sequence:
 	// 1. Insert k1 (Front: k1)
@@ -51,13 +53,150 @@ func TestLruCache_AllOps(t *testing.T) {
 }
 
 func TestLruCache_EdgeCases(t *testing.T) {
-	c := NewLruCache(1)
+	c := NewLruCache(1, 0)
 	c.RemoveFromCache("missing") // Should not panic
 
-	c.InsertIntoCache("k1", []byte("v1"))
-	c.InsertIntoCache("k2", []byte("v2")) // Trigger eviction with capacity 1
+	c.InsertIntoCache("k1", []byte("v1"), 0)
+	c.InsertIntoCache("k2", []byte("v2"), 0) // Trigger eviction with capacity 1
 
 	if _, ok := c.RetrieveFromCache("k1"); ok {
 		t.Error("k1 should be evicted")
 	}
 }
+
+func TestLruCache_ExpiredEntryIsAMiss(t *testing.T) {
+	c := NewLruCache(10, 0)
+	c.InsertIntoCache("live", []byte("v"), time.Now().Add(time.Hour).UnixNano())
+	c.InsertIntoCache("expired", []byte("v"), time.Now().Add(-time.Second).UnixNano())
+
+	if _, ok := c.RetrieveFromCache("live"); !ok {
+		t.Error("Live entry missing")
+	}
+	if _, ok := c.RetrieveFromCache("expired"); ok {
+		t.Error("Expired entry served")
+	}
+	if c.Len() != 1 {
+		t.Errorf("Expected the expired entry evicted, %d entries left", c.Len())
+	}
+}
+
+func TestLruCache_ShardsBoundTotalCapacity(t *testing.T) {
+	c := NewLruCache(4096, 0)
+	if len(c.shards) != cacheShardCount {
+		t.Fatalf("Expected %d shards, got %d", cacheShardCount, len(c.shards))
+	}
+	if small := NewLruCache(100, 0); len(small.shards) != 1 {
+		t.Errorf("Expected a small cache in one shard, got %d", len(small.shards))
+	}
+
+	for i := 0; i < 10000; i++ {
+		c.InsertIntoCache(fmt.Sprintf("key%d", i), []byte("v"), 0)
+	}
+	if n := c.Len(); n > c.CapacityCount() || n < c.CapacityCount()*3/4 {
+		t.Errorf("Expected close to %d entries, got %d", c.CapacityCount(), n)
+	}
+	if _, ok := c.RetrieveFromCache("key9999"); !ok {
+		t.Error("Most recent key evicted")
+	}
+}
+
+func TestLruCache_ResizeEvictsOldest(t *testing.T) {
+	c := NewLruCache(10, 0)
+	for i := 0; i < 10; i++ {
+		c.InsertIntoCache(fmt.Sprintf("k%d", i), []byte("v"), 0)
+	}
+
+	c.Resize(4)
+	if c.Len() != 4 || c.CapacityCount() != 4 {
+		t.Fatalf("Expected 4 entries and capacity 4, got %d and %d", c.Len(), c.CapacityCount())
+	}
+	if _, ok := c.RetrieveFromCache("k5"); ok {
+		t.Error("Expected older entries to be evicted")
+	}
+	if _, ok := c.RetrieveFromCache("k9"); !ok {
+		t.Error("Most recent key evicted")
+	}
+
+	c.Resize(20)
+	for i := 10; i < 20; i++ {
+		c.InsertIntoCache(fmt.Sprintf("k%d", i), []byte("v"), 0)
+	}
+	if c.Len() != 14 {
+		t.Errorf("Expected the grown cache to keep 14 entries, got %d", c.Len())
+	}
+}
+
+func TestLruCache_ResizeBelowShardCountKeepsCaching(t *testing.T) {
+	c := NewLruCache(4096, 0)
+	c.Resize(4)
+	if c.CapacityCount() != 4 {
+		t.Fatalf("Expected capacity 4, got %d", c.CapacityCount())
+	}
+
+	for i := 0; i < 1000; i++ {
+		c.InsertIntoCache(fmt.Sprintf("key%d", i), []byte("v"), 0)
+	}
+	if n := c.Len(); n == 0 || n > cacheShardCount {
+		t.Errorf("Expected between 1 and %d entries, got %d", cacheShardCount, n)
+	}
+	if _, ok := c.RetrieveFromCache("key999"); !ok {
+		t.Error("Most recent key evicted")
+	}
+}
+
+func TestLruCache_ByteBudgetEvictsLargeValues(t *testing.T) {
+	c := NewLruCache(100, 1000)
+	for i := 0; i < 5; i++ {
+		c.InsertIntoCache(fmt.Sprintf("k%d", i), make([]byte, 300), 0)
+	}
+	if n := c.SizeInBytes(); n > c.MaxBytes {
+		t.Fatalf("Expected at most %d bytes cached, got %d", c.MaxBytes, n)
+	}
+	if c.Len() != 3 {
+		t.Errorf("Expected 3 entries within the budget, got %d", c.Len())
+	}
+	if _, ok := c.RetrieveFromCache("k0"); ok {
+		t.Error("Oldest entry should be evicted")
+	}
+
+	// Growing a value in place also evicts from the back
+	c.InsertIntoCache("k4", make([]byte, 900), 0)
+	if c.Len() != 1 || c.SizeInBytes() != len("k4")+900 {
+		t.Errorf("Expected only k4 left, got %d entries and %d bytes", c.Len(), c.SizeInBytes())
+	}
+
+	c.RemoveFromCache("k4")
+	if c.SizeInBytes() != 0 {
+		t.Errorf("Expected an empty cache to hold 0 bytes, got %d", c.SizeInBytes())
+	}
+}
+
+// BenchmarkLruCache_Parallel compares one lock against the sharded cache
+// under a read-heavy parallel workload.
+func BenchmarkLruCache_Parallel(b *testing.B) {
+	const keys = 10000
+	for _, shards := range []int{1, cacheShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := newShardedLruCache(keys*2, 0, shards)
+			names := make([]string, keys)
+			for i := range names {
+				names[i] = fmt.Sprintf("key%d", i)
+				c.InsertIntoCache(names[i], []byte("value"), 0)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := names[i%keys]
+					if i%10 == 0 {
+						c.InsertIntoCache(key, []byte("value"), 0)
+					} else {
+						c.RetrieveFromCache(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NegativeCache remembers keys a lookup found nowhere, for a short TTL, so
+// repeated probes for absent keys skip the memtables and SSTables.
+//
+// A lookup that misses races with writes of the same key, so it records the
+// write generation before searching and RememberMissing drops the result if
+// any write was invalidated since.
+type NegativeCache struct {
+	entries    *LruCache
+	ttl        time.Duration
+	generation atomic.Uint64
+	mutex      sync.Mutex
+}
+
+func NewNegativeCache(capacityCount int, ttl time.Duration) *NegativeCache {
+	return &NegativeCache{entries: NewLruCache(capacityCount, 0), ttl: ttl}
+}
+
+// Generation returns the write generation to pass to RememberMissing.
+func (c *NegativeCache) Generation() uint64 {
+	return c.generation.Load()
+}
+
+// Contains reports whether key was recently found missing.
+func (c *NegativeCache) Contains(key string) bool {
+	_, hit := c.entries.RetrieveFromCache(key)
+	return hit
+}
+
+// RememberMissing records key as absent, unless a write has been
+// invalidated since generation was read.
+func (c *NegativeCache) RememberMissing(key string, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generation.Load() != generation {
+		return
+	}
+	c.entries.InsertIntoCache(key, nil, time.Now().Add(c.ttl).UnixNano())
+}
+
+// Invalidate forgets keys after they are written.
+func (c *NegativeCache) Invalidate(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation.Add(1)
+	for _, key := range keys {
+		c.entries.RemoveFromCache(key)
+	}
+}
+
+// Len returns the number of keys remembered as missing.
+func (c *NegativeCache) Len() int {
+	return c.entries.Len()
+}
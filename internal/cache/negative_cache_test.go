@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegativeCache_WriteDuringLookupIsNotRemembered(t *testing.T) {
+	c := NewNegativeCache(10, time.Minute)
+
+	generation := c.Generation()
+	c.RememberMissing("k1", generation)
+	if !c.Contains("k1") {
+		t.Fatal("Missing key not remembered")
+	}
+
+	// A write lands between the lookup starting and it recording the miss
+	generation = c.Generation()
+	c.Invalidate("k1", "k2")
+	c.RememberMissing("k2", generation)
+	if c.Contains("k1") || c.Contains("k2") {
+		t.Error("Written keys still reported missing")
+	}
+}
+
+func TestNegativeCache_EntriesExpire(t *testing.T) {
+	c := NewNegativeCache(10, time.Millisecond)
+	c.RememberMissing("k1", c.Generation())
+	time.Sleep(5 * time.Millisecond)
+	if c.Contains("k1") {
+		t.Error("Expired miss still remembered")
+	}
+}
@@ -0,0 +1,22 @@
+package common
+
+import "encoding/binary"
+
+// CounterSizeInBytes is the width of a fixed-width counter value.
+const CounterSizeInBytes = 8
+
+// EncodeCounter stores n as a little-endian int64, so increments never have
+// to parse or format decimal strings.
+func EncodeCounter(n int64) []byte {
+	buf := make([]byte, CounterSizeInBytes)
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+	return buf
+}
+
+// DecodeCounter is the inverse of EncodeCounter.
+func DecodeCounter(value []byte) (int64, bool) {
+	if len(value) != CounterSizeInBytes {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(value)), true
+}
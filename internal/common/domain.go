@@ -5,6 +5,16 @@ type Entry struct {
 	Value           []byte
 	ExpiryTimestamp int64
 	IsDeleted       bool
+	// IsCounter marks a value holding a fixed-width counter (see EncodeCounter).
+	IsCounter bool
+	// Sequence orders writes: every ingested entry gets a higher one than
+	// any before it. Zero marks an entry written before sequences existed.
+	Sequence uint64
+}
+
+// IsExpiredAt reports whether the entry's TTL has passed at the given time.
+func (e Entry) IsExpiredAt(nowUnixNano int64) bool {
+	return e.ExpiryTimestamp > 0 && nowUnixNano > e.ExpiryTimestamp
 }
 
 type BloomFilter interface {
@@ -14,14 +24,21 @@ type BloomFilter interface {
 
 type WriteAheadLog interface {
 	WriteBatch(entries []Entry) error
+	Sync() error
 	Replay(callback func(Entry)) error
 	Close() error
 	Delete() error
+	SizeInBytes() int64
 }
 
 type KeyValueStore interface {
 	Put(key string, value []byte, expiry int64, isDeleted bool)
+	PutEntry(e Entry)
+	// PutEntries applies entries atomically with respect to GetAll
+	PutEntries(entries []Entry)
 	Get(key string) (Entry, bool)
 	GetAll() []Entry
 	Size() int64
+	// Len counts the stored entries, tombstones included
+	Len() int
 }
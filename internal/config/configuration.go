@@ -11,26 +11,87 @@ const ConfigurationTemplate = `{
   "write_ahead_log_file_path": "./data/wal.log",
   "log_directory_path": "./logs",
   "server_port": 8080,
+  "request_timeout_in_milliseconds": 10000,
+  "server_read_timeout_in_milliseconds": 0,
+  "server_write_timeout_in_milliseconds": 0,
+  "server_idle_timeout_in_milliseconds": 0,
+  "server_maximum_connections_per_ip": 0,
+  "server_tcp_keepalive_enabled": false,
+  "server_tcp_keepalive_period_in_seconds": 0,
   "maximum_memtable_size_in_bytes": 67108864,
+  "maximum_wal_size_in_bytes": 0,
   "level_zero_compaction_trigger_count": 4,
   "sstable_block_size_in_bytes": 4096,
+  "sstable_value_compression_threshold_in_bytes": 0,
+  "sstable_partition_count": 0,
+  "sstable_mapped_reader_count": 0,
+  "sstable_open_file_count": 256,
+  "sstable_compression": "",
+  "wal_sync_mode": "always",
+  "wal_sync_interval_in_milliseconds": 100,
+  "memtable_implementation": "sharded",
+  "restore_from_path": "",
+  "maximum_immutable_memtable_count": 0,
+  "ingestion_queue_timeout_in_milliseconds": 0,
+  "ingestion_shard_count": 0,
+  "memtable_shard_count": 0,
+  "grpc_port": 0,
+  "resp_port": 0,
+  "http_compression_enabled": false,
+  "allowed_origins": [],
+  "log_format": "text",
+  "log_max_backups": 10,
+  "log_max_age_hours": 0,
+  "disk_usage_interval_in_seconds": 30,
   "bloom_filter_false_positive_rate": 0.01,
+  "bloom_filter_disabled_levels": [],
   "compaction_interval_in_seconds": 5,
+  "compaction_concurrency": 1,
+  "flush_concurrency": 1,
+  "ttl_reclamation_interval_in_seconds": 60,
+  "ttl_reclamation_expired_ratio": 0.5,
+  "memtable_ttl_sweep_interval_in_seconds": 0,
+  "checkpoint_interval_in_seconds": 0,
+  "interval_jitter_percent": 10,
   "authentication_secret": "CHANGE_ME",
+  "admin_token_ttl_in_hours": 24,
+  "admin_token_subject": "admin",
+  "admin_token_output_file": "",
   "enable_disk_durability": true,
+  "in_memory_only": false,
   "maximum_cpu_count": 0,
   "maximum_system_memory_in_bytes": 0,
+  "garbage_collection_percent": 200,
   "enable_pprof_profiling": false,
   "key_cache_capacity_count": 40000,
-  "log_severity_level": "INFO"
+  "key_cache_max_bytes": 0,
+  "negative_cache_ttl_in_milliseconds": 0,
+  "negative_cache_capacity_count": 10000,
+  "log_severity_level": "INFO",
+  "log_to_console": true
 }`
 
 const (
-	DefaultServerPort                   = 8080
-	DefaultMaximumMemtableSizeInBytes   = 64 * 1024 * 1024
-	DefaultKeyCacheCapacityCount        = 40000
-	DefaultCompactionIntervalInSeconds  = 5
-	DefaultBloomFilterFalsePositiveRate = 0.01
+	DefaultServerPort                    = 8080
+	DefaultLogMaxBackups                 = 10
+	DefaultDiskUsageIntervalInSeconds    = 30
+	DefaultMaximumMemtableSizeInBytes    = 64 * 1024 * 1024
+	DefaultSSTableBlockSizeInBytes       = 4096
+	DefaultKeyCacheCapacityCount         = 40000
+	DefaultCompactionIntervalInSeconds   = 5
+	DefaultCompactionConcurrency         = 1
+	DefaultFlushConcurrency              = 1
+	DefaultNegativeCacheCapacityCount    = 10000
+	DefaultBloomFilterFalsePositiveRate  = 0.01
+	DefaultGarbageCollectionPercent      = 200
+	DefaultTtlReclamationInterval        = 60
+	DefaultTtlReclamationExpiredRatio    = 0.5
+	DefaultRequestTimeoutInMilliseconds  = 10000
+	DefaultIntervalJitterPercent         = 10
+	DefaultAdminTokenTtlInHours          = 24
+	DefaultAdminTokenSubject             = "admin"
+	DefaultWalSyncIntervalInMilliseconds = 100
+	DefaultSSTableOpenFileCount          = 256
 )
 
 type SystemConfiguration struct {
@@ -51,17 +112,137 @@ type SystemConfiguration struct {
 	EnablePprofProfiling            bool    `json:"enable_pprof_profiling"`
 	LogSeverityLevel                string  `json:"log_severity_level"`
 	KeyCacheCapacityCount           int     `json:"key_cache_capacity_count"`
+
+	// Values of at least this size are snappy-compressed inside SSTables (0 disables)
+	SSTableValueCompressionThresholdInBytes int `json:"sstable_value_compression_threshold_in_bytes"`
+
+	// Echo log lines to stdout as well as the log file
+	LogToConsole bool `json:"log_to_console"`
+
+	// Start a new WAL segment once the active one reaches this size, without rotating the memtable;
+	// segments are deleted once the memtable holding their writes is flushed (0 disables)
+	MaximumWalSizeInBytes int64 `json:"maximum_wal_size_in_bytes"`
+
+	// GOGC value applied at startup (-1 disables the collector, 0 uses the default)
+	GarbageCollectionPercent int `json:"garbage_collection_percent"`
+
+	// Rewrite SSTables whose sampled share of expired entries reaches the ratio (0 interval disables)
+	TtlReclamationIntervalInSeconds int     `json:"ttl_reclamation_interval_in_seconds"`
+	TtlReclamationExpiredRatio      float64 `json:"ttl_reclamation_expired_ratio"`
+
+	// Upper bound for reading, handling and writing one HTTP request (0 disables)
+	RequestTimeoutInMilliseconds int `json:"request_timeout_in_milliseconds"`
+
+	// HTTP connection tuning; read/write timeouts fall back to the request timeout when 0
+	ServerReadTimeoutInMilliseconds   int  `json:"server_read_timeout_in_milliseconds"`
+	ServerWriteTimeoutInMilliseconds  int  `json:"server_write_timeout_in_milliseconds"`
+	ServerIdleTimeoutInMilliseconds   int  `json:"server_idle_timeout_in_milliseconds"`
+	ServerMaximumConnectionsPerIp     int  `json:"server_maximum_connections_per_ip"`
+	ServerTcpKeepaliveEnabled         bool `json:"server_tcp_keepalive_enabled"`
+	ServerTcpKeepalivePeriodInSeconds int  `json:"server_tcp_keepalive_period_in_seconds"`
+
+	// Flush all immutable memtables and drop their frozen WALs on this interval (0 disables)
+	CheckpointIntervalInSeconds int `json:"checkpoint_interval_in_seconds"`
+
+	// Split each flush into this many SSTables by key hash (0 or 1 disables)
+	SSTablePartitionCount int `json:"sstable_partition_count"`
+
+	// Randomise each compaction, TTL reclamation and checkpoint interval by up to ±this percent
+	IntervalJitterPercent int `json:"interval_jitter_percent"`
+
+	// Keep all data in the memtable, evicting least recently used entries when full; nothing touches disk
+	InMemoryOnly bool `json:"in_memory_only"`
+
+	// SSTable levels written without bloom filters, e.g. [0] where tables are small and hot
+	BloomFilterDisabledLevels []int `json:"bloom_filter_disabled_levels"`
+
+	// Startup admin token; written to the output file (mode 0600) instead of stdout when set
+	AdminTokenTtlInHours int    `json:"admin_token_ttl_in_hours"`
+	AdminTokenSubject    string `json:"admin_token_subject"`
+	AdminTokenOutputFile string `json:"admin_token_output_file"`
+
+	// Compaction workers; jobs over overlapping key ranges never run together (0 or 1 runs one at a time)
+	CompactionConcurrency int `json:"compaction_concurrency"`
+
+	// Flush workers, each writing a different immutable memtable (0 or 1 flushes one at a time)
+	FlushConcurrency int `json:"flush_concurrency"`
+
+	// Key cache budget for the summed bytes of cached keys and values, on top of the entry count (0 means no limit)
+	KeyCacheMaxBytes int `json:"key_cache_max_bytes"`
+
+	// Remember keys a GET found nowhere for this long, skipping the search on repeat probes (0 disables)
+	NegativeCacheTtlInMilliseconds int `json:"negative_cache_ttl_in_milliseconds"`
+	NegativeCacheCapacityCount     int `json:"negative_cache_capacity_count"`
+
+	// Sweep expired entries out of the active memtable on this interval (0 disables)
+	MemtableTtlSweepIntervalInSeconds int `json:"memtable_ttl_sweep_interval_in_seconds"`
+
+	// Keep up to this many SSTables memory-mapped for point lookups instead of opening them per read (0 disables)
+	SSTableMappedReaderCount int `json:"sstable_mapped_reader_count"`
+
+	// Keep up to this many more SSTable files open for point lookups, so reads do not open a file each (0 opens one per read)
+	SSTableOpenFileCount int `json:"sstable_open_file_count"`
+
+	// SSTable value codec: "none", or "snappy" for every value that shrinks (the threshold above still applies when set); empty uses the threshold alone
+	SSTableCompression string `json:"sstable_compression"`
+
+	// When WAL writes reach stable storage: "always" before each batch is acknowledged (empty means always),
+	// "interval" on a timer, losing up to one interval of acknowledged writes on power loss, or "never",
+	// leaving it to the OS (a process crash loses nothing either way; fsync only guards against the machine going down)
+	WalSyncMode                   string `json:"wal_sync_mode"`
+	WalSyncIntervalInMilliseconds int    `json:"wal_sync_interval_in_milliseconds"`
+
+	// "sharded" (hash-sharded maps, fastest point reads and writes) or "skiplist" (sorted, so flushes and scans skip sorting)
+	MemtableImplementation string `json:"memtable_implementation"`
+
+	// Snapshot directory to copy into the data directory before starting; refused once the data directory holds a store, so clear it after the restore
+	RestoreFromPath string `json:"restore_from_path"`
+
+	// Stall writers that would rotate the memtable while this many memtables await a flush, until one is flushed (0 means no limit)
+	MaximumImmutableMemtableCount int `json:"maximum_immutable_memtable_count"`
+
+	// Fail a write as overloaded once its shard queue has stayed full this long (0 waits as long as the request allows)
+	IngestionQueueTimeoutInMilliseconds int `json:"ingestion_queue_timeout_in_milliseconds"`
+
+	// Writer goroutines; each key is always applied by the same one, so writes to one key stay ordered (0 means maximum_cpu_count, or the CPU count)
+	IngestionShardCount int `json:"ingestion_shard_count"`
+	// Lock shards of the sharded memtable, routed by their own key hash independently of the ingestion shards (0 means 32)
+	MemtableShardCount int `json:"memtable_shard_count"`
+
+	// Port of the gRPC KeyValue service, served alongside HTTP from the same store (0 disables it)
+	GrpcPort int `json:"grpc_port"`
+	// Port of the Redis protocol (RESP2) listener for GET, SET, DEL, EXISTS and MGET (0 disables it)
+	RespPort int `json:"resp_port"`
+
+	// Gzip /get, /mget and /scan responses for clients sending Accept-Encoding: gzip, and accept gzipped JSON request bodies
+	HttpCompressionEnabled bool `json:"http_compression_enabled"`
+
+	// Browser origins allowed to call the HTTP API cross-origin, e.g. "https://app.example.com", or "*" for any (empty disables CORS)
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	// "text" (timestamp, prefix and message per line) or "json" (one object per line with ts, level and msg, plus method, path, remote and duration_ms for access logs)
+	LogFormat string `json:"log_format"`
+
+	// Rotated system.log.<nanos> files to keep; older ones are deleted after each rotation (0 keeps all)
+	LogMaxBackups int `json:"log_max_backups"`
+	// Delete rotated logs older than this after each rotation (0 keeps them regardless of age)
+	LogMaxAgeHours int `json:"log_max_age_hours"`
+
+	// How often the SSTables' total size and count are refreshed in /metrics (0 disables it)
+	DiskUsageIntervalInSeconds int `json:"disk_usage_interval_in_seconds"`
 }
 
-func LoadConfigurationFromFile(filePath string) (SystemConfiguration, error) {
-	config := SystemConfiguration{
+// DefaultConfiguration returns the settings used for every value a
+// configuration file leaves out.
+func DefaultConfiguration() SystemConfiguration {
+	return SystemConfiguration{
 		DataDirectoryPath:               "./data",
 		WriteAheadLogFilePath:           "./data/wal.log",
 		LogDirectoryPath:                "./logs",
 		ServerPort:                      DefaultServerPort,
 		MaximumMemtableSizeInBytes:      DefaultMaximumMemtableSizeInBytes,
 		LevelZeroCompactionTriggerCount: 4,
-		SSTableBlockSizeInBytes:         4096,
+		SSTableBlockSizeInBytes:         DefaultSSTableBlockSizeInBytes,
 		BloomFilterFalsePositiveRate:    DefaultBloomFilterFalsePositiveRate,
 		CompactionIntervalInSeconds:     DefaultCompactionIntervalInSeconds,
 		AuthenticationSecret:            "DEFAULT_SECRET_CHANGE_ME_IN_PROD",
@@ -71,8 +252,26 @@ func LoadConfigurationFromFile(filePath string) (SystemConfiguration, error) {
 		EnablePprofProfiling:            false,
 		LogSeverityLevel:                "INFO",
 		KeyCacheCapacityCount:           DefaultKeyCacheCapacityCount,
+		LogToConsole:                    true,
+		GarbageCollectionPercent:        DefaultGarbageCollectionPercent,
+		TtlReclamationIntervalInSeconds: DefaultTtlReclamationInterval,
+		TtlReclamationExpiredRatio:      DefaultTtlReclamationExpiredRatio,
+		RequestTimeoutInMilliseconds:    DefaultRequestTimeoutInMilliseconds,
+		IntervalJitterPercent:           DefaultIntervalJitterPercent,
+		AdminTokenTtlInHours:            DefaultAdminTokenTtlInHours,
+		AdminTokenSubject:               DefaultAdminTokenSubject,
+		CompactionConcurrency:           DefaultCompactionConcurrency,
+		FlushConcurrency:                DefaultFlushConcurrency,
+		NegativeCacheCapacityCount:      DefaultNegativeCacheCapacityCount,
+		WalSyncIntervalInMilliseconds:   DefaultWalSyncIntervalInMilliseconds,
+		LogMaxBackups:                   DefaultLogMaxBackups,
+		DiskUsageIntervalInSeconds:      DefaultDiskUsageIntervalInSeconds,
+		SSTableOpenFileCount:            DefaultSSTableOpenFileCount,
 	}
+}
 
+func LoadConfigurationFromFile(filePath string) (SystemConfiguration, error) {
+	config := DefaultConfiguration()
 	if filePath != "" {
 		file, err := os.Open(filePath)
 		if err != nil {
@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -18,6 +19,12 @@ func TestLoadConfigurationDefaults(t *testing.T) {
 	if config.KeyCacheCapacityCount != 40000 {
 		t.Errorf("Expected default cache capacity 40000, got %d", config.KeyCacheCapacityCount)
 	}
+	if !config.LogToConsole {
+		t.Error("Expected console logging enabled by default")
+	}
+	if config.GarbageCollectionPercent != DefaultGarbageCollectionPercent {
+		t.Errorf("Expected default GC percent %d, got %d", DefaultGarbageCollectionPercent, config.GarbageCollectionPercent)
+	}
 }
 
 func TestLoadConfigurationFromFile(t *testing.T) {
@@ -44,3 +51,93 @@ func TestLoadConfigurationFromFile(t *testing.T) {
 		t.Errorf("Expected log level DEBUG, got %s", config.LogSeverityLevel)
 	}
 }
+
+func TestValidateAcceptsDefaults(t *testing.T) {
+	config, err := LoadConfigurationFromFile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected the defaults to validate, got %v", err)
+	}
+}
+
+func TestValidateSubstitutesDefaults(t *testing.T) {
+	config, _ := LoadConfigurationFromFile("")
+	config.LogSeverityLevel = ""
+	config.LogFormat = ""
+	config.SSTableBlockSizeInBytes = 0
+	config.BloomFilterFalsePositiveRate = 0
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected unset values to be forgiven, got %v", err)
+	}
+	if config.LogSeverityLevel != "INFO" || config.LogFormat != "text" {
+		t.Errorf("Expected INFO and text, got %q and %q", config.LogSeverityLevel, config.LogFormat)
+	}
+	if config.SSTableBlockSizeInBytes != DefaultSSTableBlockSizeInBytes {
+		t.Errorf("Expected block size %d, got %d", DefaultSSTableBlockSizeInBytes, config.SSTableBlockSizeInBytes)
+	}
+	if config.BloomFilterFalsePositiveRate != DefaultBloomFilterFalsePositiveRate {
+		t.Errorf("Expected false positive rate %v, got %v", DefaultBloomFilterFalsePositiveRate, config.BloomFilterFalsePositiveRate)
+	}
+}
+
+func TestValidateRejectsInvalidFields(t *testing.T) {
+	cases := []struct {
+		field  string
+		modify func(*SystemConfiguration)
+	}{
+		{"maximum_memtable_size_in_bytes", func(c *SystemConfiguration) { c.MaximumMemtableSizeInBytes = 0 }},
+		{"maximum_memtable_size_in_bytes", func(c *SystemConfiguration) { c.MaximumMemtableSizeInBytes = -1 }},
+		{"level_zero_compaction_trigger_count", func(c *SystemConfiguration) { c.LevelZeroCompactionTriggerCount = 0 }},
+		{"sstable_block_size_in_bytes", func(c *SystemConfiguration) { c.SSTableBlockSizeInBytes = -4096 }},
+		{"bloom_filter_false_positive_rate", func(c *SystemConfiguration) { c.BloomFilterFalsePositiveRate = 2.0 }},
+		{"bloom_filter_false_positive_rate", func(c *SystemConfiguration) { c.BloomFilterFalsePositiveRate = -0.1 }},
+		{"ttl_reclamation_expired_ratio", func(c *SystemConfiguration) { c.TtlReclamationExpiredRatio = 1.5 }},
+		{"interval_jitter_percent", func(c *SystemConfiguration) { c.IntervalJitterPercent = 101 }},
+		{"garbage_collection_percent", func(c *SystemConfiguration) { c.GarbageCollectionPercent = -2 }},
+		{"log_severity_level", func(c *SystemConfiguration) { c.LogSeverityLevel = "VERBOSE" }},
+		{"log_format", func(c *SystemConfiguration) { c.LogFormat = "xml" }},
+		{"data_directory_path", func(c *SystemConfiguration) { c.DataDirectoryPath = "" }},
+		{"write_ahead_log_file_path", func(c *SystemConfiguration) { c.WriteAheadLogFilePath = "" }},
+		{"server_port", func(c *SystemConfiguration) { c.ServerPort = 0 }},
+		{"server_port", func(c *SystemConfiguration) { c.ServerPort = 70000 }},
+		{"grpc_port", func(c *SystemConfiguration) { c.GrpcPort = -1 }},
+		{"resp_port", func(c *SystemConfiguration) { c.RespPort = c.ServerPort }},
+		{"compaction_interval_in_seconds", func(c *SystemConfiguration) { c.CompactionIntervalInSeconds = -5 }},
+		{"key_cache_capacity_count", func(c *SystemConfiguration) { c.KeyCacheCapacityCount = -1 }},
+		{"log_max_backups", func(c *SystemConfiguration) { c.LogMaxBackups = -1 }},
+		{"bloom_filter_disabled_levels", func(c *SystemConfiguration) { c.BloomFilterDisabledLevels = []int{0, -1} }},
+	}
+
+	for _, tc := range cases {
+		config, _ := LoadConfigurationFromFile("")
+		tc.modify(&config)
+
+		err := config.Validate()
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", tc.field)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.field) {
+			t.Errorf("Expected the error to name %s, got %v", tc.field, err)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config, _ := LoadConfigurationFromFile("")
+	config.MaximumMemtableSizeInBytes = 0
+	config.LevelZeroCompactionTriggerCount = 0
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, field := range []string{"maximum_memtable_size_in_bytes", "level_zero_compaction_trigger_count"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected the error to name %s, got %v", field, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validate checks the configuration for values the server cannot run with,
+// returning every problem found joined into one error. A few unset values
+// that have an obvious meaning are filled in with their defaults instead:
+// an empty log_severity_level or log_format, and a zero
+// sstable_block_size_in_bytes or bloom_filter_false_positive_rate.
+func (c *SystemConfiguration) Validate() error {
+	c.substituteDefaults()
+
+	var problems []error
+	invalid := func(field string, value any, reason string) {
+		problems = append(problems, fmt.Errorf("invalid %s %v: %s", field, value, reason))
+	}
+
+	if c.MaximumMemtableSizeInBytes <= 0 {
+		invalid("maximum_memtable_size_in_bytes", c.MaximumMemtableSizeInBytes, "must be positive")
+	}
+	if c.LevelZeroCompactionTriggerCount < 1 {
+		invalid("level_zero_compaction_trigger_count", c.LevelZeroCompactionTriggerCount, "must be at least 1")
+	}
+	if c.SSTableBlockSizeInBytes < 0 {
+		invalid("sstable_block_size_in_bytes", c.SSTableBlockSizeInBytes, "must be positive")
+	}
+	if c.BloomFilterFalsePositiveRate <= 0 || c.BloomFilterFalsePositiveRate >= 1 {
+		invalid("bloom_filter_false_positive_rate", c.BloomFilterFalsePositiveRate, "must be between 0 and 1 exclusive")
+	}
+	if c.TtlReclamationExpiredRatio < 0 || c.TtlReclamationExpiredRatio > 1 {
+		invalid("ttl_reclamation_expired_ratio", c.TtlReclamationExpiredRatio, "must be between 0 and 1")
+	}
+	if c.IntervalJitterPercent < 0 || c.IntervalJitterPercent > 100 {
+		invalid("interval_jitter_percent", c.IntervalJitterPercent, "must be between 0 and 100")
+	}
+	if c.GarbageCollectionPercent < -1 {
+		invalid("garbage_collection_percent", c.GarbageCollectionPercent, "must be -1 or more")
+	}
+
+	switch strings.ToUpper(c.LogSeverityLevel) {
+	case "DEBUG", "INFO", "ERROR":
+	default:
+		invalid("log_severity_level", fmt.Sprintf("%q", c.LogSeverityLevel), "must be DEBUG, INFO or ERROR")
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		invalid("log_format", fmt.Sprintf("%q", c.LogFormat), `must be "text" or "json"`)
+	}
+
+	if !c.InMemoryOnly && c.DataDirectoryPath == "" {
+		invalid("data_directory_path", `""`, "must be set unless in_memory_only is enabled")
+	}
+	if !c.InMemoryOnly && c.EnableDiskDurability && c.WriteAheadLogFilePath == "" {
+		invalid("write_ahead_log_file_path", `""`, "must be set while enable_disk_durability is enabled")
+	}
+
+	if c.ServerPort < 1 || c.ServerPort > 65535 {
+		invalid("server_port", c.ServerPort, "must be between 1 and 65535")
+	}
+	listeners := map[int]string{c.ServerPort: "server_port"}
+	for _, port := range []struct {
+		field string
+		value int
+	}{{"grpc_port", c.GrpcPort}, {"resp_port", c.RespPort}} {
+		switch {
+		case port.value < 0 || port.value > 65535:
+			invalid(port.field, port.value, "must be between 0 and 65535")
+		case port.value == 0:
+		case listeners[port.value] != "":
+			invalid(port.field, port.value, "already used by "+listeners[port.value])
+		default:
+			listeners[port.value] = port.field
+		}
+	}
+
+	// Counts and intervals where 0 disables the feature or picks a default
+	for _, field := range []struct {
+		name  string
+		value int64
+	}{
+		{"compaction_interval_in_seconds", int64(c.CompactionIntervalInSeconds)},
+		{"key_cache_capacity_count", int64(c.KeyCacheCapacityCount)},
+		{"key_cache_max_bytes", int64(c.KeyCacheMaxBytes)},
+		{"maximum_cpu_count", int64(c.MaximumCpuCount)},
+		{"maximum_system_memory_in_bytes", c.MaximumSystemMemoryInBytes},
+		{"maximum_wal_size_in_bytes", c.MaximumWalSizeInBytes},
+		{"sstable_value_compression_threshold_in_bytes", int64(c.SSTableValueCompressionThresholdInBytes)},
+		{"sstable_partition_count", int64(c.SSTablePartitionCount)},
+		{"sstable_mapped_reader_count", int64(c.SSTableMappedReaderCount)},
+		{"sstable_open_file_count", int64(c.SSTableOpenFileCount)},
+		{"ttl_reclamation_interval_in_seconds", int64(c.TtlReclamationIntervalInSeconds)},
+		{"request_timeout_in_milliseconds", int64(c.RequestTimeoutInMilliseconds)},
+		{"server_read_timeout_in_milliseconds", int64(c.ServerReadTimeoutInMilliseconds)},
+		{"server_write_timeout_in_milliseconds", int64(c.ServerWriteTimeoutInMilliseconds)},
+		{"server_idle_timeout_in_milliseconds", int64(c.ServerIdleTimeoutInMilliseconds)},
+		{"server_maximum_connections_per_ip", int64(c.ServerMaximumConnectionsPerIp)},
+		{"server_tcp_keepalive_period_in_seconds", int64(c.ServerTcpKeepalivePeriodInSeconds)},
+		{"checkpoint_interval_in_seconds", int64(c.CheckpointIntervalInSeconds)},
+		{"admin_token_ttl_in_hours", int64(c.AdminTokenTtlInHours)},
+		{"compaction_concurrency", int64(c.CompactionConcurrency)},
+		{"flush_concurrency", int64(c.FlushConcurrency)},
+		{"negative_cache_ttl_in_milliseconds", int64(c.NegativeCacheTtlInMilliseconds)},
+		{"negative_cache_capacity_count", int64(c.NegativeCacheCapacityCount)},
+		{"memtable_ttl_sweep_interval_in_seconds", int64(c.MemtableTtlSweepIntervalInSeconds)},
+		{"wal_sync_interval_in_milliseconds", int64(c.WalSyncIntervalInMilliseconds)},
+		{"maximum_immutable_memtable_count", int64(c.MaximumImmutableMemtableCount)},
+		{"ingestion_queue_timeout_in_milliseconds", int64(c.IngestionQueueTimeoutInMilliseconds)},
+		{"ingestion_shard_count", int64(c.IngestionShardCount)},
+		{"memtable_shard_count", int64(c.MemtableShardCount)},
+		{"log_max_backups", int64(c.LogMaxBackups)},
+		{"log_max_age_hours", int64(c.LogMaxAgeHours)},
+		{"disk_usage_interval_in_seconds", int64(c.DiskUsageIntervalInSeconds)},
+	} {
+		if field.value < 0 {
+			invalid(field.name, field.value, "must not be negative")
+		}
+	}
+	for _, level := range c.BloomFilterDisabledLevels {
+		if level < 0 {
+			invalid("bloom_filter_disabled_levels", c.BloomFilterDisabledLevels, "levels must not be negative")
+			break
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// substituteDefaults fills in the unset values Validate forgives.
+func (c *SystemConfiguration) substituteDefaults() {
+	if c.LogSeverityLevel == "" {
+		c.LogSeverityLevel = "INFO"
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = "text"
+	}
+	if c.SSTableBlockSizeInBytes == 0 {
+		c.SSTableBlockSizeInBytes = DefaultSSTableBlockSizeInBytes
+	}
+	if c.BloomFilterFalsePositiveRate == 0 {
+		c.BloomFilterFalsePositiveRate = DefaultBloomFilterFalsePositiveRate
+	}
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"os"
+	"sndv-kv/internal/storage"
+	"sync"
+)
+
+// levelSizeMultiplier is the growth factor between the target sizes of
+// consecutive levels below L1.
+const levelSizeMultiplier = 10
+
+// LevelStats describes the on-disk footprint of one LSM level.
+type LevelStats struct {
+	Level             int     `json:"level"`
+	FileCount         int     `json:"file_count"`
+	SizeInBytes       int64   `json:"size_in_bytes"`
+	TargetSizeInBytes int64   `json:"target_size_in_bytes"`
+	Score             float64 `json:"score"`
+}
+
+// CompactionDebtReport summarises how far compaction is behind. A Score above
+// 1 means at least one level is over its target and waiting to be compacted.
+type CompactionDebtReport struct {
+	Levels      []LevelStats `json:"levels"`
+	Score       float64      `json:"score"`
+	DebtInBytes int64        `json:"debt_in_bytes"`
+}
+
+// fileSizeCache remembers SSTable sizes; the files are immutable once
+// written, so each is stat'ed only once.
+type fileSizeCache struct {
+	mutex sync.Mutex
+	sizes map[string]int64
+}
+
+// CompactionDebt reports per-level sizes against their targets. L0 is scored
+// by file count against the compaction trigger, deeper levels by bytes.
+func (s *SystemState) CompactionDebt() CompactionDebtReport {
+	s.Mutex.RLock()
+	levels := make([][]storage.SSTableMetadata, len(s.SSTables))
+	copy(levels, s.SSTables)
+	// A configuration reload may change the trigger under the lock
+	trigger := s.Configuration.LevelZeroCompactionTriggerCount
+	memtableSize := s.Configuration.MaximumMemtableSizeInBytes
+	s.Mutex.RUnlock()
+
+	sizes := s.fileSizes.lookup(levels)
+
+	report := CompactionDebtReport{Levels: make([]LevelStats, 0, len(levels))}
+	for level, tables := range levels {
+		stats := LevelStats{
+			Level:             level,
+			FileCount:         len(tables),
+			TargetSizeInBytes: levelTargetSizeInBytes(level, trigger, memtableSize),
+		}
+		for _, meta := range tables {
+			stats.SizeInBytes += sizes[meta.Filename]
+		}
+
+		if level == 0 {
+			if trigger > 0 {
+				stats.Score = float64(stats.FileCount) / float64(trigger)
+			}
+		} else if stats.TargetSizeInBytes > 0 {
+			stats.Score = float64(stats.SizeInBytes) / float64(stats.TargetSizeInBytes)
+		}
+
+		if stats.Score > 1 && stats.SizeInBytes > stats.TargetSizeInBytes {
+			report.DebtInBytes += stats.SizeInBytes - stats.TargetSizeInBytes
+		}
+		if stats.Score > report.Score {
+			report.Score = stats.Score
+		}
+		report.Levels = append(report.Levels, stats)
+	}
+	return report
+}
+
+// levelTargetSizeInBytes sizes L0 as trigger memtables of memtableSize, L1
+// the same, and every deeper level levelSizeMultiplier times the one above.
+func levelTargetSizeInBytes(level, trigger int, memtableSize int64) int64 {
+	target := int64(trigger) * memtableSize
+	for l := 1; l < level; l++ {
+		target *= levelSizeMultiplier
+	}
+	return target
+}
+
+func (c *fileSizeCache) lookup(levels [][]storage.SSTableMetadata) map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	live := make(map[string]int64)
+	for _, tables := range levels {
+		for _, meta := range tables {
+			if size, ok := c.sizes[meta.Filename]; ok {
+				live[meta.Filename] = size
+			} else if info, err := os.Stat(meta.Filename); err == nil {
+				live[meta.Filename] = info.Size()
+			}
+		}
+	}
+
+	// Dropping entries for files no longer live keeps the cache bounded.
+	c.sizes = live
+	return live
+}
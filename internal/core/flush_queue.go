@@ -0,0 +1,104 @@
+package core
+
+import (
+	"slices"
+	"sndv-kv/internal/common"
+)
+
+// Immutable memtables may be written to L0 in any order, but they leave
+// ImmutableMem oldest first. Reads check memtables before SSTables, so
+// retiring a memtable ahead of an older one would let the older versions
+// that one holds shadow its newer ones. Each frozen WAL likewise goes only
+// once its memtable, and every older one, is safely on disk.
+//
+// A memtable's writes can span several WALs, since the active WAL is also
+// rotated on its own once it outgrows MaximumWalSizeInBytes. FrozenWALs
+// stays oldest first, so the WALs of each retired memtable are at its
+// front.
+
+// FreezeActiveWal makes next the active WAL and keeps the current one in
+// FrozenWALs until the memtable holding its writes is flushed. Caller must
+// hold s.Mutex for writing.
+func (s *SystemState) FreezeActiveWal(next common.WriteAheadLog) {
+	s.FrozenWALs = append(s.FrozenWALs, s.ActiveWal)
+	s.ActiveWal = next
+	s.activeFrozenWalCount++
+}
+
+// FreezeMemTable queues the active memtable for a flush, together with the
+// WALs frozen while it filled, and makes next the active memtable. Caller
+// must hold s.Mutex for writing.
+func (s *SystemState) FreezeMemTable(next common.KeyValueStore) {
+	s.queueImmutable(s.MemTable, s.activeFrozenWalCount)
+	s.activeFrozenWalCount = 0
+	s.MemTable = next
+}
+
+// QueueRecoveredImmutable queues table for a flush with the frozen WAL it
+// was replayed from, which goes once table is flushed. Caller must hold
+// s.Mutex for writing, or own s exclusively as recovery does.
+func (s *SystemState) QueueRecoveredImmutable(table common.KeyValueStore, wal common.WriteAheadLog) {
+	s.FrozenWALs = append(s.FrozenWALs, wal)
+	s.queueImmutable(table, 1)
+}
+
+func (s *SystemState) queueImmutable(table common.KeyValueStore, frozenWals int) {
+	if s.frozenWalCounts == nil {
+		s.frozenWalCounts = make(map[common.KeyValueStore]int)
+	}
+	s.frozenWalCounts[table] = frozenWals
+	s.ImmutableMem = append(s.ImmutableMem, table)
+}
+
+// ClaimImmutableForFlush returns the oldest immutable memtable that is
+// neither claimed nor flushed yet and claims it for the caller, or nil if
+// there is none. Caller must hold s.Mutex.
+func (s *SystemState) ClaimImmutableForFlush() common.KeyValueStore {
+	for _, table := range s.ImmutableMem {
+		if !s.flushClaims[table] && !s.flushedTables[table] {
+			if s.flushClaims == nil {
+				s.flushClaims = make(map[common.KeyValueStore]bool)
+			}
+			s.flushClaims[table] = true
+			return table
+		}
+	}
+	return nil
+}
+
+// ReleaseFlushClaim gives up a claim taken by ClaimImmutableForFlush.
+// Caller must hold s.Mutex.
+func (s *SystemState) ReleaseFlushClaim(table common.KeyValueStore) {
+	delete(s.flushClaims, table)
+}
+
+// IsAwaitingFlush reports whether table is still queued and not yet written
+// to L0. Caller must hold s.Mutex.
+func (s *SystemState) IsAwaitingFlush(table common.KeyValueStore) bool {
+	return slices.Contains(s.ImmutableMem, table) && !s.flushedTables[table]
+}
+
+// RetireFlushedImmutable records that table has been written to L0 and
+// drops every memtable at the front of ImmutableMem that has been. It
+// returns how many frozen WALs held only their writes, which can go with
+// them. Caller must hold s.Mutex for writing.
+func (s *SystemState) RetireFlushedImmutable(table common.KeyValueStore) int {
+	if s.flushedTables == nil {
+		s.flushedTables = make(map[common.KeyValueStore]bool)
+	}
+	s.flushedTables[table] = true
+
+	retired, frozenWals := 0, 0
+	for len(s.ImmutableMem) > 0 && s.flushedTables[s.ImmutableMem[0]] {
+		oldest := s.ImmutableMem[0]
+		frozenWals += s.frozenWalCounts[oldest]
+		delete(s.flushedTables, oldest)
+		delete(s.frozenWalCounts, oldest)
+		s.ImmutableMem = s.ImmutableMem[1:]
+		retired++
+	}
+	if retired > 0 {
+		s.FlushProgress.Broadcast()
+	}
+	return frozenWals
+}
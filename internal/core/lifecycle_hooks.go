@@ -0,0 +1,56 @@
+package core
+
+import (
+	"sndv-kv/internal/storage"
+	"sync"
+)
+
+// SSTableCommitHook is invoked after a flush or compaction has been committed
+// to the SSTable set, receiving the metadata of the table that was produced.
+type SSTableCommitHook func(meta storage.SSTableMetadata)
+
+type lifecycleHooks struct {
+	mutex      sync.RWMutex
+	flush      []SSTableCommitHook
+	compaction []SSTableCommitHook
+}
+
+// RegisterFlushHook adds a callback fired after every committed flush.
+func (s *SystemState) RegisterFlushHook(hook SSTableCommitHook) {
+	s.hooks.mutex.Lock()
+	defer s.hooks.mutex.Unlock()
+	s.hooks.flush = append(s.hooks.flush, hook)
+}
+
+// RegisterCompactionHook adds a callback fired after every committed compaction.
+func (s *SystemState) RegisterCompactionHook(hook SSTableCommitHook) {
+	s.hooks.mutex.Lock()
+	defer s.hooks.mutex.Unlock()
+	s.hooks.compaction = append(s.hooks.compaction, hook)
+}
+
+// NotifyFlushCommitted runs the flush hooks. Callers must not hold s.Mutex so
+// hooks are free to inspect the state.
+func (s *SystemState) NotifyFlushCommitted(meta storage.SSTableMetadata) {
+	s.hooks.mutex.RLock()
+	registered := s.hooks.flush
+	s.hooks.mutex.RUnlock()
+
+	runHooks(registered, meta)
+}
+
+// NotifyCompactionCommitted runs the compaction hooks. Callers must not hold
+// s.Mutex so hooks are free to inspect the state.
+func (s *SystemState) NotifyCompactionCommitted(meta storage.SSTableMetadata) {
+	s.hooks.mutex.RLock()
+	registered := s.hooks.compaction
+	s.hooks.mutex.RUnlock()
+
+	runHooks(registered, meta)
+}
+
+func runHooks(hooks []SSTableCommitHook, meta storage.SSTableMetadata) {
+	for _, hook := range hooks {
+		hook(meta)
+	}
+}
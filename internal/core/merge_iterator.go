@@ -0,0 +1,202 @@
+package core
+
+import (
+	"container/heap"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/storage"
+	"sort"
+)
+
+// mergeSource is one sorted input to a mergeIterator. When several sources
+// hold the same key, the entry with the highest sequence wins; lower ranks
+// are newer and break ties between unsequenced entries.
+type mergeSource struct {
+	next  func() (common.Entry, bool)
+	close func()
+	head  common.Entry
+	rank  int
+
+	// err, if set, reports why next stopped early.
+	err func() error
+}
+
+// mergeIterator yields the newest version of every key in [start, end) in
+// key order, merging sorted sources while holding one entry per source.
+// Tombstones and expired entries are yielded too; callers filter them.
+type mergeIterator struct {
+	sources mergeHeap
+	all     []*mergeSource
+	err     error
+}
+
+func (v ReadView) newMergeIterator(start, end string) (*mergeIterator, error) {
+	inRange := func(key string) bool {
+		return key >= start && (end == "" || key < end)
+	}
+
+	it := &mergeIterator{}
+	add := func(src *mergeSource) {
+		src.rank = len(it.all)
+		it.all = append(it.all, src)
+		if e, ok := src.next(); ok {
+			src.head = e
+			it.sources = append(it.sources, src)
+		} else {
+			it.checkSource(src)
+		}
+	}
+
+	tables := []common.KeyValueStore{}
+	if v.MemTable != nil {
+		tables = append(tables, v.MemTable)
+	}
+	for i := len(v.ImmutableMem) - 1; i >= 0; i-- {
+		tables = append(tables, v.ImmutableMem[i])
+	}
+	for _, table := range tables {
+		add(memTableSource(table, start, end, inRange))
+	}
+
+	for _, level := range v.SSTables {
+		for i := len(level) - 1; i >= 0; i-- {
+			meta := level[i]
+			if meta.MaxKey < start || (end != "" && meta.MinKey >= end) {
+				continue
+			}
+			src, err := sstableSource(meta, start, inRange)
+			if err != nil {
+				it.Close()
+				return nil, err
+			}
+			add(src)
+		}
+	}
+
+	heap.Init(&it.sources)
+	return it, nil
+}
+
+// memTableSource copies out the table's entries in range, sorting them
+// unless the table keeps them ordered; memtables are bounded by the
+// rotation size, so copying them is cheap.
+func memTableSource(table common.KeyValueStore, start, end string, inRange func(string) bool) *mergeSource {
+	var entries []common.Entry
+	if ordered, ok := table.(storage.OrderedMemoryTable); ok {
+		ordered.AscendRange(start, end, func(e common.Entry) bool {
+			entries = append(entries, e)
+			return true
+		})
+	} else {
+		for _, e := range table.GetAll() {
+			if inRange(e.Key) {
+				entries = append(entries, e)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	}
+
+	return &mergeSource{
+		next: func() (common.Entry, bool) {
+			if len(entries) == 0 {
+				return common.Entry{}, false
+			}
+			e := entries[0]
+			entries = entries[1:]
+			return e, true
+		},
+		close: func() {},
+	}
+}
+
+func sstableSource(meta storage.SSTableMetadata, start string, inRange func(string) bool) (*mergeSource, error) {
+	reader, err := storage.OpenSSTableReader(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := reader.Seek(start); err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return &mergeSource{
+		next: func() (common.Entry, bool) {
+			e, ok := reader.Next()
+			if !ok || !inRange(e.Key) {
+				return common.Entry{}, false
+			}
+			return e, true
+		},
+		close: reader.Close,
+		err:   reader.Err,
+	}, nil
+}
+
+// Next returns the newest version of the next key, skipping older versions
+// of it in every other source.
+func (it *mergeIterator) Next() (common.Entry, bool) {
+	if len(it.sources) == 0 {
+		return common.Entry{}, false
+	}
+
+	winner := it.sources[0].head
+	for len(it.sources) > 0 && it.sources[0].head.Key == winner.Key {
+		it.advance()
+	}
+	return winner, true
+}
+
+// checkSource records why an exhausted source stopped, if it failed.
+func (it *mergeIterator) checkSource(src *mergeSource) {
+	if src.err == nil || it.err != nil {
+		return
+	}
+	it.err = src.err()
+}
+
+// Err reports the first source that failed. Entries from a failed source
+// stop early, so a caller must not treat the merge as complete.
+func (it *mergeIterator) Err() error {
+	return it.err
+}
+
+// advance moves the top source to its next entry, dropping it when done.
+func (it *mergeIterator) advance() {
+	top := it.sources[0]
+	if e, ok := top.next(); ok {
+		top.head = e
+		heap.Fix(&it.sources, 0)
+		return
+	}
+	heap.Pop(&it.sources)
+	it.checkSource(top)
+}
+
+// Close releases every open SSTable reader.
+func (it *mergeIterator) Close() {
+	for _, src := range it.all {
+		src.close()
+	}
+	it.all, it.sources = nil, nil
+}
+
+// mergeHeap orders sources by head key, newest entry first on ties.
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].head.Key != h[j].head.Key {
+		return h[i].head.Key < h[j].head.Key
+	}
+	if h[i].head.Sequence != h[j].head.Sequence {
+		return h[i].head.Sequence > h[j].head.Sequence
+	}
+	return h[i].rank < h[j].rank
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	src := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return src
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"sndv-kv/internal/common"
+	"sync"
+	"time"
+)
+
+// MergeIterator yields the live entries of a key range in key order, the
+// newest version of each key merged across the memtables and SSTables of
+// one read view. Tombstones and entries expired when the iterator was
+// created are skipped. It is not safe for concurrent use.
+type MergeIterator struct {
+	merged    *mergeIterator
+	now       int64
+	release   func()
+	closeOnce sync.Once
+}
+
+// NewRangeIterator iterates the live entries with start <= key < end, as
+// of now; an empty end means no upper bound. The SSTables it reads stay
+// pinned until Close, so compaction cannot delete them underneath it.
+func (s *SystemState) NewRangeIterator(start, end string) (*MergeIterator, error) {
+	s.PinSSTables()
+	it, err := s.CaptureReadView().NewRangeIterator(start, end)
+	if err != nil {
+		s.UnpinSSTables()
+		return nil, err
+	}
+	it.release = s.UnpinSSTables
+	return it, nil
+}
+
+// NewRangeIterator is SystemState.NewRangeIterator over this view; keeping
+// its SSTables on disk is up to the caller.
+func (v ReadView) NewRangeIterator(start, end string) (*MergeIterator, error) {
+	merged, err := v.newMergeIterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &MergeIterator{merged: merged, now: time.Now().UnixNano(), release: func() {}}, nil
+}
+
+// Next returns the next live entry, or false once the range is exhausted
+// or a source failed; Err tells the two apart.
+func (it *MergeIterator) Next() (common.Entry, bool) {
+	for {
+		e, ok := it.merged.Next()
+		if !ok {
+			return common.Entry{}, false
+		}
+		if !e.IsDeleted && !e.IsExpiredAt(it.now) {
+			return e, true
+		}
+	}
+}
+
+// Err reports the first source that failed, which ends iteration early.
+func (it *MergeIterator) Err() error {
+	return it.merged.Err()
+}
+
+// Close releases the SSTable readers and pins. It is safe to call twice.
+func (it *MergeIterator) Close() {
+	it.closeOnce.Do(func() {
+		it.merged.Close()
+		it.release()
+	})
+}
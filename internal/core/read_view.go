@@ -0,0 +1,230 @@
+package core
+
+import (
+	"slices"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/metrics"
+	"sndv-kv/internal/storage"
+	"time"
+)
+
+// ReadView is a set of table references captured under a single lock. It is
+// searched newest first: active memtable, immutable memtables (newest to
+// oldest), then SSTable levels from L0 down. Tables within a level may
+// overlap, so there the version with the highest sequence wins.
+type ReadView struct {
+	MemTable      common.KeyValueStore
+	ImmutableMem  []common.KeyValueStore
+	SSTables      [][]storage.SSTableMetadata
+	BloomFilter   common.BloomFilter
+	MappedReaders *storage.MappedReaderCache
+}
+
+// CaptureReadView snapshots the current table references. The level slices
+// are copied because flush and compaction replace them in place.
+func (s *SystemState) CaptureReadView() ReadView {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	levels := make([][]storage.SSTableMetadata, len(s.SSTables))
+	copy(levels, s.SSTables)
+
+	return ReadView{
+		MemTable:      s.MemTable,
+		ImmutableMem:  s.ImmutableMem,
+		SSTables:      levels,
+		BloomFilter:   s.BloomFilter,
+		MappedReaders: s.MappedReaders,
+	}
+}
+
+// FindEntry returns the newest version of key, which may be a tombstone or
+// an expired entry; callers decide how to treat those.
+func (v ReadView) FindEntry(key string) (common.Entry, bool) {
+	if e, ok := v.FindInMemory(key); ok {
+		return e, true
+	}
+	if len(v.SSTables) > 0 {
+		metrics.IncrementSSTableLookupCount()
+	}
+	for _, level := range v.SSTables {
+		if e, found := v.FindInLevel(level, key); found {
+			return e, true
+		}
+	}
+	return common.Entry{}, false
+}
+
+// FindInLevel returns the version of key with the highest sequence among
+// the tables of one level. Their order only breaks ties between unsequenced
+// entries, newest file first, since compaction can leave an older write in
+// a later file. Tables whose newest entry cannot beat the best version so
+// far are skipped without being opened. Tables opened are counted towards
+// the read amplification metric.
+func (v ReadView) FindInLevel(level []storage.SSTableMetadata, key string) (common.Entry, bool) {
+	var best common.Entry
+	found := false
+	opened := 0
+	defer func() { metrics.AddSSTableFilesReadCount(opened) }()
+	for i := len(level) - 1; i >= 0; i-- {
+		meta := level[i]
+		if found && meta.MaxSequence <= best.Sequence {
+			continue
+		}
+		if !meta.Partition.Contains(key) {
+			continue
+		}
+		if meta.HasBloomFilter && v.BloomFilter != nil && !v.BloomFilter.Contains(meta.FileID, []byte(key)) {
+			continue
+		}
+		if meta.InKeyRange(key) {
+			opened++
+		}
+		if e, ok := v.MappedReaders.FindInSSTable(meta, key); ok && (!found || e.Sequence > best.Sequence) {
+			best, found = e, true
+		}
+	}
+	return best, found
+}
+
+// FindEntries is FindEntry for many keys. Keys not found in memory are
+// looked up table by table in search order, so each SSTable is opened at
+// most once however many of the keys it holds. Missing keys are absent from
+// the result.
+func (v ReadView) FindEntries(keys []string) map[string]common.Entry {
+	found := make(map[string]common.Entry, len(keys))
+	var pending []string
+	for _, key := range keys {
+		if e, ok := v.FindInMemory(key); ok {
+			found[key] = e
+		} else {
+			pending = append(pending, key)
+		}
+	}
+
+	if len(v.SSTables) > 0 {
+		metrics.AddSSTableLookupCount(len(pending))
+	}
+	// As in FindInLevel, every table of a level is consulted before its
+	// keys count as resolved
+	for _, level := range v.SSTables {
+		if len(pending) == 0 {
+			break
+		}
+		for i := len(level) - 1; i >= 0; i-- {
+			v.findInTable(level[i], pending, found)
+		}
+		pending = slices.DeleteFunc(pending, func(key string) bool {
+			_, ok := found[key]
+			return ok
+		})
+	}
+	return found
+}
+
+// findInTable resolves the keys meta holds into found, keeping whichever
+// version has the higher sequence.
+func (v ReadView) findInTable(meta storage.SSTableMetadata, keys []string, found map[string]common.Entry) {
+	var candidates []string
+	for _, key := range keys {
+		if e, ok := found[key]; ok && meta.MaxSequence <= e.Sequence {
+			continue
+		}
+		if !meta.InKeyRange(key) || !meta.Partition.Contains(key) {
+			continue
+		}
+		if meta.HasBloomFilter && v.BloomFilter != nil && !v.BloomFilter.Contains(meta.FileID, []byte(key)) {
+			continue
+		}
+		candidates = append(candidates, key)
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	metrics.AddSSTableFilesReadCount(1)
+	for key, e := range v.MappedReaders.FindManyInSSTable(meta, candidates) {
+		if previous, seen := found[key]; !seen || e.Sequence > previous.Sequence {
+			found[key] = e
+		}
+	}
+}
+
+// FindInMemory searches only the active and immutable memtables.
+func (v ReadView) FindInMemory(key string) (common.Entry, bool) {
+	if v.MemTable != nil {
+		if e, ok := v.MemTable.Get(key); ok {
+			return e, true
+		}
+	}
+	for i := len(v.ImmutableMem) - 1; i >= 0; i-- {
+		if e, ok := v.ImmutableMem[i].Get(key); ok {
+			return e, true
+		}
+	}
+	return common.Entry{}, false
+}
+
+// ScanRange returns up to limit live entries with start <= key < end in key
+// order. An empty end means no upper bound, a non-positive limit means no
+// limit. The sources are merged rather than collected, so a limited scan
+// reads only as far as it needs to.
+func (v ReadView) ScanRange(start, end string, limit int) ([]common.Entry, error) {
+	it, err := v.NewRangeIterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var result []common.Entry
+	for limit <= 0 || len(result) < limit {
+		e, ok := it.Next()
+		if !ok {
+			break
+		}
+		result = append(result, e)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// FindLive returns the live version of key the way a read should: the key
+// cache first, then the negative cache, then a pinned read view. Missing,
+// deleted and expired keys all report false. Non-counter hits from the view
+// are cached; a cache hit carries only Key and Value.
+func (s *SystemState) FindLive(key string) (common.Entry, bool) {
+	if s.KeyCache != nil {
+		if val, hit := s.KeyCache.RetrieveFromCache(key); hit {
+			metrics.IncrementCacheHitCount()
+			return common.Entry{Key: key, Value: val}, true
+		}
+		metrics.IncrementCacheMissCount()
+	}
+
+	negative := s.NegativeCache
+	if negative != nil && negative.Contains(key) {
+		metrics.IncrementNegativeCacheHitCount()
+		return common.Entry{}, false
+	}
+	var generation uint64
+	if negative != nil {
+		generation = negative.Generation()
+	}
+
+	s.PinSSTables()
+	entry, found := s.CaptureReadView().FindEntry(key)
+	s.UnpinSSTables()
+	if !found && negative != nil {
+		negative.RememberMissing(key, generation)
+	}
+	if !found || entry.IsDeleted || entry.IsExpiredAt(time.Now().UnixNano()) {
+		return common.Entry{}, false
+	}
+	// Counters are not cached: the HTTP layer serves cache hits verbatim
+	if s.KeyCache != nil && !entry.IsCounter {
+		s.KeyCache.InsertIntoCache(key, entry.Value, entry.ExpiryTimestamp)
+	}
+	return entry, true
+}
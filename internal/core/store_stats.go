@@ -0,0 +1,135 @@
+package core
+
+import (
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/metrics"
+	"sndv-kv/internal/storage"
+	"sync/atomic"
+)
+
+// StoreStats answers "how big is my store" in one consistent snapshot.
+type StoreStats struct {
+	// ApproximateKeyCount sums the entries of every memtable and SSTable. It
+	// over-counts keys with versions in several tables and tombstones.
+	ApproximateKeyCount int64 `json:"approximate_key_count"`
+	MemtableKeyCount    int   `json:"memtable_key_count"`
+	SSTableKeyCount     int64 `json:"sstable_key_count"`
+
+	// MemtableSizeInBytes covers the active and immutable memtables.
+	MemtableSizeInBytes       int64 `json:"memtable_size_in_bytes"`
+	ActiveMemtableSizeInBytes int64 `json:"active_memtable_size_in_bytes"`
+	ImmutableMemtableCount    int   `json:"immutable_memtable_count"`
+	// FrozenWalCount is the WALs whose memtables still await a flush.
+	FrozenWalCount int `json:"frozen_wal_count"`
+
+	// DiskSizeInBytes is every SSTable plus every WAL.
+	DiskSizeInBytes int64       `json:"disk_size_in_bytes"`
+	WalSizeInBytes  int64       `json:"wal_size_in_bytes"`
+	Levels          []LevelSize `json:"levels"`
+
+	Cache CacheStats `json:"cache"`
+}
+
+// LevelSize is the on-disk footprint of one level.
+type LevelSize struct {
+	Level       int   `json:"level"`
+	FileCount   int   `json:"file_count"`
+	SizeInBytes int64 `json:"size_in_bytes"`
+	KeyCount    int64 `json:"key_count"`
+}
+
+// CacheStats describes the key cache; it is all zero when there is none.
+type CacheStats struct {
+	Entries     int   `json:"entries"`
+	Capacity    int   `json:"capacity"`
+	SizeInBytes int   `json:"size_in_bytes"`
+	MaxBytes    int   `json:"max_bytes"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	// HitRatio is Hits over Hits plus Misses, 0 before the first lookup.
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// Count returns the approximate number of keys in the store.
+func (s *SystemState) Count() int64 {
+	return s.Stats().ApproximateKeyCount
+}
+
+// ApproximateSize returns the bytes the store occupies on disk.
+func (s *SystemState) ApproximateSize() int64 {
+	return s.Stats().DiskSizeInBytes
+}
+
+// SSTableDiskUsage returns the summed size and the number of SSTables. File
+// sizes are cached by name, so only tables new since the last call are
+// stat'ed.
+func (s *SystemState) SSTableDiskUsage() (int64, int) {
+	s.Mutex.RLock()
+	levels := make([][]storage.SSTableMetadata, len(s.SSTables))
+	copy(levels, s.SSTables)
+	s.Mutex.RUnlock()
+
+	sizes := s.fileSizes.lookup(levels)
+	var total int64
+	count := 0
+	for _, tables := range levels {
+		for _, meta := range tables {
+			total += sizes[meta.Filename]
+			count++
+		}
+	}
+	return total, count
+}
+
+// Stats gathers key counts and sizes across memtables, SSTables and WALs.
+func (s *SystemState) Stats() StoreStats {
+	s.Mutex.RLock()
+	memtables := append([]common.KeyValueStore{s.MemTable}, s.ImmutableMem...)
+	wals := append([]common.WriteAheadLog{s.ActiveWal}, s.FrozenWALs...)
+	levels := make([][]storage.SSTableMetadata, len(s.SSTables))
+	copy(levels, s.SSTables)
+	s.Mutex.RUnlock()
+
+	stats := StoreStats{
+		ActiveMemtableSizeInBytes: memtables[0].Size(),
+		ImmutableMemtableCount:    len(memtables) - 1,
+		FrozenWalCount:            len(wals) - 1,
+	}
+	for _, table := range memtables {
+		stats.MemtableKeyCount += table.Len()
+		stats.MemtableSizeInBytes += table.Size()
+	}
+	for _, wal := range wals {
+		if wal != nil {
+			stats.WalSizeInBytes += wal.SizeInBytes()
+		}
+	}
+
+	sizes := s.fileSizes.lookup(levels)
+	stats.Levels = make([]LevelSize, 0, len(levels))
+	for level, tables := range levels {
+		levelStats := LevelSize{Level: level, FileCount: len(tables)}
+		for _, meta := range tables {
+			levelStats.SizeInBytes += sizes[meta.Filename]
+			levelStats.KeyCount += int64(meta.KeyCount)
+		}
+		stats.SSTableKeyCount += levelStats.KeyCount
+		stats.DiskSizeInBytes += levelStats.SizeInBytes
+		stats.Levels = append(stats.Levels, levelStats)
+	}
+	stats.DiskSizeInBytes += stats.WalSizeInBytes
+	stats.ApproximateKeyCount = int64(stats.MemtableKeyCount) + stats.SSTableKeyCount
+
+	if s.KeyCache != nil {
+		stats.Cache = CacheStats{
+			Entries:     s.KeyCache.Len(),
+			Capacity:    s.KeyCache.CapacityCount(),
+			SizeInBytes: s.KeyCache.SizeInBytes(),
+			MaxBytes:    s.KeyCache.MaxBytes,
+			Hits:        atomic.LoadInt64(&metrics.Global.CacheHitCount),
+			Misses:      atomic.LoadInt64(&metrics.Global.CacheMissCount),
+			HitRatio:    metrics.CacheHitRatio(),
+		}
+	}
+	return stats
+}
@@ -1,11 +1,15 @@
 package core
 
 import (
+	"fmt"
+	"slices"
 	"sndv-kv/internal/cache"
 	"sndv-kv/internal/common"
 	"sndv-kv/internal/config"
 	"sndv-kv/internal/storage"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SystemState struct {
@@ -19,21 +23,265 @@ type SystemState struct {
 
 	SSTables    [][]storage.SSTableMetadata
 	BloomFilter common.BloomFilter
+	// MappedReaders holds this store's SSTables memory-mapped or open for
+	// point lookups, so a read need not open the file itself.
+	MappedReaders *storage.MappedReaderCache
+
+	// Manifest records every committed SSTable layout, or is nil when
+	// nothing needs to survive a restart.
+	Manifest *storage.Manifest
 
 	Mutex          sync.RWMutex
 	FlushCondition *sync.Cond
+	// FlushProgress is broadcast whenever immutable memtables are retired,
+	// waking writers stalled on MaximumImmutableMemtableCount.
+	FlushProgress *sync.Cond
 
 	KeyCache *cache.LruCache
+
+	// NegativeCache remembers keys recently found missing, or is nil when
+	// disabled.
+	NegativeCache *cache.NegativeCache
+
+	// readOnlyMode freezes the on-disk state: writes are rejected and the
+	// flush/compaction agents stay idle until it is cleared.
+	readOnlyMode atomic.Bool
+
+	hooks lifecycleHooks
+
+	lastFileID   atomic.Int64
+	lastSequence atomic.Uint64
+
+	// BackgroundAgents tracks the flush/compaction goroutines so shutdown can
+	// wait for in-flight work. stopSignal is closed to ask them to exit.
+	BackgroundAgents sync.WaitGroup
+	stopSignal       chan struct{}
+	stopOnce         sync.Once
+
+	// While SSTables are pinned by a read, obsolete files are kept on disk
+	// and removed once the last pin is released. The count is atomic so a
+	// GET can pin without taking Mutex exclusively; pendingFileRemovals is
+	// guarded by Mutex.
+	sstablePinCount     atomic.Int64
+	hasPendingRemovals  atomic.Bool
+	pendingFileRemovals []string
+
+	fileSizes fileSizeCache
+
+	// CompactionMutex serialises agents that restructure existing SSTables,
+	// so a table is never rewritten by two of them at once. Compaction
+	// workers share it for reading and keep apart by claimed key ranges;
+	// everything else takes it exclusively.
+	CompactionMutex sync.RWMutex
+
+	// FlushMutex ensures each immutable memtable is flushed and dequeued by
+	// exactly one caller. Flush workers share it for reading and keep apart
+	// by claiming tables; checkpoints take it exclusively.
+	FlushMutex sync.RWMutex
+
+	// Guarded by Mutex: immutable memtables claimed by a flush worker, and
+	// those already written to L0 that wait for an older one.
+	flushClaims   map[common.KeyValueStore]bool
+	flushedTables map[common.KeyValueStore]bool
+
+	// Guarded by Mutex: how many of FrozenWALs hold each immutable
+	// memtable's writes, and how many were frozen while the active one
+	// filled.
+	frozenWalCounts      map[common.KeyValueStore]int
+	activeFrozenWalCount int
 }
 
 func NewSystemState(cfg config.SystemConfiguration) *SystemState {
 	state := &SystemState{
 		Configuration: cfg,
-		MemTable:      storage.NewMemoryTable(int(cfg.MaximumMemtableSizeInBytes / 100)),
+		MemTable:      newMemTable(cfg),
 		SSTables:      make([][]storage.SSTableMetadata, 4),
-		KeyCache:      cache.NewLruCache(cfg.KeyCacheCapacityCount),
+		KeyCache:      cache.NewLruCache(cfg.KeyCacheCapacityCount, cfg.KeyCacheMaxBytes),
 		BloomFilter:   storage.NewSharedBloomFilter(10_000_000, cfg.BloomFilterFalsePositiveRate),
+		MappedReaders: storage.NewMappedReaderCache(cfg.SSTableMappedReaderCount, cfg.SSTableOpenFileCount),
+		stopSignal:    make(chan struct{}),
 	}
 	state.FlushCondition = sync.NewCond(&state.Mutex)
+	state.FlushProgress = sync.NewCond(&state.Mutex)
+	if cfg.NegativeCacheTtlInMilliseconds > 0 {
+		ttl := time.Duration(cfg.NegativeCacheTtlInMilliseconds) * time.Millisecond
+		state.NegativeCache = cache.NewNegativeCache(cfg.NegativeCacheCapacityCount, ttl)
+	}
+
+	// Everything lives in the memtable, so the key cache would only hold
+	// a second copy that could outlive an eviction.
+	if cfg.InMemoryOnly {
+		state.MemTable = storage.NewEvictingMemoryTableWithShards(int(cfg.MaximumMemtableSizeInBytes/100), cfg.MemtableShardCount)
+		state.KeyCache = nil
+	}
 	return state
 }
+
+// newMemTable builds an empty memtable of the configured implementation.
+// In-memory-only stores always get the evicting sharded table.
+func newMemTable(cfg config.SystemConfiguration) common.KeyValueStore {
+	if cfg.MemtableImplementation == storage.MemtableSkipList && !cfg.InMemoryOnly {
+		return storage.NewSkipListMemoryTable()
+	}
+	// Sized like the first memtable; a fixed large capacity would
+	// preallocate far more than a small memtable limit can ever hold.
+	return storage.NewMemoryTableWithShards(int(cfg.MaximumMemtableSizeInBytes/100), cfg.MemtableShardCount)
+}
+
+// NewMemTable returns an empty memtable to rotate in or recover into.
+func (s *SystemState) NewMemTable() common.KeyValueStore {
+	return newMemTable(s.Configuration)
+}
+
+// BloomFilterForLevel returns the filter tables written at level should
+// populate, or nil if bloom filters are disabled for that level.
+func (s *SystemState) BloomFilterForLevel(level int) common.BloomFilter {
+	if slices.Contains(s.Configuration.BloomFilterDisabledLevels, level) {
+		return nil
+	}
+	return s.BloomFilter
+}
+
+// IsReadOnlyMode reports whether the maintenance read-only mode is active.
+func (s *SystemState) IsReadOnlyMode() bool {
+	return s.readOnlyMode.Load()
+}
+
+// SetReadOnlyMode toggles the maintenance read-only mode. Leaving the mode
+// wakes the flush agent so queued immutable tables are written out again.
+func (s *SystemState) SetReadOnlyMode(enabled bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	s.readOnlyMode.Store(enabled)
+	if !enabled {
+		s.FlushCondition.Broadcast()
+	}
+}
+
+// AllocateFileID returns a process-unique, monotonically increasing SSTable ID.
+func (s *SystemState) AllocateFileID() int64 {
+	return s.lastFileID.Add(1)
+}
+
+// ReserveFileIDsThrough makes AllocateFileID return only IDs above id, so
+// tables recovered from disk are never overwritten by new ones.
+func (s *SystemState) ReserveFileIDsThrough(id int64) {
+	for {
+		last := s.lastFileID.Load()
+		if last >= id || s.lastFileID.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+// AllocateSequences reserves n consecutive entry sequence numbers and
+// returns the first.
+func (s *SystemState) AllocateSequences(n int) uint64 {
+	return s.lastSequence.Add(uint64(n)) - uint64(n) + 1
+}
+
+// ReserveSequencesThrough makes AllocateSequences return only sequences
+// above seq, so writes after a restart order after everything recovered.
+func (s *SystemState) ReserveSequencesThrough(seq uint64) {
+	for {
+		last := s.lastSequence.Load()
+		if last >= seq || s.lastSequence.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// StopSignal is closed once background agents have been asked to stop.
+func (s *SystemState) StopSignal() <-chan struct{} {
+	return s.stopSignal
+}
+
+// IsStopping reports whether StopBackgroundAgents has been called.
+func (s *SystemState) IsStopping() bool {
+	select {
+	case <-s.stopSignal:
+		return true
+	default:
+		return false
+	}
+}
+
+// StopBackgroundAgents signals the flush and compaction agents to exit and
+// waits for any in-flight flush or compaction to finish.
+func (s *SystemState) StopBackgroundAgents() {
+	s.stopOnce.Do(func() { close(s.stopSignal) })
+
+	s.Mutex.Lock()
+	s.FlushCondition.Broadcast()
+	s.FlushProgress.Broadcast()
+	s.Mutex.Unlock()
+
+	s.BackgroundAgents.Wait()
+}
+
+// PinSSTables keeps obsolete SSTable files on disk until UnpinSSTables.
+// Pin before capturing a read view: every file the view holds then stays
+// readable until the pin is released.
+func (s *SystemState) PinSSTables() {
+	s.sstablePinCount.Add(1)
+}
+
+// UnpinSSTables releases a pin and removes files deferred while pinned.
+func (s *SystemState) UnpinSSTables() {
+	if s.sstablePinCount.Add(-1) > 0 || !s.hasPendingRemovals.Load() {
+		return
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	s.removePendingFiles()
+}
+
+// RemoveSSTableFiles deletes obsolete table files, deferring the removal
+// while any snapshot pins the SSTable set. Callers must hold s.Mutex.
+func (s *SystemState) RemoveSSTableFiles(filenames []string) {
+	s.pendingFileRemovals = append(s.pendingFileRemovals, filenames...)
+	// Flagged before the pin count is read, so an unpin racing this call
+	// either sees the flag or leaves the count at zero for the check below
+	s.hasPendingRemovals.Store(true)
+	s.removePendingFiles()
+}
+
+// removePendingFiles deletes deferred files once nothing pins them. Callers
+// must hold s.Mutex.
+func (s *SystemState) removePendingFiles() {
+	if s.sstablePinCount.Load() > 0 {
+		return
+	}
+	s.hasPendingRemovals.Store(false)
+	for _, filename := range s.pendingFileRemovals {
+		s.deleteSSTableFile(filename)
+	}
+	s.pendingFileRemovals = nil
+}
+
+// deleteSSTableFile removes a table's files and drops its bloom filter and
+// cached mapping.
+func (s *SystemState) deleteSSTableFile(filename string) {
+	s.MappedReaders.Forget(filename)
+	storage.RemoveSSTableFile(filename)
+	if shared, ok := s.BloomFilter.(*storage.SharedBloomFilter); ok {
+		if _, fileID, ok := storage.ParseSSTableFilename(filename); ok {
+			shared.DetachTable(fileID)
+		}
+	}
+}
+
+// CommitSSTables records levels in the manifest and installs it as the live
+// SSTable layout. On error the layout is left unchanged, and files only the
+// new layout references must be discarded by the caller. Callers must hold
+// s.Mutex.
+func (s *SystemState) CommitSSTables(levels [][]storage.SSTableMetadata) error {
+	if s.Manifest != nil {
+		if err := s.Manifest.Record(levels); err != nil {
+			return fmt.Errorf("failed to record manifest: %w", err)
+		}
+	}
+	s.SSTables = levels
+	return nil
+}
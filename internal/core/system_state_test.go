@@ -1,7 +1,11 @@
 package core
 
 import (
+	"os"
+	"slices"
+	"sndv-kv/internal/common"
 	"sndv-kv/internal/config"
+	"sndv-kv/internal/storage"
 	"testing"
 )
 
@@ -24,3 +28,258 @@ func TestSystemStateInitialization(t *testing.T) {
 		t.Error("SSTables slice not initialized")
 	}
 }
+
+func TestLifecycleHooks(t *testing.T) {
+	state := NewSystemState(config.SystemConfiguration{})
+
+	var flushed, compacted []storage.SSTableMetadata
+	state.RegisterFlushHook(func(meta storage.SSTableMetadata) { flushed = append(flushed, meta) })
+	state.RegisterCompactionHook(func(meta storage.SSTableMetadata) { compacted = append(compacted, meta) })
+
+	state.NotifyFlushCommitted(storage.SSTableMetadata{Filename: "L0_1.sst"})
+	state.NotifyCompactionCommitted(storage.SSTableMetadata{Filename: "L1_2.sst", Level: 1})
+
+	if len(flushed) != 1 || flushed[0].Filename != "L0_1.sst" {
+		t.Errorf("Flush hook not fired correctly: %+v", flushed)
+	}
+	if len(compacted) != 1 || compacted[0].Level != 1 {
+		t.Errorf("Compaction hook not fired correctly: %+v", compacted)
+	}
+}
+
+func TestCompactionDebt_ReflectsUnevenLevels(t *testing.T) {
+	dir := t.TempDir()
+	state := NewSystemState(config.SystemConfiguration{
+		MaximumMemtableSizeInBytes:      100,
+		LevelZeroCompactionTriggerCount: 2,
+	})
+
+	seed := func(level int, id int64, size int) storage.SSTableMetadata {
+		name := storage.SSTableFilename(dir, level, id)
+		if err := os.WriteFile(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return storage.SSTableMetadata{Level: level, FileID: id, Filename: name}
+	}
+
+	// Balanced: one L0 file, L1 well under its 200 byte target
+	state.SSTables[0] = []storage.SSTableMetadata{seed(0, 1, 50)}
+	state.SSTables[1] = []storage.SSTableMetadata{seed(1, 2, 100)}
+
+	report := state.CompactionDebt()
+	if report.Score > 1 || report.DebtInBytes != 0 {
+		t.Fatalf("Expected no debt, got score %.2f and %d bytes", report.Score, report.DebtInBytes)
+	}
+	if report.Levels[1].SizeInBytes != 100 || report.Levels[1].TargetSizeInBytes != 200 {
+		t.Errorf("Unexpected L1 stats: %+v", report.Levels[1])
+	}
+
+	// Uneven: L0 piles up past its trigger and L1 grows to 3x its target
+	state.SSTables[0] = append(state.SSTables[0], seed(0, 3, 50), seed(0, 4, 50), seed(0, 5, 50))
+	state.SSTables[1] = append(state.SSTables[1], seed(1, 6, 500))
+
+	report = state.CompactionDebt()
+	if report.Levels[0].Score != 2 {
+		t.Errorf("Expected L0 score 2, got %.2f", report.Levels[0].Score)
+	}
+	if report.Levels[1].Score != 3 {
+		t.Errorf("Expected L1 score 3, got %.2f", report.Levels[1].Score)
+	}
+	if report.Score != 3 {
+		t.Errorf("Overall score should track the worst level, got %.2f", report.Score)
+	}
+	if report.DebtInBytes != 400 {
+		t.Errorf("Expected 400 bytes of debt, got %d", report.DebtInBytes)
+	}
+}
+
+func TestReadView_ProbesOnlyTheKeysPartition(t *testing.T) {
+	dir := t.TempDir()
+	state := NewSystemState(config.SystemConfiguration{})
+
+	const count = 4
+	key := "user:42"
+	owner := storage.PartitionOf(key, count)
+	other := (owner + 1) % count
+
+	write := func(id int64, value string, partition int) storage.SSTableMetadata {
+		meta, err := storage.WriteSortedStringTableToDiskWithOptions(
+			[]common.Entry{{Key: key, Value: []byte(value)}},
+			storage.SSTableFilename(dir, 0, id), 0, state.BloomFilter,
+			storage.SSTableWriteOptions{Partition: storage.SSTablePartition{Index: partition, Count: count}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	// The newer file claims the key but sits in another partition, so a
+	// lookup that honours partitions must never open it.
+	state.SSTables[0] = []storage.SSTableMetadata{write(1, "owner", owner), write(2, "stray", other)}
+
+	e, found := state.CaptureReadView().FindEntry(key)
+	if !found || string(e.Value) != "owner" {
+		t.Errorf("Expected the owning partition's value, got %q (found=%v)", e.Value, found)
+	}
+}
+
+func TestReadView_ScanRangeMergesNewestFirst(t *testing.T) {
+	dir := t.TempDir()
+	state := NewSystemState(config.SystemConfiguration{})
+
+	write := func(level int, id int64, entries ...common.Entry) storage.SSTableMetadata {
+		meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(dir, level, id), level, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	entry := func(key, value string) common.Entry { return common.Entry{Key: key, Value: []byte(value)} }
+
+	state.SSTables[1] = []storage.SSTableMetadata{write(1, 1, entry("a", "old"), entry("b", "old"), entry("c", "old"), entry("e", "old"))}
+	state.SSTables[0] = []storage.SSTableMetadata{
+		write(0, 2, entry("b", "l0-older")),
+		write(0, 3, entry("b", "l0-newer"), common.Entry{Key: "c", IsDeleted: true}),
+	}
+
+	immutable := storage.NewMemoryTable(16)
+	immutable.PutEntry(entry("d", "immutable"))
+	immutable.PutEntry(entry("e", "immutable"))
+	state.ImmutableMem = []common.KeyValueStore{immutable}
+	state.MemTable.PutEntry(entry("e", "active"))
+	state.MemTable.PutEntry(common.Entry{Key: "f", Value: []byte("expired"), ExpiryTimestamp: 1})
+
+	entries, err := state.CaptureReadView().ScanRange("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Key+"="+string(e.Value))
+	}
+	want := []string{"a=old", "b=l0-newer", "d=immutable", "e=active"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Scan = %v, want %v", got, want)
+	}
+
+	entries, _ = state.CaptureReadView().ScanRange("b", "e", 1)
+	if len(entries) != 1 || entries[0].Key != "b" {
+		t.Errorf("Limited scan = %+v, want only b", entries)
+	}
+}
+
+func TestSystemState_RangeIteratorPinsItsTables(t *testing.T) {
+	dir := t.TempDir()
+	state := NewSystemState(config.SystemConfiguration{})
+
+	var entries []common.Entry
+	for _, key := range []string{"a", "b", "c"} {
+		entries = append(entries, common.Entry{Key: key, Value: []byte("disk")})
+	}
+	meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(dir, 0, 1), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SSTables[0] = []storage.SSTableMetadata{meta}
+	state.MemTable.PutEntry(common.Entry{Key: "b", IsDeleted: true, Sequence: 1})
+
+	it, err := state.NewRangeIterator("a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes after creation are not seen
+	state.MemTable.PutEntry(common.Entry{Key: "d", Value: []byte("late"), Sequence: 2})
+
+	// Compaction retires the table while the iterator still reads it
+	state.SSTables[0] = nil
+	state.RemoveSSTableFiles([]string{meta.Filename})
+	if _, err := os.Stat(meta.Filename); err != nil {
+		t.Fatalf("Table removed under an open iterator: %v", err)
+	}
+
+	var got []string
+	for e, ok := it.Next(); ok; e, ok = it.Next() {
+		got = append(got, e.Key)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("Iterator yielded %v, want [a c]", got)
+	}
+
+	it.Close()
+	it.Close()
+	if _, err := os.Stat(meta.Filename); !os.IsNotExist(err) {
+		t.Errorf("Table should be removed once the iterator closes, stat: %v", err)
+	}
+}
+
+func TestReadView_FindEntriesMatchesFindEntry(t *testing.T) {
+	dir := t.TempDir()
+	state := NewSystemState(config.SystemConfiguration{BloomFilterFalsePositiveRate: 0.01})
+
+	write := func(level int, id int64, entries ...common.Entry) storage.SSTableMetadata {
+		meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(dir, level, id), level, state.BloomFilter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+	entry := func(key, value string) common.Entry { return common.Entry{Key: key, Value: []byte(value)} }
+
+	state.SSTables[1] = []storage.SSTableMetadata{write(1, 1, entry("a", "deep"), entry("b", "deep"), entry("c", "deep"))}
+	state.SSTables[0] = []storage.SSTableMetadata{write(0, 2, entry("b", "l0"), common.Entry{Key: "c", IsDeleted: true})}
+	state.MemTable.PutEntry(entry("d", "memtable"))
+
+	view := state.CaptureReadView()
+	keys := []string{"a", "b", "c", "d", "missing"}
+	found := view.FindEntries(keys)
+	for _, key := range keys {
+		want, wantOK := view.FindEntry(key)
+		got, ok := found[key]
+		if ok != wantOK || string(got.Value) != string(want.Value) || got.IsDeleted != want.IsDeleted {
+			t.Errorf("Key %s: FindEntries gave %+v (%v), FindEntry gave %+v (%v)", key, got, ok, want, wantOK)
+		}
+	}
+}
+
+func TestReadView_PicksHighestSequenceInLevel(t *testing.T) {
+	dir := t.TempDir()
+	state := NewSystemState(config.SystemConfiguration{BloomFilterFalsePositiveRate: 0.01})
+
+	write := func(id int64, entries ...common.Entry) storage.SSTableMetadata {
+		meta, err := storage.WriteSortedStringTableToDisk(entries, storage.SSTableFilename(dir, 1, id), 1, state.BloomFilter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	// The newest file in the level holds the older writes
+	state.SSTables[1] = []storage.SSTableMetadata{
+		write(1, common.Entry{Key: "a", Value: []byte("new"), Sequence: 5}, common.Entry{Key: "b", IsDeleted: true, Sequence: 6}),
+		write(2, common.Entry{Key: "a", Value: []byte("old"), Sequence: 1}, common.Entry{Key: "b", Value: []byte("old"), Sequence: 2}),
+	}
+
+	view := state.CaptureReadView()
+	if e, _ := view.FindEntry("a"); string(e.Value) != "new" {
+		t.Errorf("FindEntry(a) = %q, want new", e.Value)
+	}
+	if e, _ := view.FindEntry("b"); !e.IsDeleted {
+		t.Errorf("FindEntry(b) resurrected %q", e.Value)
+	}
+
+	found := view.FindEntries([]string{"a", "b"})
+	if string(found["a"].Value) != "new" || !found["b"].IsDeleted {
+		t.Errorf("FindEntries = %+v", found)
+	}
+
+	entries, err := view.ScanRange("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "a" || string(entries[0].Value) != "new" {
+		t.Errorf("Scan = %+v, want only a=new", entries)
+	}
+}
@@ -0,0 +1,421 @@
+// Package engine runs one store: it owns one SystemState together with its
+// ingestion shards and background agents, so several engines can run side by
+// side in the same process. The server builds on it directly; embedders use
+// the public wrapper in pkg/engine.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sndv-kv/internal/agents"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/config"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/storage"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrClosed is returned by operations on an engine after Close.
+var ErrClosed = errors.New("engine closed")
+
+// ErrReadOnly is returned for writes while read-only mode is active.
+var ErrReadOnly = agents.ErrReadOnlyMode
+
+type Engine struct {
+	state     *core.SystemState
+	ingestion *agents.IngestionSubsystem
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Open recovers the write-ahead log into a fresh state and starts the
+// ingestion shards and the background agents. An in-memory-only engine
+// creates no files and runs none of the disk agents.
+func Open(cfg config.SystemConfiguration) (*Engine, error) {
+	if cfg.InMemoryOnly {
+		cfg.EnableDiskDurability = false
+		state := core.NewSystemState(cfg)
+		return &Engine{
+			state:     state,
+			ingestion: agents.InitializeIngestionSubsystem(state),
+			closed:    make(chan struct{}),
+		}, nil
+	}
+
+	if _, err := storage.ValueCompressionThreshold(cfg.SSTableCompression, cfg.SSTableValueCompressionThresholdInBytes); err != nil {
+		return nil, err
+	}
+	if _, err := storage.SyncsEveryBatch(cfg.WalSyncMode); err != nil {
+		return nil, err
+	}
+	switch cfg.MemtableImplementation {
+	case "", storage.MemtableSharded, storage.MemtableSkipList:
+	default:
+		return nil, fmt.Errorf("unknown memtable implementation %q", cfg.MemtableImplementation)
+	}
+	if err := os.MkdirAll(cfg.DataDirectoryPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	state := core.NewSystemState(cfg)
+	if err := recoverSSTables(state); err != nil {
+		return nil, fmt.Errorf("failed to recover SSTables: %w", err)
+	}
+	if err := recoverWal(state); err != nil {
+		closeRecoveredFiles(state)
+		return nil, fmt.Errorf("failed to recover WAL: %w", err)
+	}
+
+	e := &Engine{
+		state:     state,
+		ingestion: agents.InitializeIngestionSubsystem(state),
+		closed:    make(chan struct{}),
+	}
+	agents.StartFlushAgentInBackground(state)
+	agents.StartCompactionAgentInBackground(state)
+	agents.StartTtlReclamationAgentInBackground(state)
+	agents.StartMemtableTtlSweeperInBackground(state)
+	agents.StartDiskUsageMonitorInBackground(state)
+	agents.StartCheckpointAgentInBackground(state)
+	agents.StartWalSyncAgentInBackground(state)
+	return e, nil
+}
+
+// recoverSSTables rebuilds the SSTable layout from the manifest, loading
+// each table and reserving its file ID. Tables on disk that the manifest
+// does not list belong to a flush or compaction that never committed, or
+// were superseded by one, and are removed. A data directory without a
+// manifest is loaded from the table filenames instead.
+func recoverSSTables(system *core.SystemState) error {
+	dir := system.Configuration.DataDirectoryPath
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "*.sst.tmp"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "L*_*.sst"))
+	if err != nil {
+		return err
+	}
+
+	manifest, layout, ok, err := storage.OpenManifest(dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		layout = layoutFromFilenames(paths)
+	}
+
+	opts := storage.SSTableLoadOptions{
+		BlockSizeInBytes: system.Configuration.SSTableBlockSizeInBytes,
+		PartitionCount:   system.Configuration.SSTablePartitionCount,
+	}
+	live := make(map[string]bool)
+	for level, names := range layout {
+		for len(system.SSTables) <= level {
+			system.SSTables = append(system.SSTables, nil)
+		}
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			meta, err := storage.LoadSSTable(path, system.BloomFilterForLevel(level), opts)
+			if err != nil {
+				manifest.Close()
+				return err
+			}
+			meta.Level = level
+
+			system.SSTables[level] = append(system.SSTables[level], meta)
+			system.ReserveFileIDsThrough(meta.FileID)
+			system.ReserveSequencesThrough(meta.MaxSequence)
+			live[path] = true
+		}
+	}
+
+	for _, path := range paths {
+		if !live[path] {
+			logger.LogInfoEvent("Removing SSTable not listed in the manifest: %s", path)
+			storage.RemoveSSTableFile(path)
+		}
+	}
+	sidecars, _ := filepath.Glob(storage.BloomSidecarFilename(filepath.Join(dir, "*.sst")))
+	for _, path := range sidecars {
+		if !live[strings.TrimSuffix(path, filepath.Ext(path))] {
+			os.Remove(path)
+		}
+	}
+
+	// Start the manifest over from the recovered layout so it stays small
+	if err := manifest.Rewrite(system.SSTables); err != nil {
+		manifest.Close()
+		return err
+	}
+	system.Manifest = manifest
+
+	if len(live) > 0 {
+		logger.LogInfoEvent("Recovered %d SSTables from %s", len(live), dir)
+	}
+	return nil
+}
+
+// layoutFromFilenames groups tables by the level in their filename, each
+// level oldest first since file IDs are allocated in order.
+func layoutFromFilenames(paths []string) [][]string {
+	type table struct {
+		name   string
+		fileID int64
+	}
+	var levels [][]table
+	for _, path := range paths {
+		level, fileID, ok := storage.ParseSSTableFilename(path)
+		if !ok {
+			continue
+		}
+		for len(levels) <= level {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], table{filepath.Base(path), fileID})
+	}
+
+	layout := make([][]string, len(levels))
+	for level, tables := range levels {
+		sort.Slice(tables, func(i, j int) bool { return tables[i].fileID < tables[j].fileID })
+		for _, t := range tables {
+			layout[level] = append(layout[level], t.name)
+		}
+	}
+	return layout
+}
+
+// recoverWal replays the WAL segments in the order they were rotated. The
+// newest becomes the active WAL and is replayed into the memtable. The older
+// ones, whose memtables had not been flushed yet, are replayed into
+// immutable memtables, oldest first, for the flush agent to pick up. It is
+// a no-op when disk durability is disabled.
+func recoverWal(system *core.SystemState) error {
+	if !system.Configuration.EnableDiskDurability {
+		return nil
+	}
+	syncEveryBatch, err := storage.SyncsEveryBatch(system.Configuration.WalSyncMode)
+	if err != nil {
+		return err
+	}
+
+	segments, err := storage.WalSegmentPaths(system.Configuration.WriteAheadLogFilePath)
+	if err != nil {
+		return err
+	}
+	activePath := system.Configuration.WriteAheadLogFilePath
+	if len(segments) > 0 {
+		activePath = segments[len(segments)-1]
+		segments = segments[:len(segments)-1]
+	}
+	for _, path := range segments {
+		wal, err := storage.NewDiskWAL(path, syncEveryBatch)
+		if err != nil {
+			return err
+		}
+		table := system.NewMemTable()
+		if err := wal.Replay(sequenced(system, table.PutEntry)); err != nil {
+			wal.Close()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		system.QueueRecoveredImmutable(table, wal)
+	}
+
+	wal, err := storage.NewDiskWAL(activePath, syncEveryBatch)
+	if err != nil {
+		return err
+	}
+	system.ActiveWal = wal
+
+	if err := system.ActiveWal.Replay(sequenced(system, func(e common.Entry) {
+		system.MemTable.PutEntry(e)
+	})); err != nil {
+		return fmt.Errorf("%s: %w", activePath, err)
+	}
+	return nil
+}
+
+// closeRecoveredFiles closes what recovery opened before it failed.
+func closeRecoveredFiles(system *core.SystemState) {
+	for _, wal := range append([]common.WriteAheadLog{system.ActiveWal}, system.FrozenWALs...) {
+		if wal != nil {
+			wal.Close()
+		}
+	}
+	system.Manifest.Close()
+}
+
+// sequenced keeps new sequences above every replayed one. Records from logs
+// written before sequences existed are numbered as they are replayed, which
+// orders them after every recovered SSTable entry and in log order.
+func sequenced(system *core.SystemState, put func(common.Entry)) func(common.Entry) {
+	return func(e common.Entry) {
+		if e.Sequence == 0 {
+			e.Sequence = system.AllocateSequences(1)
+		} else {
+			system.ReserveSequencesThrough(e.Sequence)
+		}
+		put(e)
+	}
+}
+
+// SystemState exposes the underlying state for servers built on the engine.
+func (e *Engine) SystemState() *core.SystemState {
+	return e.state
+}
+
+// Ingestion exposes the write path for servers built on the engine.
+func (e *Engine) Ingestion() *agents.IngestionSubsystem {
+	return e.ingestion
+}
+
+// SetReadOnlyMode toggles read-only mode: writes fail with ErrReadOnly and
+// nothing is flushed or compacted, so the files on disk stay as they are.
+func (e *Engine) SetReadOnlyMode(enabled bool) {
+	e.state.SetReadOnlyMode(enabled)
+}
+
+// Put stores value under key; ttlInSeconds <= 0 means no expiry.
+func (e *Engine) Put(key string, value []byte, ttlInSeconds int) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	return e.ingestion.SubmitIngestionRequest(key, value, ttlInSeconds, false)
+}
+
+// Delete writes a tombstone for key.
+func (e *Engine) Delete(key string) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	return e.ingestion.SubmitIngestionRequest(key, nil, 0, true)
+}
+
+// BatchPut stores several keys at once; the three slices are parallel.
+func (e *Engine) BatchPut(keys []string, values [][]byte, ttlsInSeconds []int) error {
+	if err := e.checkWritable(); err != nil {
+		return err
+	}
+	if len(keys) != len(values) || len(keys) != len(ttlsInSeconds) {
+		return fmt.Errorf("batch put: %d keys, %d values and %d ttls must match", len(keys), len(values), len(ttlsInSeconds))
+	}
+	return e.ingestion.SubmitBatchIngestion(keys, values, ttlsInSeconds)
+}
+
+// Get returns the live value for key, consulting the key cache first.
+func (e *Engine) Get(key string) ([]byte, bool) {
+	entry, found := e.GetEntry(key)
+	return entry.Value, found
+}
+
+// GetEntry is Get returning the whole entry, so counters can be told apart.
+func (e *Engine) GetEntry(key string) (common.Entry, bool) {
+	return e.state.FindLive(key)
+}
+
+// Scan returns up to limit live entries with start <= key < end in key order.
+// An empty end means no upper bound and limit <= 0 means no limit.
+func (e *Engine) Scan(start, end string, limit int) ([]common.Entry, error) {
+	e.state.PinSSTables()
+	defer e.state.UnpinSSTables()
+	return e.state.CaptureReadView().ScanRange(start, end, limit)
+}
+
+// Snapshot returns a point-in-time read view. It must be released.
+func (e *Engine) Snapshot() *Snapshot {
+	return newSnapshot(e.state)
+}
+
+// Close drains pending writes, stops the background agents and closes the
+// WAL and manifest files. Unflushed memtables are recovered from the WAL on next Open.
+func (e *Engine) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.ingestion.Stop()
+		e.state.StopBackgroundAgents()
+		err = e.closeWriteAheadLogs()
+		if e.state.Manifest != nil {
+			e.state.Manifest.Close()
+		}
+		e.state.MappedReaders.Close()
+	})
+	return err
+}
+
+// Shutdown is Close for a planned stop: once pending writes are drained and
+// the agents have stopped, every memtable is flushed to SSTables, so the next
+// Open has no WAL to replay. If ctx ends first, the memtables left are
+// recovered from the WAL as after Close, and ctx's error is returned.
+func (e *Engine) Shutdown(ctx context.Context) error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.ingestion.Stop()
+		e.state.StopBackgroundAgents()
+
+		// A drained store is already flushed and must not change on disk
+		if !e.state.Configuration.InMemoryOnly && !e.state.IsReadOnlyMode() {
+			var flushed int
+			flushed, err = agents.FlushAll(ctx, e.state)
+			logger.LogInfoEvent("Shutdown flushed %d memtables", flushed)
+		}
+
+		if closeErr := e.closeWriteAheadLogs(); err == nil {
+			err = closeErr
+		}
+		if e.state.Manifest != nil {
+			e.state.Manifest.Close()
+		}
+		e.state.MappedReaders.Close()
+	})
+	return err
+}
+
+// closeWriteAheadLogs syncs and closes every open WAL.
+func (e *Engine) closeWriteAheadLogs() error {
+	e.state.Mutex.Lock()
+	defer e.state.Mutex.Unlock()
+
+	var firstErr error
+	wals := append([]common.WriteAheadLog{e.state.ActiveWal}, e.state.FrozenWALs...)
+	for _, wal := range wals {
+		if wal == nil {
+			continue
+		}
+		if err := wal.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := wal.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (e *Engine) checkWritable() error {
+	switch {
+	case e.isClosed():
+		return ErrClosed
+	case e.state.IsReadOnlyMode():
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func (e *Engine) isClosed() bool {
+	select {
+	case <-e.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,778 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sndv-kv/internal/agents"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/config"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/metrics"
+	"sndv-kv/internal/storage"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitializeLogger("./test_logs_engine", "ERROR")
+	code := m.Run()
+	os.RemoveAll("./test_logs_engine")
+	os.Exit(code)
+}
+
+func testConfig(dir string) config.SystemConfiguration {
+	return config.SystemConfiguration{
+		DataDirectoryPath:               dir,
+		WriteAheadLogFilePath:           dir + "/wal.log",
+		MaximumMemtableSizeInBytes:      1024 * 1024,
+		EnableDiskDurability:            true,
+		BloomFilterFalsePositiveRate:    0.01,
+		MaximumCpuCount:                 2,
+		LevelZeroCompactionTriggerCount: 2,
+		CompactionIntervalInSeconds:     1,
+		KeyCacheCapacityCount:           100,
+	}
+}
+
+func openTestEngine(t *testing.T, dir string) *Engine {
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	eng, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { eng.Close() })
+	return eng
+}
+
+func TestRecoverWal(t *testing.T) {
+	dir := "./test_engine_wal"
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(dir)
+
+	cfg := config.SystemConfiguration{
+		WriteAheadLogFilePath: dir + "/wal.log",
+		EnableDiskDurability:  true,
+	}
+	system := core.NewSystemState(cfg)
+
+	// Case 1: Success (New file)
+	if err := recoverWal(system); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if system.ActiveWal == nil {
+		t.Error("WAL not initialized")
+	}
+	system.ActiveWal.Close()
+
+	// Case 2: Disabled
+	system.Configuration.EnableDiskDurability = false
+	system.ActiveWal = nil
+
+	if err := recoverWal(system); err != nil {
+		t.Error("Should succeed when disabled")
+	}
+	if system.ActiveWal != nil {
+		t.Error("Should not init WAL when disabled")
+	}
+}
+
+func TestEngine_CrudAndScan(t *testing.T) {
+	eng := openTestEngine(t, "./test_engine_crud")
+
+	if err := eng.Put("a", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	eng.BatchPut([]string{"b", "c", "d"}, [][]byte{[]byte("2"), []byte("3"), []byte("4")}, []int{0, 0, 0})
+	eng.Delete("c")
+
+	if val, ok := eng.Get("a"); !ok || string(val) != "1" {
+		t.Errorf("Get a: %q %v", val, ok)
+	}
+	if _, ok := eng.Get("c"); ok {
+		t.Error("Deleted key still visible")
+	}
+
+	entries, err := eng.Scan("a", "d", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "a" || entries[1].Key != "b" {
+		t.Errorf("Unexpected scan result: %+v", entries)
+	}
+
+	if err := eng.BatchPut([]string{"x"}, nil, nil); err == nil {
+		t.Error("Mismatched batch should fail")
+	}
+}
+
+func TestEngine_SnapshotBootsAnotherInstance(t *testing.T) {
+	dir, snapshotDir := "./test_engine_snapshot_src", "./test_engine_snapshot_dst"
+	os.RemoveAll(snapshotDir)
+	t.Cleanup(func() { os.RemoveAll(snapshotDir) })
+	eng := openTestEngine(t, dir)
+
+	eng.Put("flushed", []byte("1"), 0)
+	if _, err := agents.Sync(eng.SystemState(), true); err != nil {
+		t.Fatal(err)
+	}
+	eng.Put("unflushed", []byte("2"), 0)
+
+	tables, err := agents.Snapshot(eng.SystemState(), snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 2 {
+		t.Errorf("Snapshot holds %d tables, want 2", tables)
+	}
+	if _, err := agents.Snapshot(eng.SystemState(), snapshotDir); !errors.Is(err, agents.ErrSnapshotTargetNotEmpty) {
+		t.Errorf("Snapshot into a non-empty directory should fail, got %v", err)
+	}
+	eng.Put("after", []byte("3"), 0)
+
+	restored, err := Open(testConfig(snapshotDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	for key, want := range map[string]string{"flushed": "1", "unflushed": "2"} {
+		if val, ok := restored.Get(key); !ok || string(val) != want {
+			t.Errorf("Restored %s = %q, %v", key, val, ok)
+		}
+	}
+	if _, ok := restored.Get("after"); ok {
+		t.Error("Write made after the snapshot reached it")
+	}
+}
+
+func TestEngine_SnapshotInReadOnlyMode(t *testing.T) {
+	dir, snapshotDir := "./test_engine_snapshot_ro_src", "./test_engine_snapshot_ro_dst"
+	os.RemoveAll(snapshotDir)
+	t.Cleanup(func() { os.RemoveAll(snapshotDir) })
+	eng := openTestEngine(t, dir)
+
+	eng.Put("flushed", []byte("1"), 0)
+	if _, err := agents.Sync(eng.SystemState(), true); err != nil {
+		t.Fatal(err)
+	}
+	eng.Put("unflushed", []byte("2"), 0)
+	eng.SystemState().SetReadOnlyMode(true)
+
+	before, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := agents.Snapshot(eng.SystemState(), snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 2 {
+		t.Errorf("Snapshot holds %d tables, want 2", tables)
+	}
+	after, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("Read-only snapshot changed the data directory: %d files, was %d", len(after), len(before))
+	}
+
+	restored, err := Open(testConfig(snapshotDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for key, want := range map[string]string{"flushed": "1", "unflushed": "2"} {
+		if val, ok := restored.Get(key); !ok || string(val) != want {
+			t.Errorf("Restored %s = %q, %v", key, val, ok)
+		}
+	}
+}
+
+func TestEngine_RestoreFromSnapshot(t *testing.T) {
+	dir, snapshotDir, restoreDir := "./test_engine_restore_src", "./test_engine_restore_snap", "./test_engine_restore_dst"
+	for _, d := range []string{snapshotDir, restoreDir} {
+		os.RemoveAll(d)
+		t.Cleanup(func() { os.RemoveAll(d) })
+	}
+	eng := openTestEngine(t, dir)
+	eng.Put("k1", []byte("v1"), 0)
+	eng.Put("k2", []byte("v2"), 0)
+	if _, err := agents.Snapshot(eng.SystemState(), snapshotDir); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(restoreDir)
+	cfg.RestoreFromPath = dir + "/missing"
+	if err := Restore(cfg, false); err == nil {
+		t.Error("Restore from a directory without a manifest should fail")
+	}
+
+	cfg.RestoreFromPath = snapshotDir
+	if err := Restore(cfg, false); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Put("k1", []byte("changed"), 0)
+	restored.Close()
+
+	if err := Restore(cfg, false); !errors.Is(err, ErrRestoreTargetNotEmpty) {
+		t.Fatalf("Restore over an existing store should be refused, got %v", err)
+	}
+	if err := Restore(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	restored, err = Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	for key, want := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if val, ok := restored.Get(key); !ok || string(val) != want {
+			t.Errorf("Restored %s = %q, %v, want %q", key, val, ok, want)
+		}
+	}
+}
+
+func TestEngine_SkipListMemtableFlushesAndScans(t *testing.T) {
+	dir := "./test_engine_skiplist"
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := testConfig(dir)
+	cfg.MemtableImplementation = "btree"
+	if _, err := Open(cfg); err == nil {
+		t.Fatal("Open should reject an unknown memtable implementation")
+	}
+
+	cfg.MemtableImplementation = storage.MemtableSkipList
+	eng, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	if _, ok := eng.SystemState().MemTable.(*storage.SkipListMemoryTable); !ok {
+		t.Fatalf("Expected a skip list memtable, got %T", eng.SystemState().MemTable)
+	}
+
+	for _, key := range []string{"d", "b", "e", "a", "c"} {
+		eng.Put(key, []byte("v-"+key), 0)
+	}
+	if _, err := agents.Sync(eng.SystemState(), true); err != nil {
+		t.Fatal(err)
+	}
+	eng.Put("bb", []byte("v-bb"), 0)
+
+	entries, err := eng.Scan("b", "e", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	if fmt.Sprint(keys) != "[b bb c d]" {
+		t.Errorf("Scan over a flushed table and a skip list memtable returned %v", keys)
+	}
+}
+
+func TestEngine_SnapshotIsolation(t *testing.T) {
+	eng := openTestEngine(t, "./test_engine_snapshot")
+
+	eng.Put("k", []byte("old"), 0)
+	snap := eng.Snapshot()
+	defer snap.Release()
+
+	eng.Put("k", []byte("new"), 0)
+	eng.Put("added", []byte("x"), 0)
+
+	if val, ok := snap.Get("k"); !ok || string(val) != "old" {
+		t.Errorf("Snapshot saw %q", val)
+	}
+	if _, ok := snap.Get("added"); ok {
+		t.Error("Snapshot saw a later write")
+	}
+	if val, _ := eng.Get("k"); string(val) != "new" {
+		t.Errorf("Engine saw %q", val)
+	}
+}
+
+func TestEngine_SnapshotPinsCompactedFiles(t *testing.T) {
+	eng := openTestEngine(t, "./test_engine_pin")
+	state := eng.SystemState()
+
+	meta, _ := storage.WriteSortedStringTableToDisk(nil, state.Configuration.DataDirectoryPath+"/L0_900.sst", 0, nil)
+
+	snap := eng.Snapshot()
+	state.Mutex.Lock()
+	state.RemoveSSTableFiles([]string{meta.Filename})
+	state.Mutex.Unlock()
+
+	if _, err := os.Stat(meta.Filename); err != nil {
+		t.Fatal("Pinned file removed while a snapshot is open")
+	}
+	snap.Release()
+	if _, err := os.Stat(meta.Filename); !os.IsNotExist(err) {
+		t.Error("Deferred file not removed after release")
+	}
+}
+
+func TestEngine_TwoInstancesSimultaneously(t *testing.T) {
+	first := openTestEngine(t, "./test_engine_first")
+	second := openTestEngine(t, "./test_engine_second")
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		first.Put(key, []byte("first"), 0)
+		second.Put(key, []byte("second"), 0)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if val, _ := first.Get(key); string(val) != "first" {
+			t.Fatalf("first engine returned %q for %s", val, key)
+		}
+		if val, _ := second.Get(key); string(val) != "second" {
+			t.Fatalf("second engine returned %q for %s", val, key)
+		}
+	}
+
+	first.Close()
+	if err := first.Put("late", []byte("v"), 0); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := second.Put("still", []byte("open"), 0); err != nil {
+		t.Errorf("Closing one engine affected the other: %v", err)
+	}
+}
+
+func TestEngine_ReopenRecoversFromWal(t *testing.T) {
+	dir := "./test_engine_reopen"
+	eng := openTestEngine(t, dir)
+	eng.Put("durable", []byte("yes"), 0)
+	eng.Close()
+
+	reopened, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if _, ok := reopened.Get("durable"); !ok {
+		t.Error("Key lost across reopen")
+	}
+}
+
+func TestEngine_ReopenReplaysRotatedWalsInOrder(t *testing.T) {
+	dir := "./test_engine_reopen_rotated"
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// Every write outgrows the WAL limit and rotates; with the agents
+	// stopped nothing is flushed, as after a crash
+	cfg := testConfig(dir)
+	cfg.MaximumWalSizeInBytes = 1
+	eng, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eng.state.StopBackgroundAgents()
+	for _, value := range []string{"old", "new"} {
+		if err := eng.Put("k", []byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eng.Close()
+
+	segments, err := storage.WalSegmentPaths(cfg.WriteAheadLogFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 || segments[0] != cfg.WriteAheadLogFilePath {
+		t.Fatalf("Expected the base WAL and two rotated segments, got %v", segments)
+	}
+
+	reopened, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if val, ok := reopened.Get("k"); !ok || string(val) != "new" {
+		t.Errorf("Get k = %q, %v after reopen, want the newest value", val, ok)
+	}
+	state := reopened.state
+	state.Mutex.RLock()
+	defer state.Mutex.RUnlock()
+	if got := state.ActiveWal.(*storage.DiskWAL).Path(); got != segments[2] {
+		t.Errorf("Active WAL is %s, want the newest segment %s", got, segments[2])
+	}
+	// rotateFrozenWal deletes FrozenWALs[0] first, so it must be the oldest
+	if len(state.FrozenWALs) != 2 {
+		t.Fatalf("Expected 2 frozen WALs, got %d", len(state.FrozenWALs))
+	}
+	for i, wal := range state.FrozenWALs {
+		if got := wal.(*storage.DiskWAL).Path(); got != segments[i] {
+			t.Errorf("FrozenWALs[%d] is %s, want %s", i, got, segments[i])
+		}
+	}
+}
+
+func TestEngine_IntervalWalSyncRecoversAcrossReopen(t *testing.T) {
+	dir := "./test_engine_wal_sync"
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := testConfig(dir)
+	cfg.WalSyncMode = "sometimes"
+	if _, err := Open(cfg); err == nil {
+		t.Fatal("Open should reject an unknown WAL sync mode")
+	}
+
+	cfg.WalSyncMode = storage.WalSyncInterval
+	cfg.WalSyncIntervalInMilliseconds = 10
+	eng, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncs := atomic.LoadInt64(&metrics.Global.WalSyncCount)
+	eng.Put("durable", []byte("yes"), 0)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&metrics.Global.WalSyncCount) == syncs && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&metrics.Global.WalSyncCount) == syncs {
+		t.Error("Expected a timed WAL sync")
+	}
+	eng.Close()
+
+	reopened, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, ok := reopened.Get("durable"); !ok {
+		t.Error("Key lost across reopen")
+	}
+}
+
+func TestEngine_ShutdownFlushesEverything(t *testing.T) {
+	dir := "./test_engine_shutdown"
+	eng := openTestEngine(t, dir)
+	for i := 0; i < 50; i++ {
+		eng.Put(fmt.Sprintf("k%02d", i), []byte("v"), 0)
+	}
+	if err := eng.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := eng.Put("late", []byte("v"), 0); err != ErrClosed {
+		t.Errorf("Expected writes after shutdown to fail with ErrClosed, got %v", err)
+	}
+
+	// Every frozen WAL was flushed and deleted, leaving the fresh active one
+	if wals, _ := filepath.Glob(filepath.Join(dir, "wal.log*")); len(wals) != 1 {
+		t.Errorf("Expected only the active WAL left, got %v", wals)
+	}
+
+	reopened, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if n := reopened.SystemState().MemTable.Len(); n != 0 {
+		t.Errorf("Expected nothing replayed from the WAL, got %d entries", n)
+	}
+	if _, ok := reopened.Get("k49"); !ok {
+		t.Error("Key lost across shutdown")
+	}
+}
+
+func TestEngine_ShutdownStopsFlushingOnceContextEnds(t *testing.T) {
+	dir := "./test_engine_shutdown_cancelled"
+	eng := openTestEngine(t, dir)
+	eng.Put("k", []byte("v"), 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := eng.Shutdown(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	reopened, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, ok := reopened.Get("k"); !ok {
+		t.Error("Unflushed key not recovered from the WAL")
+	}
+}
+
+func TestEngine_ReopenLoadsSSTables(t *testing.T) {
+	dir := "./test_engine_reopen_sstables"
+	eng := openTestEngine(t, dir)
+	for i := 0; i < 50; i++ {
+		eng.Put(fmt.Sprintf("k%02d", i), []byte("flushed"), 0)
+	}
+	if _, err := agents.Sync(eng.SystemState(), true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	eng.Close()
+
+	before, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(before) == 0 {
+		t.Fatal("Flush wrote no SSTables")
+	}
+
+	reopened, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if n := reopened.SystemState().MemTable.Len(); n != 0 {
+		t.Errorf("Expected an empty memtable after reopen, got %d entries", n)
+	}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if val, ok := reopened.Get(key); !ok || string(val) != "flushed" {
+			t.Fatalf("Get %s after reopen: %q %v", key, val, ok)
+		}
+	}
+
+	// A new flush must not reuse the file IDs of the recovered tables
+	reopened.Put("k00", []byte("newer"), 0)
+	if _, err := agents.Sync(reopened.SystemState(), true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(after) != len(before)+1 {
+		t.Errorf("Expected %d SSTables, found %d", len(before)+1, len(after))
+	}
+	if val, _ := reopened.Get("k00"); string(val) != "newer" {
+		t.Errorf("Expected the newest table to win, got %q", val)
+	}
+	if val, _ := reopened.Get("k49"); string(val) != "flushed" {
+		t.Errorf("Recovered table lost k49: %q", val)
+	}
+}
+
+func TestEngine_ManifestRecoversInterruptedCompaction(t *testing.T) {
+	dir := "./test_engine_manifest"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig(dir)
+	cfg.LevelZeroCompactionTriggerCount = 100
+	reopen := func() *Engine {
+		eng, err := Open(cfg)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		return eng
+	}
+	tableFiles := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+		return files
+	}
+
+	// Two flushes overlapping on k10..k19; merged is what compacting them gives
+	var merged []common.Entry
+	for i := 0; i < 30; i++ {
+		version := "v1"
+		if i >= 10 {
+			version = "v2"
+		}
+		merged = append(merged, common.Entry{Key: fmt.Sprintf("k%02d", i), Value: []byte(version)})
+	}
+	eng := reopen()
+	for _, flush := range []struct {
+		from, to int
+		version  string
+	}{{0, 20, "v1"}, {10, 30, "v2"}} {
+		for i := flush.from; i < flush.to; i++ {
+			eng.Put(fmt.Sprintf("k%02d", i), []byte(flush.version), 0)
+		}
+		if _, err := agents.Sync(eng.SystemState(), true); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	eng.Close()
+	l0Files := tableFiles()
+	if len(l0Files) != 2 {
+		t.Fatalf("Expected 2 L0 tables, found %v", l0Files)
+	}
+
+	checkLayout := func(eng *Engine, want int) {
+		t.Helper()
+		seen := make(map[string]bool)
+		for _, tables := range eng.SystemState().SSTables {
+			for _, meta := range tables {
+				if seen[meta.Filename] {
+					t.Errorf("%s is listed twice", meta.Filename)
+				}
+				seen[meta.Filename] = true
+			}
+		}
+		if len(seen) != want || len(tableFiles()) != want {
+			t.Errorf("Expected %d tables, state has %d and disk %v", want, len(seen), tableFiles())
+		}
+		for _, e := range merged {
+			if val, ok := eng.Get(e.Key); !ok || string(val) != string(e.Value) {
+				t.Fatalf("Get %s: %q %v, want %q", e.Key, val, ok, e.Value)
+			}
+		}
+	}
+
+	// Killed after writing the merged table but before committing it
+	uncommitted := storage.SSTableFilename(dir, 1, 1000)
+	if _, err := storage.WriteSortedStringTableToDisk(merged, uncommitted, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	eng = reopen()
+	checkLayout(eng, 2)
+	if _, err := os.Stat(uncommitted); !os.IsNotExist(err) {
+		t.Errorf("Uncommitted output %s was not removed", uncommitted)
+	}
+	eng.Close()
+
+	// Killed after committing but before deleting the merged inputs
+	committed := storage.SSTableFilename(dir, 1, 1001)
+	meta, err := storage.WriteSortedStringTableToDisk(merged, committed, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, _, _, err := storage.OpenManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Record([][]storage.SSTableMetadata{nil, {meta}}); err != nil {
+		t.Fatal(err)
+	}
+	manifest.Close()
+
+	eng = reopen()
+	defer eng.Close()
+	checkLayout(eng, 1)
+	if tables := eng.SystemState().SSTables; len(tables[0]) != 0 || len(tables[1]) != 1 || tables[1][0].Filename != committed {
+		t.Errorf("Unexpected layout after recovery: %v", tables)
+	}
+	for _, path := range l0Files {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Superseded input %s was not removed", path)
+		}
+	}
+}
+
+func TestEngine_ReopenRestoresBloomFilters(t *testing.T) {
+	dir := "./test_engine_reopen_bloom"
+	eng := openTestEngine(t, dir)
+	for i := 0; i < 200; i++ {
+		eng.Put(fmt.Sprintf("present_%03d", i), []byte("v"), 0)
+	}
+	if _, err := agents.Sync(eng.SystemState(), true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	meta := eng.SystemState().SSTables[0][0]
+	if _, err := os.Stat(storage.BloomSidecarFilename(meta.Filename)); err != nil {
+		t.Fatalf("No bloom filter file beside %s: %v", meta.Filename, err)
+	}
+	answers := func(bloom common.BloomFilter) []bool {
+		var out []bool
+		for i := 0; i < 200; i++ {
+			out = append(out, bloom.Contains(meta.FileID, []byte(fmt.Sprintf("present_%03d", i))))
+		}
+		for i := 0; i < 5000; i++ {
+			out = append(out, bloom.Contains(meta.FileID, []byte(fmt.Sprintf("absent_%04d", i))))
+		}
+		return out
+	}
+	before := answers(eng.SystemState().BloomFilter)
+	eng.Close()
+
+	reopened, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	after := answers(reopened.SystemState().BloomFilter)
+	falsePositives := 0
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("Answer %d changed across restart: %v -> %v", i, before[i], after[i])
+		}
+		if i < 200 && !after[i] {
+			t.Fatalf("Present key %d reported absent", i)
+		}
+		if i >= 200 && after[i] {
+			falsePositives++
+		}
+	}
+	if falsePositives > 5000/20 {
+		t.Errorf("%d of 5000 absent keys pass the restored filter", falsePositives)
+	}
+}
+
+func TestEngine_InMemoryOnly(t *testing.T) {
+	dir := "./test_engine_in_memory"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig(dir)
+	cfg.InMemoryOnly = true
+	cfg.MaximumMemtableSizeInBytes = 64 * 1024
+
+	eng, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer eng.Close()
+
+	if err := eng.Put("hot", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := eng.Get("hot"); !ok || string(val) != "value" {
+		t.Fatalf("Get hot: %q %v", val, ok)
+	}
+
+	// Each entry is ~1KB, so this writes several times the budget
+	value := make([]byte, 1000)
+	for i := 0; i < 500; i++ {
+		if err := eng.Put(fmt.Sprintf("key_%03d", i), value, 0); err != nil {
+			t.Fatal(err)
+		}
+		eng.Get("hot")
+	}
+
+	if size := eng.SystemState().MemTable.Size(); size > cfg.MaximumMemtableSizeInBytes {
+		t.Errorf("Memtable holds %d bytes, over the %d byte limit", size, cfg.MaximumMemtableSizeInBytes)
+	}
+	if _, ok := eng.Get("key_000"); ok {
+		t.Error("Oldest key should have been evicted")
+	}
+	if _, ok := eng.Get("key_499"); !ok {
+		t.Error("Newest key should still be present")
+	}
+	if _, ok := eng.Get("hot"); !ok {
+		t.Error("Frequently read key should survive eviction")
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("In-memory engine touched the disk: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sndv-kv/internal/config"
+	"sndv-kv/internal/logger"
+	"sndv-kv/internal/storage"
+	"strings"
+)
+
+// ErrRestoreTargetNotEmpty is returned for a restore into a data directory
+// that already holds a store.
+var ErrRestoreTargetNotEmpty = errors.New("data directory already holds a store")
+
+// Restore copies the snapshot at cfg.RestoreFromPath into the data
+// directory, to be recovered by the next Open: its manifest and SSTables, and
+// any WALs named like cfg.WriteAheadLogFilePath, which are placed beside it.
+// A data directory already holding a manifest, SSTables or WALs is refused
+// unless force is set, in which case those files are removed first.
+func Restore(cfg config.SystemConfiguration, force bool) error {
+	source := cfg.RestoreFromPath
+	if _, err := os.Stat(filepath.Join(source, storage.ManifestFilename)); err != nil {
+		return fmt.Errorf("restore directory %s has no manifest: %w", source, err)
+	}
+
+	existing, err := storeFiles(cfg.DataDirectoryPath, cfg.WriteAheadLogFilePath)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		if !force {
+			return fmt.Errorf("%w: %s", ErrRestoreTargetNotEmpty, cfg.DataDirectoryPath)
+		}
+		for _, path := range existing {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(cfg.DataDirectoryPath, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	restored, err := storeFiles(source, filepath.Join(source, filepath.Base(cfg.WriteAheadLogFilePath)))
+	if err != nil {
+		return err
+	}
+	// The manifest goes last, so an interrupted restore is never mistaken
+	// for a complete one
+	var manifest string
+	for _, path := range restored {
+		name := filepath.Base(path)
+		switch {
+		case name == storage.ManifestFilename:
+			manifest = path
+		case strings.HasSuffix(name, ".sst"):
+			err = storage.LinkSSTableFile(path, cfg.DataDirectoryPath)
+		case strings.HasPrefix(name, filepath.Base(cfg.WriteAheadLogFilePath)):
+			err = storage.CopyFile(path, filepath.Join(filepath.Dir(cfg.WriteAheadLogFilePath), name))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+	}
+	if err := storage.CopyFile(manifest, filepath.Join(cfg.DataDirectoryPath, storage.ManifestFilename)); err != nil {
+		return fmt.Errorf("failed to restore manifest: %w", err)
+	}
+
+	logger.LogInfoEvent("Restored %d files from %s into %s", len(restored), source, cfg.DataDirectoryPath)
+	return nil
+}
+
+// storeFiles lists the manifest, SSTables with their bloom sidecars, and the
+// active and frozen WALs at walPath that exist under dir.
+func storeFiles(dir, walPath string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{
+		filepath.Join(dir, storage.ManifestFilename),
+		filepath.Join(dir, "L*_*.sst"),
+		storage.BloomSidecarFilename(filepath.Join(dir, "L*_*.sst")),
+		walPath,
+		walPath + ".*",
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/core"
+	"sndv-kv/internal/storage"
+	"sync"
+	"time"
+)
+
+// Snapshot is a point-in-time read view of the engine. The active memtable is
+// copied, immutable memtables and SSTables are referenced, and the SSTable
+// files are pinned so compaction cannot delete them until Release.
+type Snapshot struct {
+	state       *core.SystemState
+	view        core.ReadView
+	releaseOnce sync.Once
+}
+
+func newSnapshot(state *core.SystemState) *Snapshot {
+	state.PinSSTables()
+	view := state.CaptureReadView()
+
+	frozen := storage.NewMemoryTable(1024)
+	for _, e := range view.MemTable.GetAll() {
+		frozen.PutEntry(e)
+	}
+	view.MemTable = frozen
+
+	return &Snapshot{state: state, view: view}
+}
+
+// Get returns the live value for key as of the snapshot.
+func (s *Snapshot) Get(key string) ([]byte, bool) {
+	entry, found := s.GetEntry(key)
+	return entry.Value, found
+}
+
+// GetEntry is Get returning the whole entry, so counters can be told apart.
+func (s *Snapshot) GetEntry(key string) (common.Entry, bool) {
+	entry, found := s.view.FindEntry(key)
+	if !found || entry.IsDeleted || entry.IsExpiredAt(time.Now().UnixNano()) {
+		return common.Entry{}, false
+	}
+	return entry, true
+}
+
+// Scan behaves like Engine.Scan against the snapshot.
+func (s *Snapshot) Scan(start, end string, limit int) ([]common.Entry, error) {
+	return s.view.ScanRange(start, end, limit)
+}
+
+// Release unpins the snapshot's SSTable files.
+func (s *Snapshot) Release() {
+	s.releaseOnce.Do(s.state.UnpinSSTables)
+}
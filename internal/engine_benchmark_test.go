@@ -29,7 +29,8 @@ func BenchmarkEngineWriteParallel(b *testing.B) {
 	}
 
 	bb := core.NewSystemState(cfg)
-	agents.InitializeIngestionSubsystem(bb)
+	ingestion := agents.InitializeIngestionSubsystem(bb)
+	defer ingestion.Stop()
 	agents.StartFlushAgentInBackground(bb)
 
 	var counter int64
@@ -42,7 +43,7 @@ func BenchmarkEngineWriteParallel(b *testing.B) {
 		for pb.Next() {
 			i := atomic.AddInt64(&counter, 1)
 			key := strconv.FormatInt(i, 10)
-			if err := agents.SubmitIngestionRequest(key, val, 0, false); err != nil {
+			if err := ingestion.SubmitIngestionRequest(key, val, 0, false); err != nil {
 				b.Fatal(err)
 			}
 		}
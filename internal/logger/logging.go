@@ -2,9 +2,12 @@ package logger
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,8 +19,13 @@ var (
 	globalBufferedLogWriter *bufio.Writer
 	globalLogMessageQueue   chan string
 	isLoggerInitialized     atomic.Bool
-	minimumSeverityLevel    int
+	isConsoleOutputDisabled atomic.Bool
+	isJsonFormatEnabled     atomic.Bool
+	droppedMessageCount     atomic.Uint64
+	minimumSeverityLevel    atomic.Int32
 	baseLogDirectoryPath    string
+	maximumBackupCount      int
+	maximumBackupAge        time.Duration
 	loggerMutex             sync.Mutex
 	shutdownSignalChannel   chan struct{}
 	backgroundWaitGroup     sync.WaitGroup
@@ -28,6 +36,9 @@ const (
 	SeverityInfo              = 1
 	SeverityError             = 2
 	MaximumLogFileSizeInBytes = 10 * 1024 * 1024 // 10 Megabytes
+	// droppedReportInterval is how often a warning reports messages dropped
+	// because the queue was full.
+	droppedReportInterval = 10 * time.Second
 )
 
 func InitializeLogger(directoryPath string, levelString string) error {
@@ -50,16 +61,7 @@ func InitializeLogger(directoryPath string, levelString string) error {
 	globalLogMessageQueue = make(chan string, 10000)
 	shutdownSignalChannel = make(chan struct{})
 
-	switch strings.ToUpper(levelString) {
-	case "DEBUG":
-		minimumSeverityLevel = SeverityDebug
-	case "INFO":
-		minimumSeverityLevel = SeverityInfo
-	case "ERROR":
-		minimumSeverityLevel = SeverityError
-	default:
-		minimumSeverityLevel = SeverityInfo
-	}
+	SetSeverityLevel(levelString)
 
 	isLoggerInitialized.Store(true)
 	backgroundWaitGroup.Add(1)
@@ -94,6 +96,15 @@ func closeAndFlushLoggerInternal() {
 	isLoggerInitialized.Store(false)
 }
 
+// SetRetention bounds the rotated system.log.<nanos> files kept after each
+// rotation: at most maxBackups of them (0 keeps any number), none older than
+// maxAge (0 keeps them regardless of age).
+func SetRetention(maxBackups int, maxAge time.Duration) {
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+	maximumBackupCount, maximumBackupAge = maxBackups, maxAge
+}
+
 func openLogFileInternal() error {
 	filePath := filepath.Join(baseLogDirectoryPath, "system.log")
 	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -105,31 +116,91 @@ func openLogFileInternal() error {
 	return nil
 }
 
+// SetConsoleOutputEnabled controls whether log lines are echoed to stdout in
+// addition to the log file. Echoing is enabled by default.
+func SetConsoleOutputEnabled(enabled bool) {
+	isConsoleOutputDisabled.Store(!enabled)
+}
+
+// Values of the log_format setting.
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+// SetOutputFormat selects plain "timestamp prefix message" lines (text, the
+// default) or one JSON object per line (json).
+func SetOutputFormat(format string) error {
+	switch format {
+	case "", FormatText:
+		isJsonFormatEnabled.Store(false)
+	case FormatJson:
+		isJsonFormatEnabled.Store(true)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// SetSeverityLevel changes the least severe level that is logged: DEBUG,
+// INFO or ERROR, case-insensitively. Anything else means INFO.
+func SetSeverityLevel(levelString string) {
+	switch strings.ToUpper(levelString) {
+	case "DEBUG":
+		minimumSeverityLevel.Store(SeverityDebug)
+	case "ERROR":
+		minimumSeverityLevel.Store(SeverityError)
+	default:
+		minimumSeverityLevel.Store(SeverityInfo)
+	}
+}
+
 func IsLoggerInitialized() bool {
 	return isLoggerInitialized.Load()
 }
 
+// DroppedMessageCount returns how many messages have been dropped because
+// the queue was full since the process started.
+func DroppedMessageCount() uint64 {
+	return droppedMessageCount.Load()
+}
+
 func processLogQueueInBackground() {
 	defer backgroundWaitGroup.Done()
 	flushTicker := time.NewTicker(500 * time.Millisecond)
 	defer flushTicker.Stop()
 
+	dropReportTicker := time.NewTicker(droppedReportInterval)
+	defer dropReportTicker.Stop()
+
 	bytesWrittenSinceLastCheck := int64(0)
 	consoleOutput := os.Stdout
+	writeLine := func(message string) {
+		if globalBufferedLogWriter != nil {
+			bytesWritten, _ := globalBufferedLogWriter.WriteString(message + "\n")
+			bytesWrittenSinceLastCheck += int64(bytesWritten)
+		}
+		if !isConsoleOutputDisabled.Load() {
+			fmt.Fprintln(consoleOutput, message)
+		}
+	}
+	reportedDrops := droppedMessageCount.Load()
 
 	for {
 		select {
 		case message := <-globalLogMessageQueue:
-			if globalBufferedLogWriter != nil {
-				bytesWritten, _ := globalBufferedLogWriter.WriteString(message + "\n")
-				bytesWrittenSinceLastCheck += int64(bytesWritten)
-			}
-			fmt.Fprintln(consoleOutput, message)
+			writeLine(message)
 
 			if bytesWrittenSinceLastCheck > 1024*10 {
 				CheckAndRotateLogFile()
 				bytesWrittenSinceLastCheck = 0
 			}
+		case <-dropReportTicker.C:
+			// Written directly, since the queue may still be full
+			if drops := droppedMessageCount.Load(); drops > reportedDrops {
+				writeLine(formatLogLine("[ERR]", "%d log messages dropped: the queue was full", drops-reportedDrops))
+				reportedDrops = drops
+			}
 		case <-flushTicker.C:
 			loggerMutex.Lock()
 			if globalBufferedLogWriter != nil {
@@ -160,7 +231,70 @@ func CheckAndRotateLogFile() {
 		os.Rename(oldFilePath, newFilePath)
 
 		openLogFileInternal()
+		pruneLogBackupsInternal()
+	}
+}
+
+// rotatedLogFile is a system.log.<nanos> file and its rotation time.
+type rotatedLogFile struct {
+	path      string
+	rotatedAt int64
+}
+
+// pruneLogBackupsInternal deletes rotated logs beyond the retention limits,
+// oldest first. Files whose suffix is not a timestamp are left alone.
+func pruneLogBackupsInternal() {
+	if maximumBackupCount <= 0 && maximumBackupAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(filepath.Join(baseLogDirectoryPath, "system.log.*"))
+	if err != nil {
+		return
 	}
+	backups := make([]rotatedLogFile, 0, len(matches))
+	for _, path := range matches {
+		nanos, err := strconv.ParseInt(strings.TrimPrefix(filepath.Ext(path), "."), 10, 64)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, rotatedLogFile{path: path, rotatedAt: nanos})
+	}
+	// Newest first, so the ones to keep lead
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotatedAt > backups[j].rotatedAt })
+
+	cutoff := time.Now().Add(-maximumBackupAge).UnixNano()
+	for i, backup := range backups {
+		tooMany := maximumBackupCount > 0 && i >= maximumBackupCount
+		tooOld := maximumBackupAge > 0 && backup.rotatedAt < cutoff
+		if tooMany || tooOld {
+			os.Remove(backup.path)
+		}
+	}
+}
+
+// jsonLogRecord is one line of JSON output.
+type jsonLogRecord struct {
+	Timestamp string `json:"ts"`
+	Level     string `json:"level"`
+	Message   string `json:"msg"`
+}
+
+// jsonAccessRecord is an access log line with its parts as fields.
+type jsonAccessRecord struct {
+	jsonLogRecord
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Remote     string  `json:"remote"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// levelNames maps the text prefixes to JSON levels.
+var levelNames = map[string]string{
+	"[ACC]": "access",
+	"[INF]": "info",
+	"[ERR]": "error",
+	"[DBG]": "debug",
 }
 
 func tryQueueLogMessage(prefix string, format string, args ...interface{}) {
@@ -168,13 +302,36 @@ func tryQueueLogMessage(prefix string, format string, args ...interface{}) {
 		return
 	}
 
-	timestamp := time.Now().Format("2006/01/02 15:04:05")
-	formattedMessage := fmt.Sprintf("%s %s "+format, append([]interface{}{timestamp, prefix}, args...)...)
+	queueLogLine(formatLogLine(prefix, format, args...))
+}
+
+// formatLogLine renders a message in the configured format.
+func formatLogLine(prefix string, format string, args ...interface{}) string {
+	now := time.Now()
+	if isJsonFormatEnabled.Load() {
+		return formatJsonRecord(jsonLogRecord{
+			Timestamp: now.Format(time.RFC3339Nano),
+			Level:     levelNames[prefix],
+			Message:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	timestamp := now.Format("2006/01/02 15:04:05")
+	return fmt.Sprintf("%s %s "+format, append([]interface{}{timestamp, prefix}, args...)...)
+}
+
+func formatJsonRecord(record any) string {
+	line, _ := json.Marshal(record)
+	return string(line)
+}
 
+func queueLogLine(line string) {
 	select {
-	case globalLogMessageQueue <- formattedMessage:
+	case globalLogMessageQueue <- line:
 	default:
-		// Queue full, drop message to prevent deadlock
+		// Queue full, drop message to prevent deadlock; counted so the
+		// loss is reported
+		droppedMessageCount.Add(1)
 	}
 }
 
@@ -182,20 +339,44 @@ func LogAccessEvent(format string, args ...interface{}) {
 	tryQueueLogMessage("[ACC]", format, args...)
 }
 
+// LogAccessRequest logs one served request. In JSON format the method, path,
+// remote address and duration are separate fields.
+func LogAccessRequest(method, path, remote string, duration time.Duration) {
+	if !isLoggerInitialized.Load() {
+		return
+	}
+	if !isJsonFormatEnabled.Load() {
+		tryQueueLogMessage("[ACC]", "%s %s %s %v", method, path, remote, duration)
+		return
+	}
+
+	queueLogLine(formatJsonRecord(jsonAccessRecord{
+		jsonLogRecord: jsonLogRecord{
+			Timestamp: time.Now().Format(time.RFC3339Nano),
+			Level:     levelNames["[ACC]"],
+			Message:   method + " " + path,
+		},
+		Method:     method,
+		Path:       path,
+		Remote:     remote,
+		DurationMs: float64(duration) / float64(time.Millisecond),
+	}))
+}
+
 func LogInfoEvent(format string, args ...interface{}) {
-	if minimumSeverityLevel <= SeverityInfo {
+	if minimumSeverityLevel.Load() <= SeverityInfo {
 		tryQueueLogMessage("[INF]", format, args...)
 	}
 }
 
 func LogErrorEvent(format string, args ...interface{}) {
-	if minimumSeverityLevel <= SeverityError {
+	if minimumSeverityLevel.Load() <= SeverityError {
 		tryQueueLogMessage("[ERR]", format, args...)
 	}
 }
 
 func LogDebugEvent(format string, args ...interface{}) {
-	if minimumSeverityLevel <= SeverityDebug {
+	if minimumSeverityLevel.Load() <= SeverityDebug {
 		tryQueueLogMessage("[DBG]", format, args...)
 	}
 }
@@ -1,7 +1,12 @@
 package logger
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -67,3 +72,166 @@ func TestManualLogRotationTrigger(t *testing.T) {
 		t.Error("Log file handle/identity did not change appropriately")
 	}
 }
+
+func TestConsoleOutputDisabled(t *testing.T) {
+	testDir := "./test_logs_no_console"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	// Stop any logger left running by earlier tests before swapping stdout
+	ShutdownLogger()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalStdout := os.Stdout
+	os.Stdout = writer
+
+	SetConsoleOutputEnabled(false)
+	defer SetConsoleOutputEnabled(true)
+
+	InitializeLogger(testDir, "INFO")
+	LogInfoEvent("file only line")
+	time.Sleep(100 * time.Millisecond)
+	ShutdownLogger()
+
+	os.Stdout = originalStdout
+	writer.Close()
+	consoleBytes, _ := io.ReadAll(reader)
+
+	if len(consoleBytes) != 0 {
+		t.Errorf("Expected no console output, got %q", consoleBytes)
+	}
+
+	fileBytes, _ := os.ReadFile(testDir + "/system.log")
+	if !strings.Contains(string(fileBytes), "file only line") {
+		t.Error("Log line missing from file")
+	}
+}
+
+func TestJsonFormat(t *testing.T) {
+	testDir := "./test_logs_json"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	SetConsoleOutputEnabled(false)
+	defer SetConsoleOutputEnabled(true)
+	if err := SetOutputFormat(FormatJson); err != nil {
+		t.Fatal(err)
+	}
+	defer SetOutputFormat(FormatText)
+
+	InitializeLogger(testDir, "INFO")
+	LogInfoEvent("hello %s", "world")
+	LogAccessRequest("GET", "/get", "127.0.0.1:5000", 1500*time.Microsecond)
+	time.Sleep(100 * time.Millisecond)
+	ShutdownLogger()
+
+	fileBytes, _ := os.ReadFile(testDir + "/system.log")
+	lines := strings.Split(strings.TrimSpace(string(fileBytes)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", fileBytes)
+	}
+
+	var info map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &info); err != nil {
+		t.Fatalf("Info line is not JSON: %v", err)
+	}
+	if info["level"] != "info" || info["msg"] != "hello world" || info["ts"] == nil {
+		t.Errorf("Info record = %v", info)
+	}
+
+	var access map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &access); err != nil {
+		t.Fatalf("Access line is not JSON: %v", err)
+	}
+	if access["level"] != "access" || access["method"] != "GET" || access["path"] != "/get" ||
+		access["remote"] != "127.0.0.1:5000" || access["duration_ms"] != 1.5 {
+		t.Errorf("Access record = %v", access)
+	}
+
+	if err := SetOutputFormat("xml"); err == nil {
+		t.Error("An unknown format should be refused")
+	}
+}
+
+func TestRotationKeepsMaxBackups(t *testing.T) {
+	testDir := "./test_logs_retention"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	SetRetention(2, 0)
+	defer SetRetention(0, 0)
+	InitializeLogger(testDir, "INFO")
+	defer ShutdownLogger()
+
+	// A stale backup past the age limit set below
+	stale := fmt.Sprintf("%s/system.log.%d", testDir, time.Now().Add(-48*time.Hour).UnixNano())
+	os.WriteFile(stale, []byte("old"), 0644)
+
+	for i := 0; i < 5; i++ {
+		// A sparse file past the size limit triggers rotation cheaply
+		if err := os.Truncate(testDir+"/system.log", MaximumLogFileSizeInBytes+1); err != nil {
+			t.Fatal(err)
+		}
+		CheckAndRotateLogFile()
+	}
+
+	backups, _ := filepath.Glob(testDir + "/system.log.*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups after 5 rotations, got %v", backups)
+	}
+	for _, backup := range backups {
+		if backup == stale {
+			t.Error("The oldest backup should have been deleted first")
+		}
+	}
+
+	SetRetention(0, 24*time.Hour)
+	os.WriteFile(stale, []byte("old"), 0644)
+	os.Truncate(testDir+"/system.log", MaximumLogFileSizeInBytes+1)
+	CheckAndRotateLogFile()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("A backup older than the age limit should be deleted")
+	}
+	if backups, _ := filepath.Glob(testDir + "/system.log.*"); len(backups) != 3 {
+		t.Errorf("Without a count limit every recent backup stays, got %v", backups)
+	}
+}
+
+func TestFullQueueCountsDroppedMessages(t *testing.T) {
+	testDir := "./test_logs_dropped"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	ShutdownLogger()
+
+	// Console output into a pipe nobody reads stalls the writer goroutine,
+	// so the queue fills up
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalStdout := os.Stdout
+	os.Stdout = writer
+	InitializeLogger(testDir, "INFO")
+
+	before := DroppedMessageCount()
+	padding := strings.Repeat("x", 100)
+	for i := 0; i < 30000; i++ {
+		LogInfoEvent("flood %d %s", i, padding)
+	}
+	dropped := DroppedMessageCount() - before
+
+	go io.Copy(io.Discard, reader)
+	ShutdownLogger()
+	os.Stdout = originalStdout
+	writer.Close()
+
+	if dropped == 0 {
+		t.Fatal("Flooding a stalled logger should count dropped messages")
+	}
+	if dropped > 30000 {
+		t.Errorf("Dropped %d of 30000 messages", dropped)
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sndv-kv/internal/logger"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// PrometheusContentType is the content type of the text exposition format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Gauge is a value the registry does not own, such as the memtable size,
+// for WritePrometheusText to render alongside the counters.
+type Gauge struct {
+	Name  string
+	Help  string
+	Value int64
+}
+
+// WritePrometheusText renders the registry, the goroutine count and the
+// given gauges in the Prometheus text exposition format.
+func WritePrometheusText(w io.Writer, gauges ...Gauge) {
+	writeSample(w, "sndv_write_ops_total", "counter", "Items applied to the memtable.", atomic.LoadInt64(&Global.WriteOps))
+	writeSample(w, "sndv_put_ops_total", "counter", "Puts applied to the memtable.", atomic.LoadInt64(&Global.PutOps))
+	writeSample(w, "sndv_delete_ops_total", "counter", "Deletes applied to the memtable.", atomic.LoadInt64(&Global.DeleteOps))
+	writeSample(w, "sndv_read_ops_total", "counter", "Lookups served.", atomic.LoadInt64(&Global.ReadOperationsCount))
+	writeSample(w, "sndv_cache_hits_total", "counter", "Lookups answered by the key cache.", atomic.LoadInt64(&Global.CacheHitCount))
+	writeSample(w, "sndv_cache_misses_total", "counter", "Lookups the key cache could not answer.", atomic.LoadInt64(&Global.CacheMissCount))
+	writeSample(w, "sndv_negative_cache_hits_total", "counter", "Lookups answered not found by the negative cache.", atomic.LoadInt64(&Global.NegativeCacheHitCount))
+	writeSample(w, "sndv_wal_syncs_total", "counter", "Timed WAL fsyncs under the interval sync mode.", atomic.LoadInt64(&Global.WalSyncCount))
+	writeSample(w, "sndv_write_stalls_total", "counter", "Memtable rotations that waited for the flush backlog.", atomic.LoadInt64(&Global.WriteStallCount))
+	writeSample(w, "sndv_sstable_lookups_total", "counter", "Point lookups that searched the SSTables.", atomic.LoadInt64(&Global.SSTableLookupCount))
+	writeSample(w, "sndv_sstable_files_read_total", "counter", "SSTable files opened by point lookups.", atomic.LoadInt64(&Global.SSTableFilesReadCount))
+	writeSample(w, "sndv_log_messages_dropped_total", "counter", "Log messages dropped because the log queue was full.", int64(logger.DroppedMessageCount()))
+	writeBatchSizeHistogram(w)
+	fmt.Fprintf(w, "# HELP %s Request latency by operation.\n# TYPE %s histogram\n", latencyMetricName, latencyMetricName)
+	writeLatencyHistogram(w, "read", &Global.ReadLatency)
+	writeLatencyHistogram(w, "write", &Global.WriteLatency)
+	writeSample(w, "sndv_wal_bytes", "gauge", "Size of the write-ahead logs.", atomic.LoadInt64(&Global.WalSizeInBytes))
+	writeSample(w, "sndv_disk_bytes", "gauge", "Size of the SSTables on disk.", atomic.LoadInt64(&Global.DiskSizeInBytes))
+	writeSample(w, "sndv_sstables", "gauge", "Number of SSTables.", atomic.LoadInt64(&Global.SSTableCount))
+	writeSample(w, "sndv_goroutines", "gauge", "Number of goroutines.", int64(runtime.NumGoroutine()))
+	for _, g := range gauges {
+		writeSample(w, g.Name, "gauge", g.Help, g.Value)
+	}
+}
+
+func writeSample(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+const latencyMetricName = "sndv_request_duration_seconds"
+
+func writeLatencyHistogram(w io.Writer, op string, h *LatencyHistogram) {
+	var cumulative int64
+	for i := range h.Buckets {
+		cumulative += atomic.LoadInt64(&h.Buckets[i])
+		bound := "+Inf"
+		if i < len(LatencyBucketBounds) {
+			bound = strconv.FormatFloat(LatencyBucketBounds[i].Seconds(), 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{op=\"%s\",le=\"%s\"} %d\n", latencyMetricName, op, bound, cumulative)
+	}
+	sum := time.Duration(atomic.LoadInt64(&h.SumInMicroseconds)) * time.Microsecond
+	fmt.Fprintf(w, "%s_sum{op=\"%s\"} %g\n", latencyMetricName, op, sum.Seconds())
+	fmt.Fprintf(w, "%s_count{op=\"%s\"} %d\n", latencyMetricName, op, atomic.LoadInt64(&h.Count))
+}
+
+// writeBatchSizeHistogram renders BatchSizeHistogram with cumulative
+// buckets. Item totals are not tracked, so there is no _sum series.
+func writeBatchSizeHistogram(w io.Writer) {
+	const name = "sndv_batch_size"
+	fmt.Fprintf(w, "# HELP %s Items per batch request.\n# TYPE %s histogram\n", name, name)
+	var cumulative int64
+	for i := range Global.BatchSizeHistogram {
+		cumulative += atomic.LoadInt64(&Global.BatchSizeHistogram[i])
+		bound := "+Inf"
+		if i < len(BatchSizeBucketBounds) {
+			bound = strconv.Itoa(BatchSizeBucketBounds[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
@@ -1,7 +1,9 @@
 package metrics
 
 import (
+	"sndv-kv/internal/logger"
 	"sync/atomic"
+	"time"
 )
 
 type SystemMetricsRegistry struct {
@@ -9,8 +11,71 @@ type SystemMetricsRegistry struct {
 	ReadOperationsCount  int64 `json:"read_operations_count"`
 	CacheHitCount        int64 `json:"cache_hit_count"`
 	CacheMissCount       int64 `json:"cache_miss_count"`
+	// NegativeCacheHitCount counts lookups answered "not found" by the
+	// negative cache without searching.
+	NegativeCacheHitCount int64 `json:"negative_cache_hit_count"`
+	WalSizeInBytes        int64 `json:"wal_size_in_bytes"`
+	// WalSyncCount counts timed fsyncs under the interval WAL sync mode.
+	WalSyncCount int64 `json:"wal_sync_count"`
+	// WriteStallCount counts rotations that waited for the flush backlog.
+	WriteStallCount int64 `json:"write_stall_count"`
+	// SSTableLookupCount counts point lookups that missed the memtables and
+	// searched the SSTables, and SSTableFilesReadCount the files they
+	// opened; their ratio is the read amplification.
+	SSTableLookupCount    int64 `json:"sstable_lookup_count"`
+	SSTableFilesReadCount int64 `json:"sstable_files_read_count"`
+	// DiskSizeInBytes and SSTableCount cover the SSTables, refreshed every
+	// disk_usage_interval_in_seconds.
+	DiskSizeInBytes int64 `json:"disk_size_in_bytes"`
+	SSTableCount    int64 `json:"sstable_count"`
 	// Exported as WriteOps for compatibility with agent logic
 	WriteOps int64 `json:"-"`
+
+	// PutOps and DeleteOps count applied items; WriteOps is their sum.
+	PutOps    int64 `json:"put_ops"`
+	DeleteOps int64 `json:"delete_ops"`
+	// BatchOps counts batch requests, bucketed by item count in
+	// BatchSizeHistogram (see BatchSizeBucketBounds).
+	BatchOps           int64                                 `json:"batch_ops"`
+	BatchSizeHistogram [len(BatchSizeBucketBounds) + 1]int64 `json:"batch_size_histogram"`
+
+	// ReadLatency and WriteLatency time lookup and write requests, from
+	// arrival to response, bucketed by LatencyBucketBounds.
+	ReadLatency  LatencyHistogram `json:"read_latency"`
+	WriteLatency LatencyHistogram `json:"write_latency"`
+}
+
+// BatchSizeBucketBounds are the inclusive upper bounds of the batch size
+// histogram buckets. The final bucket holds everything larger.
+var BatchSizeBucketBounds = [...]int{1, 10, 100, 1000, 10000}
+
+// LatencyBucketBounds are the inclusive upper bounds of the latency
+// histogram buckets. The final bucket holds everything slower.
+var LatencyBucketBounds = [...]time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second,
+}
+
+type LatencyHistogram struct {
+	Buckets           [len(LatencyBucketBounds) + 1]int64 `json:"buckets"`
+	Count             int64                               `json:"count"`
+	SumInMicroseconds int64                               `json:"sum_in_microseconds"`
+}
+
+func (h *LatencyHistogram) record(elapsed time.Duration) {
+	bucket := len(LatencyBucketBounds)
+	for i, bound := range LatencyBucketBounds {
+		if elapsed <= bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddInt64(&h.Buckets[bucket], 1)
+	atomic.AddInt64(&h.Count, 1)
+	atomic.AddInt64(&h.SumInMicroseconds, elapsed.Microseconds())
 }
 
 var Global SystemMetricsRegistry
@@ -27,11 +92,99 @@ func IncrementCacheMissCount() {
 	atomic.AddInt64(&Global.CacheMissCount, 1)
 }
 
+// CacheHitRatio returns the share of key cache lookups that hit, or 0
+// before the first lookup.
+func CacheHitRatio() float64 {
+	hits := atomic.LoadInt64(&Global.CacheHitCount)
+	lookups := hits + atomic.LoadInt64(&Global.CacheMissCount)
+	if lookups == 0 {
+		return 0
+	}
+	return float64(hits) / float64(lookups)
+}
+
+func IncrementNegativeCacheHitCount() {
+	atomic.AddInt64(&Global.NegativeCacheHitCount, 1)
+}
+
+// RecordWrites counts items applied to the memtable.
+func RecordWrites(puts, deletes int64) {
+	atomic.AddInt64(&Global.PutOps, puts)
+	atomic.AddInt64(&Global.DeleteOps, deletes)
+	atomic.AddInt64(&Global.WriteOps, puts+deletes)
+}
+
+// RecordBatch counts one batch request of the given number of items.
+func RecordBatch(items int) {
+	atomic.AddInt64(&Global.BatchOps, 1)
+	bucket := len(BatchSizeBucketBounds)
+	for i, bound := range BatchSizeBucketBounds {
+		if items <= bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddInt64(&Global.BatchSizeHistogram[bucket], 1)
+}
+
+// RecordReadLatency times one lookup request.
+func RecordReadLatency(elapsed time.Duration) {
+	Global.ReadLatency.record(elapsed)
+}
+
+// RecordWriteLatency times one write request.
+func RecordWriteLatency(elapsed time.Duration) {
+	Global.WriteLatency.record(elapsed)
+}
+
+func IncrementWalSyncCount() {
+	atomic.AddInt64(&Global.WalSyncCount, 1)
+}
+
+func IncrementWriteStallCount() {
+	atomic.AddInt64(&Global.WriteStallCount, 1)
+}
+
+func IncrementSSTableLookupCount() {
+	atomic.AddInt64(&Global.SSTableLookupCount, 1)
+}
+
+// AddSSTableLookupCount counts n lookups resolved together, as by /mget.
+func AddSSTableLookupCount(n int) {
+	atomic.AddInt64(&Global.SSTableLookupCount, int64(n))
+}
+
+func AddSSTableFilesReadCount(n int) {
+	if n > 0 {
+		atomic.AddInt64(&Global.SSTableFilesReadCount, int64(n))
+	}
+}
+
+// SetDiskUsage records the SSTables' summed size and count.
+func SetDiskUsage(sizeInBytes int64, tableCount int) {
+	atomic.StoreInt64(&Global.DiskSizeInBytes, sizeInBytes)
+	atomic.StoreInt64(&Global.SSTableCount, int64(tableCount))
+}
+
+func SetWalSizeInBytes(sizeInBytes int64) {
+	atomic.StoreInt64(&Global.WalSizeInBytes, sizeInBytes)
+}
+
 // GetCurrentState returns a snapshot for the API
 func GetCurrentState() map[string]int64 {
 	return map[string]int64{
-		"write_ops":  atomic.LoadInt64(&Global.WriteOps),
-		"read_ops":   atomic.LoadInt64(&Global.ReadOperationsCount),
-		"cache_hits": atomic.LoadInt64(&Global.CacheHitCount),
+		"write_ops":           atomic.LoadInt64(&Global.WriteOps),
+		"put_ops":             atomic.LoadInt64(&Global.PutOps),
+		"delete_ops":          atomic.LoadInt64(&Global.DeleteOps),
+		"batch_ops":           atomic.LoadInt64(&Global.BatchOps),
+		"read_ops":            atomic.LoadInt64(&Global.ReadOperationsCount),
+		"cache_hits":          atomic.LoadInt64(&Global.CacheHitCount),
+		"negative_cache_hits": atomic.LoadInt64(&Global.NegativeCacheHitCount),
+		"wal_bytes":           atomic.LoadInt64(&Global.WalSizeInBytes),
+		"wal_syncs":           atomic.LoadInt64(&Global.WalSyncCount),
+		"write_stalls":        atomic.LoadInt64(&Global.WriteStallCount),
+		// Owned by the logger, which drops rather than blocks when its
+		// queue is full
+		"log_messages_dropped": int64(logger.DroppedMessageCount()),
 	}
 }
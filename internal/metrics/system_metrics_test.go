@@ -1,7 +1,10 @@
 package metrics
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMetricsCounters(t *testing.T) {
@@ -28,3 +31,94 @@ func TestMetricsCounters(t *testing.T) {
 		t.Error("Snapshot failed to reflect read ops")
 	}
 }
+
+func TestMetricsCacheHitRatio(t *testing.T) {
+	Global = SystemMetricsRegistry{}
+	if r := CacheHitRatio(); r != 0 {
+		t.Errorf("Expected 0 before any lookup, got %v", r)
+	}
+
+	IncrementCacheHitCount()
+	IncrementCacheHitCount()
+	IncrementCacheHitCount()
+	IncrementCacheMissCount()
+	if r := CacheHitRatio(); r != 0.75 {
+		t.Errorf("Expected a ratio of 0.75, got %v", r)
+	}
+}
+
+func TestMetricsWriteMix(t *testing.T) {
+	Global = SystemMetricsRegistry{}
+
+	RecordWrites(3, 2)
+	if Global.PutOps != 3 || Global.DeleteOps != 2 || Global.WriteOps != 5 {
+		t.Errorf("Expected 3 puts, 2 deletes, 5 writes; got %d, %d, %d", Global.PutOps, Global.DeleteOps, Global.WriteOps)
+	}
+
+	RecordBatch(1)
+	RecordBatch(50)
+	RecordBatch(20000)
+	if Global.BatchOps != 3 {
+		t.Errorf("Expected 3 batch ops, got %d", Global.BatchOps)
+	}
+	want := [len(BatchSizeBucketBounds) + 1]int64{1, 0, 1, 0, 0, 1}
+	if Global.BatchSizeHistogram != want {
+		t.Errorf("Expected histogram %v, got %v", want, Global.BatchSizeHistogram)
+	}
+}
+
+func TestMetricsPrometheusText(t *testing.T) {
+	Global = SystemMetricsRegistry{}
+	RecordWrites(2, 1)
+	RecordBatch(5)
+	IncrementCacheHitCount()
+	RecordReadLatency(500 * time.Microsecond)
+	RecordReadLatency(2 * time.Second)
+
+	var out bytes.Buffer
+	WritePrometheusText(&out, Gauge{Name: "sndv_memtable_bytes", Help: "Memtable size.", Value: 42})
+	text := out.String()
+
+	for _, want := range []string{
+		"# TYPE sndv_write_ops_total counter\nsndv_write_ops_total 3\n",
+		"sndv_cache_hits_total 1\n",
+		"# TYPE sndv_memtable_bytes gauge\nsndv_memtable_bytes 42\n",
+		"# TYPE sndv_goroutines gauge\n",
+		"sndv_batch_size_bucket{le=\"1\"} 0\n",
+		"sndv_batch_size_bucket{le=\"10\"} 1\n",
+		"sndv_batch_size_bucket{le=\"+Inf\"} 1\n",
+		"sndv_batch_size_count 1\n",
+		"# TYPE sndv_request_duration_seconds histogram\n",
+		"sndv_request_duration_seconds_bucket{op=\"read\",le=\"0.001\"} 1\n",
+		"sndv_request_duration_seconds_bucket{op=\"read\",le=\"+Inf\"} 2\n",
+		"sndv_request_duration_seconds_sum{op=\"read\"} 2.0005\n",
+		"sndv_request_duration_seconds_count{op=\"write\"} 0\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Exposition is missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestMetricsLatencyHistogram(t *testing.T) {
+	Global = SystemMetricsRegistry{}
+
+	RecordReadLatency(50 * time.Microsecond)
+	RecordReadLatency(time.Millisecond)
+	RecordWriteLatency(3 * time.Millisecond)
+	RecordWriteLatency(time.Minute)
+
+	if Global.ReadLatency.Count != 2 || Global.WriteLatency.Count != 2 {
+		t.Fatalf("Expected 2 reads and 2 writes, got %d and %d", Global.ReadLatency.Count, Global.WriteLatency.Count)
+	}
+	// 1ms lands in the inclusive 1ms bucket, 3ms in 5ms, a minute in overflow
+	if Global.ReadLatency.Buckets[0] != 1 || Global.ReadLatency.Buckets[3] != 1 {
+		t.Errorf("Read buckets: %v", Global.ReadLatency.Buckets)
+	}
+	if Global.WriteLatency.Buckets[5] != 1 || Global.WriteLatency.Buckets[len(LatencyBucketBounds)] != 1 {
+		t.Errorf("Write buckets: %v", Global.WriteLatency.Buckets)
+	}
+	if Global.ReadLatency.SumInMicroseconds != 1050 {
+		t.Errorf("Expected a read sum of 1050us, got %d", Global.ReadLatency.SumInMicroseconds)
+	}
+}
@@ -16,10 +16,11 @@ func TestCrashRecovery_Standard(t *testing.T) {
 	defer f.Cleanup()
 
 	system := f.CreateSystem()
-	agents.InitializeIngestionSubsystem(system)
+	ingestion := agents.InitializeIngestionSubsystem(system)
+	defer ingestion.Stop()
 
 	for i := 0; i < 50; i++ {
-		agents.SubmitIngestionRequest(fmt.Sprintf("k%d", i), []byte("v"), 0, false)
+		ingestion.SubmitIngestionRequest(fmt.Sprintf("k%d", i), []byte("v"), 0, false)
 	}
 
 	system.ActiveWal.Close()
@@ -42,9 +43,10 @@ func TestCrashRecovery_CorruptedWal(t *testing.T) {
 	defer f.Cleanup()
 
 	system := f.CreateSystem()
-	agents.InitializeIngestionSubsystem(system)
+	ingestion := agents.InitializeIngestionSubsystem(system)
+	defer ingestion.Stop()
 
-	agents.SubmitIngestionRequest("v1", []byte("val"), 0, false)
+	ingestion.SubmitIngestionRequest("v1", []byte("val"), 0, false)
 	system.ActiveWal.Close()
 
 	// Append garbage
@@ -59,8 +61,9 @@ func TestCrashRecovery_CorruptedWal(t *testing.T) {
 	recovered := 0
 	err := wal.Replay(func(e common.Entry) { recovered++ })
 
-	if err == nil {
-		t.Error("Expected error on corrupted WAL")
+	// The garbage reads as a torn final record and is dropped
+	if err != nil {
+		t.Errorf("Expected a clean stop at the corrupt tail, got %v", err)
 	}
 	if recovered != 1 {
 		t.Error("Should recover valid prefix")
@@ -71,7 +74,8 @@ func TestConcurrentIntegrity(t *testing.T) {
 	f := testFactory.NewTestFactory(t)
 	defer f.Cleanup()
 	system := f.CreateSystem()
-	agents.InitializeIngestionSubsystem(system)
+	ingestion := agents.InitializeIngestionSubsystem(system)
+	defer ingestion.Stop()
 
 	var wg sync.WaitGroup
 	for i := 0; i < 10; i++ {
@@ -79,7 +83,7 @@ func TestConcurrentIntegrity(t *testing.T) {
 		go func(id int) {
 			defer wg.Done()
 			for j := 0; j < 50; j++ {
-				agents.SubmitIngestionRequest(fmt.Sprintf("w%d_%d", id, j), []byte("x"), 0, false)
+				ingestion.SubmitIngestionRequest(fmt.Sprintf("w%d_%d", id, j), []byte("x"), 0, false)
 			}
 		}(i)
 	}
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"math"
+	"os"
 	"sync"
 )
 
@@ -14,27 +16,55 @@ type bloomShard struct {
 	mutex sync.RWMutex
 }
 
+// SharedBloomFilter answers membership for every SSTable by file ID. Tables
+// written through WriteSortedStringTableToDisk get a filter of their own,
+// persisted next to the table and attached here; the shared shards hold the
+// keys of tables that were loaded without one.
 type SharedBloomFilter struct {
-	shards    []*bloomShard
-	hashCount uint64
-	shardSize uint64
+	shards            []*bloomShard
+	hashCount         uint64
+	shardSize         uint64
+	falsePositiveRate float64
+
+	tablesMutex sync.RWMutex
+	tables      map[int64]*tableBloomFilter
 }
 
 func NewSharedBloomFilter(expectedItems int, falsePositiveRate float64) *SharedBloomFilter {
-	if expectedItems <= 0 {
-		expectedItems = 1000
-	}
 	if falsePositiveRate <= 0 {
 		falsePositiveRate = 0.01
 	}
+	bits, hashes := bloomParameters(expectedItems, falsePositiveRate)
+
+	bitsPerShard := (bits + uint64(bloomShardCount) - 1) / uint64(bloomShardCount)
+
+	shards := make([]*bloomShard, bloomShardCount)
+	for i := 0; i < bloomShardCount; i++ {
+		shards[i] = &bloomShard{data: make([]uint64, (bitsPerShard+63)/64)}
+	}
+
+	return &SharedBloomFilter{
+		shards:            shards,
+		hashCount:         hashes,
+		shardSize:         bitsPerShard,
+		falsePositiveRate: falsePositiveRate,
+		tables:            make(map[int64]*tableBloomFilter),
+	}
+}
+
+// bloomParameters sizes a filter for expectedItems at the given rate.
+func bloomParameters(expectedItems int, falsePositiveRate float64) (bits, hashes uint64) {
+	if expectedItems <= 0 {
+		expectedItems = 1000
+	}
 
 	ln2 := math.Log(2)
 	n := float64(expectedItems)
 	m := -(n * math.Log(falsePositiveRate)) / (ln2 * ln2)
 	k := (m / n) * ln2
 
-	bits := uint64(math.Ceil(m))
-	hashes := uint64(math.Ceil(k))
+	bits = uint64(math.Ceil(m))
+	hashes = uint64(math.Ceil(k))
 
 	if bits < 64 {
 		bits = 64
@@ -42,23 +72,12 @@ func NewSharedBloomFilter(expectedItems int, falsePositiveRate float64) *SharedB
 	if bits > 16*1024*1024*1024 {
 		bits = 16 * 1024 * 1024 * 1024
 	}
-
-	bitsPerShard := (bits + uint64(bloomShardCount) - 1) / uint64(bloomShardCount)
-
-	shards := make([]*bloomShard, bloomShardCount)
-	for i := 0; i < bloomShardCount; i++ {
-		shards[i] = &bloomShard{data: make([]uint64, (bitsPerShard+63)/64)}
-	}
-
-	return &SharedBloomFilter{shards: shards, hashCount: hashes, shardSize: bitsPerShard}
+	return bits, hashes
 }
 
 func (bf *SharedBloomFilter) Add(id int64, key []byte) {
-	shardIdx := id % bloomShardCount
-	shard := bf.shards[shardIdx]
-	prefix := fmt.Sprintf("%d:", id)
-	h1 := uint64(crc32.ChecksumIEEE(append([]byte(prefix), key...)))
-	h2 := h1 >> 16
+	shard := bf.shards[id%bloomShardCount]
+	h1, h2 := bloomHashes(id, key)
 
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
@@ -69,11 +88,15 @@ func (bf *SharedBloomFilter) Add(id int64, key []byte) {
 }
 
 func (bf *SharedBloomFilter) Contains(id int64, key []byte) bool {
-	shardIdx := id % bloomShardCount
-	shard := bf.shards[shardIdx]
-	prefix := fmt.Sprintf("%d:", id)
-	h1 := uint64(crc32.ChecksumIEEE(append([]byte(prefix), key...)))
-	h2 := h1 >> 16
+	bf.tablesMutex.RLock()
+	table := bf.tables[id]
+	bf.tablesMutex.RUnlock()
+	if table != nil {
+		return table.contains(id, key)
+	}
+
+	shard := bf.shards[id%bloomShardCount]
+	h1, h2 := bloomHashes(id, key)
 
 	shard.mutex.RLock()
 	defer shard.mutex.RUnlock()
@@ -85,3 +108,139 @@ func (bf *SharedBloomFilter) Contains(id int64, key []byte) bool {
 	}
 	return true
 }
+
+// attachTable makes Contains answer for id from table alone.
+func (bf *SharedBloomFilter) attachTable(id int64, table *tableBloomFilter) {
+	bf.tablesMutex.Lock()
+	defer bf.tablesMutex.Unlock()
+	bf.tables[id] = table
+}
+
+// DetachTable drops the filter of a table whose file has been removed.
+func (bf *SharedBloomFilter) DetachTable(id int64) {
+	bf.tablesMutex.Lock()
+	defer bf.tablesMutex.Unlock()
+	delete(bf.tables, id)
+}
+
+// tableBloomFilter holds the keys of a single SSTable. It is only written
+// while the table is built, so reads need no locking.
+type tableBloomFilter struct {
+	data      []uint64
+	hashCount uint64
+	size      uint64
+}
+
+func newTableBloomFilter(expectedItems int, falsePositiveRate float64) *tableBloomFilter {
+	bits, hashes := bloomParameters(expectedItems, falsePositiveRate)
+	return &tableBloomFilter{data: make([]uint64, (bits+63)/64), hashCount: hashes, size: bits}
+}
+
+func (t *tableBloomFilter) add(id int64, key []byte) {
+	h1, h2 := bloomHashes(id, key)
+	for i := uint64(0); i < t.hashCount; i++ {
+		idx := (h1 + i*h2) % t.size
+		t.data[idx/64] |= (1 << (idx % 64))
+	}
+}
+
+func (t *tableBloomFilter) contains(id int64, key []byte) bool {
+	h1, h2 := bloomHashes(id, key)
+	for i := uint64(0); i < t.hashCount; i++ {
+		idx := (h1 + i*h2) % t.size
+		if t.data[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Bloom sidecar layout: magic, hash count (uint32), bit count (uint64), the
+// bit words, then a CRC32 of everything before it. All little-endian.
+const (
+	bloomSidecarSuffix     = ".bloom"
+	bloomSidecarMagic      = "SBF1"
+	bloomSidecarHeaderSize = 16
+)
+
+// BloomSidecarFilename returns the filter file kept beside an SSTable.
+func BloomSidecarFilename(sstableFilename string) string {
+	return sstableFilename + bloomSidecarSuffix
+}
+
+func writeBloomSidecar(path string, t *tableBloomFilter) error {
+	buf := make([]byte, bloomSidecarHeaderSize+8*len(t.data)+4)
+	copy(buf, bloomSidecarMagic)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(t.hashCount))
+	binary.LittleEndian.PutUint64(buf[8:], t.size)
+	for i, word := range t.data {
+		binary.LittleEndian.PutUint64(buf[bloomSidecarHeaderSize+8*i:], word)
+	}
+	binary.LittleEndian.PutUint32(buf[len(buf)-4:], crc32.ChecksumIEEE(buf[:len(buf)-4]))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readBloomSidecar(path string) (*tableBloomFilter, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < bloomSidecarHeaderSize+4 || string(buf[:4]) != bloomSidecarMagic {
+		return nil, fmt.Errorf("%s: not a bloom filter file", path)
+	}
+	body := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return nil, fmt.Errorf("%s: checksum mismatch", path)
+	}
+
+	t := &tableBloomFilter{
+		hashCount: uint64(binary.LittleEndian.Uint32(buf[4:])),
+		size:      binary.LittleEndian.Uint64(buf[8:]),
+	}
+	words := body[bloomSidecarHeaderSize:]
+	if t.hashCount == 0 || t.size == 0 || uint64(len(words)) != 8*((t.size+63)/64) {
+		return nil, fmt.Errorf("%s: inconsistent bloom filter header", path)
+	}
+	t.data = make([]uint64, len(words)/8)
+	for i := range t.data {
+		t.data[i] = binary.LittleEndian.Uint64(words[8*i:])
+	}
+	return t, nil
+}
+
+// bloomHashes derives the two hashes for double hashing from one 64-bit
+// FNV-1a hash of the file ID and key, run through a finalizer so both halves
+// are well mixed. h2 is forced odd so no probe sequence degenerates.
+func bloomHashes(id int64, key []byte) (uint64, uint64) {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for shift := 0; shift < 64; shift += 8 {
+		h ^= uint64(byte(id >> shift))
+		h *= prime64
+	}
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= prime64
+	}
+
+	// splitmix64 finalizer
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+
+	return h & 0xffffffff, (h >> 32) | 1
+}
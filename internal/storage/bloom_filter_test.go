@@ -41,3 +41,38 @@ func TestBloomFilterSharding(t *testing.T) {
 		}
 	}
 }
+
+func TestBloomFilter_MeasuredFPRNearTarget(t *testing.T) {
+	const (
+		items  = 320000
+		probes = 500000
+		rate   = 0.01
+	)
+	bf := NewSharedBloomFilter(items, rate)
+	for i := 0; i < items; i++ {
+		bf.Add(int64(i%bloomShardCount), []byte(fmt.Sprintf("key-%d", i)))
+	}
+
+	falsePositives := 0
+	for i := 0; i < probes; i++ {
+		if bf.Contains(int64(i%bloomShardCount), []byte(fmt.Sprintf("absent-%d", i))) {
+			falsePositives++
+		}
+	}
+
+	measured := float64(falsePositives) / probes
+	if measured > rate*1.15 || measured < rate*0.85 {
+		t.Errorf("measured FPR %.5f, want within 15%% of %.2f", measured, rate)
+	}
+}
+
+func BenchmarkBloomFilterContains(b *testing.B) {
+	bf := NewSharedBloomFilter(100000, 0.01)
+	key := []byte("benchmark-key")
+	bf.Add(7, key)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bf.Contains(7, key)
+	}
+}
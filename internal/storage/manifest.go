@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ManifestFilename is the name of the manifest inside the data directory.
+const ManifestFilename = "MANIFEST"
+
+// manifestRewriteThresholdInBytes bounds the manifest: once it grows past
+// this, it is rewritten to hold only the latest record.
+const manifestRewriteThresholdInBytes = 1 << 20
+
+// Manifest is an append-only log of the SSTable layout. Every committed
+// flush or compaction appends one record holding the full set of tables per
+// level, in read order, and the last complete record is authoritative.
+type Manifest struct {
+	mutex       sync.Mutex
+	file        *os.File
+	path        string
+	sizeInBytes int64
+}
+
+// manifestRecord is one newline-terminated JSON line. Tables are stored by
+// base name so the data directory can be moved.
+type manifestRecord struct {
+	Levels [][]string `json:"levels"`
+}
+
+// OpenManifest opens the manifest in dir, creating it if needed, and returns
+// the table filenames per level from its last complete record. ok is false
+// when no record has been written yet. A torn trailing record, left by a
+// crash mid-append, is dropped.
+func OpenManifest(dir string) (m *Manifest, levels [][]string, ok bool, err error) {
+	path := filepath.Join(dir, ManifestFilename)
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	valid := 0
+	for valid < len(data) {
+		end := bytes.IndexByte(data[valid:], '\n')
+		if end < 0 {
+			break
+		}
+		var record manifestRecord
+		if err := json.Unmarshal(data[valid:valid+end], &record); err != nil {
+			break
+		}
+		levels, ok = record.Levels, true
+		valid += end + 1
+	}
+	// Drop the torn tail so later records are not appended onto it
+	if valid < len(data) {
+		if err := os.Truncate(path, int64(valid)); err != nil {
+			return nil, nil, false, fmt.Errorf("failed to truncate manifest: %w", err)
+		}
+	}
+
+	m = &Manifest{path: path}
+	if err := m.open(); err != nil {
+		return nil, nil, false, err
+	}
+	return m, levels, ok, nil
+}
+
+func (m *Manifest) open() error {
+	file, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat manifest: %w", err)
+	}
+	m.file = file
+	m.sizeInBytes = info.Size()
+	return nil
+}
+
+// Record durably appends the given layout. It returns only once the record
+// is synced, so callers may then delete files the layout no longer holds.
+func (m *Manifest) Record(levels [][]SSTableMetadata) error {
+	line, err := encodeManifestRecord(levels)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.sizeInBytes+int64(len(line)) > manifestRewriteThresholdInBytes {
+		return m.rewrite(line)
+	}
+
+	written, err := m.file.Write(line)
+	m.sizeInBytes += int64(written)
+	if err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+// Rewrite replaces the manifest with a single record for levels.
+func (m *Manifest) Rewrite(levels [][]SSTableMetadata) error {
+	line, err := encodeManifestRecord(levels)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.rewrite(line)
+}
+
+// rewrite writes line to a temporary file and renames it over the manifest,
+// so a crash leaves either the old or the new manifest intact.
+func (m *Manifest) rewrite(line []byte) error {
+	tempPath := m.path + ".tmp"
+	temp, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(line); err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	temp.Close()
+
+	if err := os.Rename(tempPath, m.path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	m.file.Close()
+	return m.open()
+}
+
+// WriteManifest creates a manifest in dir holding only levels, for a data
+// directory assembled outside a running store.
+func WriteManifest(dir string, levels [][]SSTableMetadata) error {
+	line, err := encodeManifestRecord(levels)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, ManifestFilename), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (m *Manifest) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.file.Close()
+}
+
+func encodeManifestRecord(levels [][]SSTableMetadata) ([]byte, error) {
+	record := manifestRecord{Levels: make([][]string, len(levels))}
+	for l, tables := range levels {
+		record.Levels[l] = make([]string, len(tables))
+		for i, meta := range tables {
+			record.Levels[l][i] = filepath.Base(meta.Filename)
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
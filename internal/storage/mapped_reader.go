@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sndv-kv/internal/logger"
+	"sync"
+)
+
+// tableHandle is one SSTable opened for point lookups: a read-only memory
+// mapping, whose reads slice the mapped bytes, or the open file, read with
+// pread.
+//
+// The cache holds one reference while the table is cached and every
+// lookup holds one while it reads; the handle is closed with the last of
+// them. A table removed by compaction therefore stays readable to the
+// lookups already using it.
+type tableHandle struct {
+	filename string
+	reader   io.ReaderAt
+	close    func() error
+	refs     int
+}
+
+// mappedBytes reads a mapped table.
+type mappedBytes []byte
+
+func (m mappedBytes) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m mappedBytes) Size() int64 {
+	return int64(len(m))
+}
+
+func mapTable(filename string) (*tableHandle, error) {
+	data, err := mapFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &tableHandle{filename: filename, reader: mappedBytes(data), close: func() error { return unmapFile(data) }}, nil
+}
+
+func openTable(filename string) (*tableHandle, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &tableHandle{filename: filename, reader: f, close: f.Close}, nil
+}
+
+// tableHandleCache keeps up to capacity handles opened by open. When full,
+// a cache that evicts drops its least recently used handle for the new
+// one; one that does not turns the new table away until a handle is
+// forgotten.
+type tableHandleCache struct {
+	mutex    sync.Mutex
+	capacity int
+	evicts   bool
+	order    *list.List
+	tables   map[string]*list.Element
+	open     func(filename string) (*tableHandle, error)
+}
+
+func newTableHandleCache(capacity int, evicts bool, open func(string) (*tableHandle, error)) tableHandleCache {
+	return tableHandleCache{capacity: capacity, evicts: evicts, order: list.New(), tables: make(map[string]*list.Element), open: open}
+}
+
+// acquire returns the handle of filename, opening it on first use, or false
+// when the cache has no room for it or opening fails. The caller must
+// release it.
+func (c *tableHandleCache) acquire(filename string) (*tableHandle, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.tables[filename]; ok {
+		c.order.MoveToFront(elem)
+		h := elem.Value.(*tableHandle)
+		h.refs++
+		return h, true
+	}
+	if c.capacity <= 0 || (!c.evicts && c.order.Len() >= c.capacity) {
+		return nil, false
+	}
+
+	// Opening under the lock keeps two lookups from opening the same table
+	// twice; it costs one open per table while the table stays cached
+	h, err := c.open(filename)
+	if err != nil {
+		logger.LogDebugEvent("Opening %s for lookups failed: %v", filename, err)
+		return nil, false
+	}
+	h.refs = 2
+	c.tables[filename] = c.order.PushFront(h)
+	c.evictOverCapacity()
+	return h, true
+}
+
+// release drops a reference taken by acquire.
+func (c *tableHandleCache) release(h *tableHandle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unref(h)
+}
+
+func (c *tableHandleCache) forget(filename string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.tables[filename]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *tableHandleCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.order.Len() > 0 {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *tableHandleCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+func (c *tableHandleCache) evictOverCapacity() {
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *tableHandleCache) removeElement(elem *list.Element) {
+	h := c.order.Remove(elem).(*tableHandle)
+	delete(c.tables, h.filename)
+	c.unref(h)
+}
+
+func (c *tableHandleCache) unref(h *tableHandle) {
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+	if err := h.close(); err != nil {
+		logger.LogErrorEvent("Closing %s failed: %v", h.filename, err)
+	}
+	h.reader = nil
+}
+
+// MappedReaderCache holds one store's SSTables open for point lookups,
+// keyed by filename. Tables are memory-mapped while there is room for
+// another mapping; a mapping lasts until its table is forgotten, so lookups
+// never map and unmap tables in turn. The other tables are read with pread
+// through cached open files, the least recently used closed first. Only a
+// nil cache, or one holding no open files, opens the file per lookup.
+type MappedReaderCache struct {
+	mapped tableHandleCache
+	files  tableHandleCache
+}
+
+// NewMappedReaderCache keeps up to mappedCapacity tables mapped and up to
+// fileCapacity more open; either may be zero.
+func NewMappedReaderCache(mappedCapacity, fileCapacity int) *MappedReaderCache {
+	return &MappedReaderCache{
+		mapped: newTableHandleCache(mappedCapacity, false, mapTable),
+		files:  newTableHandleCache(fileCapacity, true, openTable),
+	}
+}
+
+// Close drops every cached handle, e.g. at shutdown. Lookups in flight
+// keep theirs until they finish. Later lookups open their tables again.
+func (c *MappedReaderCache) Close() {
+	if c == nil {
+		return
+	}
+	c.mapped.close()
+	c.files.close()
+}
+
+// Forget drops filename's handles, for a table about to be removed.
+func (c *MappedReaderCache) Forget(filename string) {
+	if c == nil {
+		return
+	}
+	c.mapped.forget(filename)
+	c.files.forget(filename)
+}
+
+// openForLookup returns a handle for point lookups in filename: its cached
+// mapping, else its cached open file, else a file opened for this lookup
+// alone. The returned function releases it.
+func (c *MappedReaderCache) openForLookup(filename string) (io.ReaderAt, func(), error) {
+	if c != nil {
+		for _, cache := range []*tableHandleCache{&c.mapped, &c.files} {
+			if h, ok := cache.acquire(filename); ok {
+				return h.reader, func() { cache.release(h) }, nil
+			}
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package storage
+
+import "errors"
+
+// Without mmap every lookup falls back to pread.
+func mapFile(filename string) ([]byte, error) {
+	return nil, errors.New("memory-mapped reads are not supported on this platform")
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
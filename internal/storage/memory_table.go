@@ -1,35 +1,53 @@
 package storage
 
 import (
+	"container/list"
 	"hash/fnv"
 	"sndv-kv/internal/common"
 	"sync"
 	"sync/atomic"
+	"unsafe"
 )
 
-const numShards = 32
+// DefaultMemtableShardCount is how many shards a ShardedMemoryTable splits
+// its keys across unless told otherwise.
+const DefaultMemtableShardCount = 32
 
 // MemoryShard is a single shard with its own lock
 type MemoryShard struct {
 	data  map[string]common.Entry
 	mutex sync.RWMutex
 	size  atomic.Int64
+
+	// Only set on evicting tables: keys from least to most recently used
+	recency  *list.List
+	elements map[string]*list.Element
 }
 
 // ShardedMemoryTable splits data across multiple shards to reduce lock contention
 type ShardedMemoryTable struct {
-	shards [numShards]*MemoryShard
+	shards []*MemoryShard
 }
 
 // NewMemoryTable creates a new sharded memory table
 func NewMemoryTable(capacity int) *ShardedMemoryTable {
-	mt := &ShardedMemoryTable{}
-	shardCap := capacity / numShards
+	return NewMemoryTableWithShards(capacity, DefaultMemtableShardCount)
+}
+
+// NewMemoryTableWithShards is NewMemoryTable with shardCount shards, or the
+// default when shardCount is below 1. More shards let more concurrent
+// writers and readers proceed without contending for a lock.
+func NewMemoryTableWithShards(capacity, shardCount int) *ShardedMemoryTable {
+	if shardCount < 1 {
+		shardCount = DefaultMemtableShardCount
+	}
+	mt := &ShardedMemoryTable{shards: make([]*MemoryShard, shardCount)}
+	shardCap := capacity / shardCount
 	if shardCap < 1 {
 		shardCap = 1
 	}
 
-	for i := 0; i < numShards; i++ {
+	for i := 0; i < shardCount; i++ {
 		mt.shards[i] = &MemoryShard{
 			data: make(map[string]common.Entry, shardCap),
 		}
@@ -37,39 +55,130 @@ func NewMemoryTable(capacity int) *ShardedMemoryTable {
 	return mt
 }
 
+// NewEvictingMemoryTable creates a memory table that also tracks access order
+// per shard, so EvictLeastRecentlyUsed can shed the coldest entries. Reads
+// take the shard's write lock to record the access.
+func NewEvictingMemoryTable(capacity int) *ShardedMemoryTable {
+	return NewEvictingMemoryTableWithShards(capacity, DefaultMemtableShardCount)
+}
+
+// NewEvictingMemoryTableWithShards is NewEvictingMemoryTable with shardCount
+// shards, as for NewMemoryTableWithShards.
+func NewEvictingMemoryTableWithShards(capacity, shardCount int) *ShardedMemoryTable {
+	mt := NewMemoryTableWithShards(capacity, shardCount)
+	for _, shard := range mt.shards {
+		shard.recency = list.New()
+		shard.elements = make(map[string]*list.Element)
+	}
+	return mt
+}
+
 // getShardID returns the shard index for a key
 func (mt *ShardedMemoryTable) getShardID(key string) int {
 	h := fnv.New32a()
 	h.Write([]byte(key))
-	return int(h.Sum32() % numShards)
+	return int(h.Sum32() % uint32(len(mt.shards)))
 }
 
 // Put adds or updates a key-value pair
 func (mt *ShardedMemoryTable) Put(key string, value []byte, expiry int64, isDeleted bool) {
-	shardID := mt.getShardID(key)
-	shard := mt.shards[shardID]
+	mt.PutEntry(common.Entry{
+		Key:             key,
+		Value:           value,
+		ExpiryTimestamp: expiry,
+		IsDeleted:       isDeleted,
+	})
+}
 
-	entrySize := int64(len(key) + len(value) + 16)
+// PutEntry stores e as is, keeping flags Put has no parameter for
+func (mt *ShardedMemoryTable) PutEntry(e common.Entry) {
+	shardID := mt.getShardID(e.Key)
+	shard := mt.shards[shardID]
 
 	shard.mutex.Lock()
 	defer shard.mutex.Unlock()
 
-	// Subtract old entry size if exists
-	if old, exists := shard.data[key]; exists {
-		oldSize := int64(len(old.Key) + len(old.Value) + 16)
-		shard.size.Add(-oldSize)
+	shard.put(e)
+}
+
+// PutEntries stores all entries atomically: every shard they touch is locked,
+// in ascending order, before any is written, so GetAll sees all of them or
+// none. Later entries win over earlier ones with the same key.
+func (mt *ShardedMemoryTable) PutEntries(entries []common.Entry) {
+	var stack [DefaultMemtableShardCount]bool
+	touched := stack[:]
+	if len(mt.shards) > len(stack) {
+		touched = make([]bool, len(mt.shards))
+	}
+	touched = touched[:len(mt.shards)]
+	for _, e := range entries {
+		touched[mt.getShardID(e.Key)] = true
 	}
 
-	// Add new entry
-	shard.data[key] = common.Entry{
-		Key:             key,
-		Value:           value,
-		ExpiryTimestamp: expiry,
-		IsDeleted:       isDeleted,
+	for i, locked := range touched {
+		if locked {
+			mt.shards[i].mutex.Lock()
+		}
+	}
+	for _, e := range entries {
+		mt.shards[mt.getShardID(e.Key)].put(e)
+	}
+	for i, locked := range touched {
+		if locked {
+			mt.shards[i].mutex.Unlock()
+		}
+	}
+}
+
+// put stores e unless the table already holds a later write of its key.
+// Caller must hold the shard's write lock.
+func (s *MemoryShard) put(e common.Entry) {
+	// The old entry is read and replaced under the same lock, so the delta
+	// always matches what is actually stored.
+	delta := entrySizeInBytes(e.Key, e.Value)
+	if old, exists := s.data[e.Key]; exists {
+		if old.Sequence > e.Sequence {
+			return
+		}
+		delta -= entrySizeInBytes(old.Key, old.Value)
 	}
 
-	// Add new entry size
-	shard.size.Add(entrySize)
+	s.data[e.Key] = e
+	s.touch(e.Key)
+
+	s.addSize(delta)
+}
+
+// touch marks key as most recently used on evicting tables. Caller must hold
+// the shard's write lock.
+func (s *MemoryShard) touch(key string) {
+	if s.recency == nil {
+		return
+	}
+	if element, ok := s.elements[key]; ok {
+		s.recency.MoveToBack(element)
+		return
+	}
+	s.elements[key] = s.recency.PushBack(key)
+}
+
+// addSize applies a size delta, clamping at zero so that any accounting
+// mistake can never make the flush trigger unreachable.
+func (s *MemoryShard) addSize(delta int64) {
+	if s.size.Add(delta) < 0 {
+		s.size.Store(0)
+	}
+}
+
+// entryOverheadInBytes approximates what an entry costs beyond its key and
+// value bytes: a map slot holding the key's string header and the Entry,
+// scaled by 1.5 for the free slots Go maps keep through their load factor
+// and growth by doubling. That is 120 bytes on 64-bit platforms.
+const entryOverheadInBytes = int64(unsafe.Sizeof("")+unsafe.Sizeof(common.Entry{})) * 3 / 2
+
+// entrySizeInBytes approximates the memory held by one entry
+func entrySizeInBytes(key string, value []byte) int64 {
+	return int64(len(key)+len(value)) + entryOverheadInBytes
 }
 
 // Get retrieves a value by key
@@ -77,6 +186,17 @@ func (mt *ShardedMemoryTable) Get(key string) (common.Entry, bool) {
 	shardID := mt.getShardID(key)
 	shard := mt.shards[shardID]
 
+	if shard.recency != nil {
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
+
+		val, ok := shard.data[key]
+		if ok {
+			shard.touch(key)
+		}
+		return val, ok
+	}
+
 	shard.mutex.RLock()
 	defer shard.mutex.RUnlock()
 
@@ -84,20 +204,82 @@ func (mt *ShardedMemoryTable) Get(key string) (common.Entry, bool) {
 	return val, ok
 }
 
+// EvictLeastRecentlyUsed drops the least recently used entries of each shard
+// until the table holds at most targetBytes, and returns how many it dropped.
+// Keys hash evenly across shards, so each shard is held to an equal share.
+// It is a no-op on tables not created by NewEvictingMemoryTable.
+func (mt *ShardedMemoryTable) EvictLeastRecentlyUsed(targetBytes int64) int {
+	perShard := targetBytes / int64(len(mt.shards))
+	evicted := 0
+	for _, shard := range mt.shards {
+		if shard.recency == nil {
+			return 0
+		}
+
+		shard.mutex.Lock()
+		for shard.size.Load() > perShard && shard.recency.Len() > 0 {
+			key := shard.recency.Remove(shard.recency.Front()).(string)
+			delete(shard.elements, key)
+			old := shard.data[key]
+			delete(shard.data, key)
+			shard.addSize(-entrySizeInBytes(old.Key, old.Value))
+			evicted++
+		}
+		shard.mutex.Unlock()
+	}
+	return evicted
+}
+
+// SweepExpired removes entries whose TTL passed by nowUnixNano and returns
+// how many it swept. Shards are locked one at a time, so a writer waits for
+// at most one shard's scan. With keepTombstones an expired entry becomes a
+// value-less tombstone rather than disappearing, so it still shadows older
+// versions of its key in later tables.
+func (mt *ShardedMemoryTable) SweepExpired(nowUnixNano int64, keepTombstones bool) int {
+	swept := 0
+	for _, shard := range mt.shards {
+		shard.mutex.Lock()
+		for key, e := range shard.data {
+			if !e.IsExpiredAt(nowUnixNano) || (keepTombstones && e.IsDeleted) {
+				continue
+			}
+			if keepTombstones {
+				shard.data[key] = common.Entry{Key: key, IsDeleted: true, Sequence: e.Sequence}
+				shard.addSize(-int64(len(e.Value)))
+			} else {
+				delete(shard.data, key)
+				if element, ok := shard.elements[key]; ok {
+					shard.recency.Remove(element)
+					delete(shard.elements, key)
+				}
+				shard.addSize(-entrySizeInBytes(e.Key, e.Value))
+			}
+			swept++
+		}
+		shard.mutex.Unlock()
+	}
+	return swept
+}
+
 // GetAll returns all entries (used for flushing)
 func (mt *ShardedMemoryTable) GetAll() []common.Entry {
 	var entries []common.Entry
 	return mt.DumpToSlice(entries)
 }
 
-// DumpToSlice appends all entries to the provided slice
+// DumpToSlice appends all entries to the provided slice. Every shard is read
+// locked for the whole copy, so the result never contains part of a
+// PutEntries call.
 func (mt *ShardedMemoryTable) DumpToSlice(out []common.Entry) []common.Entry {
-	for i := 0; i < numShards; i++ {
-		shard := mt.shards[i]
+	for _, shard := range mt.shards {
 		shard.mutex.RLock()
+	}
+	for _, shard := range mt.shards {
 		for _, e := range shard.data {
 			out = append(out, e)
 		}
+	}
+	for _, shard := range mt.shards {
 		shard.mutex.RUnlock()
 	}
 	return out
@@ -106,8 +288,19 @@ func (mt *ShardedMemoryTable) DumpToSlice(out []common.Entry) []common.Entry {
 // Size returns the approximate total size in bytes
 func (mt *ShardedMemoryTable) Size() int64 {
 	var total int64
-	for i := 0; i < numShards; i++ {
-		total += mt.shards[i].size.Load()
+	for _, shard := range mt.shards {
+		total += shard.size.Load()
+	}
+	return total
+}
+
+// Len returns the number of entries, tombstones included
+func (mt *ShardedMemoryTable) Len() int {
+	total := 0
+	for _, shard := range mt.shards {
+		shard.mutex.RLock()
+		total += len(shard.data)
+		shard.mutex.RUnlock()
 	}
 	return total
 }
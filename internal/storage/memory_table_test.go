@@ -2,8 +2,13 @@ package storage
 
 import (
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sndv-kv/internal/common"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemoryTable_BasicOperations(t *testing.T) {
@@ -35,6 +40,31 @@ func TestMemoryTable_BasicOperations(t *testing.T) {
 	}
 }
 
+func TestMemoryTable_ShardCount(t *testing.T) {
+	for _, shardCount := range []int{0, 1, 7, 100} {
+		mt := NewMemoryTableWithShards(1000, shardCount)
+		want := shardCount
+		if want < 1 {
+			want = DefaultMemtableShardCount
+		}
+		if len(mt.shards) != want {
+			t.Errorf("Shard count %d: got %d shards, want %d", shardCount, len(mt.shards), want)
+		}
+
+		entries := make([]common.Entry, 300)
+		for i := range entries {
+			entries[i] = common.Entry{Key: fmt.Sprintf("key%03d", i), Value: []byte("v")}
+		}
+		mt.PutEntries(entries)
+		if mt.Len() != len(entries) || len(mt.GetAll()) != len(entries) {
+			t.Errorf("Shard count %d: stored %d of %d entries", shardCount, mt.Len(), len(entries))
+		}
+		if e, ok := mt.Get("key123"); !ok || string(e.Value) != "v" {
+			t.Errorf("Shard count %d: lookup failed", shardCount)
+		}
+	}
+}
+
 func TestMemoryTable_ConcurrentWrites(t *testing.T) {
 	mt := NewMemoryTable(10000)
 
@@ -113,6 +143,69 @@ func TestMemoryTable_ConcurrentReadsAndWrites(t *testing.T) {
 	}
 }
 
+func TestMemoryTable_SizeNeverNegativeUnderOverwriteChurn(t *testing.T) {
+	mt := NewMemoryTable(1000)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(goroutineID int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				// Few keys, wildly varying value sizes and tombstones
+				key := fmt.Sprintf("hot%d", i%16)
+				val := make([]byte, (goroutineID*i)%257)
+				mt.Put(key, val, 0, i%7 == 0)
+				if mt.Size() < 0 {
+					t.Errorf("Size went negative: %d", mt.Size())
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	var expected int64
+	for _, e := range mt.GetAll() {
+		expected += entrySizeInBytes(e.Key, e.Value)
+	}
+	if mt.Size() != expected {
+		t.Errorf("Size drifted: reported %d, actual %d", mt.Size(), expected)
+	}
+}
+
+func TestMemoryTable_SizeTracksHeapUsage(t *testing.T) {
+	heapInUse := func() int64 {
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return int64(stats.HeapAlloc)
+	}
+
+	for _, valueSize := range []int{10, 100, 1000} {
+		before := heapInUse()
+		mt := NewMemoryTable(1000)
+		for i := 0; i < 50000; i++ {
+			mt.Put(fmt.Sprintf("key-%08d", i), make([]byte, valueSize), 0, false)
+		}
+		actual := heapInUse() - before
+
+		if diff := math.Abs(float64(mt.Size()-actual)) / float64(actual); diff > 0.15 {
+			t.Errorf("%d-byte values: reported %d bytes, heap grew by %d (%.0f%% off)", valueSize, mt.Size(), actual, diff*100)
+		}
+		runtime.KeepAlive(mt)
+	}
+}
+
+func TestMemoryShard_SizeClampsAtZero(t *testing.T) {
+	shard := &MemoryShard{}
+	shard.addSize(10)
+	shard.addSize(-50)
+	if shard.size.Load() != 0 {
+		t.Errorf("Expected clamp to 0, got %d", shard.size.Load())
+	}
+}
+
 func BenchmarkMemoryTable_Put_Sequential(b *testing.B) {
 	mt := NewMemoryTable(1000000)
 
@@ -188,3 +281,168 @@ func BenchmarkMemoryTable_MixedWorkload(b *testing.B) {
 		}
 	})
 }
+
+func TestEvictingMemoryTable_DropsLeastRecentlyUsed(t *testing.T) {
+	mt := NewEvictingMemoryTable(1000)
+	for i := 0; i < 1000; i++ {
+		mt.Put(fmt.Sprintf("key_%04d", i), make([]byte, 100), 0, false)
+	}
+	mt.Get("key_0000")
+
+	target := mt.Size() / 2
+	if evicted := mt.EvictLeastRecentlyUsed(target); evicted == 0 {
+		t.Fatal("Expected entries to be evicted")
+	}
+	if mt.Size() > target {
+		t.Errorf("Size %d still above target %d", mt.Size(), target)
+	}
+	if _, ok := mt.Get("key_0000"); !ok {
+		t.Error("Recently read key was evicted")
+	}
+	if _, ok := mt.Get("key_0001"); ok {
+		t.Error("Least recently used key survived")
+	}
+
+	plain := NewMemoryTable(10)
+	plain.Put("a", []byte("1"), 0, false)
+	if plain.EvictLeastRecentlyUsed(0) != 0 {
+		t.Error("Plain memtables must not evict")
+	}
+}
+
+func TestMemoryTable_KeepsHighestSequence(t *testing.T) {
+	mt := NewMemoryTable(16)
+	mt.PutEntry(common.Entry{Key: "k", Value: []byte("new"), Sequence: 2})
+	mt.PutEntry(common.Entry{Key: "k", Value: []byte("old"), Sequence: 1})
+
+	if e, _ := mt.Get("k"); string(e.Value) != "new" {
+		t.Errorf("An older write replaced a newer one: %q", e.Value)
+	}
+}
+
+func TestMemoryTable_SweepExpired(t *testing.T) {
+	past := time.Now().Add(-time.Second).UnixNano()
+	for _, keepTombstones := range []bool{true, false} {
+		mt := NewMemoryTable(100)
+		if !keepTombstones {
+			mt = NewEvictingMemoryTable(100)
+		}
+		mt.Put("live", []byte("v"), 0, false)
+		for i := 0; i < 10; i++ {
+			mt.PutEntry(common.Entry{Key: fmt.Sprintf("expired%d", i), Value: make([]byte, 1000), ExpiryTimestamp: past, Sequence: 5})
+		}
+
+		before := mt.Size()
+		if swept := mt.SweepExpired(time.Now().UnixNano(), keepTombstones); swept != 10 {
+			t.Fatalf("keepTombstones=%v: expected 10 swept, got %d", keepTombstones, swept)
+		}
+		if before-mt.Size() < 10*1000 {
+			t.Errorf("keepTombstones=%v: size only dropped from %d to %d", keepTombstones, before, mt.Size())
+		}
+
+		e, ok := mt.Get("expired0")
+		if keepTombstones && (!ok || !e.IsDeleted || len(e.Value) != 0 || e.Sequence != 5) {
+			t.Errorf("Expected a value-less tombstone at the same sequence, got %+v (found %v)", e, ok)
+		}
+		if !keepTombstones && (ok || mt.Len() != 1) {
+			t.Errorf("Expected expired entries dropped, %d left", mt.Len())
+		}
+		if _, ok := mt.Get("live"); !ok {
+			t.Error("Live entry swept")
+		}
+		if mt.SweepExpired(time.Now().UnixNano(), keepTombstones) != 0 {
+			t.Error("Second sweep found more to sweep")
+		}
+	}
+}
+
+func TestSkipListMemoryTable_KeepsKeysOrdered(t *testing.T) {
+	mt := NewSkipListMemoryTable()
+	for _, i := range rand.Perm(500) {
+		mt.PutEntry(common.Entry{Key: fmt.Sprintf("key%03d", i), Value: []byte("v"), Sequence: 2})
+	}
+	mt.PutEntry(common.Entry{Key: "key007", Value: []byte("newer"), Sequence: 3})
+	mt.PutEntry(common.Entry{Key: "key008", Value: []byte("older"), Sequence: 1})
+	mt.PutEntries([]common.Entry{{Key: "key009", Value: []byte("a"), Sequence: 4}, {Key: "key009", Value: []byte("b"), Sequence: 4}})
+
+	if mt.Len() != 500 {
+		t.Fatalf("Expected 500 entries, got %d", mt.Len())
+	}
+	all := mt.GetAll()
+	for i, e := range all {
+		if want := fmt.Sprintf("key%03d", i); e.Key != want {
+			t.Fatalf("Entry %d is %s, want %s", i, e.Key, want)
+		}
+	}
+	for key, want := range map[string]string{"key007": "newer", "key008": "v", "key009": "b"} {
+		if e, _ := mt.Get(key); string(e.Value) != want {
+			t.Errorf("%s = %q, want %q", key, e.Value, want)
+		}
+	}
+
+	var scanned []string
+	mt.AscendRange("key100", "key105", func(e common.Entry) bool {
+		scanned = append(scanned, e.Key)
+		return true
+	})
+	if len(scanned) != 5 || scanned[0] != "key100" || scanned[4] != "key104" {
+		t.Errorf("AscendRange [key100, key105) returned %v", scanned)
+	}
+
+	past := time.Now().Add(-time.Second).UnixNano()
+	mt.PutEntry(common.Entry{Key: "key250", Value: make([]byte, 1000), ExpiryTimestamp: past, Sequence: 5})
+	before := mt.Size()
+	if swept := mt.SweepExpired(time.Now().UnixNano(), false); swept != 1 || mt.Len() != 499 || before-mt.Size() < 1000 {
+		t.Errorf("Sweep removed %d entries, leaving %d and %d bytes (from %d)", swept, mt.Len(), mt.Size(), before)
+	}
+	if _, ok := mt.Get("key250"); ok {
+		t.Error("Swept key still found")
+	}
+}
+
+func BenchmarkSkipListMemoryTable_Put_Sequential(b *testing.B) {
+	mt := NewSkipListMemoryTable()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := []byte("testvalue1234567890")
+		mt.Put(key, val, 0, false)
+	}
+}
+
+func BenchmarkSkipListMemoryTable_Put_Parallel(b *testing.B) {
+	mt := NewSkipListMemoryTable()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := fmt.Sprintf("key%d", i)
+			val := []byte("testvalue1234567890")
+			mt.Put(key, val, 0, false)
+			i++
+		}
+	})
+}
+
+func BenchmarkSkipListMemoryTable_Get_Parallel(b *testing.B) {
+	mt := NewSkipListMemoryTable()
+
+	// Pre-populate
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := []byte("testvalue1234567890")
+		mt.Put(key, val, 0, false)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := fmt.Sprintf("key%d", i%10000)
+			mt.Get(key)
+			i++
+		}
+	})
+}
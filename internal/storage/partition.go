@@ -0,0 +1,52 @@
+package storage
+
+import "hash/fnv"
+
+// SSTablePartition places a table in one of Count equal ranges of the 32-bit
+// key hash space. The zero value means the table is not partitioned and may
+// hold any key.
+type SSTablePartition struct {
+	Index int
+	Count int
+}
+
+// PartitionOf returns the partition index key hashes into when the hash space
+// is split count ways.
+func PartitionOf(key string, count int) int {
+	if count <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(uint64(h.Sum32()) * uint64(count) >> 32)
+}
+
+// IsPartitioned reports whether the table only holds a slice of the key space.
+func (p SSTablePartition) IsPartitioned() bool {
+	return p.Count > 1
+}
+
+// Contains reports whether key can be stored in a table of this partition.
+func (p SSTablePartition) Contains(key string) bool {
+	return !p.IsPartitioned() || PartitionOf(key, p.Count) == p.Index
+}
+
+// Overlaps reports whether a key could belong to both partitions.
+func (p SSTablePartition) Overlaps(other SSTablePartition) bool {
+	low, high := p.HashRange()
+	otherLow, otherHigh := other.HashRange()
+	return low <= otherHigh && otherLow <= high
+}
+
+// HashRange returns the inclusive range of key hashes the partition covers.
+func (p SSTablePartition) HashRange() (low, high uint32) {
+	if !p.IsPartitioned() {
+		return 0, ^uint32(0)
+	}
+	span := (uint64(1) << 32) / uint64(p.Count)
+	low = uint32(uint64(p.Index) * span)
+	if p.Index == p.Count-1 {
+		return low, ^uint32(0)
+	}
+	return low, uint32(uint64(p.Index+1)*span - 1)
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"math/rand/v2"
+	"sndv-kv/internal/common"
+	"sync"
+	"sync/atomic"
+)
+
+// Memtable implementations selectable by the memtable_implementation
+// setting. An empty name is MemtableSharded.
+const (
+	MemtableSharded  = "sharded"
+	MemtableSkipList = "skiplist"
+)
+
+const (
+	skipListMaxHeight = 20
+	// Each level links about a quarter of the nodes of the level below
+	skipListBranching = 4
+)
+
+// OrderedMemoryTable is a memtable that can walk its entries in key order,
+// so flushes and scans need not sort a copy of it.
+type OrderedMemoryTable interface {
+	common.KeyValueStore
+	// AscendRange calls fn for every entry with start <= key < end, in key
+	// order, until fn returns false. An empty end means no upper bound.
+	AscendRange(start, end string, fn func(common.Entry) bool)
+}
+
+// SkipListMemoryTable keeps its entries sorted in a skip list. Lookups cost
+// O(log n) against the sharded table's O(1), and one lock serialises all
+// writers, but a flush or scan reads it in order instead of sorting.
+type SkipListMemoryTable struct {
+	mutex  sync.RWMutex
+	head   skipListNode
+	height int
+	length int
+	size   atomic.Int64
+}
+
+type skipListNode struct {
+	entry common.Entry
+	next  []*skipListNode
+}
+
+func NewSkipListMemoryTable() *SkipListMemoryTable {
+	t := &SkipListMemoryTable{height: 1}
+	t.head.next = make([]*skipListNode, skipListMaxHeight)
+	return t
+}
+
+func randomSkipListHeight() int {
+	height := 1
+	for height < skipListMaxHeight && rand.IntN(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// findPredecessors fills prev with the last node before key on every level
+// and returns the node holding key, if any. Caller must hold the lock.
+func (t *SkipListMemoryTable) findPredecessors(key string, prev *[skipListMaxHeight]*skipListNode) *skipListNode {
+	node := &t.head
+	for level := t.height - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.Key < key {
+			node = node.next[level]
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	if next := node.next[0]; next != nil && next.entry.Key == key {
+		return next
+	}
+	return nil
+}
+
+// seek returns the first node with a key at or after key. Caller must hold
+// the lock.
+func (t *SkipListMemoryTable) seek(key string) *skipListNode {
+	node := &t.head
+	for level := t.height - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.Key < key {
+			node = node.next[level]
+		}
+	}
+	return node.next[0]
+}
+
+func (t *SkipListMemoryTable) Put(key string, value []byte, expiry int64, isDeleted bool) {
+	t.PutEntry(common.Entry{
+		Key:             key,
+		Value:           value,
+		ExpiryTimestamp: expiry,
+		IsDeleted:       isDeleted,
+	})
+}
+
+func (t *SkipListMemoryTable) PutEntry(e common.Entry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.put(e)
+}
+
+// PutEntries stores all entries under one lock, so GetAll sees all of them
+// or none. Later entries win over earlier ones with the same key.
+func (t *SkipListMemoryTable) PutEntries(entries []common.Entry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, e := range entries {
+		t.put(e)
+	}
+}
+
+// put stores e unless the table already holds a later write of its key.
+// Caller must hold the write lock.
+func (t *SkipListMemoryTable) put(e common.Entry) {
+	var prev [skipListMaxHeight]*skipListNode
+	if node := t.findPredecessors(e.Key, &prev); node != nil {
+		if node.entry.Sequence > e.Sequence {
+			return
+		}
+		t.addSize(entrySizeInBytes(e.Key, e.Value) - entrySizeInBytes(node.entry.Key, node.entry.Value))
+		node.entry = e
+		return
+	}
+
+	height := randomSkipListHeight()
+	for level := t.height; level < height; level++ {
+		prev[level] = &t.head
+	}
+	t.height = max(t.height, height)
+
+	node := &skipListNode{entry: e, next: make([]*skipListNode, height)}
+	for level := 0; level < height; level++ {
+		node.next[level] = prev[level].next[level]
+		prev[level].next[level] = node
+	}
+	t.length++
+	t.addSize(entrySizeInBytes(e.Key, e.Value))
+}
+
+// remove unlinks the node holding key. Caller must hold the write lock.
+func (t *SkipListMemoryTable) remove(key string) {
+	var prev [skipListMaxHeight]*skipListNode
+	node := t.findPredecessors(key, &prev)
+	if node == nil {
+		return
+	}
+	for level := 0; level < len(node.next); level++ {
+		prev[level].next[level] = node.next[level]
+	}
+	t.length--
+	t.addSize(-entrySizeInBytes(node.entry.Key, node.entry.Value))
+}
+
+// addSize applies a size delta, clamping at zero like the sharded table.
+func (t *SkipListMemoryTable) addSize(delta int64) {
+	if t.size.Add(delta) < 0 {
+		t.size.Store(0)
+	}
+}
+
+func (t *SkipListMemoryTable) Get(key string) (common.Entry, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if node := t.findPredecessors(key, nil); node != nil {
+		return node.entry, true
+	}
+	return common.Entry{}, false
+}
+
+// GetAll returns every entry in key order.
+func (t *SkipListMemoryTable) GetAll() []common.Entry {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	entries := make([]common.Entry, 0, t.length)
+	for node := t.head.next[0]; node != nil; node = node.next[0] {
+		entries = append(entries, node.entry)
+	}
+	return entries
+}
+
+// AscendRange walks the entries in [start, end) in key order under the read
+// lock; fn must not write to the table.
+func (t *SkipListMemoryTable) AscendRange(start, end string, fn func(common.Entry) bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for node := t.seek(start); node != nil; node = node.next[0] {
+		if end != "" && node.entry.Key >= end {
+			return
+		}
+		if !fn(node.entry) {
+			return
+		}
+	}
+}
+
+// SweepExpired behaves as ShardedMemoryTable.SweepExpired.
+func (t *SkipListMemoryTable) SweepExpired(nowUnixNano int64, keepTombstones bool) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	swept := 0
+	var expired []string
+	for node := t.head.next[0]; node != nil; node = node.next[0] {
+		e := node.entry
+		if !e.IsExpiredAt(nowUnixNano) || (keepTombstones && e.IsDeleted) {
+			continue
+		}
+		if keepTombstones {
+			node.entry = common.Entry{Key: e.Key, IsDeleted: true, Sequence: e.Sequence}
+			t.addSize(-int64(len(e.Value)))
+		} else {
+			expired = append(expired, e.Key)
+		}
+		swept++
+	}
+	for _, key := range expired {
+		t.remove(key)
+	}
+	return swept
+}
+
+func (t *SkipListMemoryTable) Size() int64 {
+	return t.size.Load()
+}
+
+func (t *SkipListMemoryTable) Len() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.length
+}
@@ -2,28 +2,326 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"sndv-kv/internal/common"
+	"sndv-kv/internal/logger"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+const (
+	entryHeaderSizeInBytes = 17
+
+	// Format 2 tables start with sstableMagic and the version byte, and
+	// every entry header carries a CRC32 of the header fields, key and
+	// stored value. Format 1 tables have neither. Format 3 headers add the
+	// entry's sequence number after the flags, covered by the CRC.
+	sstableMagic                      = "SNDV"
+	sstableFormatVersion         byte = 3
+	sstableFileHeaderSizeInBytes      = len(sstableMagic) + 1
+	checksummedEntryHeaderSize        = entryHeaderSizeInBytes + 4
+	sequencedEntryHeaderSize          = entryHeaderSizeInBytes + 8 + 4
+
+	// Bits of the flags byte at the end of each entry header.
+	entryFlagDeleted    byte = 1 << 0
+	entryFlagCompressed byte = 1 << 1
+	entryFlagCounter    byte = 1 << 2
 )
 
+// SSTableFilename builds the canonical L<level>_<id>.sst path for a table.
+func SSTableFilename(dir string, level int, fileID int64) string {
+	return filepath.Join(dir, fmt.Sprintf("L%d_%d.sst", level, fileID))
+}
+
+// ParseSSTableFilename extracts level and FileID from an L<level>_<id>.sst name.
+func ParseSSTableFilename(filename string) (level int, fileID int64, ok bool) {
+	base := strings.TrimSuffix(filepath.Base(filename), ".sst")
+	levelPart, idPart, found := strings.Cut(base, "_")
+	if !found || !strings.HasPrefix(levelPart, "L") {
+		return 0, 0, false
+	}
+
+	level, err := strconv.Atoi(levelPart[1:])
+	if err != nil || level < 0 {
+		return 0, 0, false
+	}
+	fileID, err = strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return level, fileID, true
+}
+
 type SSTableMetadata struct {
 	Level    int
 	Filename string
 	FileID   int64
-	Index    map[string]int64
 	MinKey   string
 	MaxKey   string
+
+	// Index is sparse: the first key and offset of each block, in key
+	// order. Lookups binary-search it and scan the one candidate block.
+	Index    []IndexEntry
+	KeyCount int
+
+	// Partition is the key-hash range the table holds, if partitioned.
+	Partition SSTablePartition
+
+	// HasBloomFilter is false when the table was written without a bloom
+	// filter; lookups must then skip the filter check.
+	HasBloomFilter bool
+
+	// FormatVersion is the on-disk format; zero is read as format 1.
+	FormatVersion byte
+
+	// MaxSequence is the highest entry sequence in the table, zero for
+	// tables written before sequences existed.
+	MaxSequence uint64
+}
+
+// IndexEntry locates the block that starts with Key.
+type IndexEntry struct {
+	Key    string
+	Offset int64
+}
+
+// InKeyRange reports whether key lies between the table's first and last
+// keys, the cheapest check before any lookup.
+func (meta SSTableMetadata) InKeyRange(key string) bool {
+	return meta.KeyCount > 0 && key >= meta.MinKey && key <= meta.MaxKey
+}
+
+// blockOf returns the offset of the block that would hold key, and the
+// offset of the next block, or -1 for the last one.
+func (meta SSTableMetadata) blockOf(key string) (start, next int64, ok bool) {
+	if !meta.InKeyRange(key) {
+		return 0, 0, false
+	}
+	i := sort.Search(len(meta.Index), func(i int) bool { return meta.Index[i].Key > key }) - 1
+	if i < 0 {
+		return 0, 0, false
+	}
+	next = -1
+	if i+1 < len(meta.Index) {
+		next = meta.Index[i+1].Offset
+	}
+	return meta.Index[i].Offset, next, true
+}
+
+// sparseIndexBuilder starts a new block whenever the current one has
+// reached blockSize bytes; a blockSize of zero or less indexes every entry.
+type sparseIndexBuilder struct {
+	blockSize  int64
+	blockStart int64
+	index      []IndexEntry
+}
+
+func (b *sparseIndexBuilder) observe(key string, offset int64) {
+	if len(b.index) == 0 || b.blockSize <= 0 || offset-b.blockStart >= b.blockSize {
+		b.index = append(b.index, IndexEntry{Key: key, Offset: offset})
+		b.blockStart = offset
+	}
+}
+
+// SSTableWriteOptions tunes how entries are encoded on disk.
+type SSTableWriteOptions struct {
+	// BlockSizeInBytes is how many bytes of entries share one index entry.
+	// Zero indexes every entry.
+	BlockSizeInBytes int
+
+	// ValueCompressionThresholdInBytes compresses values at or above this
+	// size with snappy. Zero disables per-value compression.
+	ValueCompressionThresholdInBytes int
+
+	// Partition is recorded in the returned metadata. The caller is
+	// responsible for only passing keys that belong to it.
+	Partition SSTablePartition
+}
+
+// Codecs accepted by ValueCompressionThreshold. A compressed value is flagged
+// in its entry header, so readers decompress it whatever the writer's
+// setting was.
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy"
+)
+
+// ValueCompressionThreshold resolves a codec name and a size threshold into
+// ValueCompressionThresholdInBytes. CompressionNone disables compression and
+// CompressionSnappy compresses every value that shrinks, or only values of
+// at least thresholdInBytes when that is set. An empty codec leaves the
+// threshold alone.
+func ValueCompressionThreshold(codec string, thresholdInBytes int) (int, error) {
+	switch codec {
+	case "":
+		return thresholdInBytes, nil
+	case CompressionNone:
+		return 0, nil
+	case CompressionSnappy:
+		return max(thresholdInBytes, 1), nil
+	}
+	return 0, fmt.Errorf("unknown sstable compression %q", codec)
 }
 
 type SSTableReader struct {
-	file   *os.File
-	reader *bufio.Reader
-	buffer []byte
+	file    *os.File
+	reader  *bufio.Reader
+	buffer  []byte
+	index   []IndexEntry
+	size    int64
+	version byte
+	start   int64
+	err     error
+
+	// pending holds an entry already consumed by Seek but not yet returned
+	pending *common.Entry
+}
+
+// ErrChecksumMismatch reports an entry whose contents no longer match the
+// checksum written with it.
+var ErrChecksumMismatch = errors.New("sstable entry checksum mismatch")
+
+// formatLayout returns the entry header size and the offset of the first
+// entry for a table format version.
+func formatLayout(version byte) (headerSize int, dataStart int64) {
+	switch {
+	case version >= 3:
+		return sequencedEntryHeaderSize, int64(sstableFileHeaderSizeInBytes)
+	case version == 2:
+		return checksummedEntryHeaderSize, int64(sstableFileHeaderSizeInBytes)
+	}
+	return entryHeaderSizeInBytes, 0
+}
+
+// detectFormatVersion reads the file header. Tables without one predate
+// versioning and are format 1.
+func detectFormatVersion(f io.ReaderAt) (byte, error) {
+	header := make([]byte, sstableFileHeaderSizeInBytes)
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[:len(sstableMagic)]) != sstableMagic {
+		return 1, nil
+	}
+	version := header[len(sstableMagic)]
+	if version < 2 || version > sstableFormatVersion {
+		return 0, fmt.Errorf("unsupported sstable format version %d", version)
+	}
+	return version, nil
+}
+
+type entryHeader struct {
+	keyLength   uint32
+	valueLength uint32
+	expiry      int64
+	flags       byte
+	sequence    uint64
+	checksum    uint32
+
+	// size is how many bytes the header took on disk.
+	size int64
+}
+
+// encodeEntryHeader writes a format 2 or 3 header, chosen by h.size.
+func encodeEntryHeader(buffer []byte, h entryHeader) {
+	encodeEntryFields(buffer, h)
+	binary.LittleEndian.PutUint32(buffer[h.size-4:], h.checksum)
+}
+
+// encodeEntryFields writes everything the checksum covers: the format 1
+// fields, and the sequence for format 3.
+func encodeEntryFields(buffer []byte, h entryHeader) {
+	binary.LittleEndian.PutUint32(buffer[0:4], h.keyLength)
+	binary.LittleEndian.PutUint32(buffer[4:8], h.valueLength)
+	binary.LittleEndian.PutUint64(buffer[8:16], uint64(h.expiry))
+	buffer[16] = h.flags
+	if h.size >= sequencedEntryHeaderSize {
+		binary.LittleEndian.PutUint64(buffer[17:25], h.sequence)
+	}
+}
+
+// decodeEntryHeader decodes a format 1, 2 or 3 header, told apart by the
+// length of buffer.
+func decodeEntryHeader(buffer []byte) entryHeader {
+	h := entryHeader{
+		keyLength:   binary.LittleEndian.Uint32(buffer[0:4]),
+		valueLength: binary.LittleEndian.Uint32(buffer[4:8]),
+		expiry:      int64(binary.LittleEndian.Uint64(buffer[8:16])),
+		flags:       buffer[16],
+		size:        int64(len(buffer)),
+	}
+	if len(buffer) >= sequencedEntryHeaderSize {
+		h.sequence = binary.LittleEndian.Uint64(buffer[17:25])
+	}
+	if len(buffer) >= checksummedEntryHeaderSize {
+		h.checksum = binary.LittleEndian.Uint32(buffer[len(buffer)-4:])
+	}
+	return h
+}
+
+// checksumPrefix is the running CRC over the header fields and key; the
+// stored value completes it.
+func (h entryHeader) checksumPrefix(key []byte) uint32 {
+	var fields [sequencedEntryHeaderSize]byte
+	encodeEntryFields(fields[:], h)
+	covered := fields[:h.size-4]
+	return crc32.Update(crc32.ChecksumIEEE(covered), crc32.IEEETable, key)
+}
+
+// verify checks key and stored value against a format 2 checksum.
+func (h entryHeader) verify(key, stored []byte) error {
+	if h.size < checksummedEntryHeaderSize {
+		return nil
+	}
+	if crc32.Update(h.checksumPrefix(key), crc32.IEEETable, stored) != h.checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// entrySize is the total length of the entry on disk.
+func (h entryHeader) entrySize() int64 {
+	return h.size + int64(h.keyLength) + int64(h.valueLength)
+}
+
+// maxSnappyExpansion bounds how much larger than its encoding a snappy block
+// can decode to: the densest op, a 3-byte copy, emits at most 64 bytes.
+const maxSnappyExpansion = 22
+
+// errCorruptEntry reports an entry whose lengths cannot fit in its table.
+var errCorruptEntry = errors.New("corrupt sstable entry")
+
+// decodeStoredValue reverses the per-value compression applied on write. The
+// declared length is checked first so corrupt input cannot force a huge
+// allocation.
+func decodeStoredValue(h entryHeader, stored []byte) ([]byte, error) {
+	if h.flags&entryFlagCompressed == 0 {
+		return stored, nil
+	}
+	n, err := snappy.DecodedLen(stored)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSnappyExpansion*len(stored) {
+		return nil, errCorruptEntry
+	}
+	return snappy.Decode(nil, stored)
+}
+
+// fitsIn reports whether the entry at offset, with h's lengths, lies within a
+// table of size bytes. A negative size means unknown and is not checked.
+func (h entryHeader) fitsIn(offset, size int64) bool {
+	if size < 0 {
+		return true
+	}
+	return offset+h.entrySize() <= size
 }
 
 func NewSSTableReader(filename string) (*SSTableReader, error) {
@@ -31,36 +329,143 @@ func NewSSTableReader(filename string) (*SSTableReader, error) {
 	if err != nil {
 		return nil, err
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	version, err := detectFormatVersion(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	headerSize, start := formatLayout(version)
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	return &SSTableReader{
-		file:   f,
-		reader: bufio.NewReader(f),
-		buffer: make([]byte, 17),
+		file:    f,
+		reader:  bufio.NewReader(f),
+		buffer:  make([]byte, headerSize),
+		size:    info.Size(),
+		version: version,
+		start:   start,
 	}, nil
 }
 
+// OpenSSTableReader opens a reader that can use the table's index to Seek
+// without scanning from the start of the file.
+func OpenSSTableReader(meta SSTableMetadata) (*SSTableReader, error) {
+	r, err := NewSSTableReader(meta.Filename)
+	if err != nil {
+		return nil, err
+	}
+	r.index = meta.Index
+	return r, nil
+}
+
+// Seek positions the reader so that the following Next returns the first
+// entry whose key is >= key. With an index, the scan for it starts at the
+// last block whose first key is <= key; otherwise at the start of the file.
+func (r *SSTableReader) Seek(key string) error {
+	r.pending = nil
+
+	start := r.start
+	if i := sort.Search(len(r.index), func(i int) bool { return r.index[i].Key > key }) - 1; i >= 0 {
+		start = r.index[i].Offset
+	}
+	return r.scanFrom(start, key)
+}
+
+func (r *SSTableReader) scanFrom(offset int64, key string) error {
+	if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.reader.Reset(r.file)
+
+	for {
+		e, ok := r.Next()
+		if !ok {
+			return nil
+		}
+		if e.Key >= key {
+			r.pending = &e
+			return nil
+		}
+	}
+}
+
+// Next returns the following entry, or false at the end of the table or on
+// the first entry that cannot be read; Err tells the two apart.
 func (r *SSTableReader) Next() (common.Entry, bool) {
+	if r.pending != nil {
+		e := *r.pending
+		r.pending = nil
+		return e, true
+	}
+	if r.err != nil {
+		return common.Entry{}, false
+	}
+
 	if _, err := io.ReadFull(r.reader, r.buffer); err != nil {
+		if err != io.EOF {
+			r.fail(err)
+		}
+		return common.Entry{}, false
+	}
+
+	h := decodeEntryHeader(r.buffer)
+	// Checked against the whole file; a short read below catches the rest
+	if !h.fitsIn(0, r.size) {
+		r.fail(errCorruptEntry)
 		return common.Entry{}, false
 	}
 
-	kLen := binary.LittleEndian.Uint32(r.buffer[0:4])
-	vLen := binary.LittleEndian.Uint32(r.buffer[4:8])
-	expiry := int64(binary.LittleEndian.Uint64(r.buffer[8:16]))
-	isDeleted := r.buffer[16] == 1
+	key := make([]byte, h.keyLength)
+	if _, err := io.ReadFull(r.reader, key); err != nil {
+		r.fail(err)
+		return common.Entry{}, false
+	}
+	stored := make([]byte, h.valueLength)
+	if _, err := io.ReadFull(r.reader, stored); err != nil {
+		r.fail(err)
+		return common.Entry{}, false
+	}
+	if err := h.verify(key, stored); err != nil {
+		r.fail(err)
+		return common.Entry{}, false
+	}
 
-	key := make([]byte, kLen)
-	io.ReadFull(r.reader, key)
-	val := make([]byte, vLen)
-	io.ReadFull(r.reader, val)
+	val, err := decodeStoredValue(h, stored)
+	if err != nil {
+		r.fail(err)
+		return common.Entry{}, false
+	}
 
 	return common.Entry{
 		Key:             string(key),
 		Value:           val,
-		ExpiryTimestamp: expiry,
-		IsDeleted:       isDeleted,
+		ExpiryTimestamp: h.expiry,
+		IsDeleted:       h.flags&entryFlagDeleted != 0,
+		IsCounter:       h.flags&entryFlagCounter != 0,
+		Sequence:        h.sequence,
 	}, true
 }
 
+func (r *SSTableReader) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = fmt.Errorf("%s: %w", r.file.Name(), err)
+}
+
+// Err returns the error that stopped Next, or nil at a clean end of table.
+func (r *SSTableReader) Err() error {
+	return r.err
+}
+
 func (r *SSTableReader) Close() {
 	if r.file != nil {
 		r.file.Close()
@@ -68,102 +473,672 @@ func (r *SSTableReader) Close() {
 }
 
 func WriteSortedStringTableToDisk(entries []common.Entry, filename string, level int, bloom common.BloomFilter) (SSTableMetadata, error) {
-	f, err := os.Create(filename)
+	return WriteSortedStringTableToDiskWithOptions(entries, filename, level, bloom, SSTableWriteOptions{})
+}
+
+// sstableTempSuffix marks a table still being written. It is renamed into
+// place only once complete and synced, so a crash never leaves a truncated
+// .sst behind for LoadSSTable to pick up.
+const sstableTempSuffix = ".tmp"
+
+func WriteSortedStringTableToDiskWithOptions(entries []common.Entry, filename string, level int, bloom common.BloomFilter, opts SSTableWriteOptions) (SSTableMetadata, error) {
+	w, err := NewSSTableWriter(filename, level, bloom, opts, len(entries))
 	if err != nil {
 		return SSTableMetadata{}, err
 	}
-	defer f.Close()
+	for _, e := range entries {
+		if err := w.Add(e); err != nil {
+			w.Abort()
+			return SSTableMetadata{}, err
+		}
+	}
+	return w.Finish()
+}
+
+// SSTableWriter writes a table one entry at a time, so a table can be built
+// from a stream without holding its entries in memory. Entries must be added
+// in key order. The table only appears under its name once Finish succeeds.
+type SSTableWriter struct {
+	file        *os.File
+	writer      *bufio.Writer
+	filename    string
+	level       int
+	fileID      int64
+	bloom       common.BloomFilter
+	shared      *SharedBloomFilter
+	table       *tableBloomFilter
+	opts        SSTableWriteOptions
+	index       sparseIndexBuilder
+	header      []byte
+	offset      int64
+	minKey      string
+	maxKey      string
+	keyCount    int
+	maxSequence uint64
+}
+
+// NewSSTableWriter starts a table at filename. expectedEntries sizes its
+// bloom filter; an overestimate only costs space.
+func NewSSTableWriter(filename string, level int, bloom common.BloomFilter, opts SSTableWriteOptions, expectedEntries int) (*SSTableWriter, error) {
+	f, err := os.Create(filename + sstableTempSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	_, fileID, _ := ParseSSTableFilename(filename)
+	w := &SSTableWriter{
+		file:     f,
+		writer:   bufio.NewWriter(f),
+		filename: filename,
+		level:    level,
+		fileID:   fileID,
+		bloom:    bloom,
+		opts:     opts,
+		index:    sparseIndexBuilder{blockSize: int64(opts.BlockSizeInBytes)},
+		header:   make([]byte, sequencedEntryHeaderSize),
+		offset:   int64(sstableFileHeaderSizeInBytes),
+	}
+
+	// A shared filter gets a per-table filter it can reload after a restart
+	w.shared, _ = bloom.(*SharedBloomFilter)
+	if w.shared != nil {
+		w.table = newTableBloomFilter(expectedEntries, w.shared.falsePositiveRate)
+	}
+
+	w.writer.WriteString(sstableMagic)
+	w.writer.WriteByte(sstableFormatVersion)
+	return w, nil
+}
+
+// Add appends e, which must sort after every entry added before it.
+func (w *SSTableWriter) Add(e common.Entry) error {
+	if w.keyCount == 0 {
+		w.minKey = e.Key
+	} else if e.Key <= w.maxKey {
+		return fmt.Errorf("%s: key %q added after %q", w.filename, e.Key, w.maxKey)
+	}
+	w.maxKey = e.Key
+	w.keyCount++
+
+	if w.table != nil {
+		w.table.add(w.fileID, []byte(e.Key))
+	} else if w.bloom != nil {
+		w.bloom.Add(w.fileID, []byte(e.Key))
+	}
+	w.index.observe(e.Key, w.offset)
 
-	w := bufio.NewWriter(f)
-	index := make(map[string]int64)
+	var flags byte
+	if e.IsDeleted {
+		flags |= entryFlagDeleted
+	}
+	if e.IsCounter {
+		flags |= entryFlagCounter
+	}
 
-	var fileID int64 = 0
-	base := filepath.Base(filename)
-	parts := strings.Split(base, "_")
-	if len(parts) >= 2 {
-		idPart := strings.TrimSuffix(parts[1], ".sst")
-		if val, err := strconv.ParseInt(idPart, 10, 64); err == nil {
-			fileID = val
+	stored := e.Value
+	if threshold := w.opts.ValueCompressionThresholdInBytes; threshold > 0 && len(e.Value) >= threshold {
+		if compressed := snappy.Encode(nil, e.Value); len(compressed) < len(e.Value) {
+			stored = compressed
+			flags |= entryFlagCompressed
 		}
 	}
 
-	var offset int64 = 0
-	var minKey, maxKey string
-	header := make([]byte, 17)
+	h := entryHeader{
+		keyLength:   uint32(len(e.Key)),
+		valueLength: uint32(len(stored)),
+		expiry:      e.ExpiryTimestamp,
+		flags:       flags,
+		sequence:    e.Sequence,
+		size:        sequencedEntryHeaderSize,
+	}
+	w.maxSequence = max(w.maxSequence, e.Sequence)
+	h.checksum = crc32.Update(h.checksumPrefix([]byte(e.Key)), crc32.IEEETable, stored)
+	encodeEntryHeader(w.header, h)
+
+	w.writer.Write(w.header)
+	w.writer.WriteString(e.Key)
+	if _, err := w.writer.Write(stored); err != nil {
+		return err
+	}
+
+	w.offset += h.entrySize()
+	return nil
+}
 
-	for i, e := range entries {
-		if i == 0 {
-			minKey = e.Key
+// SizeInBytes returns how much of the table has been written so far.
+func (w *SSTableWriter) SizeInBytes() int64 {
+	return w.offset
+}
+
+// KeyCount returns the number of entries added so far.
+func (w *SSTableWriter) KeyCount() int {
+	return w.keyCount
+}
+
+// Abort discards the table.
+func (w *SSTableWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// Finish syncs the table and renames it into place.
+func (w *SSTableWriter) Finish() (SSTableMetadata, error) {
+	defer w.file.Close()
+	tempFilename := w.file.Name()
+	filename := w.filename
+
+	if err := w.writer.Flush(); err != nil {
+		os.Remove(tempFilename)
+		return SSTableMetadata{}, err
+	}
+	if err := w.file.Sync(); err != nil {
+		os.Remove(tempFilename)
+		return SSTableMetadata{}, err
+	}
+	if w.table != nil {
+		if err := writeBloomSidecar(BloomSidecarFilename(filename), w.table); err != nil {
+			os.Remove(tempFilename)
+			os.Remove(BloomSidecarFilename(filename))
+			return SSTableMetadata{}, err
+		}
+	}
+	if err := os.Rename(tempFilename, filename); err != nil {
+		os.Remove(tempFilename)
+		os.Remove(BloomSidecarFilename(filename))
+		return SSTableMetadata{}, err
+	}
+	if w.table != nil {
+		w.shared.attachTable(w.fileID, w.table)
+	}
+
+	return SSTableMetadata{
+		Level:    w.level,
+		Filename: filename,
+		FileID:   w.fileID,
+		MinKey:   w.minKey,
+		MaxKey:   w.maxKey,
+		Index:    w.index.index,
+		KeyCount: w.keyCount,
+
+		Partition:      w.opts.Partition,
+		HasBloomFilter: w.bloom != nil,
+		FormatVersion:  sstableFormatVersion,
+		MaxSequence:    w.maxSequence,
+	}, nil
+}
+
+// SSTableLoadOptions describes how a table being loaded was configured.
+type SSTableLoadOptions struct {
+	// BlockSizeInBytes sizes the rebuilt sparse index, as on write.
+	BlockSizeInBytes int
+
+	// PartitionCount is the configured key-hash split. Partitions are not
+	// stored in the file, so a table whose keys all fall in one partition
+	// of this split is assumed to belong to it.
+	PartitionCount int
+}
+
+// LoadSSTable rebuilds the metadata of an existing table by reading it
+// through once: the index, key range, highest sequence, partition, and
+// level and FileID from the filename. When bloom is non-nil, the table's persisted filter is
+// attached to it, or its keys are added if there is no usable one.
+func LoadSSTable(filename string, bloom common.BloomFilter, opts SSTableLoadOptions) (SSTableMetadata, error) {
+	level, fileID, ok := ParseSSTableFilename(filename)
+	if !ok {
+		return SSTableMetadata{}, fmt.Errorf("not an sstable filename: %s", filename)
+	}
+
+	hasBloomFilter := bloom != nil
+	shared, _ := bloom.(*SharedBloomFilter)
+	var table *tableBloomFilter
+	if shared != nil {
+		if persisted, err := readBloomSidecar(BloomSidecarFilename(filename)); err == nil {
+			table, bloom = persisted, nil
+		}
+	}
+
+	r, err := NewSSTableReader(filename)
+	if err != nil {
+		return SSTableMetadata{}, err
+	}
+	defer r.Close()
+
+	meta := SSTableMetadata{
+		Level:          level,
+		Filename:       filename,
+		FileID:         fileID,
+		HasBloomFilter: hasBloomFilter,
+		FormatVersion:  r.version,
+	}
+	index := sparseIndexBuilder{blockSize: int64(opts.BlockSizeInBytes)}
+	partition, mixedPartitions := -1, false
+
+	offset := r.start
+	for offset < r.size {
+		if _, err := io.ReadFull(r.reader, r.buffer); err != nil {
+			return SSTableMetadata{}, fmt.Errorf("%s: entry at offset %d: %w", filename, offset, err)
+		}
+		h := decodeEntryHeader(r.buffer)
+		if !h.fitsIn(offset, r.size) {
+			return SSTableMetadata{}, fmt.Errorf("%s: entry at offset %d: %w", filename, offset, errCorruptEntry)
+		}
+
+		key := make([]byte, h.keyLength)
+		if _, err := io.ReadFull(r.reader, key); err != nil {
+			return SSTableMetadata{}, fmt.Errorf("%s: entry at offset %d: %w", filename, offset, err)
+		}
+		if _, err := r.reader.Discard(int(h.valueLength)); err != nil {
+			return SSTableMetadata{}, fmt.Errorf("%s: entry at offset %d: %w", filename, offset, err)
 		}
-		if i == len(entries)-1 {
-			maxKey = e.Key
+
+		k := string(key)
+		if meta.KeyCount == 0 {
+			meta.MinKey = k
 		}
+		meta.MaxKey = k
+		meta.KeyCount++
+		meta.MaxSequence = max(meta.MaxSequence, h.sequence)
+		index.observe(k, offset)
 
+		if opts.PartitionCount > 1 {
+			p := PartitionOf(k, opts.PartitionCount)
+			mixedPartitions = mixedPartitions || (partition >= 0 && p != partition)
+			partition = p
+		}
 		if bloom != nil {
-			bloom.Add(fileID, []byte(e.Key))
+			bloom.Add(fileID, key)
 		}
-		index[e.Key] = offset
+		offset += h.entrySize()
+	}
 
-		kLen := len(e.Key)
-		vLen := len(e.Value)
+	meta.Index = index.index
+	if partition >= 0 && !mixedPartitions {
+		meta.Partition = SSTablePartition{Index: partition, Count: opts.PartitionCount}
+	}
 
-		binary.LittleEndian.PutUint32(header[0:4], uint32(kLen))
-		binary.LittleEndian.PutUint32(header[4:8], uint32(vLen))
-		binary.LittleEndian.PutUint64(header[8:16], uint64(e.ExpiryTimestamp))
+	if table != nil {
+		shared.attachTable(fileID, table)
+	}
+	return meta, nil
+}
 
-		if e.IsDeleted {
-			header[16] = 1
-		} else {
-			header[16] = 0
+// RemoveSSTableFile deletes a table together with its bloom filter file.
+// A mapping cached for it should be forgotten first; lookups still reading
+// the mapping finish on it.
+func RemoveSSTableFile(filename string) {
+	os.Remove(filename)
+	os.Remove(BloomSidecarFilename(filename))
+}
+
+// LinkSSTableFile hard-links a table and its bloom sidecar, if it has one,
+// into dir under the same base names. Tables are immutable, so a link is as
+// good as a copy; it falls back to copying across filesystems.
+func LinkSSTableFile(filename, dir string) error {
+	for _, path := range []string{filename, BloomSidecarFilename(filename)} {
+		target := filepath.Join(dir, filepath.Base(path))
+		err := os.Link(path, target)
+		if err != nil && !os.IsNotExist(err) {
+			err = CopyFile(path, target)
+		}
+		// Tables written without a bloom filter have no sidecar
+		if os.IsNotExist(err) && path != filename {
+			continue
+		}
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// CopyFile copies from into a new file to and syncs it. It fails if to
+// already exists.
+func CopyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
 
-		w.Write(header)
-		w.WriteString(e.Key)
-		w.Write(e.Value)
+// SampleExpiredRatio estimates the fraction of entries in a table whose TTL
+// has passed. It reads only the headers of up to sampleSize entries, taken
+// in runs from blocks spread evenly across the table.
+func SampleExpiredRatio(meta SSTableMetadata, sampleSize int, nowUnixNano int64) (float64, error) {
+	if meta.KeyCount == 0 || len(meta.Index) == 0 || sampleSize <= 0 {
+		return 0, nil
+	}
 
-		offset += int64(17 + kLen + vLen)
+	f, err := os.Open(meta.Filename)
+	if err != nil {
+		return 0, err
 	}
-	w.Flush()
+	defer f.Close()
+	size := readerAtSize(f)
 
-	return SSTableMetadata{
-		Level:    level,
-		Filename: filename,
-		FileID:   fileID,
-		Index:    index,
-		MinKey:   minKey,
-		MaxKey:   maxKey,
-	}, nil
+	blocks := len(meta.Index)
+	step := max(1, blocks/sampleSize)
+	chosen := (blocks + step - 1) / step
+	perBlock := (sampleSize + chosen - 1) / chosen
+
+	headerSize, _ := formatLayout(meta.FormatVersion)
+	header := make([]byte, headerSize)
+	sampled, expired := 0, 0
+	for b := 0; b < blocks && sampled < sampleSize; b += step {
+		offset, end := meta.Index[b].Offset, size
+		if b+1 < blocks {
+			end = meta.Index[b+1].Offset
+		}
+		for n := 0; n < perBlock && offset < end && sampled < sampleSize; n++ {
+			if _, err := f.ReadAt(header, offset); err != nil {
+				return 0, err
+			}
+			h := decodeEntryHeader(header)
+			if !h.fitsIn(offset, size) {
+				return 0, errCorruptEntry
+			}
+			if h.expiry > 0 && nowUnixNano > h.expiry {
+				expired++
+			}
+			sampled++
+			offset += h.entrySize()
+		}
+	}
+	return float64(expired) / float64(sampled), nil
 }
 
+// FindInSSTable looks key up in meta's table, reading the file with pread.
 func FindInSSTable(meta SSTableMetadata, key string) (common.Entry, bool) {
-	offset, ok := meta.Index[key]
-	if !ok {
+	var pread *MappedReaderCache
+	return pread.FindInSSTable(meta, key)
+}
+
+// FindInSSTable looks key up in meta's table through c's mapping of it.
+func (c *MappedReaderCache) FindInSSTable(meta SSTableMetadata, key string) (common.Entry, bool) {
+	if !meta.InKeyRange(key) {
 		return common.Entry{}, false
 	}
 
-	f, err := os.Open(meta.Filename)
+	f, release, err := c.openForLookup(meta.Filename)
 	if err != nil {
 		return common.Entry{}, false
 	}
-	defer f.Close()
+	defer release()
 
-	f.Seek(offset, 0)
-	header := make([]byte, 17)
-	io.ReadFull(f, header)
+	return FindInSSTableFile(f, meta, key)
+}
+
+// FindManyInSSTable looks several keys up in one table, opening the file
+// once. The keys are visited in sorted order, so the reads move forward
+// through the file and a key in the same block as the previous one resumes
+// the scan where that one stopped. Keys the table does not hold are absent
+// from the result.
+func FindManyInSSTable(meta SSTableMetadata, keys []string) map[string]common.Entry {
+	var pread *MappedReaderCache
+	return pread.FindManyInSSTable(meta, keys)
+}
+
+// FindManyInSSTable is FindManyInSSTable through c's mapping of the table.
+func (c *MappedReaderCache) FindManyInSSTable(meta SSTableMetadata, keys []string) map[string]common.Entry {
+	found := make(map[string]common.Entry, len(keys))
+	sorted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if meta.InKeyRange(key) {
+			sorted = append(sorted, key)
+		}
+	}
+	if len(sorted) == 0 {
+		return found
+	}
+	sort.Strings(sorted)
+
+	f, release, err := c.openForLookup(meta.Filename)
+	if err != nil {
+		return found
+	}
+	defer release()
 
-	kLen := binary.LittleEndian.Uint32(header[0:4])
-	vLen := binary.LittleEndian.Uint32(header[4:8])
-	expiry := int64(binary.LittleEndian.Uint64(header[8:16]))
-	isDeleted := header[16] == 1
+	var resume int64
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			continue
+		}
+		offset, h, ok, err := locateEntryFrom(f, meta, key, resume)
+		resume = offset
+		if err != nil {
+			logger.LogErrorEvent("SSTable lookup of %q in %s failed: %v", key, meta.Filename, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if e, err := readEntryAt(f, offset, h, key); err != nil {
+			logger.LogErrorEvent("SSTable lookup of %q in %s failed: %v", key, meta.Filename, err)
+		} else {
+			found[key] = e
+		}
+	}
+	return found
+}
+
+// FindInSSTableFile looks key up through an already open handle. It only uses
+// ReadAt (pread), which keeps no file position, so one handle can serve any
+// number of concurrent lookups without seeks or locks.
+// A corrupt entry is logged and reported as not found.
+func FindInSSTableFile(f io.ReaderAt, meta SSTableMetadata, key string) (common.Entry, bool) {
+	offset, h, found, err := locateEntry(f, meta, key)
+	if err == nil && found {
+		var e common.Entry
+		if e, err = readEntryAt(f, offset, h, key); err == nil {
+			return e, true
+		}
+	}
+	if err != nil {
+		logger.LogErrorEvent("SSTable lookup of %q in %s failed: %v", key, meta.Filename, err)
+	}
+	return common.Entry{}, false
+}
 
-	f.Seek(int64(kLen), 1)
-	val := make([]byte, vLen)
-	io.ReadFull(f, val)
+// readEntryAt reads and verifies the value of the entry for key found at
+// offset.
+func readEntryAt(f io.ReaderAt, offset int64, h entryHeader, key string) (common.Entry, error) {
+	stored := make([]byte, h.valueLength)
+	if _, err := f.ReadAt(stored, offset+h.size+int64(h.keyLength)); err != nil {
+		return common.Entry{}, err
+	}
+	if err := h.verify([]byte(key), stored); err != nil {
+		return common.Entry{}, err
+	}
+	val, err := decodeStoredValue(h, stored)
+	if err != nil {
+		return common.Entry{}, err
+	}
 
 	return common.Entry{
 		Key:             key,
 		Value:           val,
-		ExpiryTimestamp: expiry,
-		IsDeleted:       isDeleted,
-	}, true
+		ExpiryTimestamp: h.expiry,
+		IsDeleted:       h.flags&entryFlagDeleted != 0,
+		IsCounter:       h.flags&entryFlagCounter != 0,
+		Sequence:        h.sequence,
+	}, nil
+}
+
+// locateEntry scans the block that would hold key, reading only headers and
+// keys, and returns the offset and header of its entry if present.
+func locateEntry(f io.ReaderAt, meta SSTableMetadata, key string) (int64, entryHeader, bool, error) {
+	offset, h, found, err := locateEntryFrom(f, meta, key, 0)
+	if !found {
+		return 0, entryHeader{}, false, err
+	}
+	return offset, h, true, nil
+}
+
+// locateEntryFrom is locateEntry starting no earlier than resume, the
+// offset an earlier search for a smaller key returned. It returns the
+// offset of key's entry, or of the first entry past key, so a search for a
+// larger key can resume there.
+func locateEntryFrom(f io.ReaderAt, meta SSTableMetadata, key string, resume int64) (int64, entryHeader, bool, error) {
+	offset, end, ok := meta.blockOf(key)
+	if !ok {
+		return resume, entryHeader{}, false, nil
+	}
+	if resume > offset && (end < 0 || resume < end) {
+		offset = resume
+	}
+	size := readerAtSize(f)
+	if end < 0 {
+		end = size
+	}
+
+	headerSize, _ := formatLayout(meta.FormatVersion)
+	header := make([]byte, headerSize)
+	var stored []byte
+	for end < 0 || offset < end {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			if err == io.EOF && end < 0 {
+				break
+			}
+			return 0, entryHeader{}, false, err
+		}
+		h := decodeEntryHeader(header)
+		if !h.fitsIn(offset, size) {
+			return 0, entryHeader{}, false, errCorruptEntry
+		}
+
+		if cap(stored) < int(h.keyLength) {
+			stored = make([]byte, h.keyLength)
+		}
+		stored = stored[:h.keyLength]
+		if _, err := f.ReadAt(stored, offset+h.size); err != nil {
+			return 0, entryHeader{}, false, err
+		}
+
+		switch strings.Compare(string(stored), key) {
+		case 0:
+			return offset, h, true, nil
+		case 1:
+			// Keys are sorted, so key is not in this block
+			return offset, entryHeader{}, false, nil
+		}
+		offset += h.entrySize()
+	}
+	return offset, entryHeader{}, false, nil
+}
+
+// SSTableValue is an open handle on one entry's value inside a table file. It
+// lets callers copy a large value out in chunks instead of loading it whole.
+type SSTableValue struct {
+	ExpiryTimestamp int64
+	IsDeleted       bool
+	IsCounter       bool
+	Sequence        uint64
+	// Length is the size of the value Reader yields.
+	Length int64
+
+	file   *os.File
+	reader io.Reader
+}
+
+// OpenSSTableValue locates key in the table and returns a handle positioned on
+// its value. Compressed values are snappy blocks that cannot be decoded
+// incrementally, so those are decoded into memory. A streamed value is
+// checked against its checksum as it is read, and Read returns
+// ErrChecksumMismatch instead of io.EOF if it does not match. The caller
+// must Close it.
+func OpenSSTableValue(meta SSTableMetadata, key string) (*SSTableValue, bool, error) {
+	if !meta.InKeyRange(key) {
+		return nil, false, nil
+	}
+
+	f, err := os.Open(meta.Filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	offset, h, found, err := locateEntry(f, meta, key)
+	if err != nil || !found {
+		f.Close()
+		return nil, false, err
+	}
+
+	valueOffset := offset + h.size + int64(h.keyLength)
+	v := &SSTableValue{
+		ExpiryTimestamp: h.expiry,
+		IsDeleted:       h.flags&entryFlagDeleted != 0,
+		IsCounter:       h.flags&entryFlagCounter != 0,
+		Sequence:        h.sequence,
+		Length:          int64(h.valueLength),
+		file:            f,
+		reader:          io.NewSectionReader(f, valueOffset, int64(h.valueLength)),
+	}
+	if h.size >= checksummedEntryHeaderSize {
+		v.reader = &checksumReader{reader: v.reader, crc: h.checksumPrefix([]byte(key)), want: h.checksum}
+	}
+
+	if h.flags&entryFlagCompressed != 0 {
+		val, err := io.ReadAll(v.reader)
+		if err == nil {
+			val, err = decodeStoredValue(h, val)
+		}
+		if err != nil {
+			f.Close()
+			return nil, false, err
+		}
+		v.Length = int64(len(val))
+		v.reader = bytes.NewReader(val)
+	}
+	return v, true, nil
+}
+
+// checksumReader completes an entry checksum over the value it passes
+// through and fails at the end of it on a mismatch.
+type checksumReader struct {
+	reader io.Reader
+	crc    uint32
+	want   uint32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.crc = crc32.Update(c.crc, crc32.IEEETable, p[:n])
+	if err == io.EOF && c.crc != c.want {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+func (v *SSTableValue) Read(p []byte) (int, error) {
+	return v.reader.Read(p)
+}
+
+func (v *SSTableValue) Close() error {
+	return v.file.Close()
+}
+
+// readerAtSize returns the size of files and section readers, or -1.
+func readerAtSize(f io.ReaderAt) int64 {
+	switch r := f.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case *os.File:
+		if info, err := r.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return -1
 }
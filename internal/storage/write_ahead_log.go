@@ -3,18 +3,83 @@ package storage
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
 	"sndv-kv/internal/common"
+	"sndv-kv/internal/logger"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+// Bits of the flags byte closing each record. Older logs only ever wrote 0
+// or 1, which still decode the same.
+const (
+	walFlagDeleted byte = 1 << 0
+	walFlagCounter byte = 1 << 1
+)
+
+const (
+	walRecordMetaSizeInBytes = 9
+
+	// Format 2 logs start with walMagic and the version byte, and every
+	// record ends with a CRC32 of its lengths, key, value, expiry and flags.
+	// Format 1 logs have neither; they are still replayed and appended to
+	// in their own format. Format 3 records add the entry's sequence number
+	// after the flags.
+	walMagic                      = "SWAL"
+	walFormatVersion         byte = 3
+	walFileHeaderSizeInBytes      = len(walMagic) + 1
+	walChecksumSizeInBytes        = 4
+	walSequenceSizeInBytes        = 8
+)
+
+// errWalChecksumMismatch reports a record that decodes but whose contents do
+// not match its checksum.
+var errWalChecksumMismatch = errors.New("wal record checksum mismatch")
+
+// errWalRecordLength reports a record whose key or value length runs past the
+// end of the log: a record cut short by a crash, or a damaged length.
+var errWalRecordLength = errors.New("wal record length exceeds the log")
+
+// ErrWalCorrupt reports a damaged record with intact records after it. Unlike
+// a record torn by a crash, it is not the tail of the log, so Replay leaves
+// the log as it is rather than discard the records behind it.
+var ErrWalCorrupt = errors.New("wal corrupt before its tail")
+
+// Values of the wal_sync_mode setting.
+const (
+	WalSyncAlways   = "always"
+	WalSyncInterval = "interval"
+	WalSyncNever    = "never"
+)
+
+// SyncsEveryBatch reports whether WALs opened under mode fsync each batch
+// before it is acknowledged, the shouldSync argument of NewDiskWAL. An empty
+// mode is WalSyncAlways.
+func SyncsEveryBatch(mode string) (bool, error) {
+	switch mode {
+	case "", WalSyncAlways:
+		return true, nil
+	case WalSyncInterval, WalSyncNever:
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown wal sync mode %q", mode)
+}
+
 type DiskWAL struct {
-	file       *os.File
-	mutex      sync.Mutex
-	path       string
-	shouldSync bool
+	file        *os.File
+	mutex       sync.Mutex
+	path        string
+	shouldSync  bool
+	version     byte
+	sizeInBytes atomic.Int64
 }
 
 func NewDiskWAL(path string, shouldSync bool) (*DiskWAL, error) {
@@ -22,26 +87,124 @@ func NewDiskWAL(path string, shouldSync bool) (*DiskWAL, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
-	return &DiskWAL{
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat WAL: %w", err)
+	}
+
+	version, err := detectWalFormatVersion(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	wal := &DiskWAL{
 		file:       file,
 		path:       path,
 		shouldSync: shouldSync,
-	}, nil
+		version:    version,
+	}
+	size := info.Size()
+	if size == 0 {
+		header := append([]byte(walMagic), walFormatVersion)
+		if _, err := file.Write(header); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write WAL header: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to sync WAL header: %w", err)
+		}
+		wal.version = walFormatVersion
+		size = int64(len(header))
+	}
+	wal.sizeInBytes.Store(size)
+	return wal, nil
+}
+
+// WalSegmentPaths returns the logs on disk that were rotated from basePath,
+// oldest first: basePath itself, then each basePath.<nanos> segment in the
+// order it was started. Rotation freezes the active log and starts a new
+// segment, so the last path is the log that was active.
+func WalSegmentPaths(basePath string) ([]string, error) {
+	matches, err := filepath.Glob(basePath + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	type segment struct {
+		path    string
+		started int64
+	}
+	segments := make([]segment, 0, len(matches))
+	prefix := filepath.Base(basePath) + "."
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(filepath.Base(match), prefix)
+		started, err := strconv.ParseInt(suffix, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{basePath + "." + suffix, started})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].started < segments[j].started })
+
+	var paths []string
+	if _, err := os.Stat(basePath); err == nil {
+		paths = append(paths, basePath)
+	}
+	for _, s := range segments {
+		paths = append(paths, s.path)
+	}
+	return paths, nil
+}
+
+// walRecordLayout returns the size of the fields after the value and of the
+// checksum trailer for a log format version.
+func walRecordLayout(version byte) (metaSize, trailerSize int) {
+	switch {
+	case version >= 3:
+		return walRecordMetaSizeInBytes + walSequenceSizeInBytes, walChecksumSizeInBytes
+	case version == 2:
+		return walRecordMetaSizeInBytes, walChecksumSizeInBytes
+	}
+	return walRecordMetaSizeInBytes, 0
+}
+
+// detectWalFormatVersion reads the file header. Logs without the magic,
+// including empty ones, are format 1.
+func detectWalFormatVersion(f io.ReaderAt) (byte, error) {
+	header := make([]byte, walFileHeaderSizeInBytes)
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[:len(walMagic)]) != walMagic {
+		return 1, nil
+	}
+	version := header[len(walMagic)]
+	if version < 2 || version > walFormatVersion {
+		return 0, fmt.Errorf("unsupported wal format version %d", version)
+	}
+	return version, nil
+}
+
+// SizeInBytes returns the current length of the log file.
+func (w *DiskWAL) SizeInBytes() int64 {
+	return w.sizeInBytes.Load()
 }
 
 func (w *DiskWAL) WriteBatch(entries []common.Entry) error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
+	metaSize, trailerSize := walRecordLayout(w.version)
 	totalSize := 0
 	for _, e := range entries {
-		totalSize += 4 + len(e.Key) + 4 + len(e.Value) + 9
+		totalSize += 4 + len(e.Key) + 4 + len(e.Value) + metaSize + trailerSize
 	}
 
 	buffer := make([]byte, totalSize)
 	offset := 0
 
 	for _, e := range entries {
+		start := offset
 		kLen := len(e.Key)
 		vLen := len(e.Value)
 
@@ -58,15 +221,29 @@ func (w *DiskWAL) WriteBatch(entries []common.Entry) error {
 		binary.LittleEndian.PutUint64(buffer[offset:], uint64(e.ExpiryTimestamp))
 		offset += 8
 
+		var flags byte
 		if e.IsDeleted {
-			buffer[offset] = 1
-		} else {
-			buffer[offset] = 0
+			flags |= walFlagDeleted
+		}
+		if e.IsCounter {
+			flags |= walFlagCounter
 		}
+		buffer[offset] = flags
 		offset += 1
+
+		if metaSize > walRecordMetaSizeInBytes {
+			binary.LittleEndian.PutUint64(buffer[offset:], e.Sequence)
+			offset += walSequenceSizeInBytes
+		}
+		if trailerSize > 0 {
+			binary.LittleEndian.PutUint32(buffer[offset:], crc32.ChecksumIEEE(buffer[start:offset]))
+			offset += walChecksumSizeInBytes
+		}
 	}
 
-	if _, err := w.file.Write(buffer); err != nil {
+	written, err := w.file.Write(buffer)
+	w.sizeInBytes.Add(int64(written))
+	if err != nil {
 		return err
 	}
 
@@ -76,57 +253,225 @@ func (w *DiskWAL) WriteBatch(entries []common.Entry) error {
 	return nil
 }
 
+// Sync flushes every record written so far to stable storage.
+func (w *DiskWAL) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Sync()
+}
+
+// Replay passes every record to callback in write order. A damaged record
+// at the tail, left by a crash mid-WriteBatch, ends the replay cleanly and
+// is truncated away so new records follow the last complete one. A damaged
+// record with intact ones after it ends the replay with ErrWalCorrupt and
+// the log untouched. I/O errors are still returned.
 func (w *DiskWAL) Replay(callback func(common.Entry)) error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	if _, err := w.file.Seek(0, 0); err != nil {
+	records, err := newWalRecordReader(w.file)
+	if err != nil {
 		return err
 	}
 
-	reader := bufio.NewReader(w.file)
-	header := make([]byte, 4)
-
 	for {
-		if _, err := io.ReadFull(reader, header); err == io.EOF {
+		e, err := records.next()
+		if err == io.EOF {
+			break
+		} else if isDamagedWalRecord(err) {
+			if err := w.discardDamagedTail(records, err); err != nil {
+				return err
+			}
 			break
 		} else if err != nil {
 			return err
 		}
+		callback(e)
+	}
 
-		kLen := binary.LittleEndian.Uint32(header)
-		key := make([]byte, kLen)
-		if _, err := io.ReadFull(reader, key); err != nil {
-			return err
-		}
+	w.file.Seek(0, 2)
+	return nil
+}
 
-		if _, err := io.ReadFull(reader, header); err != nil {
-			return err
+func isDamagedWalRecord(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errWalRecordLength) || errors.Is(err, errWalChecksumMismatch)
+}
+
+// discardDamagedTail truncates the damaged record at records.offset away if
+// it is the tail of the log, and returns ErrWalCorrupt if an intact record
+// follows it. Callers must hold w.mutex.
+func (w *DiskWAL) discardDamagedTail(records *walRecordReader, damage error) error {
+	rest := make([]byte, records.size-records.offset)
+	if _, err := w.file.ReadAt(rest, records.offset); err != nil && err != io.EOF {
+		return err
+	}
+	if len(rest) > 0 && intactWalRecordIn(rest[1:], records.version) {
+		logger.LogErrorEvent("WAL %s: %v at offset %d with intact records after it; leaving the log as it is",
+			w.path, damage, records.offset)
+		return fmt.Errorf("%w: %s at offset %d: %v", ErrWalCorrupt, w.path, records.offset, damage)
+	}
+	return w.truncateAt(records.offset, fmt.Sprintf("a damaged final record (%v)", damage))
+}
+
+// intactWalRecordIn reports whether a record passing its checksum starts
+// anywhere in data. A crash only ever damages the end of the log, so one
+// found after a damaged record means the damage is not a torn tail. Format 1
+// records carry no checksum to tell them from noise, so there it is false.
+func intactWalRecordIn(data []byte, version byte) bool {
+	if version < 2 {
+		return false
+	}
+	metaSize, _ := walRecordLayout(version)
+	for start := range data {
+		record := data[start:]
+		if len(record) < 8+metaSize+walChecksumSizeInBytes {
+			return false
 		}
-		vLen := binary.LittleEndian.Uint32(header)
-		val := make([]byte, vLen)
-		if _, err := io.ReadFull(reader, val); err != nil {
-			return err
+		kLen := int64(binary.LittleEndian.Uint32(record))
+		if 8+kLen > int64(len(record)) {
+			continue
+		}
+		vLen := int64(binary.LittleEndian.Uint32(record[4+kLen:]))
+		end := 8 + kLen + vLen + int64(metaSize)
+		if end+walChecksumSizeInBytes > int64(len(record)) {
+			continue
+		}
+		if crc32.ChecksumIEEE(record[:end]) == binary.LittleEndian.Uint32(record[end:]) {
+			return true
 		}
+	}
+	return false
+}
+
+// truncateAt cuts the log back to validBytes. Callers must hold w.mutex.
+func (w *DiskWAL) truncateAt(validBytes int64, dropped string) error {
+	logger.LogErrorEvent("WAL %s: dropping %d bytes of %s at offset %d",
+		w.path, w.sizeInBytes.Load()-validBytes, dropped, validBytes)
+
+	if err := w.file.Truncate(validBytes); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+	w.sizeInBytes.Store(validBytes)
+	return w.file.Sync()
+}
 
-		meta := make([]byte, 9)
-		if _, err := io.ReadFull(reader, meta); err != nil {
+// walRecordReader decodes records sequentially. It tracks the offset of the
+// record being read and checks lengths against the file size, so a corrupt
+// length is reported instead of triggering a huge allocation.
+type walRecordReader struct {
+	reader  *bufio.Reader
+	version byte
+	offset  int64
+	size    int64
+	header  []byte
+	meta    []byte
+}
+
+// newWalRecordReader positions file after its header, if any.
+func newWalRecordReader(file *os.File) (*walRecordReader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	version, err := detectWalFormatVersion(file)
+	if err != nil {
+		return nil, err
+	}
+	metaSize, _ := walRecordLayout(version)
+	r := &walRecordReader{
+		version: version,
+		size:    info.Size(),
+		header:  make([]byte, 4),
+		meta:    make([]byte, metaSize),
+	}
+	if r.version >= 2 {
+		r.offset = int64(walFileHeaderSizeInBytes)
+	}
+	if _, err := file.Seek(r.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r.reader = bufio.NewReader(file)
+	return r, nil
+}
+
+// next returns io.EOF at a clean end of log, io.ErrUnexpectedEOF for a
+// partial record, errWalRecordLength for a length running past the end and
+// errWalChecksumMismatch for a damaged record. On any error other than
+// io.EOF, offset still points at the start of the bad record.
+func (r *walRecordReader) next() (common.Entry, error) {
+	consumed := int64(0)
+	checksum := uint32(0)
+	read := func(buf []byte) error {
+		if _, err := io.ReadFull(r.reader, buf); err != nil {
+			if err == io.EOF && consumed > 0 {
+				return io.ErrUnexpectedEOF
+			}
 			return err
 		}
+		consumed += int64(len(buf))
+		checksum = crc32.Update(checksum, crc32.IEEETable, buf)
+		return nil
+	}
+	readLength := func() (uint32, error) {
+		if err := read(r.header); err != nil {
+			return 0, err
+		}
+		n := binary.LittleEndian.Uint32(r.header)
+		if int64(n) > r.size-r.offset-consumed {
+			return 0, fmt.Errorf("record length %d exceeds remaining log size: %w", n, errWalRecordLength)
+		}
+		return n, nil
+	}
 
-		expiry := int64(binary.LittleEndian.Uint64(meta[:8]))
-		isDeleted := meta[8] == 1
+	kLen, err := readLength()
+	if err != nil {
+		return common.Entry{}, err
+	}
+	key := make([]byte, kLen)
+	if err := read(key); err != nil {
+		return common.Entry{}, err
+	}
 
-		callback(common.Entry{
-			Key:             string(key),
-			Value:           val,
-			ExpiryTimestamp: expiry,
-			IsDeleted:       isDeleted,
-		})
+	vLen, err := readLength()
+	if err != nil {
+		return common.Entry{}, err
+	}
+	val := make([]byte, vLen)
+	if err := read(val); err != nil {
+		return common.Entry{}, err
 	}
 
-	w.file.Seek(0, 2)
-	return nil
+	if err := read(r.meta); err != nil {
+		return common.Entry{}, err
+	}
+
+	if r.version >= 2 {
+		expected := checksum
+		if err := read(r.header); err != nil {
+			return common.Entry{}, err
+		}
+		if binary.LittleEndian.Uint32(r.header) != expected {
+			return common.Entry{}, errWalChecksumMismatch
+		}
+	}
+
+	r.offset += consumed
+	e := common.Entry{
+		Key:             string(key),
+		Value:           val,
+		ExpiryTimestamp: int64(binary.LittleEndian.Uint64(r.meta[:8])),
+		IsDeleted:       r.meta[8]&walFlagDeleted != 0,
+		IsCounter:       r.meta[8]&walFlagCounter != 0,
+	}
+	if len(r.meta) > walRecordMetaSizeInBytes {
+		e.Sequence = binary.LittleEndian.Uint64(r.meta[walRecordMetaSizeInBytes:])
+	}
+	return e, nil
+}
+
+// Path returns the file the log is written to.
+func (w *DiskWAL) Path() string {
+	return w.path
 }
 
 func (w *DiskWAL) Close() error {
@@ -139,3 +484,79 @@ func (w *DiskWAL) Delete() error {
 	w.Close()
 	return os.Remove(w.path)
 }
+
+// WALVerification summarises a verify-only pass over a log.
+type WALVerification struct {
+	Path        string
+	Records     int
+	Tombstones  int
+	ValidBytes  int64
+	SizeInBytes int64
+	// CorruptOffset is where the first undecodable record starts, or -1.
+	CorruptOffset int64
+	Corruption    error
+	KeySizes      SizeSummary
+	ValueSizes    SizeSummary
+}
+
+// SizeSummary describes a distribution of byte lengths.
+type SizeSummary struct {
+	Min, Max int
+	Total    int64
+}
+
+func (s *SizeSummary) observe(n, count int) {
+	if count == 1 || n < s.Min {
+		s.Min = n
+	}
+	if n > s.Max {
+		s.Max = n
+	}
+	s.Total += int64(n)
+}
+
+// Mean returns the average length over count observations.
+func (s SizeSummary) Mean(count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(s.Total) / float64(count)
+}
+
+// VerifyWAL decodes every record in the log at path without applying
+// anything, stopping at the first record that cannot be decoded.
+func VerifyWAL(path string) (WALVerification, error) {
+	report := WALVerification{Path: path, CorruptOffset: -1}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer file.Close()
+
+	records, err := newWalRecordReader(file)
+	if err != nil {
+		return report, err
+	}
+	report.SizeInBytes = records.size
+
+	for {
+		e, err := records.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			report.CorruptOffset = records.offset
+			report.Corruption = err
+			break
+		}
+
+		report.Records++
+		if e.IsDeleted {
+			report.Tombstones++
+		}
+		report.KeySizes.observe(len(e.Key), report.Records)
+		report.ValueSizes.observe(len(e.Value), report.Records)
+	}
+	report.ValidBytes = records.offset
+	return report, nil
+}
@@ -15,7 +15,12 @@ type TestSystemFactory struct {
 }
 
 func NewTestFactory(t *testing.T) *TestSystemFactory {
-	dir := "./test_data_factory_" + t.Name()
+	return NewNamedTestFactory(t, t.Name())
+}
+
+// NewNamedTestFactory is for tests that need more than one system directory.
+func NewNamedTestFactory(t *testing.T, name string) *TestSystemFactory {
+	dir := "./test_data_factory_" + name
 	os.RemoveAll(dir)
 	os.MkdirAll(dir, 0755)
 
@@ -49,7 +54,11 @@ func (f *TestSystemFactory) CreateSystem(opts ...func(*config.SystemConfiguratio
 
 	// Always init WAL if durability is on, unless disabled by opts
 	if cfg.EnableDiskDurability {
-		wal, err := storage.NewDiskWAL(cfg.WriteAheadLogFilePath, true)
+		syncEveryBatch, err := storage.SyncsEveryBatch(cfg.WalSyncMode)
+		if err != nil {
+			f.t.Fatalf("Factory got a bad WAL sync mode: %v", err)
+		}
+		wal, err := storage.NewDiskWAL(cfg.WriteAheadLogFilePath, syncEveryBatch)
 		if err != nil {
 			f.t.Fatalf("Factory failed to create WAL: %v", err)
 		}
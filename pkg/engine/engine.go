@@ -0,0 +1,217 @@
+// Package engine is the embeddable entry point to the store. Each Engine owns
+// its own ingestion shards and background agents, so several engines can run
+// side by side in the same process.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sndv-kv/internal/common"
+	"sndv-kv/internal/config"
+	"sndv-kv/internal/engine"
+	"strconv"
+	"time"
+)
+
+// ErrClosed is returned by operations on an engine after Close.
+var ErrClosed = engine.ErrClosed
+
+// ErrReadOnly is returned for writes while read-only mode is active.
+var ErrReadOnly = engine.ErrReadOnly
+
+// Config selects where an engine keeps its data and how it is tuned. Zero
+// values pick the same defaults as the server.
+type Config struct {
+	// DataDirectoryPath holds the SSTables and the manifest. It is required
+	// unless InMemoryOnly is set.
+	DataDirectoryPath string
+	// WriteAheadLogFilePath defaults to wal.log inside DataDirectoryPath.
+	WriteAheadLogFilePath string
+	// InMemoryOnly keeps all data in the memtable, evicting least recently
+	// used entries when full; nothing touches disk.
+	InMemoryOnly bool
+
+	MaximumMemtableSizeInBytes int64
+	// Start a new WAL segment once the active one reaches this size, so a
+	// restart has less to replay (0 disables).
+	MaximumWalSizeInBytes int64
+	KeyCacheCapacityCount int
+	// "always" (the default), "interval" or "never"; see wal_sync_mode.
+	WalSyncMode string
+	// "sharded" (the default) or "skiplist".
+	MemtableImplementation string
+	// "none" or "snappy"; empty leaves values uncompressed.
+	SSTableCompression    string
+	IngestionShardCount   int
+	FlushConcurrency      int
+	CompactionConcurrency int
+}
+
+// systemConfiguration fills the server's defaults in around c.
+func (c Config) systemConfiguration() config.SystemConfiguration {
+	cfg := config.DefaultConfiguration()
+	cfg.DataDirectoryPath = c.DataDirectoryPath
+	cfg.WriteAheadLogFilePath = c.WriteAheadLogFilePath
+	if cfg.WriteAheadLogFilePath == "" && c.DataDirectoryPath != "" {
+		cfg.WriteAheadLogFilePath = filepath.Join(c.DataDirectoryPath, "wal.log")
+	}
+	cfg.InMemoryOnly = c.InMemoryOnly
+
+	cfg.MaximumMemtableSizeInBytes = orDefault(c.MaximumMemtableSizeInBytes, cfg.MaximumMemtableSizeInBytes)
+	cfg.MaximumWalSizeInBytes = c.MaximumWalSizeInBytes
+	cfg.KeyCacheCapacityCount = orDefault(c.KeyCacheCapacityCount, cfg.KeyCacheCapacityCount)
+	cfg.WalSyncMode = c.WalSyncMode
+	cfg.MemtableImplementation = c.MemtableImplementation
+	cfg.SSTableCompression = c.SSTableCompression
+	cfg.IngestionShardCount = c.IngestionShardCount
+	cfg.FlushConcurrency = orDefault(c.FlushConcurrency, cfg.FlushConcurrency)
+	cfg.CompactionConcurrency = orDefault(c.CompactionConcurrency, cfg.CompactionConcurrency)
+	return cfg
+}
+
+func orDefault[T int | int64](value, fallback T) T {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+// Entry is a live key and its value. Counters written through the server
+// read back in decimal, as the server serves them.
+type Entry struct {
+	Key   string
+	Value []byte
+	// ExpiresAt is when the key's TTL runs out; zero if it has none.
+	ExpiresAt time.Time
+}
+
+func newEntry(e common.Entry) Entry {
+	entry := Entry{Key: e.Key, Value: entryValue(e)}
+	if e.ExpiryTimestamp > 0 {
+		entry.ExpiresAt = time.Unix(0, e.ExpiryTimestamp)
+	}
+	return entry
+}
+
+func newEntries(entries []common.Entry) []Entry {
+	out := make([]Entry, len(entries))
+	for i, e := range entries {
+		out[i] = newEntry(e)
+	}
+	return out
+}
+
+func entryValue(e common.Entry) []byte {
+	if e.IsCounter {
+		n, _ := common.DecodeCounter(e.Value)
+		return strconv.AppendInt(nil, n, 10)
+	}
+	return e.Value
+}
+
+type Engine struct {
+	engine *engine.Engine
+}
+
+// Open validates cfg, recovers the store in its data directory and starts
+// the ingestion shards and the background agents.
+func Open(c Config) (*Engine, error) {
+	cfg := c.systemConfiguration()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	eng, err := engine.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{engine: eng}, nil
+}
+
+// SetReadOnlyMode toggles read-only mode: writes fail with ErrReadOnly and
+// nothing is flushed or compacted, so the data directory can be copied
+// consistently. Reads carry on as before.
+func (e *Engine) SetReadOnlyMode(enabled bool) {
+	e.engine.SetReadOnlyMode(enabled)
+}
+
+// Put stores value under key; ttlInSeconds <= 0 means no expiry.
+func (e *Engine) Put(key string, value []byte, ttlInSeconds int) error {
+	return e.engine.Put(key, value, ttlInSeconds)
+}
+
+// Delete writes a tombstone for key.
+func (e *Engine) Delete(key string) error {
+	return e.engine.Delete(key)
+}
+
+// BatchPut stores several keys at once; the three slices are parallel.
+func (e *Engine) BatchPut(keys []string, values [][]byte, ttlsInSeconds []int) error {
+	return e.engine.BatchPut(keys, values, ttlsInSeconds)
+}
+
+// Get returns the live value for key.
+func (e *Engine) Get(key string) ([]byte, bool) {
+	entry, found := e.engine.GetEntry(key)
+	if !found {
+		return nil, false
+	}
+	return entryValue(entry), true
+}
+
+// Scan returns up to limit live entries with start <= key < end in key order.
+// An empty end means no upper bound and limit <= 0 means no limit.
+func (e *Engine) Scan(start, end string, limit int) ([]Entry, error) {
+	entries, err := e.engine.Scan(start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	return newEntries(entries), nil
+}
+
+// Snapshot returns a point-in-time read view. It must be released.
+func (e *Engine) Snapshot() *Snapshot {
+	return &Snapshot{snapshot: e.engine.Snapshot()}
+}
+
+// Close drains pending writes, stops the background agents and closes the
+// store's files. Unflushed writes are recovered from the WAL on next Open.
+func (e *Engine) Close() error {
+	return e.engine.Close()
+}
+
+// Shutdown is Close for a planned stop: every memtable is flushed first, so
+// the next Open has no WAL to replay. If ctx ends first, the rest is
+// recovered from the WAL as after Close, and ctx's error is returned.
+func (e *Engine) Shutdown(ctx context.Context) error {
+	return e.engine.Shutdown(ctx)
+}
+
+// Snapshot is a point-in-time read view of an engine. Writes made after it
+// was taken are not visible through it.
+type Snapshot struct {
+	snapshot *engine.Snapshot
+}
+
+// Get returns the live value for key as of the snapshot.
+func (s *Snapshot) Get(key string) ([]byte, bool) {
+	entry, found := s.snapshot.GetEntry(key)
+	if !found {
+		return nil, false
+	}
+	return entryValue(entry), true
+}
+
+// Scan behaves like Engine.Scan against the snapshot.
+func (s *Snapshot) Scan(start, end string, limit int) ([]Entry, error) {
+	entries, err := s.snapshot.Scan(start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	return newEntries(entries), nil
+}
+
+// Release lets compaction delete the files the snapshot was reading.
+func (s *Snapshot) Release() {
+	s.snapshot.Release()
+}
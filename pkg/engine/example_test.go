@@ -0,0 +1,101 @@
+package engine_test
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sndv-kv/pkg/engine"
+	"testing"
+)
+
+// The example lives outside the package, so it only compiles while Open
+// and everything it returns can be used from another module.
+func Example() {
+	dir, err := os.MkdirTemp("", "sndv-kv-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	eng, err := engine.Open(engine.Config{DataDirectoryPath: dir})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer eng.Close()
+
+	eng.Put("user:1", []byte("Alice"), 0)
+	eng.Put("user:2", []byte("Bob"), 3600)
+	if val, ok := eng.Get("user:1"); ok {
+		fmt.Printf("user:1 = %s\n", val)
+	}
+
+	entries, err := eng.Scan("user:", "user;", 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range entries {
+		fmt.Printf("%s = %s, expires: %v\n", e.Key, e.Value, !e.ExpiresAt.IsZero())
+	}
+	// Output:
+	// user:1 = Alice
+	// user:1 = Alice, expires: false
+	// user:2 = Bob, expires: true
+}
+
+func TestOpen_RejectsInvalidConfig(t *testing.T) {
+	if _, err := engine.Open(engine.Config{}); err == nil {
+		t.Error("Open without a data directory should fail")
+	}
+	if _, err := engine.Open(engine.Config{InMemoryOnly: true, MaximumMemtableSizeInBytes: -1}); err == nil {
+		t.Error("Open with a negative memtable size should fail")
+	}
+}
+
+func TestEngine_WritesFailInReadOnlyMode(t *testing.T) {
+	eng, err := engine.Open(engine.Config{InMemoryOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	eng.Put("k", []byte("v"), 0)
+	eng.SetReadOnlyMode(true)
+	if err := eng.Put("k", []byte("w"), 0); !errors.Is(err, engine.ErrReadOnly) {
+		t.Errorf("Put in read-only mode: %v", err)
+	}
+	if err := eng.Delete("k"); !errors.Is(err, engine.ErrReadOnly) {
+		t.Errorf("Delete in read-only mode: %v", err)
+	}
+	if err := eng.BatchPut([]string{"x"}, [][]byte{[]byte("1")}, []int{0}); !errors.Is(err, engine.ErrReadOnly) {
+		t.Errorf("BatchPut in read-only mode: %v", err)
+	}
+	if val, ok := eng.Get("k"); !ok || string(val) != "v" {
+		t.Errorf("Get k = %q, %v; reads should carry on", val, ok)
+	}
+
+	eng.SetReadOnlyMode(false)
+	if err := eng.Put("k", []byte("w"), 0); err != nil {
+		t.Errorf("Put after leaving read-only mode: %v", err)
+	}
+}
+
+func TestSnapshot_HidesLaterWrites(t *testing.T) {
+	eng, err := engine.Open(engine.Config{InMemoryOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	eng.Put("k", []byte("before"), 0)
+	snap := eng.Snapshot()
+	defer snap.Release()
+	eng.Put("k", []byte("after"), 0)
+
+	if val, ok := snap.Get("k"); !ok || string(val) != "before" {
+		t.Errorf("Snapshot Get k = %q, %v", val, ok)
+	}
+	if val, _ := eng.Get("k"); string(val) != "after" {
+		t.Errorf("Engine Get k = %q", val)
+	}
+}